@@ -1,401 +0,0 @@
-package main
-
-import (
-	"database/sql"
-	"errors"
-	"fmt"
-	"net/http"
-	"time"
-
-	"github.com/oklog/ulid/v2"
-)
-
-type chairPostChairsRequest struct {
-	Name               string `json:"name"`
-	Model              string `json:"model"`
-	ChairRegisterToken string `json:"chair_register_token"`
-}
-
-type chairPostChairsResponse struct {
-	ID      string `json:"id"`
-	OwnerID string `json:"owner_id"`
-}
-
-func chairPostChairs(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	req := &chairPostChairsRequest{}
-	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if req.Name == "" || req.Model == "" || req.ChairRegisterToken == "" {
-		writeError(w, http.StatusBadRequest, errors.New("some of required fields(name, model, chair_register_token) are empty"))
-		return
-	}
-
-	owner := &Owner{}
-	if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	chairID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
-
-	_, err := db.ExecContext(
-		ctx,
-		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?)",
-		chairID, owner.ID, req.Name, req.Model, false, accessToken,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// selectで今追加したchairを取得(FIXME: ↓のReturningが使えなかった)
-	chair := &Chair{}
-	if err := db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ?", chairID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// // returiningを使って、追加したchairを取得
-	// chair := &Chair{}
-	// if err := db.QueryRow("INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?) RETURNING id, owner_id, name, model, is_active, access_token", chairID, owner.ID, req.Name, req.Model, false, accessToken).Scan(
-	// 	&chair.ID,
-	// 	&chair.OwnerID,
-	// 	&chair.Name,
-	// 	&chair.Model,
-	// 	&chair.IsActive,
-	// 	&chair.AccessToken,
-	// ); err != nil {
-	// 	writeError(w, http.StatusInternalServerError, err)
-	// 	return
-	// }
-
-	// キャッシュ更新
-	chairCache.Get(ctx, accessToken)
-
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "chair_session",
-		Value: accessToken,
-	})
-
-	writeJSON(w, http.StatusCreated, &chairPostChairsResponse{
-		ID:      chairID,
-		OwnerID: owner.ID,
-	})
-}
-
-type postChairActivityRequest struct {
-	IsActive bool `json:"is_active"`
-}
-
-func chairPostActivity(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	chair := ctx.Value("chair").(*Chair)
-
-	req := &postChairActivityRequest{}
-	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// キャッシュ更新
-	chair.IsActive = req.IsActive
-	chairCache.Get(ctx, chair.AccessToken)
-
-	w.WriteHeader(http.StatusNoContent)
-}
-
-type chairPostCoordinateResponse struct {
-	RecordedAt int64 `json:"recorded_at"`
-}
-
-func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	req := &Coordinate{}
-	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	chair := ctx.Value("chair").(*Chair)
-
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-
-	createdAt := time.Now()
-	chairLocationID := ulid.Make().String()
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) 
-		 VALUES (?, ?, ?, ?, ?)`,
-		chairLocationID, chair.ID, req.Latitude, req.Longitude, createdAt,
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	location := &ChairLocation{
-		ID:        chairLocationID,
-		ChairID:   chair.ID,
-		Latitude:  req.Latitude,
-		Longitude: req.Longitude,
-		CreatedAt: createdAt,
-	}
-
-	distanceIncrement := 0
-	if chair.LastLatitude != nil && chair.LastLongitude != nil {
-		distanceIncrement = calculateDistance(location.Latitude, location.Longitude, *chair.LastLatitude, *chair.LastLongitude)
-	}
-
-	// chairの total_distance, last_latitude, last_longitudeを更新
-	_, err = tx.ExecContext(
-		ctx,
-		`UPDATE chairs 
-		 SET total_distance = IFNULL(total_distance, 0) + ?,
-		     total_distance_updated_at = ?,
-		     last_latitude = ?,
-		     last_longitude = ?
-		 WHERE id = ?`,
-		distanceIncrement, location.CreatedAt, location.Latitude, location.Longitude, chair.ID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// キャッシュ更新
-	chair.TotalDistance += distanceIncrement
-	chair.TotalDistanceUpdatedAt = &location.CreatedAt
-	chair.LastLatitude = &location.Latitude
-	chair.LastLongitude = &location.Longitude
-	chairCache.Get(ctx, chair.AccessToken)
-
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	} else {
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
-
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
-		RecordedAt: location.CreatedAt.UnixMilli(),
-	})
-}
-
-type simpleUser struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-}
-
-type chairGetNotificationResponse struct {
-	Data         *chairGetNotificationResponseData `json:"data"`
-	RetryAfterMs int                               `json:"retry_after_ms"`
-}
-
-type chairGetNotificationResponseData struct {
-	RideID                string     `json:"ride_id"`
-	User                  simpleUser `json:"user"`
-	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate Coordinate `json:"destination_coordinate"`
-	Status                string     `json:"status"`
-}
-
-func chairGetNotification(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	chair := ctx.Value("chair").(*Chair)
-
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-	ride := &Ride{}
-	yetSentRideStatus := RideStatus{}
-	status := ""
-
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-				// 状態変更から3秒以内に通知されている必要があるため、2秒後にリトライする
-				// see: https://gist.github.com/wtks/8eadf471daf7cb59942de02273ce7884#通知エンドポイント
-				RetryAfterMs: 100,
-			})
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			status, err = getLatestRideStatus(ctx, tx, ride.ID)
-			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	} else {
-		status = yetSentRideStatus.Status
-	}
-
-	user := &User{}
-	err = tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	if yetSentRideStatus.ID != "" {
-		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-		Data: &chairGetNotificationResponseData{
-			RideID: ride.ID,
-			User: simpleUser{
-				ID:   user.ID,
-				Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
-			},
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Status: status,
-		},
-		// 状態変更から3秒以内に通知されている必要があるため、2秒後にリトライする
-		// see: https://gist.github.com/wtks/8eadf471daf7cb59942de02273ce7884#通知エンドポイント
-		RetryAfterMs: 100,
-	})
-}
-
-type postChairRidesRideIDStatusRequest struct {
-	Status string `json:"status"`
-}
-
-func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	rideID := r.PathValue("ride_id")
-
-	chair := ctx.Value("chair").(*Chair)
-
-	req := &postChairRidesRideIDStatusRequest{}
-	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
-		return
-	}
-
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusNotFound, errors.New("ride not found"))
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	if ride.ChairID.String != chair.ID {
-		writeError(w, http.StatusBadRequest, errors.New("not assigned to this ride"))
-		return
-	}
-
-	switch req.Status {
-	case "ENROUTE":
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	case "CARRYING":
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "PICKUP" {
-			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
-			return
-		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	default:
-		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
-		return
-	}
-
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	w.WriteHeader(http.StatusNoContent)
-}
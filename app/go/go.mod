@@ -9,7 +9,6 @@ require (
 	github.com/go-sql-driver/mysql v1.8.1
 	github.com/jmoiron/sqlx v1.4.0
 	github.com/kaz/pprotein v1.2.4
-	github.com/motoki317/sc v1.8.1
 	github.com/oklog/ulid/v2 v2.1.0
 )
 
@@ -0,0 +1,102 @@
+// Package fare は運賃計算のうちDBに依存しない部分をまとめたもの
+// 金額は32bit環境や長時間の集計でも溢れないよう int64 の円で扱う
+package fare
+
+import "math"
+
+const (
+	// Initial は距離に関わらずかかる初乗り運賃
+	Initial = 500
+	// PerDistance は距離1あたりの運賃
+	PerDistance = 100
+)
+
+const (
+	// RoundUp は丸めの単位に切り上げる
+	RoundUp = "up"
+	// RoundNearest は丸めの単位に四捨五入する
+	RoundNearest = "nearest"
+	// RoundDown は丸めの単位に切り捨てる
+	RoundDown = "down"
+)
+
+// Rounding は運賃を丸める単位と方法。Unit が1以下なら丸めない
+type Rounding struct {
+	Unit int
+	Mode string
+}
+
+// Apply は fare を丸める。負の値も数直線上で丸めるので、切り上げは0の側へ、切り捨ては0から離れる側へ寄る
+func (r Rounding) Apply(fare int64) int64 {
+	if r.Unit <= 1 {
+		return fare
+	}
+	unit := int64(r.Unit)
+	switch r.Mode {
+	case RoundNearest:
+		return floorDiv(fare+unit/2, unit) * unit
+	case RoundDown:
+		return floorDiv(fare, unit) * unit
+	default:
+		return -floorDiv(-fare, unit) * unit
+	}
+}
+
+// floorDiv は a / b を負の無限大の方向に丸める。b は正であること
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b < 0 {
+		q--
+	}
+	return q
+}
+
+// Scale は amount を丸めてから Unit で割り、Unit 円を1とした値にする
+func (r Rounding) Scale(amount int64) int64 {
+	if r.Unit <= 1 {
+		return amount
+	}
+	return r.Apply(amount) / int64(r.Unit)
+}
+
+// Input は運賃の計算に必要な値
+type Input struct {
+	// Distance は配車位置から目的地までの距離
+	Distance int
+	// Discount はクーポンの割引額。距離に応じた運賃までしか割り引かない
+	Discount int64
+	// Multiplier は距離に応じた運賃にかける倍率。0なら1倍。1円未満は四捨五入する
+	Multiplier float64
+	Rounding   Rounding
+}
+
+// Calculate は割引と丸めを適用した運賃を返す
+func Calculate(in Input) int64 {
+	metered := Metered(in.Distance)
+	if in.Multiplier > 0 {
+		metered = Multiply(metered, in.Multiplier)
+	}
+	return in.Rounding.Apply(Initial + max(metered-in.Discount, 0))
+}
+
+// Metered は距離に応じた運賃を返す
+func Metered(distance int) int64 {
+	return PerDistance * int64(distance)
+}
+
+// Multiply は amount に倍率をかけ、1円未満を四捨五入する
+func Multiply(amount int64, multiplier float64) int64 {
+	return int64(math.Floor(float64(amount)*multiplier + 0.5))
+}
+
+// Distance は2点間のマンハッタン距離を返す
+func Distance(aLatitude, aLongitude, bLatitude, bLongitude int) int {
+	return abs(aLatitude-bLatitude) + abs(aLongitude-bLongitude)
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,257 @@
+package fare
+
+import "testing"
+
+func TestCalculateRoundingChangesFare(t *testing.T) {
+	// 丸めない場合と運賃が変わる組み合わせ。unrounded は Unit が1のときの運賃
+	tests := []struct {
+		name      string
+		in        Input
+		unrounded int64
+		want      int64
+	}{
+		{name: "up to 10", in: Input{Distance: 3, Discount: 255, Rounding: Rounding{Unit: 10, Mode: RoundUp}}, unrounded: 545, want: 550},
+		{name: "up to 10 from just above", in: Input{Distance: 3, Discount: 259, Rounding: Rounding{Unit: 10, Mode: RoundUp}}, unrounded: 541, want: 550},
+		{name: "nearest 10 rounds half up", in: Input{Distance: 3, Discount: 255, Rounding: Rounding{Unit: 10, Mode: RoundNearest}}, unrounded: 545, want: 550},
+		{name: "nearest 10 rounds down below half", in: Input{Distance: 3, Discount: 256, Rounding: Rounding{Unit: 10, Mode: RoundNearest}}, unrounded: 544, want: 540},
+		{name: "up to 100", in: Input{Distance: 8, Discount: 150, Rounding: Rounding{Unit: 100, Mode: RoundUp}}, unrounded: 1150, want: 1200},
+		{name: "nearest 100", in: Input{Distance: 8, Discount: 151, Rounding: Rounding{Unit: 100, Mode: RoundNearest}}, unrounded: 1149, want: 1100},
+		{name: "up to 1000", in: Input{Distance: 12, Rounding: Rounding{Unit: 1000, Mode: RoundUp}}, unrounded: 1700, want: 2000},
+		{name: "nearest 1000", in: Input{Distance: 9, Rounding: Rounding{Unit: 1000, Mode: RoundNearest}}, unrounded: 1400, want: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := tt.in
+			plain.Rounding = Rounding{Unit: 1}
+			if got := Calculate(plain); got != tt.unrounded {
+				t.Fatalf("unrounded fare = %d, want %d", got, tt.unrounded)
+			}
+			if got := Calculate(tt.in); got != tt.want {
+				t.Fatalf("Calculate(%+v) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Input
+		want int64
+	}{
+		{name: "zero distance", in: Input{}, want: Initial},
+		{name: "zero distance with discount", in: Input{Discount: 3000}, want: Initial},
+		{name: "metered", in: Input{Distance: 20}, want: Initial + 20*PerDistance},
+		{name: "discount below metered fare", in: Input{Distance: 20, Discount: 500}, want: Initial + 20*PerDistance - 500},
+		{name: "discount equal to metered fare", in: Input{Distance: 20, Discount: 2000}, want: Initial},
+		// 割引は距離に応じた運賃までで、初乗り運賃は割り引かない
+		{name: "discount exceeds metered fare", in: Input{Distance: 20, Discount: 3000}, want: Initial},
+		{name: "multiplier", in: Input{Distance: 20, Multiplier: 1.5}, want: Initial + 3000},
+		{name: "multiplier before discount", in: Input{Distance: 20, Multiplier: 1.5, Discount: 1000}, want: Initial + 2000},
+		{name: "discount exceeds multiplied fare", in: Input{Distance: 20, Multiplier: 0.5, Discount: 1500}, want: Initial},
+		{name: "multiplier rounds half up", in: Input{Distance: 1, Multiplier: 1.125}, want: Initial + 113},
+		{name: "multiplier on zero distance", in: Input{Multiplier: 2}, want: Initial},
+		{name: "rounded after discount", in: Input{Distance: 20, Discount: 1, Rounding: Rounding{Unit: 100, Mode: RoundUp}}, want: 2500},
+		{name: "rounded after multiplier", in: Input{Distance: 3, Multiplier: 1.25, Rounding: Rounding{Unit: 100, Mode: RoundNearest}}, want: 900},
+		{name: "rounded down", in: Input{Distance: 3, Discount: 1, Rounding: Rounding{Unit: 100, Mode: RoundDown}}, want: 700},
+		{name: "zero distance rounded", in: Input{Rounding: Rounding{Unit: 300, Mode: RoundUp}}, want: 600},
+		{name: "long trip does not overflow", in: Input{Distance: 1 << 40}, want: Initial + PerDistance<<40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Calculate(tt.in); got != tt.want {
+				t.Fatalf("Calculate(%+v) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateEveryRoundingMode(t *testing.T) {
+	// 丸める前は 500 + 1234 - 0 = 1734
+	in := Input{Distance: 12, Discount: -34}
+	tests := []struct {
+		rounding Rounding
+		want     int64
+	}{
+		{rounding: Rounding{}, want: 1734},
+		{rounding: Rounding{Unit: 1, Mode: RoundUp}, want: 1734},
+		{rounding: Rounding{Unit: 100, Mode: RoundUp}, want: 1800},
+		{rounding: Rounding{Unit: 100, Mode: RoundNearest}, want: 1700},
+		{rounding: Rounding{Unit: 100, Mode: RoundDown}, want: 1700},
+		{rounding: Rounding{Unit: 1000, Mode: RoundUp}, want: 2000},
+		{rounding: Rounding{Unit: 1000, Mode: RoundNearest}, want: 2000},
+		{rounding: Rounding{Unit: 1000, Mode: RoundDown}, want: 1000},
+		// 不明な方法は切り上げとして扱う
+		{rounding: Rounding{Unit: 100, Mode: "unknown"}, want: 1800},
+	}
+	for _, tt := range tests {
+		in := in
+		in.Rounding = tt.rounding
+		if got := Calculate(in); got != tt.want {
+			t.Errorf("Calculate with %+v = %d, want %d", tt.rounding, got, tt.want)
+		}
+	}
+}
+
+func TestMultiply(t *testing.T) {
+	tests := []struct {
+		amount     int64
+		multiplier float64
+		want       int64
+	}{
+		{amount: 1000, multiplier: 1, want: 1000},
+		{amount: 1000, multiplier: 1.5, want: 1500},
+		{amount: 125, multiplier: 1.5, want: 188},
+		{amount: 123, multiplier: 1.5, want: 185},
+		{amount: 5, multiplier: 0.5, want: 3},
+		{amount: 3, multiplier: 0.5, want: 2},
+		{amount: 1, multiplier: 0.49, want: 0},
+		{amount: 100, multiplier: 1.15, want: 115},
+		{amount: 0, multiplier: 2.5, want: 0},
+		{amount: -5, multiplier: 0.5, want: -2},
+		{amount: 1 << 40, multiplier: 2, want: 1 << 41},
+	}
+	for _, tt := range tests {
+		if got := Multiply(tt.amount, tt.multiplier); got != tt.want {
+			t.Errorf("Multiply(%d, %g) = %d, want %d", tt.amount, tt.multiplier, got, tt.want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b [2]int
+		want int
+	}{
+		{a: [2]int{0, 0}, b: [2]int{0, 0}, want: 0},
+		{a: [2]int{0, 0}, b: [2]int{3, 4}, want: 7},
+		{a: [2]int{3, 4}, b: [2]int{0, 0}, want: 7},
+		{a: [2]int{-3, 4}, b: [2]int{3, -4}, want: 14},
+		{a: [2]int{-10, -10}, b: [2]int{-10, -20}, want: 10},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a[0], tt.a[1], tt.b[0], tt.b[1]); got != tt.want {
+			t.Errorf("Distance(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// legacyFare は internal/fare に移す前に calculateDiscountedFare と applyDiscount がその場で行っていた計算
+func legacyFare(distance, discount, roundingUnit int, roundingMode string) int {
+	const initialFare, farePerDistance = 500, 100
+	roundFare := func(fare int) int {
+		if roundingUnit <= 1 {
+			return fare
+		}
+		switch roundingMode {
+		case "nearest":
+			return (fare + roundingUnit/2) / roundingUnit * roundingUnit
+		default:
+			return (fare + roundingUnit - 1) / roundingUnit * roundingUnit
+		}
+	}
+	meteredFare := farePerDistance * distance
+	discountedMeteredFare := max(meteredFare-discount, 0)
+	return roundFare(initialFare + discountedMeteredFare)
+}
+
+func TestCalculateMatchesLegacyCalculation(t *testing.T) {
+	// 初期データのライドの距離は0〜800程度で、クーポンの割引額は 0, 1000, 2000, 3000 のいずれか
+	distances := []int{0, 1, 2, 9, 10, 19, 20, 29, 30, 55, 101, 400, 799, 800}
+	discounts := []int{0, 1, 99, 1000, 2000, 3000, 5000}
+	for _, rounding := range []Rounding{{Unit: 1, Mode: RoundUp}, {Unit: 10, Mode: RoundUp}, {Unit: 100, Mode: RoundUp}, {Unit: 7, Mode: RoundUp}, {Unit: 10, Mode: RoundNearest}, {Unit: 100, Mode: RoundNearest}, {Unit: 7, Mode: RoundNearest}} {
+		for _, distance := range distances {
+			for _, discount := range discounts {
+				want := legacyFare(distance, discount, rounding.Unit, rounding.Mode)
+				got := Calculate(Input{Distance: distance, Discount: int64(discount), Rounding: rounding})
+				if got != int64(want) {
+					t.Errorf("Calculate(distance=%d, discount=%d, %+v) = %d, legacy = %d", distance, discount, rounding, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRoundingApply(t *testing.T) {
+	up, nearest, down := Rounding{Unit: 10, Mode: RoundUp}, Rounding{Unit: 10, Mode: RoundNearest}, Rounding{Unit: 10, Mode: RoundDown}
+	tests := []struct {
+		rounding Rounding
+		fare     int64
+		want     int64
+	}{
+		{rounding: Rounding{}, fare: 1234, want: 1234},
+		{rounding: Rounding{Unit: 1, Mode: RoundNearest}, fare: -1234, want: -1234},
+		{rounding: Rounding{Unit: -10, Mode: RoundUp}, fare: 1234, want: 1234},
+
+		{rounding: up, fare: 0, want: 0},
+		{rounding: up, fare: 1, want: 10},
+		{rounding: up, fare: 10, want: 10},
+		{rounding: up, fare: 15, want: 20},
+		{rounding: up, fare: -1, want: 0},
+		{rounding: up, fare: -15, want: -10},
+		{rounding: up, fare: -20, want: -20},
+
+		// nearest は四捨五入で、ちょうど半分は大きい方へ寄せる
+		{rounding: nearest, fare: 0, want: 0},
+		{rounding: nearest, fare: 4, want: 0},
+		{rounding: nearest, fare: 5, want: 10},
+		{rounding: nearest, fare: 14, want: 10},
+		{rounding: nearest, fare: 15, want: 20},
+		{rounding: nearest, fare: -4, want: 0},
+		{rounding: nearest, fare: -5, want: 0},
+		{rounding: nearest, fare: -6, want: -10},
+		{rounding: nearest, fare: -15, want: -10},
+		{rounding: nearest, fare: -16, want: -20},
+
+		{rounding: down, fare: 0, want: 0},
+		{rounding: down, fare: 9, want: 0},
+		{rounding: down, fare: 15, want: 10},
+		{rounding: down, fare: -1, want: -10},
+		{rounding: down, fare: -15, want: -20},
+		{rounding: down, fare: -20, want: -20},
+
+		// 単位が奇数なら半分の値は無い
+		{rounding: Rounding{Unit: 3, Mode: RoundNearest}, fare: 4, want: 3},
+		{rounding: Rounding{Unit: 3, Mode: RoundNearest}, fare: 5, want: 6},
+		{rounding: Rounding{Unit: 3, Mode: RoundNearest}, fare: -4, want: -3},
+		{rounding: Rounding{Unit: 3, Mode: RoundNearest}, fare: -5, want: -6},
+
+		{rounding: Rounding{Unit: 1000, Mode: RoundUp}, fare: 1 << 50, want: (1<<50/1000 + 1) * 1000},
+	}
+	for _, tt := range tests {
+		if got := tt.rounding.Apply(tt.fare); got != tt.want {
+			t.Errorf("%+v.Apply(%d) = %d, want %d", tt.rounding, tt.fare, got, tt.want)
+		}
+	}
+}
+
+func TestRoundingScale(t *testing.T) {
+	tests := []struct {
+		rounding Rounding
+		amount   int64
+		want     int64
+	}{
+		{rounding: Rounding{}, amount: 1234, want: 1234},
+		{rounding: Rounding{Unit: 1, Mode: RoundDown}, amount: -1234, want: -1234},
+
+		{rounding: Rounding{Unit: 100, Mode: RoundUp}, amount: 1201, want: 13},
+		{rounding: Rounding{Unit: 100, Mode: RoundUp}, amount: 1200, want: 12},
+		{rounding: Rounding{Unit: 100, Mode: RoundUp}, amount: -1250, want: -12},
+
+		{rounding: Rounding{Unit: 100, Mode: RoundNearest}, amount: 1249, want: 12},
+		{rounding: Rounding{Unit: 100, Mode: RoundNearest}, amount: 1250, want: 13},
+		{rounding: Rounding{Unit: 100, Mode: RoundNearest}, amount: -1250, want: -12},
+		{rounding: Rounding{Unit: 100, Mode: RoundNearest}, amount: -1251, want: -13},
+
+		{rounding: Rounding{Unit: 100, Mode: RoundDown}, amount: 1299, want: 12},
+		{rounding: Rounding{Unit: 100, Mode: RoundDown}, amount: -1201, want: -13},
+
+		{rounding: Rounding{Unit: 1000, Mode: RoundNearest}, amount: 0, want: 0},
+		{rounding: Rounding{Unit: 1000, Mode: RoundNearest}, amount: 1 << 60, want: (1<<60 + 500) / 1000},
+	}
+	for _, tt := range tests {
+		if got := tt.rounding.Scale(tt.amount); got != tt.want {
+			t.Errorf("%+v.Scale(%d) = %d, want %d", tt.rounding, tt.amount, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	accessLogBufferSize    = 64 * 1024
+	accessLogFlushInterval = time.Second
+)
+
+// accessLogWriter は nginx を経由しない構成向けに、nginx と同じ ltsv 形式のアクセスログを書き出す
+// 書き込みはバッファリングして定期的にフラッシュし、SIGHUP を受け取るとファイルを開き直す
+type accessLogWriter struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	buf  *bufio.Writer
+}
+
+func newAccessLogWriter(path string) (*accessLogWriter, error) {
+	l := &accessLogWriter{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(accessLogFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := l.flush(); err != nil {
+				slog.Error("failed to flush access log", "err", err)
+			}
+		}
+	}()
+
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGHUP)
+		for range ch {
+			if err := l.reopen(); err != nil {
+				slog.Error("failed to reopen access log", "err", err)
+			}
+		}
+	}()
+
+	return l, nil
+}
+
+func (l *accessLogWriter) reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		if err := l.buf.Flush(); err != nil {
+			slog.Error("failed to flush access log", "err", err)
+		}
+		l.file.Close()
+	}
+	l.file = file
+	l.buf = bufio.NewWriterSize(file, accessLogBufferSize)
+	return nil
+}
+
+func (l *accessLogWriter) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Flush()
+}
+
+func (l *accessLogWriter) write(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.buf.WriteString(line); err != nil {
+		slog.Error("failed to write access log", "err", err)
+	}
+}
+
+// Middleware は nginx.conf の log_format ltsv と同じキーでアクセスログを書き出す
+func (l *accessLogWriter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		reqTime := time.Since(start)
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		l.write(fmt.Sprintf(
+			"time:%s\thost:%s\tforwardedfor:%s\treq:%s %s %s\tstatus:%d\tmethod:%s\turi:%s\tsize:%d\treferer:%s\tua:%s\treqtime:%.3f\tcache:-\truntime:-\n",
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			host,
+			orHyphen(r.Header.Get("X-Forwarded-For")),
+			r.Method, r.RequestURI, r.Proto,
+			status,
+			r.Method,
+			r.RequestURI,
+			ww.BytesWritten(),
+			orHyphen(r.Referer()),
+			orHyphen(r.UserAgent()),
+			reqTime.Seconds(),
+		))
+	})
+}
+
+// orHyphen は nginx と同じく空の値を "-" として出力する
+func orHyphen(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,62 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestActiveRidesListsOnlyNonTerminalRides(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "done")
+	completedID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+
+	// 完了したライドの椅子はまだ通知を受け取っていないので、次のライドは carrying-chair に割り当てる
+	g := ts.newRideFixture(t, "carrying")
+	carryingID := ts.requestRide(t, g.User, testPickup, testDestination)
+	ts.runMatching(t)
+	if got := ts.assignedChair(t, carryingID); got != g.Chair.ID {
+		t.Fatalf("ride was assigned to %q, want %s", got, g.Chair.ID)
+	}
+	ts.postRideStatus(t, g.Chair, carryingID, RideStatusEnroute)
+	ts.moveChair(t, g.Chair, testPickup)
+	ts.postRideStatus(t, g.Chair, carryingID, RideStatusCarrying)
+
+	waiting := ts.registerUser(t, "waiting-user", nil)
+	waitingID := ts.requestRide(t, waiting, testDestination, testPickup)
+
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/internal/rides/active", nil, nil)
+	res := decodeJSON[internalGetActiveRidesResponse](t, rec)
+	if len(res.Rides) != 2 || res.NextOffset != nil {
+		t.Fatalf("active rides = %+v, want the carrying and the waiting ride only", res)
+	}
+	for _, ride := range res.Rides {
+		if ride.ID == completedID {
+			t.Fatalf("the completed ride %s is listed as active", completedID)
+		}
+	}
+	carrying, matching := res.Rides[0], res.Rides[1]
+	if carrying.ID != carryingID || carrying.Status != RideStatusCarrying || carrying.ChairID == nil || *carrying.ChairID != g.Chair.ID {
+		t.Fatalf("first ride = %+v, want %s CARRYING on %s", carrying, carryingID, g.Chair.ID)
+	}
+	if carrying.PickupCoordinate != testPickup || carrying.DestinationCoordinate != testDestination {
+		t.Fatalf("carrying ride coordinates = %+v -> %+v", carrying.PickupCoordinate, carrying.DestinationCoordinate)
+	}
+	if matching.ID != waitingID || matching.Status != RideStatusMatching || matching.ChairID != nil || matching.RideMs != 0 {
+		t.Fatalf("second ride = %+v, want %s MATCHING without a chair", matching, waitingID)
+	}
+
+	// limit で区切ったページを next_offset で辿れる
+	rec = ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/internal/rides/active?limit=1", nil, nil)
+	page := decodeJSON[internalGetActiveRidesResponse](t, rec)
+	if len(page.Rides) != 1 || page.Rides[0].ID != carryingID || page.NextOffset == nil || *page.NextOffset != 1 {
+		t.Fatalf("first page = %+v, want the carrying ride and next_offset 1", page)
+	}
+	rec = ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/internal/rides/active?limit=1&offset=1", nil, nil)
+	page = decodeJSON[internalGetActiveRidesResponse](t, rec)
+	if len(page.Rides) != 1 || page.Rides[0].ID != waitingID || page.NextOffset != nil {
+		t.Fatalf("second page = %+v, want the waiting ride and no next page", page)
+	}
+	ts.mustDo(t, http.StatusBadRequest, http.MethodGet, "/api/internal/rides/active?limit=0", nil, nil)
+}
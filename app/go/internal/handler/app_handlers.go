@@ -0,0 +1,1726 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/internal/fare"
+	"github.com/jmoiron/sqlx"
+)
+
+type appPostUsersRequest struct {
+	Username       string  `json:"username"`
+	FirstName      string  `json:"firstname"`
+	LastName       string  `json:"lastname"`
+	DateOfBirth    string  `json:"date_of_birth"`
+	InvitationCode *string `json:"invitation_code"`
+}
+
+type appPostUsersResponse struct {
+	ID             string `json:"id"`
+	InvitationCode string `json:"invitation_code"`
+}
+
+func (s *server) appPostUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostUsersRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if errs := (fieldErrors{}).
+		required("username", req.Username == "").
+		required("firstname", req.FirstName == "").
+		required("lastname", req.LastName == "").
+		required("date_of_birth", req.DateOfBirth == ""); len(errs) > 0 {
+		writeValidationError(w, errors.New("required fields(username, firstname, lastname, date_of_birth) are empty"), errs)
+		return
+	}
+
+	userID := newID()
+	accessToken := secureRandomStr(32)
+	invitationCode := secureRandomStr(15)
+
+	tx, err := s.beginTx("appPostUsers")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, accessToken, invitationCode,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 初回登録キャンペーンのクーポンを付与
+	// 付与するクーポンは最後にまとめて1回のINSERTで追加する
+	grants := []couponGrant{{UserID: userID, Code: "CP_NEW2024", Discount: 3000}}
+
+	// 招待コードを使った登録
+	if req.InvitationCode != nil && *req.InvitationCode != "" {
+		// 招待する側の招待数をチェック
+		var coupons []Coupon
+		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? FOR UPDATE", "INV_"+*req.InvitationCode)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if len(coupons) >= 3 {
+			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+			return
+		}
+
+		// ユーザーチェック
+		var inviter User
+		err = tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ?", *req.InvitationCode)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// 招待クーポン付与
+		// 招待コードの使用回数と招待の連鎖はこのクーポンで数えるので、未使用のクーポンの上限に関係なく付与する
+		grants = append(grants, couponGrant{UserID: userID, Code: "INV_" + *req.InvitationCode, Discount: 1500, Uncapped: true})
+		// 招待した人にもRewardを付与
+		grants = append(grants, couponGrant{UserID: inviter.ID, Code: "RWD_" + *req.InvitationCode, Discount: 1000, Timestamped: true})
+		// さらに上の招待者にも段階的に少ないRewardを付与
+		chainRewards, err := referralChainRewards(ctx, tx.Tx, &inviter)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		grants = append(grants, chainRewards...)
+	}
+
+	if err := insertCoupons(ctx, tx.Tx, grants); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 招待した人たちはクーポンが増えたので見積もりが変わる
+	invalidated := map[string]bool{userID: true}
+	for _, grant := range grants {
+		if !invalidated[grant.UserID] {
+			invalidated[grant.UserID] = true
+			s.invalidateFareEstimates(grant.UserID)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Path:  "/",
+		Name:  "app_session",
+		Value: accessToken,
+	})
+
+	writeJSON(w, http.StatusCreated, &appPostUsersResponse{
+		ID:             userID,
+		InvitationCode: invitationCode,
+	})
+}
+
+const (
+	// referralChainBaseReward は2段目の招待者へのRewardの額。1段上がるごとに半分になる
+	referralChainBaseReward = 500
+	// referralChainRewardCap は1回の登録で2段目以降に付与するRewardの合計の上限
+	referralChainRewardCap = 1000
+)
+
+// couponGrant は付与するクーポン
+type couponGrant struct {
+	UserID   string
+	Code     string
+	Discount int64
+	// Timestamped なら同じコードを何度でも付与できるよう、コードの後ろに付与時刻のミリ秒を付ける
+	Timestamped bool
+	// Uncapped なら MaxUnusedCoupons に達していても付与する
+	Uncapped bool
+}
+
+// unusedCouponCountsQuery はユーザーごとの未使用のクーポンの数を数える
+const unusedCouponCountsQuery = `SELECT user_id, COUNT(*) AS count FROM coupons WHERE user_id IN (?) AND used_by IS NULL GROUP BY user_id`
+
+// insertCoupons はクーポンをまとめて1回のINSERTで付与する
+// 1文で入れると付与日時が揃ってしまうので、古いクーポンから使う順番が変わらないよう1マイクロ秒ずつずらす
+func insertCoupons(ctx context.Context, tx *sqlx.Tx, grants []couponGrant) error {
+	grants, err := capCouponGrants(ctx, tx, grants)
+	if err != nil {
+		return err
+	}
+	if len(grants) == 0 {
+		return nil
+	}
+	var query strings.Builder
+	query.WriteString("INSERT INTO coupons (user_id, code, discount, created_at) VALUES ")
+	args := make([]any, 0, len(grants)*4)
+	for i, g := range grants {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		if g.Timestamped {
+			query.WriteString("(?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?, CURRENT_TIMESTAMP(6) + INTERVAL ? MICROSECOND)")
+		} else {
+			query.WriteString("(?, ?, ?, CURRENT_TIMESTAMP(6) + INTERVAL ? MICROSECOND)")
+		}
+		args = append(args, g.UserID, g.Code, g.Discount, i)
+	}
+	_, err = tx.ExecContext(ctx, query.String(), args...)
+	return err
+}
+
+// capCouponGrants は未使用のクーポンが MaxUnusedCoupons に達しているユーザーへの付与を取り除く。Uncapped の付与は残す
+// 未使用のクーポンが多いと使うクーポンを選ぶクエリが遅くなるため。取り除いた付与はログに出す
+// 同時に付与されると上限を少し超えることはある
+func capCouponGrants(ctx context.Context, tx *sqlx.Tx, grants []couponGrant) ([]couponGrant, error) {
+	limit := loadRuntimeConfig().MaxUnusedCoupons
+	if limit == 0 || len(grants) == 0 {
+		return grants, nil
+	}
+
+	userIDs := []string{}
+	counts := map[string]int{}
+	for _, g := range grants {
+		if _, ok := counts[g.UserID]; !ok {
+			counts[g.UserID] = 0
+			userIDs = append(userIDs, g.UserID)
+		}
+	}
+	rows := []struct {
+		UserID string `db:"user_id"`
+		Count  int    `db:"count"`
+	}{}
+	query, args := expandIn(unusedCouponCountsQuery, userIDs)
+	if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		counts[row.UserID] = row.Count
+	}
+
+	allowed := make([]couponGrant, 0, len(grants))
+	for _, g := range grants {
+		if counts[g.UserID] >= limit && !g.Uncapped {
+			slog.Info("skipped coupon grant: too many unused coupons", "user_id", g.UserID, "code", g.Code, "unused", counts[g.UserID], "limit", limit)
+			continue
+		}
+		counts[g.UserID]++
+		allowed = append(allowed, g)
+	}
+	return allowed, nil
+}
+
+// referralChainRewards は inviter を招待したユーザーを順にたどり、付与するRewardを返す
+// 招待した人は招待コードのクーポン(INV_招待コード)を持っているので、それを使って上にたどる
+func referralChainRewards(ctx context.Context, tx *sqlx.Tx, inviter *User) ([]couponGrant, error) {
+	grants := []couponGrant{}
+	visited := map[string]bool{inviter.ID: true}
+	current := inviter
+	reward := referralChainBaseReward
+	total := 0
+	maxDepth := loadRuntimeConfig().ReferralChainDepth
+	for depth := 0; depth < maxDepth && reward > 0; depth++ {
+		if total+reward > referralChainRewardCap {
+			break
+		}
+
+		var invitationCoupon Coupon
+		if err := tx.GetContext(ctx, &invitationCoupon, "SELECT * FROM coupons WHERE user_id = ? AND code LIKE 'INV\\_%' LIMIT 1", current.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return grants, nil
+			}
+			return nil, err
+		}
+		var parent User
+		if err := tx.GetContext(ctx, &parent, "SELECT * FROM users WHERE invitation_code = ?", strings.TrimPrefix(invitationCoupon.Code, "INV_")); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return grants, nil
+			}
+			return nil, err
+		}
+		if visited[parent.ID] {
+			return grants, nil
+		}
+		visited[parent.ID] = true
+
+		grants = append(grants, couponGrant{UserID: parent.ID, Code: "RWD_" + parent.InvitationCode, Discount: int64(reward), Timestamped: true})
+
+		total += reward
+		reward /= 2
+		current = &parent
+	}
+	return grants, nil
+}
+
+type appPostPaymentMethodsRequest struct {
+	Token string `json:"token"`
+}
+
+func (s *server) appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostPaymentMethodsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Token == "" {
+		writeError(w, http.StatusBadRequest, errors.New("token is required but was empty"))
+		return
+	}
+
+	user := ctx.Value("user").(*User)
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO payment_tokens (user_id, token) VALUES (?, ?)`,
+		user.ID,
+		req.Token,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type getAppRidesResponse struct {
+	Rides []getAppRidesResponseItem `json:"rides"`
+}
+
+type getAppRidesResponseItem struct {
+	ID                    string                       `json:"id"`
+	PickupCoordinate      Coordinate                   `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate                   `json:"destination_coordinate"`
+	Chair                 getAppRidesResponseItemChair `json:"chair"`
+	Fare                  int64                        `json:"fare"`
+	Evaluation            int                          `json:"evaluation"`
+	RequestedAt           int64                        `json:"requested_at"`
+	CompletedAt           int64                        `json:"completed_at"`
+}
+
+type getAppRidesResponseItemChair struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	Model string `json:"model"`
+}
+
+// appGetRidesStatusFilters は status クエリで指定できる値
+// ライドを取り消す遷移は無いので、CANCELED は受け付けない
+var appGetRidesStatusFilters = map[string]bool{
+	string(RideStatusCompleted): true,
+	"all":                       true,
+}
+
+func (s *server) appGetRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	// 後方互換のためデフォルトはCOMPLETEDのみ
+	statusFilter := r.URL.Query().Get("status")
+	if statusFilter == "" {
+		statusFilter = string(RideStatusCompleted)
+	}
+	if !appGetRidesStatusFilters[statusFilter] {
+		writeError(w, http.StatusBadRequest, errors.New("status must be COMPLETED or all"))
+		return
+	}
+	// fields はライドごとのフィールドを指定する
+	fields, err := parseFields(r, reflect.TypeOf(getAppRidesResponseItem{}))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := s.beginTx("appGetRides")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	rides := []Ride{}
+	if err := tx.SelectContext(
+		ctx,
+		&rides,
+		`SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC`,
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(rides) == 0 {
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &getAppRidesResponse{Rides: []getAppRidesResponseItem{}})
+		return
+	}
+
+	// 最新ステータスを一括取得
+	rideIDs := make([]string, 0, len(rides))
+	for _, ride := range rides {
+		rideIDs = append(rideIDs, ride.ID)
+	}
+
+	statusMap, err := getLatestRideStatuses(ctx, tx.Tx, rideIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 指定されたステータスのライドのみ残す
+	filteredRides := []Ride{}
+	for _, ride := range rides {
+		if statusFilter == "all" || string(statusMap[ride.ID]) == statusFilter {
+			filteredRides = append(filteredRides, ride)
+		}
+	}
+
+	if len(filteredRides) == 0 {
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &getAppRidesResponse{Rides: []getAppRidesResponseItem{}})
+		return
+	}
+
+	// 割り当て時の椅子の情報が残っていないライドだけ、今の椅子とオーナーを読む
+	chairIDs := make([]string, 0, len(filteredRides))
+	for _, ride := range filteredRides {
+		if ride.ChairID.Valid && ride.ChairName == nil {
+			chairIDs = append(chairIDs, ride.ChairID.String)
+		}
+	}
+
+	chairMap := make(map[string]*Chair)
+	ownerIDs := make([]string, 0, len(chairIDs))
+	if len(chairIDs) > 0 {
+		queryChairs, argsChairs, err := sqlx.In(`SELECT * FROM chairs WHERE id IN (?)`, chairIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		queryChairs = tx.Rebind(queryChairs)
+
+		chairs := []Chair{}
+		if err := tx.SelectContext(ctx, &chairs, queryChairs, argsChairs...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, c := range chairs {
+			chairMap[c.ID] = &c
+			ownerIDs = append(ownerIDs, c.OwnerID)
+		}
+	}
+
+	// Owner一括取得
+	ownerMap := make(map[string]*Owner)
+	if len(ownerIDs) > 0 {
+		queryOwners, argsOwners, err := sqlx.In(`SELECT * FROM owners WHERE id IN (?)`, ownerIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		queryOwners = tx.Rebind(queryOwners)
+
+		owners := []Owner{}
+		if err := tx.SelectContext(ctx, &owners, queryOwners, argsOwners...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, o := range owners {
+			ownerMap[o.ID] = &o
+		}
+	}
+
+	items := []getAppRidesResponseItem{}
+	for _, ride := range filteredRides {
+		// TODO: ここがN+1のままになってる
+		fare, err := calculateDiscountedFare(ctx, tx.Tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		item := getAppRidesResponseItem{
+			ID:                    ride.ID,
+			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+			Fare:                  fare,
+			RequestedAt:           ride.CreatedAt.UnixMilli(),
+			CompletedAt:           ride.UpdatedAt.UnixMilli(),
+		}
+		// COMPLETED以外のライドは未評価のことがある
+		if ride.Evaluation != nil {
+			item.Evaluation = *ride.Evaluation
+		}
+
+		if ride.ChairID.Valid && ride.ChairName != nil {
+			item.Chair.ID = ride.ChairID.String
+			item.Chair.Name = *ride.ChairName
+			if ride.ChairModel != nil {
+				item.Chair.Model = *ride.ChairModel
+			}
+			if ride.ChairOwnerName != nil {
+				item.Chair.Owner = *ride.ChairOwnerName
+			}
+		} else if ride.ChairID.Valid {
+			if c, ok := chairMap[ride.ChairID.String]; ok {
+				item.Chair.ID = c.ID
+				item.Chair.Name = c.Name
+				item.Chair.Model = c.Model
+				if o, ok := ownerMap[c.OwnerID]; ok {
+					item.Chair.Owner = o.Name
+				}
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if fields != nil {
+		projected, err := fields.project(items)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"rides": projected})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &getAppRidesResponse{
+		Rides: items,
+	})
+}
+
+// errCodeEvaluationRequired は前のライドの評価が必要なことをクライアントが判別するためのエラーコード
+const errCodeEvaluationRequired = "evaluation_required"
+
+type appPostRidesRequest struct {
+	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// PriceLock は見積もりで受け取った price_lock。期限内なら見積もりの運賃で乗れる
+	PriceLock string `json:"price_lock"`
+}
+
+type appPostRidesResponse struct {
+	RideID string `json:"ride_id"`
+	Fare   int64  `json:"fare"`
+}
+
+type executableGet interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+// missingRideStatus はステータスが1件も無いライドの状態として扱う値
+var missingRideStatus = RideStatusMatching
+
+// getLatestRideStatus はライドの最新ステータスを返す
+// ステータスが無いライドはエラーにせず missingRideStatus として扱う
+func getLatestRideStatus(ctx context.Context, tx executableGet, rideID string) (RideStatusType, error) {
+	var status RideStatusType
+	if err := tx.GetContext(ctx, &status, `SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			slog.Warn("ride has no status", "ride_id", rideID)
+			return missingRideStatus, nil
+		}
+		return "", err
+	}
+	return status, nil
+}
+
+// repairStatuslessRides はステータスが1件も無いライドに missingRideStatus のステータスを追加する
+func (s *server) repairStatuslessRides(ctx context.Context) error {
+	rideIDs := []string{}
+	if err := s.db.SelectContext(ctx, &rideIDs, `
+		SELECT r.id FROM rides r
+		WHERE NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id)`); err != nil {
+		return err
+	}
+	for _, rideID := range rideIDs {
+		if _, err := s.db.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", newID(), rideID, missingRideStatus); err != nil {
+			return err
+		}
+	}
+	if len(rideIDs) > 0 {
+		slog.Info("repaired rides without status", "count", len(rideIDs))
+	}
+	return nil
+}
+
+type latestStatusRow struct {
+	RideID string         `db:"ride_id"`
+	Status RideStatusType `db:"status"`
+}
+
+// latestStatusRowsPool は getLatestRideStatuses のスキャン先を使い回してアロケーションを減らす
+var latestStatusRowsPool = sync.Pool{
+	New: func() any {
+		rows := make([]latestStatusRow, 0, 64)
+		return &rows
+	},
+}
+
+// getLatestRideStatuses は複数のライドの最新ステータスを一括で取得する
+// ステータスが無いライドは結果に含まれない
+func getLatestRideStatuses(ctx context.Context, tx *sqlx.Tx, rideIDs []string) (map[string]RideStatusType, error) {
+	statusMap := make(map[string]RideStatusType, len(rideIDs))
+	if len(rideIDs) == 0 {
+		return statusMap, nil
+	}
+
+	query, args := expandIn(latestRideStatusesQuery, rideIDs)
+
+	latestStatuses := latestStatusRowsPool.Get().(*[]latestStatusRow)
+	defer func() {
+		*latestStatuses = (*latestStatuses)[:0]
+		latestStatusRowsPool.Put(latestStatuses)
+	}()
+	if err := tx.SelectContext(ctx, latestStatuses, query, args...); err != nil {
+		return nil, err
+	}
+	for _, s := range *latestStatuses {
+		statusMap[s.RideID] = s.Status
+	}
+	return statusMap, nil
+}
+
+func (s *server) appPostRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostRidesRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if errs := (fieldErrors{}).
+		required("pickup_coordinate", req.PickupCoordinate == nil).
+		required("destination_coordinate", req.DestinationCoordinate == nil); len(errs) > 0 {
+		writeValidationError(w, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"), errs)
+		return
+	}
+	if err := checkTripDistance(*req.PickupCoordinate, *req.DestinationCoordinate); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user := ctx.Value("user").(*User)
+	rideID := newID()
+
+	var lockedFare *int64
+	if req.PriceLock != "" {
+		fare, err := verifyPriceLock(s.priceLockKey, req.PriceLock, user.ID, *req.PickupCoordinate, *req.DestinationCoordinate, clockNow())
+		if err != nil {
+			if errors.Is(err, errPriceLockExpired) {
+				writeErrorWithCode(w, http.StatusBadRequest, errCodePriceLockExpired, err)
+				return
+			}
+			writeErrorWithCode(w, http.StatusBadRequest, errCodePriceLockInvalid, err)
+			return
+		}
+		lockedFare = &fare
+	}
+
+	tx, err := s.beginTx("appPostRides")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	rides := []Ride{}
+	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ?`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// ここで rides から rideIDs を抽出して一括で最新ステータスを取得する
+	rideIDs := make([]string, len(rides))
+	for i, ride := range rides {
+		rideIDs[i] = ride.ID
+	}
+
+	statusMap, err := getLatestRideStatuses(ctx, tx.Tx, rideIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 継続中ライド数と、到着済みなのに評価されていないライドの数を計算
+	continuingRideCount := 0
+	unevaluatedRideCount := 0
+	for _, ride := range rides {
+		status := statusMap[ride.ID]
+		if status != RideStatusCompleted && status != "" {
+			continuingRideCount++
+		}
+		if (status == RideStatusArrived || status == RideStatusCompleted) && ride.Evaluation == nil {
+			unevaluatedRideCount++
+		}
+	}
+
+	if loadRuntimeConfig().RequireEvaluationBeforeRide && unevaluatedRideCount > 0 {
+		writeErrorWithCode(w, http.StatusConflict, errCodeEvaluationRequired, errors.New("previous ride must be evaluated first"))
+		return
+	}
+
+	if continuingRideCount > 0 {
+		writeError(w, http.StatusConflict, errors.New("ride already exists"))
+		return
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, distance, locked_fare)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
+		calculateDistance(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude),
+		lockedFare,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := recordFareEvent(ctx, tx.Tx, rideID, fareEventCreated, calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude), nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := s.insertRideStatus(ctx, tx.Tx, rideID, RideStatusMatching); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var rideCount int
+	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	coupon, err := selectCoupon(ctx, tx.Tx, user.ID, rideCount == 1, true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if coupon != nil {
+		if _, err := tx.ExecContext(
+			ctx,
+			"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
+			rideID, user.ID, coupon.Code,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	ride := Ride{}
+	if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	fare, err := calculateDiscountedFare(ctx, tx.Tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if coupon != nil {
+		if err := recordFareEvent(ctx, tx.Tx, rideID, fareEventCouponApplied, fare, &coupon.Code); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 新しいライドを通知できるように状態をリセット
+	s.resetDeliveredRide(user.ID, rideID)
+	// クーポンを使ったか、初回のライドではなくなったので見積もりが変わる
+	s.invalidateFareEstimates(user.ID)
+
+	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
+		RideID: rideID,
+		Fare:   fare,
+	})
+}
+
+type appPostRidesEstimatedFareRequest struct {
+	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+}
+
+type appPostRidesEstimatedFareResponse struct {
+	Fare     int64 `json:"fare"`
+	Discount int64 `json:"discount"`
+	// PriceLock を appPostRides に渡すと、期限内であればこの運賃で乗れる
+	PriceLock string `json:"price_lock"`
+}
+
+func (s *server) appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostRidesEstimatedFareRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if errs := (fieldErrors{}).
+		required("pickup_coordinate", req.PickupCoordinate == nil).
+		required("destination_coordinate", req.DestinationCoordinate == nil); len(errs) > 0 {
+		writeValidationError(w, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"), errs)
+		return
+	}
+	if err := checkTripDistance(*req.PickupCoordinate, *req.DestinationCoordinate); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user := ctx.Value("user").(*User)
+
+	discounted, err := s.estimateFare(ctx, user.ID, *req.PickupCoordinate, *req.DestinationCoordinate)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	lock := priceLock{
+		UserID:      user.ID,
+		Pickup:      *req.PickupCoordinate,
+		Destination: *req.DestinationCoordinate,
+		Fare:        discounted,
+		ExpiresAt:   clockNow().Add(priceLockTTL),
+	}
+
+	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
+		Fare:      discounted,
+		Discount:  calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		PriceLock: lock.token(s.priceLockKey),
+	})
+}
+
+// estimateFare はこれから作るライドの割引後の運賃を見積もる
+// 見積もりを繰り返す間に DB を読み直さないよう、FareEstimateCacheTTL の間はキャッシュを返す
+func (s *server) estimateFare(ctx context.Context, userID string, pickup, destination Coordinate) (int64, error) {
+	ttl := loadRuntimeConfig().FareEstimateCacheTTL
+	key := fareEstimateKey{pickup: pickup, destination: destination}
+	if ttl > 0 {
+		if fare, ok := s.state.fareEstimates.get(userID, key, clockNow()); ok {
+			return fare, nil
+		}
+	}
+
+	tx, err := s.beginTx("appPostRidesEstimatedFare")
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	discounted, err := calculateDiscountedFare(ctx, tx.Tx, userID, nil, pickup.Latitude, pickup.Longitude, destination.Latitude, destination.Longitude)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if ttl > 0 {
+		s.state.fareEstimates.set(userID, key, discounted, clockNow(), ttl)
+	}
+	return discounted, nil
+}
+
+type appPostRoutesRequest struct {
+	Name                  string      `json:"name"`
+	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+}
+
+type appPostRoutesResponse struct {
+	ID string `json:"id"`
+}
+
+func (s *server) appPostRoutes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostRoutesRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if errs := (fieldErrors{}).
+		required("name", req.Name == "").
+		required("pickup_coordinate", req.PickupCoordinate == nil).
+		required("destination_coordinate", req.DestinationCoordinate == nil); len(errs) > 0 {
+		writeValidationError(w, errors.New("required fields(name, pickup_coordinate, destination_coordinate) are empty"), errs)
+		return
+	}
+
+	user := ctx.Value("user").(*User)
+	routeID := newID()
+
+	if _, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO routes (id, user_id, name, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
+				  VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		routeID, user.ID, req.Name, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &appPostRoutesResponse{
+		ID: routeID,
+	})
+}
+
+type appGetRouteEstimateResponse struct {
+	ID                    string     `json:"id"`
+	Name                  string     `json:"name"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Fare                  int64      `json:"fare"`
+	Discount              int64      `json:"discount"`
+}
+
+func (s *server) appGetRouteEstimate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	routeID := r.PathValue("route_id")
+	user := ctx.Value("user").(*User)
+
+	tx, err := s.beginTx("appGetRouteEstimate")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	route := &Route{}
+	if err := tx.GetContext(ctx, route, `SELECT * FROM routes WHERE id = ? AND user_id = ?`, routeID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("route not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 現時点で使われるクーポンを反映した見積もり
+	discounted, err := calculateDiscountedFare(ctx, tx.Tx, user.ID, nil, route.PickupLatitude, route.PickupLongitude, route.DestinationLatitude, route.DestinationLongitude)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &appGetRouteEstimateResponse{
+		ID:                    route.ID,
+		Name:                  route.Name,
+		PickupCoordinate:      Coordinate{Latitude: route.PickupLatitude, Longitude: route.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: route.DestinationLatitude, Longitude: route.DestinationLongitude},
+		Fare:                  discounted,
+		Discount:              calculateFare(route.PickupLatitude, route.PickupLongitude, route.DestinationLatitude, route.DestinationLongitude) - discounted,
+	})
+}
+
+// マンハッタン距離を求める
+func calculateDistance(aLatitude, aLongitude, bLatitude, bLongitude int) int {
+	return fare.Distance(aLatitude, aLongitude, bLatitude, bLongitude)
+}
+
+var errTripTooLong = errors.New("trip too long")
+
+// checkTripDistance は配車位置から目的地までが MaxTripDistance を超えていれば errTripTooLong を返す
+func checkTripDistance(pickup, destination Coordinate) error {
+	if limit := loadRuntimeConfig().MaxTripDistance; limit > 0 && calculateDistance(pickup.Latitude, pickup.Longitude, destination.Latitude, destination.Longitude) > limit {
+		return errTripTooLong
+	}
+	return nil
+}
+
+// neutralEvaluation は評価されずに完了したライドの評価として扱う値
+const neutralEvaluation = 3
+
+type appPostRideEvaluationRequest struct {
+	Evaluation int `json:"evaluation"`
+	// Tip は運賃に上乗せして支払うチップ
+	Tip int64 `json:"tip"`
+}
+
+type appPostRideEvaluationResponse struct {
+	CompletedAt int64 `json:"completed_at"`
+}
+
+func (s *server) appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	rideID := r.PathValue("ride_id")
+
+	req := &appPostRideEvaluationRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Evaluation < 1 || req.Evaluation > 5 {
+		writeError(w, http.StatusBadRequest, errors.New("evaluation must be between 1 and 5"))
+		return
+	}
+	if req.Tip < 0 || req.Tip > maxTip {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("tip must be between 0 and %d", maxTip))
+		return
+	}
+
+	tx, err := s.beginTx("appPostRideEvaluatation")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 他のユーザーのライドは存在しないライドと区別できないようにする
+	ride, err := rideForUser(ctx, tx, user.ID, rideID)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 椅子側で完了済みのライドは、支払いは済んでいるので評価だけを受け付ける
+	if status == RideStatusCompleted && ride.Evaluation == nil {
+		if req.Tip != 0 {
+			writeError(w, http.StatusBadRequest, errors.New("tip cannot be paid after the ride is completed"))
+			return
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE rides SET evaluation = ? WHERE id = ?`, req.Evaluation, rideID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		completedAt := time.Time{}
+		if err := tx.GetContext(ctx, &completedAt, `SELECT created_at FROM ride_statuses WHERE ride_id = ? AND status = 'COMPLETED'`, rideID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.invalidateUserStats(ride.UserID)
+		writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
+			CompletedAt: completedAt.UnixMilli(),
+		})
+		return
+	}
+
+	if status != RideStatusArrived {
+		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
+		return
+	}
+
+	// 決済できないときは何も変更せずに返し、支払い方法を登録してから同じ評価をやり直せるようにする
+	paymentToken, err := getPaymentToken(ctx, tx, ride.UserID)
+	if err != nil {
+		if errors.Is(err, errPaymentTokenNotRegistered) {
+			writeErrorWithCode(w, http.StatusBadRequest, errCodePaymentTokenRequired, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		`UPDATE rides SET evaluation = ?, tip = ? WHERE id = ?`,
+		req.Evaluation, req.Tip, rideID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	if err := s.completeRide(ctx, tx.Tx, ride, paymentToken); err != nil {
+		switch {
+		case errors.Is(err, erroredUpstream):
+			writeError(w, http.StatusBadGateway, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.state.chairPositions.endRide(ride.ChairID.String, ride.ID)
+	s.invalidateUserStats(ride.UserID)
+	var ownerID string
+	if err := s.db.GetContext(ctx, &ownerID, `SELECT owner_id FROM chairs WHERE id = ?`, ride.ChairID.String); err != nil {
+		slog.Error("failed to load chair owner", "chair_id", ride.ChairID.String, "err", err)
+	} else {
+		s.state.ownerCompletions.notify(ownerID)
+	}
+
+	// レスポンスを遅らせないように後から確認する
+	go s.checkRidePath(context.WithoutCancel(ctx), ride)
+
+	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
+		CompletedAt: ride.UpdatedAt.UnixMilli(),
+	})
+}
+
+var errPaymentTokenNotRegistered = errors.New("payment token not registered")
+
+// errCodePaymentTokenRequired は支払い方法を登録すれば同じリクエストをやり直せることをクライアントが判別するためのエラーコード
+const errCodePaymentTokenRequired = "payment_token_required"
+
+// getPaymentToken はユーザーの支払い方法を返す。登録されていなければ errPaymentTokenNotRegistered を返す
+func getPaymentToken(ctx context.Context, q executableGet, userID string) (*PaymentToken, error) {
+	paymentToken := &PaymentToken{}
+	if err := q.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errPaymentTokenNotRegistered
+		}
+		return nil, err
+	}
+	return paymentToken, nil
+}
+
+// completeRide はライドにCOMPLETEDを追加して運賃とチップを決済する
+// 支払い方法は何かを変更する前に呼び出し側で確かめておく
+// 呼び出し後の ride は最新の値に読み直されている
+func (s *server) completeRide(ctx context.Context, tx *sqlx.Tx, ride *Ride, paymentToken *PaymentToken) error {
+	if err := s.insertRideStatus(ctx, tx, ride.ID, RideStatusCompleted); err != nil {
+		return err
+	}
+
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, ride.ID); err != nil {
+		return err
+	}
+
+	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	if err != nil {
+		return err
+	}
+	if err := recordFareEvent(ctx, tx, ride.ID, fareEventCompleted, fare, nil); err != nil {
+		return err
+	}
+	// 後から運賃の計算を変えても過去の請求額と比べられるように残しておく
+	if _, err := tx.ExecContext(ctx, `UPDATE rides SET charged_fare = ? WHERE id = ?`, fare, ride.ID); err != nil {
+		return err
+	}
+	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
+		Amount: fare + ride.Tip,
+	}
+
+	paymentGatewayURL, err := s.getPaymentGatewayURL(ctx)
+	if err != nil {
+		return err
+	}
+
+	return requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
+		rides := []Ride{}
+		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
+			return nil, err
+		}
+		return rides, nil
+	})
+}
+
+type appGetNotificationResponse struct {
+	Data         *appGetNotificationResponseData `json:"data"`
+	RetryAfterMs int                             `json:"retry_after_ms"`
+}
+
+type appGetNotificationResponseData struct {
+	RideID                string                           `json:"ride_id"`
+	PickupCoordinate      Coordinate                       `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate                       `json:"destination_coordinate"`
+	Fare                  int64                            `json:"fare"`
+	Status                RideStatusType                   `json:"status"`
+	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
+	CreatedAt             int64                            `json:"created_at"`
+	UpdateAt              int64                            `json:"updated_at"`
+	// MatchingHint はMATCHINGのときのみ searching, no_chairs_available, assigned のいずれかが入る
+	MatchingHint string `json:"matching_hint,omitempty"`
+}
+
+type appGetNotificationResponseChair struct {
+	ID    string                               `json:"id"`
+	Name  string                               `json:"name"`
+	Model string                               `json:"model"`
+	Stats appGetNotificationResponseChairStats `json:"stats"`
+}
+
+type appGetNotificationResponseChairStats struct {
+	TotalRidesCount    int     `json:"total_rides_count"`
+	TotalEvaluationAvg float64 `json:"total_evaluation_avg"`
+}
+
+const (
+	// 通知済みのライドしか無いユーザーは新しいライドを作るまで状態が変わらないので、ゆっくりポーリングさせる
+	deliveredRetryAfterMs = 1000
+)
+
+// initializeDeliveredRides は最新のライドのCOMPLETEDが通知済みのユーザーを読み込む
+func (s *server) initializeDeliveredRides(ctx context.Context) error {
+	rows := []struct {
+		UserID string `db:"user_id"`
+		RideID string `db:"ride_id"`
+	}{}
+	if err := s.db.SelectContext(ctx, &rows, `
+		SELECT r.user_id, r.id AS ride_id FROM rides r
+		INNER JOIN (
+			SELECT user_id, MAX(created_at) AS max_created FROM rides GROUP BY user_id
+		) t ON t.user_id = r.user_id AND t.max_created = r.created_at
+		INNER JOIN ride_statuses rs ON rs.ride_id = r.id
+		WHERE rs.status = 'COMPLETED' AND rs.app_sent_at IS NOT NULL
+	`); err != nil {
+		return err
+	}
+
+	m := make(map[string]string, len(rows))
+	for _, row := range rows {
+		m[row.UserID] = row.RideID
+	}
+
+	s.state.deliveredRides.replace(m)
+	return nil
+}
+
+// appGetNotification はポーリングで状態の変化を1つずつ返す
+// 未送信の状態は app_sent_at が NULL の行として残るので、ポーリングの間隔が空いても取りこぼさない
+// resend=true のときは通知済みかに関わらず最新の状態を返し、通知済みにはしない。アプリの起動直後に今の状態を知るために使う
+// Accept に text/event-stream を指定したときは appStreamNotification でストリームとして返す
+func (s *server) appGetNotification(w http.ResponseWriter, r *http.Request) {
+	if wantsEventStream(r) {
+		s.appStreamNotification(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	resend := r.URL.Query().Get("resend") == "true"
+
+	// COMPLETEDまで通知済みで新しいライドが無ければDBを見ずに返す
+	if !resend && s.state.deliveredRides.isDelivered(user.ID) {
+		writeJSON(w, http.StatusOK, &appGetNotificationResponse{
+			RetryAfterMs: deliveredRetryAfterMs,
+		})
+		return
+	}
+
+	// 同じユーザーの通知を並行して取得すると、同じステータスを取り合って片方が何も返せなくなる
+	if s.serializeUserNotifications {
+		unlock := s.state.userNotifications.lock(user.ID)
+		defer unlock()
+	}
+
+	if !s.tryAcquireNotification() {
+		writeJSON(w, http.StatusOK, &appGetNotificationResponse{
+			RetryAfterMs: shedRetryAfterMs,
+		})
+		return
+	}
+	defer s.releaseNotification()
+
+	// ライドを読んだ後に新しいライドが作られていたら、読んだライドを通知済みにしない
+	generation := s.state.deliveredRides.generation()
+
+	tx, err := s.beginTx("appGetNotification")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	const latestRideQuery = `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`
+	if err := timedQuery("app_notification_latest_ride", latestRideQuery, func() error {
+		return tx.GetContext(ctx, ride, latestRideQuery, user.ID)
+	}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusOK, &appGetNotificationResponse{
+				// 状態変更から3秒以内に通知されている必要があるため、2秒後にリトライする
+				// see: https://gist.github.com/wtks/8eadf471daf7cb59942de02273ce7884#通知エンドポイント
+				RetryAfterMs: 100,
+			})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	yetSentRideStatus := RideStatus{}
+	var status RideStatusType
+	const yetSentStatusQuery = `SELECT * FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`
+	if resend {
+		status, err = getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else if err := timedQuery("app_notification_yet_sent_status", yetSentStatusQuery, func() error {
+		return tx.GetContext(ctx, &yetSentRideStatus, yetSentStatusQuery, ride.ID)
+	}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			status, err = getLatestRideStatus(ctx, tx, ride.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		} else {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		status = yetSentRideStatus.Status
+	}
+
+	data, err := s.appNotificationData(ctx, tx.Tx, user.ID, ride, status)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := &appGetNotificationResponse{
+		Data: data,
+		// 状態変更から3秒以内に通知されている必要があるため、2秒後にリトライする
+		// see: https://gist.github.com/wtks/8eadf471daf7cb59942de02273ce7884#通知エンドポイント
+		RetryAfterMs: 100,
+	}
+
+	if yetSentRideStatus.ID != "" {
+		if err := markAppNotificationSent(ctx, tx.Tx, &yetSentRideStatus); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 再送では通知済みにしていないので、未通知のCOMPLETEDを通知済みとして扱わないようにする
+	if status == RideStatusCompleted && !resend {
+		s.state.deliveredRides.markDelivered(user.ID, ride.ID, generation)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// appNotificationData は status の時点のライドの通知内容を作る。ポーリングとストリームで共通
+func (s *server) appNotificationData(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, status RideStatusType) (*appGetNotificationResponseData, error) {
+	fare, err := calculateDiscountedFare(ctx, tx, userID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &appGetNotificationResponseData{
+		RideID: ride.ID,
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Fare:      fare,
+		Status:    status,
+		CreatedAt: ride.CreatedAt.UnixMilli(),
+		UpdateAt:  ride.UpdatedAt.UnixMilli(),
+	}
+
+	if status == RideStatusMatching {
+		data.MatchingHint = matchingHint(ride.ChairID.Valid)
+	}
+
+	if ride.ChairID.Valid {
+		chair := &Chair{}
+		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID.String); err != nil {
+			return nil, err
+		}
+
+		stats, err := getChairStats(ctx, tx, chair.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		data.Chair = &appGetNotificationResponseChair{
+			ID:    chair.ID,
+			Name:  chair.Name,
+			Model: chair.Model,
+			Stats: stats,
+		}
+	}
+	return data, nil
+}
+
+func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
+	stats := appGetNotificationResponseChairStats{}
+
+	rides := []Ride{}
+	err := tx.SelectContext(
+		ctx,
+		&rides,
+		`SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC`,
+		chairID,
+	)
+	if err != nil {
+		return stats, err
+	}
+
+	totalRideCount := 0
+	totalEvaluation := 0.0
+	for _, ride := range rides {
+		rideStatuses := []RideStatus{}
+		err = tx.SelectContext(
+			ctx,
+			&rideStatuses,
+			`SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at`,
+			ride.ID,
+		)
+		if err != nil {
+			return stats, err
+		}
+
+		var arrivedAt, pickupedAt *time.Time
+		var isCompleted bool
+		for _, status := range rideStatuses {
+			if status.Status == RideStatusArrived {
+				arrivedAt = &status.CreatedAt
+			} else if status.Status == RideStatusCarrying {
+				pickupedAt = &status.CreatedAt
+			}
+			if status.Status == RideStatusCompleted {
+				isCompleted = true
+			}
+		}
+		if arrivedAt == nil || pickupedAt == nil {
+			continue
+		}
+		if !isCompleted {
+			continue
+		}
+
+		totalRideCount++
+		// 椅子側で完了して評価されていないライドは中立の評価として扱う
+		evaluation := neutralEvaluation
+		if ride.Evaluation != nil {
+			evaluation = *ride.Evaluation
+		}
+		totalEvaluation += float64(evaluation)
+	}
+
+	stats.TotalRidesCount = totalRideCount
+	if totalRideCount > 0 {
+		stats.TotalEvaluationAvg = totalEvaluation / float64(totalRideCount)
+	}
+
+	return stats, nil
+}
+
+type appGetNearbyChairsResponse struct {
+	Chairs      []appGetNearbyChairsResponseChair `json:"chairs"`
+	RetrievedAt int64                             `json:"retrieved_at"`
+}
+
+type appGetNearbyChairsResponseChair struct {
+	ID                string     `json:"id"`
+	Name              string     `json:"name"`
+	Model             string     `json:"model"`
+	CurrentCoordinate Coordinate `json:"current_coordinate"`
+}
+
+func (s *server) appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	latStr := r.URL.Query().Get("latitude")
+	lonStr := r.URL.Query().Get("longitude")
+	distanceStr := r.URL.Query().Get("distance")
+	if latStr == "" || lonStr == "" {
+		writeError(w, http.StatusBadRequest, errors.New("latitude or longitude is empty"))
+		return
+	}
+
+	lat, err := strconv.Atoi(latStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("latitude is invalid"))
+		return
+	}
+
+	lon, err := strconv.Atoi(lonStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("longitude is invalid"))
+		return
+	}
+
+	distance := 50
+	if distanceStr != "" {
+		distance, err = strconv.Atoi(distanceStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("distance is invalid"))
+			return
+		}
+		if maxDistance := loadMatchingParams().MaxNearbyDistance; distance < 0 || distance > maxDistance {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("distance must be between 0 and %d", maxDistance))
+			return
+		}
+	}
+
+	coordinate := Coordinate{Latitude: lat, Longitude: lon}
+
+	tx, err := s.beginTx("appGetNearbyChairs")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 全ての椅子を一度に取得
+	// is_active と current_ride_id の変更がすぐに反映されるよう、キャッシュは使わずDBから読む
+	chairs := []Chair{}
+	err = tx.SelectContext(
+		ctx,
+		&chairs,
+		`SELECT * FROM chairs WHERE deleted_at IS NULL`,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 有効な椅子のIDを抽出
+	activeChairIDs := make([]string, 0, len(chairs))
+	for _, chair := range chairs {
+		if chair.IsActive {
+			activeChairIDs = append(activeChairIDs, chair.ID)
+		}
+	}
+
+	if len(activeChairIDs) == 0 {
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// 有効な椅子がない場合はそのままレスポンス
+		writeNearbyChairs(w, r, &appGetNearbyChairsResponse{
+			Chairs:      []appGetNearbyChairsResponseChair{},
+			RetrievedAt: clockNow().UnixMilli(),
+		})
+		return
+	}
+
+	// 最新のchair位置情報を一回で取得
+	// 最終位置情報は chair_id ごとに最新一件を取得する
+	chairLocations := []ChairLocation{}
+	queryLocations, argsLocations := expandIn(latestChairLocationsQuery, activeChairIDs)
+	if err := tx.SelectContext(ctx, &chairLocations, queryLocations, argsLocations...); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	locationMap := make(map[string]*ChairLocation)
+	for i := range chairLocations {
+		loc := &chairLocations[i]
+		locationMap[loc.ChairID] = loc
+	}
+
+	// ライドを割り当てられている椅子はスキップ
+	nearbyChairs := []appGetNearbyChairsResponseChair{}
+	for _, chair := range chairs {
+		if !chair.IsActive {
+			continue
+		}
+
+		if chair.CurrentRideID.Valid {
+			continue
+		}
+
+		// 最新位置情報がない場合はスキップ
+		loc := locationMap[chair.ID]
+		if loc == nil {
+			continue
+		}
+
+		// 距離判定
+		if calculateDistance(coordinate.Latitude, coordinate.Longitude, loc.Latitude, loc.Longitude) <= distance {
+			nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
+				ID:    chair.ID,
+				Name:  chair.Name,
+				Model: chair.Model,
+				CurrentCoordinate: Coordinate{
+					Latitude:  loc.Latitude,
+					Longitude: loc.Longitude,
+				},
+			})
+		}
+	}
+
+	retrievedAt := clockNow()
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeNearbyChairs(w, r, &appGetNearbyChairsResponse{
+		Chairs:      nearbyChairs,
+		RetrievedAt: retrievedAt.UnixMilli(),
+	})
+}
+
+type nearbyChairsFeatureCollection struct {
+	Type     string                `json:"type"`
+	Features []nearbyChairsFeature `json:"features"`
+	// RetrievedAt はGeoJSONの仕様外のメンバーとして残す
+	RetrievedAt int64 `json:"retrieved_at"`
+}
+
+type nearbyChairsFeature struct {
+	Type       string                        `json:"type"`
+	ID         string                        `json:"id"`
+	Geometry   nearbyChairsPoint             `json:"geometry"`
+	Properties nearbyChairsFeatureProperties `json:"properties"`
+}
+
+type nearbyChairsPoint struct {
+	Type string `json:"type"`
+	// Coordinates はGeoJSONの仕様に合わせて [経度, 緯度] の順
+	Coordinates [2]int `json:"coordinates"`
+}
+
+type nearbyChairsFeatureProperties struct {
+	Name  string `json:"name"`
+	Model string `json:"model"`
+}
+
+// wantsGeoJSON は format=geojson か Accept: application/geo+json が指定されているかを返す
+func wantsGeoJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "geojson" || strings.Contains(r.Header.Get("Accept"), "application/geo+json")
+}
+
+// writeNearbyChairs は要求された形式で近くの椅子を返す。デフォルトは従来のJSON
+func writeNearbyChairs(w http.ResponseWriter, r *http.Request, res *appGetNearbyChairsResponse) {
+	if !wantsGeoJSON(r) {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	fc := nearbyChairsFeatureCollection{
+		Type:        "FeatureCollection",
+		Features:    make([]nearbyChairsFeature, 0, len(res.Chairs)),
+		RetrievedAt: res.RetrievedAt,
+	}
+	for _, c := range res.Chairs {
+		fc.Features = append(fc.Features, nearbyChairsFeature{
+			Type: "Feature",
+			ID:   c.ID,
+			Geometry: nearbyChairsPoint{
+				Type:        "Point",
+				Coordinates: [2]int{c.CurrentCoordinate.Longitude, c.CurrentCoordinate.Latitude},
+			},
+			Properties: nearbyChairsFeatureProperties{
+				Name:  c.Name,
+				Model: c.Model,
+			},
+		})
+	}
+	writeJSONAs(w, http.StatusOK, "application/geo+json", fc)
+}
+
+func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int64 {
+	return calculateFareByDistance(calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude))
+}
+
+func calculateFareByDistance(distance int) int64 {
+	return fare.Calculate(fare.Input{Distance: distance, Rounding: loadRuntimeConfig().FareRounding})
+}
+
+func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int64, error) {
+	var coupon Coupon
+	var discount int64
+	var distance int
+	if ride != nil {
+		if ride.LockedFare != nil {
+			return *ride.LockedFare, nil
+		}
+		// ライド作成時に計算済みの距離を使う
+		distance = ride.Distance
+
+		// すでにクーポンが紐づいているならそれの割引額を参照
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return 0, err
+			}
+		} else {
+			discount = coupon.Discount
+		}
+	} else {
+		distance = calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+
+		// これから作るライドに使われるクーポンを見積もる
+		var rideCount int
+		if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ?`, userID); err != nil {
+			return 0, err
+		}
+		selected, err := selectCoupon(ctx, tx, userID, rideCount == 0, false)
+		if err != nil {
+			return 0, err
+		}
+		if selected != nil {
+			discount = selected.Discount
+		}
+	}
+
+	return fare.Calculate(fare.Input{Distance: distance, Discount: discount, Rounding: loadRuntimeConfig().FareRounding}), nil
+}
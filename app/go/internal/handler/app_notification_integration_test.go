@@ -0,0 +1,185 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// pollAppNotification は通知を1回取得する
+func (ts *testServer) pollAppNotification(t *testing.T, user testUser) appGetNotificationResponse {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/notification", user.Cookie, nil)
+	return decodeJSON[appGetNotificationResponse](t, rec)
+}
+
+// drainAppNotifications は未通知のステータスを全て受け取り、最後に受け取ったステータスを返す
+// drainChairNotifications と同じく、最新のステータスが繰り返されるまで受け取る
+func (ts *testServer) drainAppNotifications(t *testing.T, user testUser) RideStatusType {
+	t.Helper()
+	var last RideStatusType
+	for i := 0; i < 20; i++ {
+		res := ts.pollAppNotification(t, user)
+		if res.Data == nil {
+			return last
+		}
+		if res.Data.Status == last && last == ts.latestStatus(t, res.Data.RideID) {
+			return last
+		}
+		last = res.Data.Status
+	}
+	return last
+}
+
+// appAuthQuery は認証のミドルウェアが毎回発行するクエリ。通知のDBアクセスの回数からは除く
+const appAuthQuery = "SELECT * FROM users WHERE access_token"
+
+func TestAppNotificationIdlePollsSkipDB(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "idle")
+
+	rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	if got := ts.drainAppNotifications(t, f.User); got != RideStatusCompleted {
+		t.Fatalf("last delivered status = %q, want COMPLETED", got)
+	}
+
+	// COMPLETEDを受け取った後の10回のポーリングのうち、DBを読んでよいのは最初の1回だけ
+	for i := 0; i < 10; i++ {
+		mark := ts.queries.mark()
+		res := ts.pollAppNotification(t, f.User)
+		queries := ts.queries.since(mark, appAuthQuery)
+		if res.Data != nil && res.Data.Status != RideStatusCompleted {
+			t.Fatalf("poll %d returned %q for ride %s", i, res.Data.Status, res.Data.RideID)
+		}
+		if i == 0 {
+			continue
+		}
+		if res.Data != nil {
+			t.Fatalf("poll %d returned ride %s, want empty data", i, res.Data.RideID)
+		}
+		if res.RetryAfterMs != deliveredRetryAfterMs {
+			t.Fatalf("poll %d retry_after_ms = %d, want %d", i, res.RetryAfterMs, deliveredRetryAfterMs)
+		}
+		if len(queries) != 0 {
+			t.Fatalf("idle poll %d touched the DB: %q", i, queries)
+		}
+	}
+
+	// 新しいライドを作ったら通知が再開する
+	nextRideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	res := ts.pollAppNotification(t, f.User)
+	if res.Data == nil || res.Data.RideID != nextRideID || res.Data.Status != RideStatusMatching {
+		t.Fatalf("after a new ride: got %+v, want MATCHING for %s (previous %s)", res.Data, nextRideID, rideID)
+	}
+}
+
+func TestAppNotificationKeepsNewRideCreatedDuringPoll(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "racing")
+	oldRideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+
+	// 古いライドのCOMPLETEDを読んでいる通知の途中で新しいライドが作られた状況
+	generation := ts.state.deliveredRides.generation()
+	newRideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	if ts.state.deliveredRides.markDelivered(f.User.ID, oldRideID, generation) {
+		t.Fatal("markDelivered accepted the old ride after a new ride was created")
+	}
+
+	got := ts.drainAppNotifications(t, f.User)
+	if got != RideStatusMatching {
+		t.Fatalf("last status = %q, want MATCHING for the new ride %s", got, newRideID)
+	}
+}
+
+func TestConcurrentAppNotificationPollsDeliverEachStatusOnce(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "concurrent")
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusEnroute)
+
+	// 未通知の MATCHING と ENROUTE を2つのポーリングで同時に取りに行く
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 2)
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = ts.do(t, http.MethodGet, "/api/app/notification", f.User.Cookie, nil)
+		}()
+	}
+	wg.Wait()
+
+	delivered := map[RideStatusType]int{}
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("poll %d = %d: %s", i, rec.Code, rec.Body.String())
+		}
+		res := decodeJSON[appGetNotificationResponse](t, rec)
+		if res.Data == nil {
+			t.Fatalf("poll %d = %+v, want a status", i, res)
+		}
+		delivered[res.Data.Status]++
+	}
+	// 順に処理されるので、同じステータスを取り合わずに1つずつ届く
+	if delivered[RideStatusMatching] != 1 || delivered[RideStatusEnroute] != 1 {
+		t.Fatalf("delivered = %v, want MATCHING and ENROUTE once each", delivered)
+	}
+	var unsent int
+	if err := ts.db.Get(&unsent, "SELECT COUNT(*) FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL", rideID); err != nil {
+		t.Fatal(err)
+	}
+	if unsent != 0 {
+		t.Fatalf("%d statuses are left unsent", unsent)
+	}
+}
+
+func TestAppNotificationResendReturnsAlreadySentStatus(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "resend")
+	rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	if got := ts.drainAppNotifications(t, f.User); got != RideStatusCompleted {
+		t.Fatalf("last delivered status = %q, want COMPLETED", got)
+	}
+	completedID := ts.rideStatusID(t, rideID, RideStatusCompleted)
+	var sentAt string
+	if err := ts.db.Get(&sentAt, "SELECT app_sent_at FROM ride_statuses WHERE id = ?", completedID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 通知済みなので普段のポーリングでは何も返らない
+	if res := ts.pollAppNotification(t, f.User); res.Data != nil {
+		t.Fatalf("poll after COMPLETED = %+v, want empty data", res.Data)
+	}
+
+	// 起動し直したアプリは resend=true で今の状態を受け取れる
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/notification?resend=true", f.User.Cookie, nil)
+	res := decodeJSON[appGetNotificationResponse](t, rec)
+	if res.Data == nil || res.Data.RideID != rideID || res.Data.Status != RideStatusCompleted {
+		t.Fatalf("resend = %+v, want %s COMPLETED", res.Data, rideID)
+	}
+	var resentAt string
+	if err := ts.db.Get(&resentAt, "SELECT app_sent_at FROM ride_statuses WHERE id = ?", completedID); err != nil {
+		t.Fatal(err)
+	}
+	if resentAt != sentAt {
+		t.Fatalf("app_sent_at = %s after resend, want it kept at %s", resentAt, sentAt)
+	}
+
+	// 未通知のステータスを resend で返しても通知済みにはしない
+	nextRideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	rec = ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/notification?resend=true", f.User.Cookie, nil)
+	if res := decodeJSON[appGetNotificationResponse](t, rec); res.Data == nil || res.Data.RideID != nextRideID || res.Data.Status != RideStatusMatching {
+		t.Fatalf("resend = %+v, want %s MATCHING", res.Data, nextRideID)
+	}
+	var unsent int
+	if err := ts.db.Get(&unsent, "SELECT COUNT(*) FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL", nextRideID); err != nil {
+		t.Fatal(err)
+	}
+	if unsent != 1 {
+		t.Fatalf("unsent statuses of the new ride = %d after resend, want MATCHING left unsent", unsent)
+	}
+}
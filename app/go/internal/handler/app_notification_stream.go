@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// appNotificationStreamInterval ごとにストリームで送っていないステータスを取りに行く
+const appNotificationStreamInterval = 100 * time.Millisecond
+
+// wantsEventStream は通知をポーリングではなく Server-Sent Events で受け取りたいリクエストかどうかを返す
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// appStreamNotification は自分のライドのステータスが変わるたびに、ride_statuses.id をイベントIDとして送り続ける
+// Last-Event-ID を付けて再接続すると、切れている間に記録されたステータスをそのIDの後から順に送り直してから続きを送る
+// 付けなかったときや自分のライドのステータスでないIDのときは、最新のライドの今のステータスから送る
+func (s *server) appStreamNotification(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	var last *RideStatus
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		status := &RideStatus{}
+		err := s.db.GetContext(ctx, status, `
+			SELECT rs.* FROM ride_statuses rs
+			INNER JOIN rides r ON r.id = rs.ride_id
+			WHERE rs.id = ? AND r.user_id = ?`, lastEventID, user.ID)
+		if err == nil {
+			last = status
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(appNotificationStreamInterval)
+	defer ticker.Stop()
+	for {
+		statuses, err := s.appNotificationStatusesAfter(ctx, user.ID, last)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("failed to read ride statuses for the notification stream", "user_id", user.ID, "err", err)
+			}
+			return
+		}
+		for i := range statuses {
+			if err := s.writeAppNotificationEvent(ctx, w, user, &statuses[i]); err != nil {
+				if ctx.Err() == nil {
+					slog.Error("failed to send a notification event", "user_id", user.ID, "err", err)
+				}
+				return
+			}
+			flusher.Flush()
+			last = &statuses[i]
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// appNotificationStatusesAfter は last の後に記録されたユーザーのライドのステータスを記録順に返す
+// last が nil なら最新のライドの最新のステータスだけを返す
+func (s *server) appNotificationStatusesAfter(ctx context.Context, userID string, last *RideStatus) ([]RideStatus, error) {
+	statuses := []RideStatus{}
+	if last == nil {
+		err := s.db.SelectContext(ctx, &statuses, `
+			SELECT * FROM ride_statuses
+			WHERE ride_id = (SELECT id FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1)
+			ORDER BY created_at DESC, id DESC
+			LIMIT 1`, userID)
+		return statuses, err
+	}
+	err := s.db.SelectContext(ctx, &statuses, `
+		SELECT rs.* FROM ride_statuses rs
+		INNER JOIN rides r ON r.id = rs.ride_id
+		WHERE r.user_id = ? AND (rs.created_at > ? OR (rs.created_at = ? AND rs.id > ?))
+		ORDER BY rs.created_at, rs.id`, userID, last.CreatedAt, last.CreatedAt, last.ID)
+	return statuses, err
+}
+
+// writeAppNotificationEvent は status をポーリングと同じ内容のイベントとして送り、未通知なら通知済みにする
+func (s *server) writeAppNotificationEvent(ctx context.Context, w http.ResponseWriter, user *User, status *RideStatus) error {
+	if s.serializeUserNotifications {
+		unlock := s.state.userNotifications.lock(user.ID)
+		defer unlock()
+	}
+
+	tx, err := s.beginTx("appStreamNotification")
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, status.RideID); err != nil {
+		return err
+	}
+	data, err := s.appNotificationData(ctx, tx.Tx, user.ID, ride, status.Status)
+	if err != nil {
+		return err
+	}
+	if status.AppSentAt == nil {
+		if err := markAppNotificationSent(ctx, tx.Tx, status); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", status.ID, buf)
+	return err
+}
+
+// markAppNotificationSent はステータスをユーザーに通知済みにし、COMPLETEDなら椅子を空ける
+func markAppNotificationSent(ctx context.Context, tx *sqlx.Tx, status *RideStatus) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND app_sent_at IS NULL`, status.ID); err != nil {
+		return err
+	}
+	if status.Status == RideStatusCompleted {
+		return releaseChairIfCompletionDelivered(ctx, tx, status.RideID)
+	}
+	return nil
+}
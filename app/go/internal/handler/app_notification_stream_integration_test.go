@@ -0,0 +1,89 @@
+//go:build integration
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type appNotificationEvent struct {
+	ID     string
+	RideID string
+	Status RideStatusType
+}
+
+// nextAppNotificationEvent は通知のストリームから id と data の行を1組受け取る
+func nextAppNotificationEvent(t *testing.T, lines <-chan string) appNotificationEvent {
+	t.Helper()
+	id, ok := strings.CutPrefix(nextStreamLine(t, lines), "id: ")
+	if !ok {
+		t.Fatal("the event does not start with an id")
+	}
+	data, ok := strings.CutPrefix(nextStreamLine(t, lines), "data: ")
+	if !ok {
+		t.Fatal("the event has no data")
+	}
+	// Coordinate の UnmarshalJSON が昇格しないよう、必要な項目だけを受け取る
+	var payload struct {
+		RideID string         `json:"ride_id"`
+		Status RideStatusType `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		t.Fatal(err)
+	}
+	return appNotificationEvent{ID: id, RideID: payload.RideID, Status: payload.Status}
+}
+
+func (ts *testServer) rideStatusID(t *testing.T, rideID string, status RideStatusType) string {
+	t.Helper()
+	var id string
+	if err := ts.db.Get(&id, "SELECT id FROM ride_statuses WHERE ride_id = ? AND status = ?", rideID, status); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestAppNotificationStreamReplaysStatusesMissedWhileDisconnected(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "resumed")
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	accept := http.Header{"Accept": {"text/event-stream"}}
+
+	lines, disconnect := ts.openEventStream(t, "/api/app/notification", f.User.Cookie, accept)
+	matching := nextAppNotificationEvent(t, lines)
+	if matching.ID != ts.rideStatusID(t, rideID, RideStatusMatching) || matching.RideID != rideID || matching.Status != RideStatusMatching {
+		t.Fatalf("first event = %+v, want the MATCHING status of %s", matching, rideID)
+	}
+	disconnect()
+
+	// 切れている間に椅子が割り当てられ、配車位置に着く
+	ts.runMatching(t)
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusEnroute)
+	ts.moveChair(t, f.Chair, testPickup)
+
+	// 最新の PICKUP だけでなく、その前の ENROUTE から順に送り直す
+	resumeHeader := http.Header{"Accept": {"text/event-stream"}, "Last-Event-Id": {matching.ID}}
+	lines, _ = ts.openEventStream(t, "/api/app/notification", f.User.Cookie, resumeHeader)
+	for _, want := range []RideStatusType{RideStatusEnroute, RideStatusPickup} {
+		event := nextAppNotificationEvent(t, lines)
+		if event.ID != ts.rideStatusID(t, rideID, want) || event.Status != want {
+			t.Fatalf("replayed event = %+v, want the missed %s status", event, want)
+		}
+		var appSentAt *string
+		if err := ts.db.Get(&appSentAt, "SELECT app_sent_at FROM ride_statuses WHERE id = ?", event.ID); err != nil {
+			t.Fatal(err)
+		}
+		if appSentAt == nil {
+			t.Fatalf("the replayed %s status is not marked as sent to the app", want)
+		}
+	}
+
+	// 送り直した後は続きをそのまま受け取る
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusCarrying)
+	if carrying := nextAppNotificationEvent(t, lines); carrying.ID != ts.rideStatusID(t, rideID, RideStatusCarrying) || carrying.Status != RideStatusCarrying {
+		t.Fatalf("live event = %+v, want CARRYING", carrying)
+	}
+}
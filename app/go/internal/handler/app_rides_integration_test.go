@@ -0,0 +1,405 @@
+//go:build integration
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/internal/fare"
+)
+
+func TestAppGetRidesStatusFilter(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "filter")
+
+	completedRideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	matchingRideID := ts.requestRide(t, f.User, testPickup, testDestination)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "", want: []string{completedRideID}},
+		{query: "?status=COMPLETED", want: []string{completedRideID}},
+		{query: "?status=all", want: []string{matchingRideID, completedRideID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/rides"+tt.query, f.User.Cookie, nil)
+			res := decodeJSON[getAppRidesResponse](t, rec)
+			got := make([]string, 0, len(res.Rides))
+			for _, ride := range res.Rides {
+				got = append(got, ride.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("rides = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 取り消しの遷移は無いので、CANCELED などの未知の値は400にする
+	for _, status := range []string{"CANCELED", "MATCHING", "completed"} {
+		t.Run(status, func(t *testing.T) {
+			ts.mustDo(t, http.StatusBadRequest, http.MethodGet, "/api/app/rides?status="+status, f.User.Cookie, nil)
+		})
+	}
+}
+
+func TestAppGetRidesFieldSelection(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "fields")
+	rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/rides?fields=id,fare,chair.name", f.User.Cookie, nil)
+	res := decodeJSON[map[string][]map[string]any](t, rec)
+	if len(res["rides"]) != 1 {
+		t.Fatalf("rides = %v, want the completed ride", res["rides"])
+	}
+	ride := res["rides"][0]
+	if len(ride) != 3 || ride["id"] != rideID || ride["fare"] == nil {
+		t.Fatalf("ride = %v, want only id, fare and chair", ride)
+	}
+	if chair, _ := ride["chair"].(map[string]any); len(chair) != 1 || chair["name"] != "fields-chair" {
+		t.Fatalf("chair = %v, want only its name", ride["chair"])
+	}
+
+	// 未知のフィールドはライドが無くても400にする
+	other := ts.registerUser(t, "fields-other-user", nil)
+	for _, fields := range []string{"price", "chair.speed", "id.value"} {
+		t.Run(fields, func(t *testing.T) {
+			rec := ts.mustDo(t, http.StatusBadRequest, http.MethodGet, "/api/app/rides?fields="+fields, other.Cookie, nil)
+			if !strings.Contains(rec.Body.String(), "unknown field: "+fields) {
+				t.Fatalf("error = %s, want the unknown field named", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRideFareUsesStoredDistance(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "distance")
+	rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+
+	var stored int
+	if err := ts.db.Get(&stored, "SELECT distance FROM rides WHERE id = ?", rideID); err != nil {
+		t.Fatal(err)
+	}
+	if want := calculateDistance(testPickup.Latitude, testPickup.Longitude, testDestination.Latitude, testDestination.Longitude); stored != want {
+		t.Fatalf("rides.distance = %d, want %d", stored, want)
+	}
+
+	// 保存した距離を書き換えると、履歴の運賃は座標ではなく保存した距離から計算される
+	const altered = 100
+	if _, err := ts.db.Exec("UPDATE rides SET distance = ? WHERE id = ?", altered, rideID); err != nil {
+		t.Fatal(err)
+	}
+	var discount int64
+	if err := ts.db.Get(&discount, "SELECT IFNULL(SUM(discount), 0) FROM coupons WHERE used_by = ?", rideID); err != nil {
+		t.Fatal(err)
+	}
+	want := fare.Calculate(fare.Input{Distance: altered, Discount: discount, Rounding: loadRuntimeConfig().FareRounding})
+
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/rides", f.User.Cookie, nil)
+	rides := decodeJSON[getAppRidesResponse](t, rec).Rides
+	if len(rides) != 1 || rides[0].Fare != want {
+		t.Fatalf("ride history = %+v, want fare %d from the stored distance", rides, want)
+	}
+}
+
+func TestTippedEvaluationChargesTipAndCountsInSales(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "tipping")
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.driveToArrival(t, f.Chair, rideID, testPickup, testDestination)
+
+	const tip = 500
+	ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 5, Tip: tip})
+
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/rides", f.User.Cookie, nil)
+	rides := decodeJSON[getAppRidesResponse](t, rec).Rides
+	if len(rides) != 1 {
+		t.Fatalf("ride history = %+v, want the tipped ride", rides)
+	}
+	if got, want := ts.lastPayment.Load(), rides[0].Fare+tip; got != want {
+		t.Fatalf("payment amount = %d, want fare %d + tip %d", got, rides[0].Fare, tip)
+	}
+
+	now := time.Now()
+	query := fmt.Sprintf("?since=%d&until=%d", now.Add(-time.Hour).UnixMilli(), now.Add(time.Hour).UnixMilli())
+	rec = ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/owner/sales"+query, f.Owner.Cookie, nil)
+	sales := decodeJSON[ownerGetSalesResponse](t, rec)
+	if sales.Tips != tip || len(sales.Chairs) != 1 || sales.Chairs[0].Tips != tip {
+		t.Fatalf("sales = %+v, want tips %d", sales, tip)
+	}
+	// チップは運賃の売上には含めない
+	if sales.NetSales != rides[0].Fare {
+		t.Fatalf("net_sales = %d, want the fare %d without the tip", sales.NetSales, rides[0].Fare)
+	}
+
+	// 上限を超えるチップは受け付けない
+	ts.drainChairNotifications(t, f.Chair)
+	ts.drainAppNotifications(t, f.User)
+	ts.moveChair(t, f.Chair, testPickup)
+	nextRideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.driveToArrival(t, f.Chair, nextRideID, testPickup, testDestination)
+	ts.mustDo(t, http.StatusBadRequest, http.MethodPost, "/api/app/rides/"+nextRideID+"/evaluation", f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 5, Tip: maxTip + 1})
+	ts.mustDo(t, http.StatusBadRequest, http.MethodPost, "/api/app/rides/"+nextRideID+"/evaluation", f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 5, Tip: -1})
+	if got := ts.payments.Load(); got != 1 {
+		t.Fatalf("payments = %d, want only the first ride charged", got)
+	}
+}
+
+func TestRideTimestampsAreUTCUnderLocalTimezone(t *testing.T) {
+	// サーバーのタイムゾーンがUTCでなくても、返すUNIX時刻と集計範囲はずれない
+	local := time.Local
+	time.Local = time.FixedZone("JST", 9*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "timezone")
+	before := time.Now().Add(-time.Second)
+	ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	after := time.Now().Add(time.Second)
+
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/rides", f.User.Cookie, nil)
+	rides := decodeJSON[getAppRidesResponse](t, rec).Rides
+	if len(rides) != 1 {
+		t.Fatalf("ride history = %+v, want the completed ride", rides)
+	}
+	for name, ms := range map[string]int64{"requested_at": rides[0].RequestedAt, "completed_at": rides[0].CompletedAt} {
+		if ms < before.UnixMilli() || ms > after.UnixMilli() {
+			t.Errorf("%s = %s, want between %s and %s", name, time.UnixMilli(ms).UTC(), before.UTC(), after.UTC())
+		}
+	}
+
+	query := fmt.Sprintf("?since=%d&until=%d", before.UnixMilli(), after.UnixMilli())
+	rec = ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/owner/sales"+query, f.Owner.Cookie, nil)
+	if sales := decodeJSON[ownerGetSalesResponse](t, rec); sales.NetSales != rides[0].Fare {
+		t.Fatalf("sales between the ride's request and completion = %+v, want the ride's fare %d", sales, rides[0].Fare)
+	}
+}
+
+func TestOwnerSalesBoundariesMatchAcrossTimezones(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "boundary")
+	rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	var updatedAt time.Time
+	if err := ts.db.Get(&updatedAt, "SELECT updated_at FROM rides WHERE id = ?", rideID); err != nil {
+		t.Fatal(err)
+	}
+	completed := updatedAt.UnixMilli()
+
+	// since はその時刻を含み、until はその時刻を含まない。どのタイムゾーンで動かしても同じ範囲になる
+	ranges := []struct {
+		since, until int64
+		want         bool
+	}{
+		{since: completed, until: completed + 1, want: true},
+		{since: completed + 1, until: completed + 2, want: false},
+		{since: completed - 1, until: completed, want: false},
+	}
+	inTimezones(t, func(t *testing.T) {
+		for _, r := range ranges {
+			query := fmt.Sprintf("?since=%d&until=%d", r.since, r.until)
+			rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/owner/sales"+query, f.Owner.Cookie, nil)
+			sales := decodeJSON[ownerGetSalesResponse](t, rec)
+			if got := sales.TotalSales > 0; got != r.want {
+				t.Errorf("sales%s = %+v, want the ride counted: %v", query, sales, r.want)
+			}
+			if sales.Since != r.since || sales.Until != r.until {
+				t.Errorf("sales%s reported range [%d, %d)", query, sales.Since, sales.Until)
+			}
+		}
+	})
+}
+
+func TestOwnerSalesRangeAtMillisecondEdges(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "edges")
+	rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+
+	// ミリ秒の最後のマイクロ秒に完了したライドも、そのミリ秒を since にした範囲に入る
+	const completed = int64(1733000000123)
+	updatedAt := unixMilliUTC(completed).Add(time.Millisecond - time.Microsecond)
+	if _, err := ts.db.Exec("UPDATE rides SET updated_at = ? WHERE id = ?", updatedAt, rideID); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		since, until int64
+		want         bool
+	}{
+		{since: completed, until: completed + 1, want: true},
+		{since: completed + 1, until: completed + 1000, want: false},
+	} {
+		query := fmt.Sprintf("?since=%d&until=%d", r.since, r.until)
+		sales := decodeJSON[ownerGetSalesResponse](t, ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/owner/sales"+query, f.Owner.Cookie, nil))
+		if got := sales.TotalSales > 0; got != r.want {
+			t.Errorf("sales%s = %+v, want the ride counted: %v", query, sales, r.want)
+		}
+	}
+
+	// 空の範囲や逆転した範囲は受け付けない
+	for _, query := range []string{
+		fmt.Sprintf("?since=%d&until=%d", completed, completed),
+		fmt.Sprintf("?since=%d&until=%d", completed+1, completed),
+	} {
+		ts.mustDo(t, http.StatusBadRequest, http.MethodGet, "/api/owner/sales"+query, f.Owner.Cookie, nil)
+	}
+}
+
+func TestEvaluationWithoutPaymentTokenCanBeRetried(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "tokenless")
+	if _, err := ts.db.Exec("DELETE FROM payment_tokens WHERE user_id = ?", f.User.ID); err != nil {
+		t.Fatal(err)
+	}
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.driveToArrival(t, f.Chair, rideID, testPickup, testDestination)
+
+	// 支払い方法が無ければ何も変えずに、登録を促すコードを返す
+	evaluation := appPostRideEvaluationRequest{Evaluation: 4}
+	rec := ts.mustDo(t, http.StatusBadRequest, http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", f.User.Cookie, evaluation)
+	if res := decodeJSON[map[string]string](t, rec); res["code"] != errCodePaymentTokenRequired {
+		t.Fatalf("error = %v, want code %s", res, errCodePaymentTokenRequired)
+	}
+	var evaluated *int
+	if err := ts.db.Get(&evaluated, "SELECT evaluation FROM rides WHERE id = ?", rideID); err != nil {
+		t.Fatal(err)
+	}
+	if evaluated != nil || ts.latestStatus(t, rideID) != RideStatusArrived || ts.payments.Load() != 0 {
+		t.Fatalf("evaluation = %v, status = %q, payments = %d after the rejected evaluation, want nothing changed", evaluated, ts.latestStatus(t, rideID), ts.payments.Load())
+	}
+
+	// 支払い方法を登録すれば同じ評価をやり直せる
+	ts.mustDo(t, http.StatusNoContent, http.MethodPost, "/api/app/payment-methods", f.User.Cookie, appPostPaymentMethodsRequest{Token: "token-tokenless"})
+	ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", f.User.Cookie, evaluation)
+	var completed int
+	if err := ts.db.Get(&completed, "SELECT COUNT(*) FROM ride_statuses WHERE ride_id = ? AND status = 'COMPLETED'", rideID); err != nil {
+		t.Fatal(err)
+	}
+	if completed != 1 {
+		t.Fatalf("COMPLETED statuses = %d, want 1", completed)
+	}
+	if got := ts.payments.Load(); got != 1 {
+		t.Fatalf("payments = %d, want 1", got)
+	}
+}
+
+// setMaxTripDistance はテストの間だけ MaxTripDistance を変える
+func setMaxTripDistance(t *testing.T, limit int) {
+	t.Helper()
+	orig := loadRuntimeConfig()
+	rc := *orig
+	rc.MaxTripDistance = limit
+	currentRuntimeConfig.Store(&rc)
+	t.Cleanup(func() { currentRuntimeConfig.Store(orig) })
+}
+
+func TestTripDistanceLimitBoundary(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "far")
+	setMaxTripDistance(t, 20)
+	atLimit := Coordinate{Latitude: 10, Longitude: 10}
+	beyond := Coordinate{Latitude: 10, Longitude: 11}
+
+	estimate := func(destination Coordinate) *httptest.ResponseRecorder {
+		return ts.do(t, http.MethodPost, "/api/app/rides/estimated-fare", f.User.Cookie, appPostRidesEstimatedFareRequest{
+			PickupCoordinate:      &Coordinate{},
+			DestinationCoordinate: &destination,
+		})
+	}
+	create := func(destination Coordinate) *httptest.ResponseRecorder {
+		return ts.do(t, http.MethodPost, "/api/app/rides", f.User.Cookie, appPostRidesRequest{
+			PickupCoordinate:      &Coordinate{},
+			DestinationCoordinate: &destination,
+		})
+	}
+	tooLong := func(name string, rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), errTripTooLong.Error()) {
+			t.Fatalf("%s beyond the limit = %d %s, want 400 %q", name, rec.Code, rec.Body.String(), errTripTooLong)
+		}
+	}
+
+	// 上限ちょうどは受け付け、1つでも超えれば断る
+	if rec := estimate(atLimit); rec.Code != http.StatusOK {
+		t.Fatalf("estimate at the limit = %d %s, want 200", rec.Code, rec.Body.String())
+	}
+	tooLong("estimate", estimate(beyond))
+	tooLong("ride", create(beyond))
+	if rec := create(atLimit); rec.Code != http.StatusAccepted {
+		t.Fatalf("ride at the limit = %d %s, want 202", rec.Code, rec.Body.String())
+	}
+
+	// 0 なら上限を設けない
+	setMaxTripDistance(t, 0)
+	if rec := estimate(beyond); rec.Code != http.StatusOK {
+		t.Fatalf("estimate without a limit = %d %s, want 200", rec.Code, rec.Body.String())
+	}
+}
+
+// setFareEstimateCacheTTL はテストの間だけ FareEstimateCacheTTL を変える
+func setFareEstimateCacheTTL(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	orig := loadRuntimeConfig()
+	rc := *orig
+	rc.FareEstimateCacheTTL = ttl
+	currentRuntimeConfig.Store(&rc)
+	t.Cleanup(func() { currentRuntimeConfig.Store(orig) })
+}
+
+func TestFareEstimateCacheHitAndCouponInvalidation(t *testing.T) {
+	ts := newTestServer(t)
+	clock := useFakeClock(t)
+	setFareEstimateCacheTTL(t, time.Minute)
+	f := ts.newRideFixture(t, "estimate-cache")
+	estimate := func() (appPostRidesEstimatedFareResponse, []string) {
+		t.Helper()
+		pickup, destination := testPickup, testDestination
+		mark := ts.queries.mark()
+		rec := ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/estimated-fare", f.User.Cookie, appPostRidesEstimatedFareRequest{
+			PickupCoordinate:      &pickup,
+			DestinationCoordinate: &destination,
+		})
+		return decodeJSON[appPostRidesEstimatedFareResponse](t, rec), ts.queries.since(mark, appAuthQuery)
+	}
+
+	first, queries := estimate()
+	if first.Discount == 0 || len(queries) == 0 {
+		t.Fatalf("first estimate = %+v after %d queries, want the registration coupon read from the DB", first, len(queries))
+	}
+
+	// 同じ見積もりを繰り返してもDBは読まない
+	again, queries := estimate()
+	if again.Fare != first.Fare || again.Discount != first.Discount {
+		t.Fatalf("cached estimate = %+v, want %+v", again, first)
+	}
+	if len(queries) != 0 {
+		t.Fatalf("cached estimate touched the DB: %q", queries)
+	}
+
+	// ライドでクーポンを使ったら、キャッシュを捨ててクーポンの無い運賃を読み直す
+	ts.requestRide(t, f.User, testPickup, testDestination)
+	after, queries := estimate()
+	if len(queries) == 0 {
+		t.Fatal("estimate after the coupon was used came from the cache")
+	}
+	if after.Discount != 0 || after.Fare != first.Fare+first.Discount {
+		t.Fatalf("estimate after the coupon was used = %+v, want the full fare %d", after, first.Fare+first.Discount)
+	}
+
+	// TTLが過ぎたら読み直す
+	if _, queries := estimate(); len(queries) != 0 {
+		t.Fatalf("second estimate after invalidation touched the DB: %q", queries)
+	}
+	clock.advance(time.Minute)
+	if _, queries := estimate(); len(queries) == 0 {
+		t.Fatal("estimate after the TTL came from the cache")
+	}
+}
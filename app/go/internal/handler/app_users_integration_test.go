@@ -0,0 +1,158 @@
+//go:build integration
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// setMaxUnusedCoupons はテストの間だけ MaxUnusedCoupons を変える
+func setMaxUnusedCoupons(t *testing.T, limit int) {
+	t.Helper()
+	orig := loadRuntimeConfig()
+	rc := *orig
+	rc.MaxUnusedCoupons = limit
+	currentRuntimeConfig.Store(&rc)
+	t.Cleanup(func() { currentRuntimeConfig.Store(orig) })
+}
+
+// setReferralChainDepth はテストの間だけ ReferralChainDepth を変える
+func setReferralChainDepth(t *testing.T, depth int) {
+	t.Helper()
+	orig := loadRuntimeConfig()
+	rc := *orig
+	rc.ReferralChainDepth = depth
+	currentRuntimeConfig.Store(&rc)
+	t.Cleanup(func() { currentRuntimeConfig.Store(orig) })
+}
+
+func (ts *testServer) unusedCouponCodes(t *testing.T, user testUser) []string {
+	t.Helper()
+	codes := []string{}
+	if err := ts.db.Select(&codes, "SELECT code FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at", user.ID); err != nil {
+		t.Fatal(err)
+	}
+	return codes
+}
+
+func TestCouponGrantsStopAtUnusedCap(t *testing.T) {
+	ts := newTestServer(t)
+	setMaxUnusedCoupons(t, 2)
+
+	// 登録時の CP_NEW2024 と、1人目を招待した報酬で上限に達する
+	inviter := ts.registerUser(t, "cap-inviter", nil)
+	ts.registerUser(t, "cap-invitee-1", &inviter.InvitationCode)
+	if got := ts.unusedCouponCodes(t, inviter); len(got) != 2 {
+		t.Fatalf("inviter's unused coupons = %v, want 2", got)
+	}
+
+	// 2人目の招待の報酬は作られないが、招待された側の登録とクーポンはそのまま
+	invitee := ts.registerUser(t, "cap-invitee-2", &inviter.InvitationCode)
+	if got := ts.unusedCouponCodes(t, inviter); len(got) != 2 {
+		t.Fatalf("inviter's unused coupons = %v, want the grant past the cap to be skipped", got)
+	}
+	if got := ts.unusedCouponCodes(t, invitee); len(got) != 2 {
+		t.Fatalf("invitee's unused coupons = %v, want CP_NEW2024 and INV_", got)
+	}
+}
+
+func TestCouponGrantsCapWithinOneRegistration(t *testing.T) {
+	ts := newTestServer(t)
+	inviter := ts.registerUser(t, "batch-inviter", nil)
+	setMaxUnusedCoupons(t, 1)
+
+	// 招待コードの使用回数を数える INV_ は上限を超えても作る
+	invitee := ts.registerUser(t, "batch-invitee", &inviter.InvitationCode)
+	got := ts.unusedCouponCodes(t, invitee)
+	if len(got) != 2 || got[0] != "CP_NEW2024" || got[1] != "INV_"+inviter.InvitationCode {
+		t.Fatalf("invitee's unused coupons = %v, want CP_NEW2024 and INV_", got)
+	}
+	if got := ts.unusedCouponCodes(t, inviter); len(got) != 1 {
+		t.Fatalf("inviter's unused coupons = %v, want only CP_NEW2024", got)
+	}
+
+	// 上限で報酬が付与されなくても、招待コードは3回までしか使えない
+	ts.registerUser(t, "batch-invitee-2", &inviter.InvitationCode)
+	ts.registerUser(t, "batch-invitee-3", &inviter.InvitationCode)
+	ts.mustDo(t, http.StatusBadRequest, http.MethodPost, "/api/app/users", nil, appPostUsersRequest{
+		Username:       "batch-invitee-4",
+		FirstName:      "太郎",
+		LastName:       "椅子",
+		DateOfBirth:    "2000-01-01",
+		InvitationCode: &inviter.InvitationCode,
+	})
+
+	// 上限を外せば報酬も付与される
+	setMaxUnusedCoupons(t, 0)
+	other := ts.registerUser(t, "uncapped-inviter", nil)
+	ts.registerUser(t, "uncapped-invitee", &other.InvitationCode)
+	if got := ts.unusedCouponCodes(t, other); len(got) != 2 {
+		t.Fatalf("inviter's unused coupons = %v, want CP_NEW2024 and one RWD_", got)
+	}
+}
+
+// couponGrants はユーザーたちが持つクーポンを「ユーザー:コード:割引額」で返す
+// RWD_ のコードに付く付与時刻は除く
+func (ts *testServer) couponGrants(t *testing.T, users ...testUser) []string {
+	t.Helper()
+	grants := []string{}
+	for _, user := range users {
+		coupons := []Coupon{}
+		if err := ts.db.Select(&coupons, "SELECT * FROM coupons WHERE user_id = ?", user.ID); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range coupons {
+			code := c.Code
+			if strings.HasPrefix(code, "RWD_") {
+				code = code[:strings.LastIndex(code, "_")]
+			}
+			grants = append(grants, fmt.Sprintf("%s:%s:%d", user.ID, code, c.Discount))
+		}
+	}
+	slices.Sort(grants)
+	return grants
+}
+
+func TestRegistrationGrantsCouponsInOneStatement(t *testing.T) {
+	ts := newTestServer(t)
+	setReferralChainDepth(t, 1)
+	grandInviter := ts.registerUser(t, "grand-inviter", nil)
+	inviter := ts.registerUser(t, "inviter", &grandInviter.InvitationCode)
+	before := ts.couponGrants(t, grandInviter, inviter)
+
+	mark := ts.queries.mark()
+	rec := ts.mustDo(t, http.StatusCreated, http.MethodPost, "/api/app/users", nil, appPostUsersRequest{
+		Username:       "invitee",
+		FirstName:      "太郎",
+		LastName:       "椅子",
+		DateOfBirth:    "2000-01-01",
+		InvitationCode: &inviter.InvitationCode,
+	})
+	invitee := testUser{ID: decodeJSON[appPostUsersResponse](t, rec).ID}
+
+	// 登録キャンペーン・招待・招待者と2段目の招待者へのRewardが、1回のINSERTで作られる
+	inserts := 0
+	for _, q := range ts.queries.since(mark) {
+		if strings.HasPrefix(strings.TrimSpace(q), "INSERT INTO coupons") {
+			inserts++
+		}
+	}
+	if inserts != 1 {
+		t.Fatalf("coupon INSERT statements = %d, want 1", inserts)
+	}
+
+	want := append(before,
+		fmt.Sprintf("%s:CP_NEW2024:3000", invitee.ID),
+		fmt.Sprintf("%s:INV_%s:1500", invitee.ID, inviter.InvitationCode),
+		fmt.Sprintf("%s:RWD_%s:1000", inviter.ID, inviter.InvitationCode),
+		fmt.Sprintf("%s:RWD_%s:%d", grandInviter.ID, grandInviter.InvitationCode, referralChainBaseReward),
+	)
+	slices.Sort(want)
+	if got := ts.couponGrants(t, grandInviter, inviter, invitee); !slices.Equal(got, want) {
+		t.Fatalf("coupons = %v, want %v", got, want)
+	}
+}
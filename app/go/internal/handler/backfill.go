@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// backfillBatchSize は1回のトランザクションで処理する行数
+	backfillBatchSize = 100
+	// backfillBatchRetries は1バッチあたりの再試行回数
+	backfillBatchRetries = 3
+)
+
+// backfillProgress はバッチごとにコミットしたところまでの進捗
+type backfillProgress struct {
+	Name string
+	// LastID はコミット済みの最後のID。再試行はここから再開する
+	LastID    string
+	Processed int
+	Scanned   int
+	StartedAt time.Time
+}
+
+// backfillError はバックフィルが途中で失敗したときに、どこまで終わっていたかを伝える
+type backfillError struct {
+	progress backfillProgress
+	err      error
+}
+
+func (e *backfillError) Error() string {
+	return fmt.Sprintf(
+		"backfill %s failed after %d rows (last committed id: %q, scanned: %d): %v",
+		e.progress.Name, e.progress.Processed, e.progress.LastID, e.progress.Scanned, e.err,
+	)
+}
+
+func (e *backfillError) Unwrap() error {
+	return e.err
+}
+
+// backfillBatch は afterID より後ろのIDを最大 backfillBatchSize 件処理する
+// 処理した最後のIDと件数、読み込んだ行数を返し、処理する行が無くなったら lastID に空文字を返す
+type backfillBatch func(ctx context.Context, tx *sqlx.Tx, afterID string) (lastID string, processed int, scanned int, err error)
+
+// runBackfill はバッチごとにコミットしながら batch を最後まで実行する
+// 失敗したバッチは直前にコミットしたIDから再試行する
+func (s *server) runBackfill(ctx context.Context, name string, batch backfillBatch) error {
+	progress := backfillProgress{Name: name, StartedAt: time.Now()}
+
+	for {
+		var lastID string
+		var err error
+		for attempt := 0; attempt <= backfillBatchRetries; attempt++ {
+			var processed, scanned int
+			lastID, processed, scanned, err = s.runBackfillBatch(ctx, batch, progress.LastID)
+			if err == nil {
+				progress.Processed += processed
+				progress.Scanned += scanned
+				break
+			}
+			slog.Warn("backfill batch failed", "name", name, "after_id", progress.LastID, "attempt", attempt+1, "err", err)
+		}
+		if err != nil {
+			return &backfillError{progress: progress, err: err}
+		}
+		if lastID == "" {
+			break
+		}
+		progress.LastID = lastID
+	}
+
+	slog.Info("backfill finished",
+		"name", name,
+		"processed", progress.Processed,
+		"scanned", progress.Scanned,
+		"duration", time.Since(progress.StartedAt),
+	)
+	return nil
+}
+
+func (s *server) runBackfillBatch(ctx context.Context, batch backfillBatch, afterID string) (string, int, int, error) {
+	tx, err := s.beginTx("runBackfillBatch")
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer tx.Rollback()
+
+	lastID, processed, scanned, err := batch(ctx, tx.Tx, afterID)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", 0, 0, err
+	}
+	return lastID, processed, scanned, nil
+}
+
+// initializeChairTotalDistance は各椅子の位置情報から総移動距離と最後の位置を埋める
+// 既に埋まっている椅子は chair_locations を読まずに飛ばす
+func (s *server) initializeChairTotalDistance(ctx context.Context) error {
+	return s.runBackfill(ctx, "chair_total_distance", backfillChairTotalDistance)
+}
+
+// initializeRideChairSnapshots は初期データの割り当て済みのライドに、今の椅子の名前・モデル・オーナーの名前を残す
+func (s *server) initializeRideChairSnapshots(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE rides
+		INNER JOIN chairs ON chairs.id = rides.chair_id
+		INNER JOIN owners ON owners.id = chairs.owner_id
+		SET rides.chair_name = chairs.name, rides.chair_model = chairs.model, rides.chair_owner_name = owners.name
+		WHERE rides.chair_name IS NULL`)
+	return err
+}
+
+// primeChairCache は chairs テーブルを1回読むだけで椅子のキャッシュを埋める
+// 位置と総移動距離は chairs に非正規化してあるので chair_locations は読まない
+func (s *server) primeChairCache(ctx context.Context) error {
+	startedAt := time.Now()
+	chairs := []Chair{}
+	if err := s.db.SelectContext(ctx, &chairs, `SELECT * FROM chairs WHERE deleted_at IS NULL`); err != nil {
+		return err
+	}
+	s.state.chairs.prime(chairs)
+	slog.Info("chair cache primed", "chairs", len(chairs), "duration", time.Since(startedAt))
+	return nil
+}
+
+func backfillChairTotalDistance(ctx context.Context, tx *sqlx.Tx, afterID string) (string, int, int, error) {
+	chairIDs := []string{}
+	if err := tx.SelectContext(ctx, &chairIDs, `SELECT id FROM chairs WHERE id > ? AND total_distance_updated_at IS NULL ORDER BY id LIMIT ?`, afterID, backfillBatchSize); err != nil {
+		return "", 0, 0, err
+	}
+	if len(chairIDs) == 0 {
+		return "", 0, 0, nil
+	}
+
+	query, args, err := sqlx.In(`SELECT * FROM chair_locations WHERE chair_id IN (?) ORDER BY chair_id, created_at ASC`, chairIDs)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	locations := []ChairLocation{}
+	if err := tx.SelectContext(ctx, &locations, tx.Rebind(query), args...); err != nil {
+		return "", 0, 0, err
+	}
+
+	query, args, err = sqlx.In(`
+		SELECT rides.chair_id, ride_statuses.status, ride_statuses.created_at
+		FROM ride_statuses
+		JOIN rides ON rides.id = ride_statuses.ride_id
+		WHERE rides.chair_id IN (?) AND ride_statuses.status IN ('ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED')
+		ORDER BY rides.chair_id, ride_statuses.created_at ASC`, chairIDs)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	statuses := []chairRideStatus{}
+	if err := tx.SelectContext(ctx, &statuses, tx.Rebind(query), args...); err != nil {
+		return "", 0, 0, err
+	}
+
+	// chair_idごとに位置情報をグループ化
+	chairLocations := make(map[string][]ChairLocation)
+	for _, loc := range locations {
+		chairLocations[loc.ChairID] = append(chairLocations[loc.ChairID], loc)
+	}
+	chairStatuses := make(map[string][]chairRideStatus)
+	for _, st := range statuses {
+		chairStatuses[st.ChairID] = append(chairStatuses[st.ChairID], st)
+	}
+
+	for chairID, locs := range chairLocations {
+		onRide, idle := splitChairDistance(locs, chairStatuses[chairID])
+		last := locs[len(locs)-1]
+
+		if _, err := tx.ExecContext(
+			ctx,
+			`UPDATE chairs SET total_distance = ?, distance_on_ride = ?, distance_idle = ?, total_distance_updated_at = ?, last_latitude = ?, last_longitude = ? WHERE id = ?`,
+			onRide+idle, onRide, idle, last.CreatedAt, last.Latitude, last.Longitude, chairID,
+		); err != nil {
+			return "", 0, 0, fmt.Errorf("failed to update chair distances: %w", err)
+		}
+	}
+
+	return chairIDs[len(chairIDs)-1], len(chairIDs), len(locations), nil
+}
+
+type chairRideStatus struct {
+	ChairID   string         `db:"chair_id"`
+	Status    RideStatusType `db:"status"`
+	CreatedAt time.Time      `db:"created_at"`
+}
+
+// isOnRideStatus は配車位置か目的地へ向かっている間のステータスかどうかを返す
+// この間の移動をライドの移動、それ以外をライド外の移動として数える
+func isOnRideStatus(status RideStatusType) bool {
+	return status == RideStatusEnroute || status == RideStatusCarrying
+}
+
+// splitChairDistance は時刻順の位置情報の移動距離を、ライド中とそれ以外に分けて合計する
+// 各移動は移動後の位置を送った時点の椅子のステータスで振り分ける。statuses も時刻順であること
+func splitChairDistance(locs []ChairLocation, statuses []chairRideStatus) (onRide int, idle int) {
+	j := 0
+	var status RideStatusType
+	for i := 1; i < len(locs); i++ {
+		// chairPostCoordinate と同じく、位置を送った時点で既に記録されていたステータスを見る
+		for j < len(statuses) && statuses[j].CreatedAt.Before(locs[i].CreatedAt) {
+			status = statuses[j].Status
+			j++
+		}
+		d := calculateDistance(
+			locs[i].Latitude,
+			locs[i].Longitude,
+			locs[i-1].Latitude,
+			locs[i-1].Longitude,
+		)
+		if isOnRideStatus(status) {
+			onRide += d
+		} else {
+			idle += d
+		}
+	}
+	return onRide, idle
+}
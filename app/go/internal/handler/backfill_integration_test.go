@@ -0,0 +1,170 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// insertUnbackfilledChairs は総移動距離が未計算の椅子を n 台、(0,0) から (3,4) へ1回動いた位置情報付きで入れる
+func (ts *testServer) insertUnbackfilledChairs(t *testing.T, n int) {
+	t.Helper()
+	at := time.Now().UTC().Truncate(time.Microsecond)
+	for i := 0; i < n; i++ {
+		chairID := fmt.Sprintf("backfill-chair-%03d", i)
+		if _, err := ts.db.Exec(
+			"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, 'backfill-owner', ?, 'リラックスシート NEO', TRUE, ?)",
+			chairID, chairID, chairID,
+		); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ts.db.Exec(
+			"INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (?, ?, 0, 0, ?), (?, ?, 3, 4, ?)",
+			chairID+"-0", chairID, at, chairID+"-1", chairID, at.Add(time.Second),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (ts *testServer) backfilledChairs(t *testing.T) int {
+	t.Helper()
+	var n int
+	if err := ts.db.Get(&n, "SELECT COUNT(*) FROM chairs WHERE total_distance_updated_at IS NOT NULL AND total_distance = 7"); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestChairTotalDistanceBackfillResumesAfterFailedBatch(t *testing.T) {
+	ts := newTestServer(t)
+	ts.insertUnbackfilledChairs(t, backfillBatchSize+backfillBatchSize/2)
+
+	// 2つ目のバッチは更新を書いた後で毎回失敗させ、ロールバックされることを確かめる
+	attempts := 0
+	err := ts.runBackfill(context.Background(), "chair_total_distance", func(ctx context.Context, tx *sqlx.Tx, afterID string) (string, int, int, error) {
+		lastID, processed, scanned, err := backfillChairTotalDistance(ctx, tx, afterID)
+		if err != nil || afterID == "" {
+			return lastID, processed, scanned, err
+		}
+		attempts++
+		return "", 0, 0, errors.New("injected failure")
+	})
+	var backfillErr *backfillError
+	if !errors.As(err, &backfillErr) {
+		t.Fatalf("err = %v, want a backfillError", err)
+	}
+	firstBatchLastID := fmt.Sprintf("backfill-chair-%03d", backfillBatchSize-1)
+	if backfillErr.progress.LastID != firstBatchLastID || backfillErr.progress.Processed != backfillBatchSize {
+		t.Fatalf("progress = %+v, want the first batch up to %s committed", backfillErr.progress, firstBatchLastID)
+	}
+	if attempts != backfillBatchRetries+1 {
+		t.Fatalf("failed batch was attempted %d times, want %d", attempts, backfillBatchRetries+1)
+	}
+	if got := ts.backfilledChairs(t); got != backfillBatchSize {
+		t.Fatalf("backfilled chairs after the failure = %d, want only the committed batch (%d)", got, backfillBatchSize)
+	}
+
+	// 再実行はコミット済みの椅子を読まずに残りだけを処理する
+	resumed := 0
+	err = ts.runBackfill(context.Background(), "chair_total_distance", func(ctx context.Context, tx *sqlx.Tx, afterID string) (string, int, int, error) {
+		lastID, processed, scanned, err := backfillChairTotalDistance(ctx, tx, afterID)
+		resumed += processed
+		return lastID, processed, scanned, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed != backfillBatchSize/2 {
+		t.Fatalf("resumed run processed %d chairs, want the remaining %d", resumed, backfillBatchSize/2)
+	}
+	if got := ts.backfilledChairs(t); got != backfillBatchSize+backfillBatchSize/2 {
+		t.Fatalf("backfilled chairs after the resumed run = %d, want all %d", got, backfillBatchSize+backfillBatchSize/2)
+	}
+}
+
+type chairPosition struct {
+	Latitude, Longitude, TotalDistance int
+}
+
+// chairPositionsFromLocations は chair_locations だけから各椅子の最後の位置と総移動距離を計算し直す
+func (ts *testServer) chairPositionsFromLocations(t *testing.T) map[string]chairPosition {
+	t.Helper()
+	locations := []ChairLocation{}
+	if err := ts.db.Select(&locations, "SELECT * FROM chair_locations ORDER BY chair_id, created_at"); err != nil {
+		t.Fatal(err)
+	}
+	positions := map[string]chairPosition{}
+	for i, loc := range locations {
+		p := positions[loc.ChairID]
+		if i > 0 && locations[i-1].ChairID == loc.ChairID {
+			p.TotalDistance += calculateDistance(p.Latitude, p.Longitude, loc.Latitude, loc.Longitude)
+		}
+		p.Latitude, p.Longitude = loc.Latitude, loc.Longitude
+		positions[loc.ChairID] = p
+	}
+	return positions
+}
+
+func TestPrimedChairCacheMatchesRebuildFromLocations(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	ts.insertUnbackfilledChairs(t, 3)
+	if err := ts.initializeChairTotalDistance(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1台だけ非正規化した列が古くなっているとみなし、新しい位置情報を足して NULL に戻す
+	const staleChairID = "backfill-chair-001"
+	if _, err := ts.db.Exec(
+		"INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (?, ?, 6, 8, ?)",
+		staleChairID+"-2", staleChairID, time.Now().UTC().Add(time.Minute),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.db.Exec("UPDATE chairs SET total_distance_updated_at = NULL, last_latitude = NULL, last_longitude = NULL WHERE id = ?", staleChairID); err != nil {
+		t.Fatal(err)
+	}
+
+	// chair_locations を読むのは列が NULL の椅子だけ
+	processed := 0
+	if err := ts.runBackfill(ctx, "chair_total_distance", func(ctx context.Context, tx *sqlx.Tx, afterID string) (string, int, int, error) {
+		lastID, n, scanned, err := backfillChairTotalDistance(ctx, tx, afterID)
+		processed += n
+		return lastID, n, scanned, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if processed != 1 {
+		t.Fatalf("backfill processed %d chairs, want only the stale one", processed)
+	}
+
+	ts.state.Reset()
+	if err := ts.primeChairCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := ts.chairPositionsFromLocations(t)
+	if got := want[staleChairID]; got != (chairPosition{Latitude: 6, Longitude: 8, TotalDistance: 14}) {
+		t.Fatalf("rebuild of %s = %+v, want the added location counted", staleChairID, got)
+	}
+	ts.state.chairs.mu.RLock()
+	defer ts.state.chairs.mu.RUnlock()
+	if len(ts.state.chairs.byToken) != len(want) {
+		t.Fatalf("primed %d chairs, want %d", len(ts.state.chairs.byToken), len(want))
+	}
+	for _, chair := range ts.state.chairs.byToken {
+		if chair.LastLatitude == nil || chair.LastLongitude == nil {
+			t.Fatalf("primed chair %s has no position", chair.ID)
+		}
+		got := chairPosition{Latitude: *chair.LastLatitude, Longitude: *chair.LastLongitude, TotalDistance: chair.TotalDistance}
+		if got != want[chair.ID] {
+			t.Errorf("primed chair %s = %+v, want %+v rebuilt from chair_locations", chair.ID, got, want[chair.ID])
+		}
+	}
+}
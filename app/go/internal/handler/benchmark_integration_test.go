@@ -0,0 +1,82 @@
+//go:build integration
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// アロケーションを比べるときは -benchmem を付けて実行する
+//
+//	go test -tags integration -run '^$' -bench . -benchmem ./internal/handler/
+
+// benchmarkMatchingSize は BenchmarkInternalMatching で待たせるライドと空いている椅子のそれぞれの数
+const benchmarkMatchingSize = 100
+
+// insertMatchingFixtures は MATCHING のライドと、空いている椅子を n 件ずつ入れる
+func (ts *testServer) insertMatchingFixtures(b *testing.B, n int) {
+	b.Helper()
+	at := time.Now().UTC().Truncate(time.Microsecond)
+	for i := 0; i < n; i++ {
+		chairID := fmt.Sprintf("bench-chair-%03d", i)
+		if _, err := ts.db.Exec(
+			"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token, last_latitude, last_longitude) VALUES (?, 'bench-owner', ?, ?, TRUE, ?, ?, ?)",
+			chairID, chairID, testChairModel, chairID, i%50, i/50,
+		); err != nil {
+			b.Fatal(err)
+		}
+
+		rideID := fmt.Sprintf("bench-ride-%03d", i)
+		created := at.Add(time.Duration(i) * time.Millisecond)
+		if _, err := ts.db.Exec(
+			"INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, distance, created_at, updated_at) VALUES (?, 'bench-user', ?, ?, ?, ?, ?, ?, ?)",
+			rideID, (i*7)%50, (i*3)%50, (i*11)%50, (i*13)%50, 0, created, created,
+		); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ts.db.Exec("INSERT INTO ride_statuses (id, ride_id, status, created_at) VALUES (?, ?, 'MATCHING', ?)", rideID+"-matching", rideID, created); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInternalMatching(b *testing.B) {
+	ts := newTestServer(b)
+	ts.insertMatchingFixtures(b, benchmarkMatchingSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// 毎回同じライドと椅子の組み合わせから解く
+		b.StopTimer()
+		if _, err := ts.db.Exec("UPDATE rides SET chair_id = NULL"); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ts.db.Exec("UPDATE chairs SET current_ride_id = NULL"); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		ts.runMatching(b)
+	}
+	b.StopTimer()
+	if summary := lastMatchingSummary.Load(); summary.Assigned != benchmarkMatchingSize {
+		b.Fatalf("assigned = %d, want %d", summary.Assigned, benchmarkMatchingSize)
+	}
+}
+
+func BenchmarkAppGetNotification(b *testing.B) {
+	ts := newTestServer(b)
+	f := ts.newRideFixture(b, "bench")
+	ts.requestRide(b, f.User, testPickup, testDestination)
+	ts.runMatching(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts.mustDo(b, http.StatusOK, http.MethodGet, "/api/app/notification", f.User.Cookie, nil)
+	}
+}
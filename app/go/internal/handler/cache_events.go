@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// cache_events の namespace。受け取った側は namespace ごとに該当するキャッシュを捨てる
+const (
+	cacheNamespaceChairs        = "chairs"
+	cacheNamespaceUserStats     = "user_stats"
+	cacheNamespaceFareEstimates = "fare_estimates"
+	// cacheNamespaceDeliveredRides はライドが作られたユーザーの通知済みの状態を捨てさせる
+	cacheNamespaceDeliveredRides = "delivered_rides"
+	// cacheNamespaceAll は /api/initialize でDBを作り直したことを知らせ、全てのキャッシュを捨てさせる
+	cacheNamespaceAll = "all"
+)
+
+type cacheEvent struct {
+	ID        int64  `db:"id"`
+	Namespace string `db:"namespace"`
+	CacheKey  string `db:"cache_key"`
+	Origin    string `db:"origin"`
+}
+
+// cacheEventLog は複数台構成でキャッシュを揃えるため、キャッシュを捨てたことを cache_events で他のインスタンスに知らせる
+type cacheEventLog struct {
+	// instanceID は自分が書いたイベントを読み飛ばすためのID
+	instanceID string
+	// lastID は読み終えた cache_events の id
+	lastID atomic.Int64
+}
+
+// publishCacheEvent はキャッシュを捨てたことを記録する。失敗しても自分のキャッシュは捨て終えているのでログだけ出す
+func (s *server) publishCacheEvent(namespace, key string) {
+	if s.cacheSyncInterval <= 0 {
+		return
+	}
+	if _, err := s.db.Exec("INSERT INTO cache_events (namespace, cache_key, origin) VALUES (?, ?, ?)", namespace, key, s.cacheEvents.instanceID); err != nil {
+		slog.Error("failed to publish cache event", "namespace", namespace, "key", key, "err", err)
+	}
+}
+
+// forgetChair は椅子の認証キャッシュを捨て、他のインスタンスにも捨てさせる
+func (s *server) forgetChair(accessToken string) {
+	s.state.chairs.forget(accessToken)
+	s.publishCacheEvent(cacheNamespaceChairs, accessToken)
+}
+
+// invalidateUserStats はユーザーの集計のキャッシュを捨て、他のインスタンスにも捨てさせる
+func (s *server) invalidateUserStats(userID string) {
+	s.state.userStats.invalidate(userID)
+	s.publishCacheEvent(cacheNamespaceUserStats, userID)
+}
+
+// invalidateFareEstimates はユーザーの見積もり運賃のキャッシュを捨て、他のインスタンスにも捨てさせる
+func (s *server) invalidateFareEstimates(userID string) {
+	s.state.fareEstimates.invalidate(userID)
+	s.publishCacheEvent(cacheNamespaceFareEstimates, userID)
+}
+
+// resetDeliveredRide は新しいライドを通知できるように通知済みの状態を捨て、他のインスタンスにも捨てさせる
+// 通知済みの状態はユーザーごとなので、別のインスタンスに来た通知のポーリングも新しいライドを返す必要がある
+func (s *server) resetDeliveredRide(userID, rideID string) {
+	s.state.deliveredRides.rideCreated(userID, rideID)
+	s.publishCacheEvent(cacheNamespaceDeliveredRides, userID)
+}
+
+// startCacheEventPoller は他のインスタンスが書いた cache_events を定期的に読んでキャッシュを捨てる
+func (s *server) startCacheEventPoller() {
+	if s.cacheSyncInterval <= 0 {
+		return
+	}
+	var lastID int64
+	if err := s.db.Get(&lastID, "SELECT COALESCE(MAX(id), 0) FROM cache_events"); err != nil {
+		slog.Error("failed to load last cache event", "err", err)
+	}
+	s.cacheEvents.lastID.Store(lastID)
+	gate := s.registerWorker("cache_event_poller")
+	go func() {
+		ticker := time.NewTicker(s.cacheSyncInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !gate.enter() {
+				continue
+			}
+			if err := s.pollCacheEvents(context.Background()); err != nil {
+				slog.Error("failed to poll cache events", "err", err)
+			}
+			gate.leave()
+		}
+	}()
+}
+
+func (s *server) pollCacheEvents(ctx context.Context) error {
+	var maxID int64
+	if err := s.db.GetContext(ctx, &maxID, "SELECT COALESCE(MAX(id), 0) FROM cache_events"); err != nil {
+		return err
+	}
+	loaded := s.cacheEvents.lastID.Load()
+	lastID := loaded
+	// 他のインスタンスの /api/initialize でテーブルが作り直された
+	if maxID < lastID {
+		s.flushSharedCaches()
+		lastID = 0
+	}
+	if maxID == lastID {
+		s.cacheEvents.lastID.CompareAndSwap(loaded, lastID)
+		return nil
+	}
+
+	events := []cacheEvent{}
+	if err := s.db.SelectContext(ctx, &events, "SELECT id, namespace, cache_key, origin FROM cache_events WHERE id > ? AND id <= ? ORDER BY id", lastID, maxID); err != nil {
+		return err
+	}
+	for _, e := range events {
+		if e.Origin == s.cacheEvents.instanceID {
+			continue
+		}
+		switch e.Namespace {
+		case cacheNamespaceChairs:
+			s.state.chairs.forget(e.CacheKey)
+		case cacheNamespaceUserStats:
+			s.state.userStats.invalidate(e.CacheKey)
+		case cacheNamespaceFareEstimates:
+			s.state.fareEstimates.invalidate(e.CacheKey)
+		case cacheNamespaceDeliveredRides:
+			s.state.deliveredRides.forget(e.CacheKey)
+		case cacheNamespaceAll:
+			s.flushSharedCaches()
+		}
+	}
+	// 読んでいる間に /api/initialize で 0 に戻されていたら、そちらを優先する
+	s.cacheEvents.lastID.CompareAndSwap(loaded, maxID)
+	return nil
+}
+
+// flushSharedCaches はDBから読んだ値とユーザーごとの通知済みの状態を捨てる
+// 椅子の位置の購読などは各インスタンスが受けた接続の状態なので残す
+func (s *server) flushSharedCaches() {
+	s.state.chairs.reset()
+	s.state.userStats.reset()
+	s.state.fareEstimates.reset()
+	s.state.deliveredRides.reset()
+}
+
+// resetCacheEvents は /api/initialize でテーブルを作り直した後に呼び、他のインスタンスに全てのキャッシュを捨てさせる
+func (s *server) resetCacheEvents() {
+	if s.cacheSyncInterval <= 0 {
+		return
+	}
+	s.cacheEvents.lastID.Store(0)
+	s.publishCacheEvent(cacheNamespaceAll, "")
+}
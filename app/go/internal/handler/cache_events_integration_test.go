@@ -0,0 +1,78 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestServerPair は同じDBを共有する2台のインスタンスを作り、cache_events で同期させる
+// 同期は peer.pollCacheEvents を呼んだときだけ行う
+func newTestServerPair(t *testing.T) (*testServer, *testServer) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.CacheSyncInterval = time.Second
+	ts := newTestServerWithConfig(t, cfg)
+	return ts, ts.peer(t)
+}
+
+func (ts *testServer) syncCacheEvents(t *testing.T) {
+	t.Helper()
+	if err := ts.pollCacheEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeletedChairIsRejectedByPeer(t *testing.T) {
+	a, b := newTestServerPair(t)
+	owner := a.registerOwner(t, "revoking-owner")
+	chair := a.registerChair(t, owner, "revoked-chair", Coordinate{Latitude: 0, Longitude: 0})
+
+	// b の認証キャッシュに椅子を載せておく
+	b.moveChair(t, chair, Coordinate{Latitude: 1, Longitude: 1})
+
+	a.mustDo(t, http.StatusNoContent, http.MethodDelete, "/api/owner/chairs/"+chair.ID, owner.Cookie, nil)
+	b.syncCacheEvents(t)
+	b.mustDo(t, http.StatusUnauthorized, http.MethodPost, "/api/chair/coordinate", chair.Cookie, Coordinate{Latitude: 2, Longitude: 2})
+}
+
+func TestRideCreatedOnPeerResetsDeliveredRide(t *testing.T) {
+	a, b := newTestServerPair(t)
+	f := a.newRideFixture(t, "two-instance")
+
+	a.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	// 通知は b が受けるので、COMPLETEDを通知済みにするのは b
+	if got := b.drainAppNotifications(t, f.User); got != RideStatusCompleted {
+		t.Fatalf("last status on b = %q, want COMPLETED", got)
+	}
+	if !b.state.deliveredRides.isDelivered(f.User.ID) {
+		t.Fatal("b did not mark the completed ride as delivered")
+	}
+
+	rideID := a.requestRide(t, f.User, testPickup, testDestination)
+	b.syncCacheEvents(t)
+	res := b.pollAppNotification(t, f.User)
+	if res.Data == nil || res.Data.RideID != rideID || res.Data.Status != RideStatusMatching {
+		t.Fatalf("b returned %+v, want MATCHING for %s", res.Data, rideID)
+	}
+}
+
+func TestInitializeFlushesDeliveredRidesOnPeer(t *testing.T) {
+	a, b := newTestServerPair(t)
+	f := a.newRideFixture(t, "flushed")
+
+	a.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	b.drainAppNotifications(t, f.User)
+	if !b.state.deliveredRides.isDelivered(f.User.ID) {
+		t.Fatal("b did not mark the completed ride as delivered")
+	}
+
+	a.publishCacheEvent(cacheNamespaceAll, "")
+	b.syncCacheEvents(t)
+	if b.state.deliveredRides.isDelivered(f.User.ID) {
+		t.Fatal("b kept the delivered ride after an all event")
+	}
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func (s *server) touchChairActivity(chair *Chair) {
+	if s.inactiveChairThreshold <= 0 {
+		return
+	}
+	s.state.chairActivities.touch(chair, clockNow())
+}
+
+// reactivateChairIfSwept はスイーパーによって非アクティブにされた椅子を再度アクティブにする
+func (s *server) reactivateChairIfSwept(ctx context.Context, tx *sqlx.Tx, chair *Chair) error {
+	if !s.state.chairActivities.isDeactivated(chair.ID) {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = TRUE WHERE id = ?", chair.ID); err != nil {
+		return err
+	}
+	// キャッシュ更新
+	s.state.chairs.update(chair.AccessToken, func(c *Chair) {
+		c.IsActive = true
+	})
+	s.state.chairActivities.clearDeactivated(chair.ID)
+	return nil
+}
+
+// startInactiveChairSweeper は一定時間アクセスの無い椅子を定期的に非アクティブにする
+func (s *server) startInactiveChairSweeper() {
+	if s.inactiveChairThreshold <= 0 {
+		return
+	}
+	gate := s.registerWorker("inactive_chair_sweeper")
+	go func() {
+		ticker := time.NewTicker(s.inactiveChairThreshold / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !gate.enter() {
+				continue
+			}
+			s.sweepInactiveChairs(context.Background())
+			gate.leave()
+		}
+	}()
+}
+
+// sweepInactiveChairs は clockNow を基準に判定するので、テストでは clockNow を進めてから直接呼べば待たずに確かめられる
+func (s *server) sweepInactiveChairs(ctx context.Context) {
+	stale := s.state.chairActivities.popStale(clockNow().Add(-s.inactiveChairThreshold))
+
+	for id, a := range stale {
+		// ライド中の椅子は非アクティブにしない
+		result, err := s.db.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE WHERE id = ? AND is_active = TRUE AND current_ride_id IS NULL", id)
+		if err != nil {
+			slog.Error("failed to deactivate inactive chair", "chair_id", id, "err", err)
+			continue
+		}
+		if count, err := result.RowsAffected(); err != nil || count == 0 {
+			continue
+		}
+
+		s.state.chairActivities.markDeactivated(id)
+		// キャッシュ更新
+		s.state.chairs.update(a.accessToken, func(c *Chair) {
+			c.IsActive = false
+		})
+
+		slog.Info("chair deactivated due to inactivity", "chair_id", id, "last_seen_at", a.seenAt)
+	}
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// chairOpenRidesQuery はride_statusesから導出した、椅子ごとの終わっていないライド
+// COMPLETEDがユーザーと椅子の両方に通知されるまでは椅子はライド中とみなす
+const chairOpenRidesQuery = `
+	SELECT r.chair_id, r.id AS ride_id FROM rides r
+	WHERE r.chair_id IS NOT NULL AND NOT EXISTS (
+		SELECT 1 FROM ride_statuses rs
+		WHERE rs.ride_id = r.id AND rs.status = 'COMPLETED' AND rs.app_sent_at IS NOT NULL AND rs.chair_sent_at IS NOT NULL
+	)`
+
+// initializeChairCurrentRides は初期データのライドから chairs.current_ride_id を埋める
+func (s *server) initializeChairCurrentRides(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE chairs c
+		INNER JOIN (`+chairOpenRidesQuery+`) t ON t.chair_id = c.id
+		SET c.current_ride_id = t.ride_id`)
+	return err
+}
+
+// releaseChairIfCompletionDelivered はCOMPLETEDがユーザーと椅子の両方に通知済みなら椅子を空きにする
+func releaseChairIfCompletionDelivered(ctx context.Context, tx *sqlx.Tx, rideID string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE chairs SET current_ride_id = NULL
+		WHERE current_ride_id = ? AND EXISTS (
+			SELECT 1 FROM ride_statuses
+			WHERE ride_id = ? AND status = 'COMPLETED' AND app_sent_at IS NOT NULL AND chair_sent_at IS NOT NULL
+		)`, rideID, rideID)
+	return err
+}
+
+// getChairCurrentRide は椅子に割り当てられているライドを返す
+// 割り当てられていなければ sql.ErrNoRows を返す
+func getChairCurrentRide(ctx context.Context, tx executableGet, chairID string) (*Ride, error) {
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT r.* FROM rides r INNER JOIN chairs c ON c.current_ride_id = r.id WHERE c.id = ?`, chairID); err != nil {
+		return nil, err
+	}
+	return ride, nil
+}
+
+type internalGetChairAssignmentResponse struct {
+	ChairID          string         `json:"chair_id"`
+	RideID           string         `json:"ride_id"`
+	Status           RideStatusType `json:"status"`
+	PickupCoordinate Coordinate     `json:"pickup_coordinate"`
+}
+
+// internalGetChairAssignment はマッチングで椅子に割り当てられたライドを返す
+// 椅子が存在しなければ404、割り当てられているライドが無ければ204を返す
+func (s *server) internalGetChairAssignment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+
+	var exists bool
+	if err := s.db.GetContext(ctx, &exists, `SELECT 1 FROM chairs WHERE id = ?`, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ride, err := getChairCurrentRide(ctx, s.db, chairID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status, err := getLatestRideStatus(ctx, s.db, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &internalGetChairAssignmentResponse{
+		ChairID: chairID,
+		RideID:  ride.ID,
+		Status:  status,
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+	})
+}
+
+type internalGetInvariantsResponse struct {
+	ChairCurrentRide []chairCurrentRideMismatch `json:"chair_current_ride"`
+	CouponLeaks      couponLeaks                `json:"coupon_leaks"`
+}
+
+type chairCurrentRideMismatch struct {
+	ChairID string `json:"chair_id"`
+	// Stored は chairs.current_ride_id の値
+	Stored *string `json:"stored"`
+	// Derived はride_statusesから導出した終わっていないライド
+	Derived []string `json:"derived"`
+}
+
+// internalGetInvariants は非正規化したカラムが元のテーブルと食い違っていないかと、割引が漏れている可能性のあるクーポンを返す
+func (s *server) internalGetInvariants(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	chairs := []struct {
+		ID            string  `db:"id"`
+		CurrentRideID *string `db:"current_ride_id"`
+	}{}
+	if err := s.db.SelectContext(ctx, &chairs, `SELECT id, current_ride_id FROM chairs`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	openRides := []struct {
+		ChairID string `db:"chair_id"`
+		RideID  string `db:"ride_id"`
+	}{}
+	if err := s.db.SelectContext(ctx, &openRides, chairOpenRidesQuery); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	derived := make(map[string][]string, len(openRides))
+	for _, row := range openRides {
+		derived[row.ChairID] = append(derived[row.ChairID], row.RideID)
+	}
+
+	res := internalGetInvariantsResponse{ChairCurrentRide: []chairCurrentRideMismatch{}}
+	for _, c := range chairs {
+		rides := derived[c.ID]
+		if c.CurrentRideID == nil && len(rides) == 0 {
+			continue
+		}
+		if c.CurrentRideID != nil && len(rides) == 1 && rides[0] == *c.CurrentRideID {
+			continue
+		}
+		if rides == nil {
+			rides = []string{}
+		}
+		res.ChairCurrentRide = append(res.ChairCurrentRide, chairCurrentRideMismatch{
+			ChairID: c.ID,
+			Stored:  c.CurrentRideID,
+			Derived: rides,
+		})
+	}
+
+	// クーポンのレポートと同じ基準で判定する
+	leaks, err := s.findCouponLeaks(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res.CouponLeaks = leaks
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,83 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func (ts *testServer) chairCurrentRide(t *testing.T, chair testChair) string {
+	t.Helper()
+	var rideID sql.NullString
+	if err := ts.db.Get(&rideID, "SELECT current_ride_id FROM chairs WHERE id = ?", chair.ID); err != nil {
+		t.Fatal(err)
+	}
+	return rideID.String
+}
+
+func (ts *testServer) chairCurrentRideMismatches(t *testing.T) []chairCurrentRideMismatch {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/internal/invariants", nil, nil)
+	return decodeJSON[internalGetInvariantsResponse](t, rec).ChairCurrentRide
+}
+
+func TestChairCurrentRideFollowsRideLifecycle(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "current")
+
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	if got := ts.chairCurrentRide(t, f.Chair); got != rideID {
+		t.Fatalf("current_ride_id = %q after matching, want %s", got, rideID)
+	}
+
+	ts.driveToArrival(t, f.Chair, rideID, testPickup, testDestination)
+	ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 5})
+	// COMPLETEDがユーザーにしか届いていない間は椅子はライド中のまま
+	ts.drainAppNotifications(t, f.User)
+	if got := ts.chairCurrentRide(t, f.Chair); got != rideID {
+		t.Fatalf("current_ride_id = %q before the chair saw COMPLETED, want %s", got, rideID)
+	}
+	if mismatches := ts.chairCurrentRideMismatches(t); len(mismatches) != 0 {
+		t.Fatalf("invariants = %+v during the handoff, want none", mismatches)
+	}
+
+	ts.drainChairNotifications(t, f.Chair)
+	if got := ts.chairCurrentRide(t, f.Chair); got != "" {
+		t.Fatalf("current_ride_id = %q after both sides saw COMPLETED, want NULL", got)
+	}
+	if mismatches := ts.chairCurrentRideMismatches(t); len(mismatches) != 0 {
+		t.Fatalf("invariants = %+v after the ride, want none", mismatches)
+	}
+}
+
+func TestInvariantsReportChairCurrentRideDrift(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "drift")
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+
+	// 割り当て済みのライドがあるのに current_ride_id が消えてしまった状態
+	if _, err := ts.db.Exec("UPDATE chairs SET current_ride_id = NULL WHERE id = ?", f.Chair.ID); err != nil {
+		t.Fatal(err)
+	}
+	mismatches := ts.chairCurrentRideMismatches(t)
+	if len(mismatches) != 1 || mismatches[0].ChairID != f.Chair.ID || mismatches[0].Stored != nil || !slices.Equal(mismatches[0].Derived, []string{rideID}) {
+		t.Fatalf("invariants = %+v, want the chair with derived ride %s", mismatches, rideID)
+	}
+
+	// initialize と同じ埋め直しで元に戻る
+	if err := ts.initializeChairCurrentRides(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.chairCurrentRide(t, f.Chair); got != rideID {
+		t.Fatalf("current_ride_id = %q after the backfill, want %s", got, rideID)
+	}
+	if mismatches := ts.chairCurrentRideMismatches(t); len(mismatches) != 0 {
+		t.Fatalf("invariants = %+v after the backfill, want none", mismatches)
+	}
+}
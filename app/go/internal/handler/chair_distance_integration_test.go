@@ -0,0 +1,65 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// ownerChairDistances はオーナーの椅子一覧に出る椅子の総移動距離と、その内訳を返す
+func (ts *testServer) ownerChairDistances(t *testing.T, owner testOwner, chairID string) (total, onRide, idle int) {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/owner/chairs", owner.Cookie, nil)
+	for _, c := range decodeJSON[ownerGetChairResponse](t, rec).Chairs {
+		if c.ID == chairID {
+			return c.TotalDistance, c.DistanceOnRide, c.DistanceIdle
+		}
+	}
+	t.Fatalf("chair %s is not listed", chairID)
+	return 0, 0, 0
+}
+
+func TestChairDistanceSplitsRideAndIdleMovement(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "distance")
+	pickup := Coordinate{Latitude: 5, Longitude: 0}
+	destination := Coordinate{Latitude: 5, Longitude: 5}
+
+	// 空いている間の移動
+	ts.moveChair(t, f.Chair, Coordinate{Latitude: 2, Longitude: 0})
+	rideID := ts.requestRide(t, f.User, pickup, destination)
+	ts.runMatching(t)
+	// 割り当てられても ENROUTE の前はライドの移動ではない
+	ts.moveChair(t, f.Chair, Coordinate{Latitude: 1, Longitude: 0})
+
+	// 配車位置へ向かう間と、目的地へ乗せていく間の移動
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusEnroute)
+	ts.moveChair(t, f.Chair, pickup)
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusCarrying)
+	ts.moveChair(t, f.Chair, destination)
+
+	// 目的地に着いた後の移動
+	// 評価の後はライドの経路の確認が裏で chair_locations を読むので、その前に動かしておく
+	ts.moveChair(t, f.Chair, Coordinate{Latitude: 5, Longitude: 4})
+	ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 5})
+
+	const wantOnRide, wantIdle = 4 + 5, 2 + 1 + 1
+	total, onRide, idle := ts.ownerChairDistances(t, f.Owner, f.Chair.ID)
+	if onRide != wantOnRide || idle != wantIdle || total != onRide+idle {
+		t.Fatalf("total = %d, on ride = %d, idle = %d, want %d on ride and %d idle", total, onRide, idle, wantOnRide, wantIdle)
+	}
+
+	// 初期化時の位置情報からの計算も同じ内訳になる
+	if _, err := ts.db.Exec("UPDATE chairs SET total_distance = 0, distance_on_ride = 0, distance_idle = 0, total_distance_updated_at = NULL WHERE id = ?", f.Chair.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.initializeChairTotalDistance(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	total, onRide, idle = ts.ownerChairDistances(t, f.Owner, f.Chair.ID)
+	if onRide != wantOnRide || idle != wantIdle || total != onRide+idle {
+		t.Fatalf("backfilled total = %d, on ride = %d, idle = %d, want %d on ride and %d idle", total, onRide, idle, wantOnRide, wantIdle)
+	}
+}
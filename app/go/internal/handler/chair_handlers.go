@@ -0,0 +1,682 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type chairPostChairsRequest struct {
+	Name               string `json:"name"`
+	Model              string `json:"model"`
+	ChairRegisterToken string `json:"chair_register_token"`
+}
+
+type chairPostChairsResponse struct {
+	ID      string `json:"id"`
+	OwnerID string `json:"owner_id"`
+}
+
+func (s *server) chairPostChairs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &chairPostChairsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errs := (fieldErrors{}).
+		required("name", req.Name == "").
+		required("model", req.Model == "").
+		required("chair_register_token", req.ChairRegisterToken == ""); len(errs) > 0 {
+		writeValidationError(w, errors.New("some of required fields(name, model, chair_register_token) are empty"), errs)
+		return
+	}
+
+	upsert := r.URL.Query().Get("upsert") == "true"
+
+	tx, err := s.beginTx("chairPostChairs")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 同じオーナーの登録を直列にする。同じ名前の椅子が作られないことは chairs_owner_id_active_name でも保証する
+	owner := &Owner{}
+	if err := tx.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ? FOR UPDATE", req.ChairRegisterToken); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	accessToken := secureRandomStr(32)
+
+	// 名前はオーナーごとに一意。削除した椅子と同じ名前では登録し直せる
+	existing := &Chair{}
+	err = tx.GetContext(ctx, existing, "SELECT * FROM chairs WHERE owner_id = ? AND active_name = ?", owner.ID, req.Name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err == nil {
+		if !upsert {
+			writeError(w, http.StatusConflict, errors.New("chair with the same name already exists"))
+			return
+		}
+		// 登録をやり直すスクリプトのため、既存の椅子のアクセストークンを発行し直して返す
+		if _, err := tx.ExecContext(ctx, "UPDATE chairs SET access_token = ? WHERE id = ?", accessToken, existing.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.forgetChair(existing.AccessToken)
+
+		http.SetCookie(w, &http.Cookie{
+			Path:  "/",
+			Name:  "chair_session",
+			Value: accessToken,
+		})
+		writeJSON(w, http.StatusOK, &chairPostChairsResponse{
+			ID:      existing.ID,
+			OwnerID: owner.ID,
+		})
+		return
+	}
+
+	chairID := newID()
+
+	// 座標を一度も送っていない椅子は、走行距離0・最終位置なしとして扱う
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token, total_distance, last_latitude, last_longitude) VALUES (?, ?, ?, ?, ?, ?, 0, NULL, NULL)",
+		chairID, owner.ID, req.Name, req.Model, false, accessToken,
+	)
+	if err != nil {
+		if isDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, errors.New("chair with the same name already exists"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// selectで今追加したchairを取得(FIXME: ↓のReturningが使えなかった)
+	chair := &Chair{}
+	if err := s.db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ?", chairID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// // returiningを使って、追加したchairを取得
+	// chair := &Chair{}
+	// if err := s.db.QueryRow("INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?) RETURNING id, owner_id, name, model, is_active, access_token", chairID, owner.ID, req.Name, req.Model, false, accessToken).Scan(
+	// 	&chair.ID,
+	// 	&chair.OwnerID,
+	// 	&chair.Name,
+	// 	&chair.Model,
+	// 	&chair.IsActive,
+	// 	&chair.AccessToken,
+	// ); err != nil {
+	// 	writeError(w, http.StatusInternalServerError, err)
+	// 	return
+	// }
+
+	// キャッシュ更新
+	if _, err := s.state.chairs.get(ctx, accessToken); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Path:  "/",
+		Name:  "chair_session",
+		Value: accessToken,
+	})
+
+	writeJSON(w, http.StatusCreated, &chairPostChairsResponse{
+		ID:      chairID,
+		OwnerID: owner.ID,
+	})
+}
+
+type postChairActivityRequest struct {
+	IsActive bool `json:"is_active"`
+}
+
+func (s *server) chairPostActivity(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	req := &postChairActivityRequest{}
+	if err := bindJSON(r, req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, err := s.db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// キャッシュ更新
+	s.state.chairs.update(chair.AccessToken, func(c *Chair) {
+		c.IsActive = req.IsActive
+	})
+	s.state.chairActivities.clearDeactivated(chair.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type postChairMaintenanceRequest struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+func (s *server) chairPostMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	req := &postChairMaintenanceRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := s.setChairMaintenance(ctx, chair, req.Maintenance); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setChairMaintenance はメンテナンス待ちの状態を切り替える
+// 割り当て済みのライドや通知には影響させず、マッチングの候補からだけ外す
+func (s *server) setChairMaintenance(ctx context.Context, chair *Chair, maintenance bool) error {
+	if _, err := s.db.ExecContext(ctx, "UPDATE chairs SET maintenance = ? WHERE id = ?", maintenance, chair.ID); err != nil {
+		return err
+	}
+	// キャッシュ更新
+	s.state.chairs.update(chair.AccessToken, func(c *Chair) {
+		c.Maintenance = maintenance
+	})
+	return nil
+}
+
+// renameChair は椅子の名前を変える。同じオーナーの削除していない椅子と名前が重なると一意制約のエラーを返す
+func (s *server) renameChair(ctx context.Context, chair *Chair, name string) error {
+	if _, err := s.db.ExecContext(ctx, "UPDATE chairs SET name = ? WHERE id = ?", name, chair.ID); err != nil {
+		return err
+	}
+	// キャッシュ更新
+	s.state.chairs.update(chair.AccessToken, func(c *Chair) {
+		c.Name = name
+	})
+	return nil
+}
+
+type chairPostCoordinateResponse struct {
+	RecordedAt int64 `json:"recorded_at"`
+}
+
+func (s *server) chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &Coordinate{}
+	if err := bindJSON(r, req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	chair := ctx.Value("chair").(*Chair)
+
+	tx, err := s.beginTx("chairPostCoordinate")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 放置により非アクティブにされていた椅子は座標の送信で復帰する
+	if err := s.reactivateChairIfSwept(ctx, tx.Tx, chair); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// DBから読み直した値とキャッシュの値が一致するよう、UTCでDATETIME(6)の精度に揃える
+	createdAt := clockNow().UTC().Truncate(time.Microsecond)
+	chairLocationID := newID()
+	// バッファを使うときはコミットした後でバッファに積み、フラッシャーがまとめて書き込む
+	if s.coordinateBuffer == nil {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) 
+			 VALUES (?, ?, ?, ?, ?)`,
+			chairLocationID, chair.ID, req.Latitude, req.Longitude, createdAt,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	location := &ChairLocation{
+		ID:        chairLocationID,
+		ChairID:   chair.ID,
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		CreatedAt: createdAt,
+	}
+
+	ride := &Ride{}
+	var status RideStatusType
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		status, err = getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	distanceIncrement := 0
+	if chair.LastLatitude != nil && chair.LastLongitude != nil {
+		distanceIncrement = calculateDistance(location.Latitude, location.Longitude, *chair.LastLatitude, *chair.LastLongitude)
+	}
+	// 配車位置や目的地へ向かっている間の移動だけをライドの移動とみなす
+	onRideIncrement, idleIncrement := 0, distanceIncrement
+	if isOnRideStatus(status) {
+		onRideIncrement, idleIncrement = distanceIncrement, 0
+	}
+
+	// chairの total_distance, last_latitude, last_longitudeを更新
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE chairs 
+		 SET total_distance = IFNULL(total_distance, 0) + ?,
+		     distance_on_ride = distance_on_ride + ?,
+		     distance_idle = distance_idle + ?,
+		     total_distance_updated_at = ?,
+		     last_latitude = ?,
+		     last_longitude = ?
+		 WHERE id = ?`,
+		distanceIncrement, onRideIncrement, idleIncrement, location.CreatedAt, location.Latitude, location.Longitude, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// キャッシュ更新
+	s.state.chairs.update(chair.AccessToken, func(c *Chair) {
+		c.TotalDistance += distanceIncrement
+		c.DistanceOnRide += onRideIncrement
+		c.DistanceIdle += idleIncrement
+		c.TotalDistanceUpdatedAt = &location.CreatedAt
+		c.LastLatitude = &location.Latitude
+		c.LastLongitude = &location.Longitude
+	})
+
+	if status != "" {
+		if status != RideStatusCompleted {
+			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == RideStatusEnroute {
+				if err := s.insertRideStatus(ctx, tx.Tx, ride.ID, RideStatusPickup); err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
+			}
+
+			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == RideStatusCarrying {
+				if err := s.insertRideStatus(ctx, tx.Tx, ride.ID, RideStatusArrived); err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.state.chairPositions.publish(chair.ID, *location)
+
+	// 椅子の最新の位置はコミット済みなので、履歴を書き込めなくてもマッチングには今の位置が使われる
+	if s.coordinateBuffer != nil {
+		if err := s.coordinateBuffer.add(ctx, *location); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
+		RecordedAt: location.CreatedAt.UnixMilli(),
+	})
+}
+
+type simpleUser struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type chairGetNotificationResponse struct {
+	Data         *chairGetNotificationResponseData `json:"data"`
+	RetryAfterMs int                               `json:"retry_after_ms"`
+}
+
+type chairGetNotificationResponseData struct {
+	RideID                string         `json:"ride_id"`
+	User                  simpleUser     `json:"user"`
+	PickupCoordinate      Coordinate     `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate     `json:"destination_coordinate"`
+	Status                RideStatusType `json:"status"`
+	// StatusID は ack=manual のときに POST /api/chair/notification/ack へ渡すステータスのID
+	StatusID string `json:"status_id,omitempty"`
+}
+
+// chairGetNotification は椅子にまだ届けていないステータスを古い順に1件ずつ返す
+// ack=manual なら返しただけでは届けたことにせず、POST /api/chair/notification/ack されるまで同じステータスを返し続ける
+func (s *server) chairGetNotification(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+	manualAck := r.URL.Query().Get("ack") == chairNotificationAckManual
+
+	if !s.tryAcquireNotification() {
+		writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+			RetryAfterMs: shedRetryAfterMs,
+		})
+		return
+	}
+	defer s.releaseNotification()
+
+	tx, err := s.beginTx("chairGetNotification")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	ride := &Ride{}
+	yetSentRideStatus := RideStatus{}
+	var status RideStatusType
+
+	const currentRideQuery = `SELECT r.* FROM rides r INNER JOIN chairs c ON c.current_ride_id = r.id WHERE c.id = ?`
+	if err := timedQuery("chair_notification_current_ride", currentRideQuery, func() error {
+		return tx.GetContext(ctx, ride, currentRideQuery, chair.ID)
+	}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+				// 割り当てを待っている椅子は、次のマッチングが終わる頃に来てもらう
+				RetryAfterMs: chairRetryAfterMs(chair.ID, clockNow()),
+			})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	const yetSentStatusQuery = `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`
+	if err := timedQuery("chair_notification_yet_sent_status", yetSentStatusQuery, func() error {
+		return tx.GetContext(ctx, &yetSentRideStatus, yetSentStatusQuery, ride.ID)
+	}); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			status, err = getLatestRideStatus(ctx, tx, ride.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		} else {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		status = yetSentRideStatus.Status
+	}
+
+	user := &User{}
+	err = tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if yetSentRideStatus.ID != "" && !manualAck {
+		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if yetSentRideStatus.Status == RideStatusCompleted {
+			if err := releaseChairIfCompletionDelivered(ctx, tx.Tx, ride.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statusID := ""
+	if manualAck {
+		statusID = yetSentRideStatus.ID
+	}
+	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+		Data: &chairGetNotificationResponseData{
+			RideID: ride.ID,
+			User: simpleUser{
+				ID:   user.ID,
+				Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+			},
+			PickupCoordinate: Coordinate{
+				Latitude:  ride.PickupLatitude,
+				Longitude: ride.PickupLongitude,
+			},
+			DestinationCoordinate: Coordinate{
+				Latitude:  ride.DestinationLatitude,
+				Longitude: ride.DestinationLongitude,
+			},
+			Status:   status,
+			StatusID: statusID,
+		},
+		// 状態変更から3秒以内に通知されている必要があるため、2秒後にリトライする
+		// see: https://gist.github.com/wtks/8eadf471daf7cb59942de02273ce7884#通知エンドポイント
+		RetryAfterMs: 100,
+	})
+}
+
+type postChairRidesRideIDStatusRequest struct {
+	Status string `json:"status"`
+}
+
+func (s *server) chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	chair := ctx.Value("chair").(*Chair)
+
+	req := &postChairRidesRideIDStatusRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	next, err := ParseRideStatus(req.Status)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
+	}
+
+	tx, err := s.beginTx("chairPostRideStatus")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 他の椅子に割り当てられたライドは存在しないライドと区別できないようにする
+	ride, err := lockRideForChair(ctx, tx, chair.ID, rideID)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch next {
+	case RideStatusEnroute:
+		if err := s.insertRideStatus(ctx, tx.Tx, ride.ID, RideStatusEnroute); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	case RideStatusCarrying:
+		status, err := getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if status != RideStatusPickup {
+			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
+			return
+		}
+		if err := checkChairPosition(ctx, tx.Tx, chair.ID, ride.ID, "pickup", ride.PickupLatitude, ride.PickupLongitude); err != nil {
+			if errors.Is(err, errChairNotAtPosition) {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := s.insertRideStatus(ctx, tx.Tx, ride.ID, RideStatusCarrying); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	case RideStatusCompleted:
+		// ユーザーが評価しなくても椅子が次のライドを受けられるよう、椅子側からも完了できる
+		// 評価は後から受け付け、チップ無しで決済する
+		status, err := getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if status != RideStatusArrived {
+			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived at the destination yet"))
+			return
+		}
+		if err := checkChairPosition(ctx, tx.Tx, chair.ID, ride.ID, "destination", ride.DestinationLatitude, ride.DestinationLongitude); err != nil {
+			if errors.Is(err, errChairNotAtPosition) {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		paymentToken, err := getPaymentToken(ctx, tx, ride.UserID)
+		if err != nil {
+			if errors.Is(err, errPaymentTokenNotRegistered) {
+				writeErrorWithCode(w, http.StatusBadRequest, errCodePaymentTokenRequired, err)
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := s.completeRide(ctx, tx.Tx, ride, paymentToken); err != nil {
+			switch {
+			case errors.Is(err, erroredUpstream):
+				writeError(w, http.StatusBadGateway, err)
+			default:
+				writeError(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if next == RideStatusCompleted {
+		s.state.chairPositions.endRide(chair.ID, ride.ID)
+		s.invalidateUserStats(ride.UserID)
+		s.state.ownerCompletions.notify(chair.OwnerID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type chairGetCurrentRideStatusResponse struct {
+	RideID                string         `json:"ride_id"`
+	Status                RideStatusType `json:"status"`
+	PickupCoordinate      Coordinate     `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate     `json:"destination_coordinate"`
+}
+
+// chairGetCurrentRideStatus は椅子に割り当てられているライドと最新の状態をまとめて返す
+// 割り当てられているライドが無ければ204を返す
+func (s *server) chairGetCurrentRideStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	tx, err := s.beginTx("chairGetCurrentRideStatus")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride, err := getChairCurrentRide(ctx, tx, chair.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &chairGetCurrentRideStatusResponse{
+		RideID: ride.ID,
+		Status: status,
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+	})
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// chairNotificationAckManual を ack に指定すると、通知を返しただけでは届けたことにしない
+	chairNotificationAckManual = "manual"
+	// maxChairNotificationAckIDs は1回の ack で受け付けるステータスIDの最大数
+	maxChairNotificationAckIDs = 100
+)
+
+type chairPostNotificationAckRequest struct {
+	StatusIDs []string `json:"status_ids"`
+}
+
+type chairPostNotificationAckResponse struct {
+	// Acknowledged は新しく届けたことにしたステータスの数。既に ack 済みや他の椅子のステータスは数えない
+	Acknowledged int `json:"acknowledged"`
+}
+
+// chairPostNotificationAck は ack=manual で受け取ったステータスを、椅子が処理し終えたものとして記録する
+// ack されるまでは同じステータスが通知され続けるので、椅子が処理の途中で落ちても取りこぼさない
+func (s *server) chairPostNotificationAck(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	req := &chairPostNotificationAckRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.StatusIDs) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("status_ids is required"))
+		return
+	}
+	if len(req.StatusIDs) > maxChairNotificationAckIDs {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("status_ids must not exceed %d", maxChairNotificationAckIDs))
+		return
+	}
+
+	tx, err := s.beginTx("chairPostNotificationAck")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	query, args, err := sqlx.In(`
+		SELECT ride_statuses.* FROM ride_statuses
+		INNER JOIN rides ON rides.id = ride_statuses.ride_id
+		WHERE ride_statuses.id IN (?) AND rides.chair_id = ? AND ride_statuses.chair_sent_at IS NULL
+		FOR UPDATE`, req.StatusIDs, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	statuses := []RideStatus{}
+	if err := tx.SelectContext(ctx, &statuses, tx.Rebind(query), args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(statuses) > 0 {
+		ids := make([]string, 0, len(statuses))
+		for _, st := range statuses {
+			ids = append(ids, st.ID)
+		}
+		query, args, err := sqlx.In(`UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id IN (?)`, ids)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, st := range statuses {
+			if st.Status == RideStatusCompleted {
+				if err := releaseChairIfCompletionDelivered(ctx, tx.Tx, st.RideID); err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &chairPostNotificationAckResponse{Acknowledged: len(statuses)})
+}
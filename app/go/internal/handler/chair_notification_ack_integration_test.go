@@ -0,0 +1,122 @@
+//go:build integration
+
+package handler
+
+import (
+	"database/sql"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// manualChairNotification は ack=manual で椅子の通知を1件取る
+func (ts *testServer) manualChairNotification(t *testing.T, chair testChair) *chairGetNotificationResponseData {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/chair/notification?ack=manual", chair.Cookie, nil)
+	return decodeJSON[chairGetNotificationResponse](t, rec).Data
+}
+
+func (ts *testServer) ackChairStatuses(t *testing.T, chair testChair, ids ...string) int {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/chair/notification/ack", chair.Cookie, chairPostNotificationAckRequest{StatusIDs: ids})
+	return decodeJSON[chairPostNotificationAckResponse](t, rec).Acknowledged
+}
+
+func (ts *testServer) chairSentAt(t *testing.T, statusID string) sql.NullTime {
+	t.Helper()
+	var sentAt sql.NullTime
+	if err := ts.db.Get(&sentAt, "SELECT chair_sent_at FROM ride_statuses WHERE id = ?", statusID); err != nil {
+		t.Fatal(err)
+	}
+	return sentAt
+}
+
+func TestChairNotificationRedeliversUntilAcked(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "redeliver")
+	ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+
+	// ack するまでは同じステータスを何度でも返す
+	first := ts.manualChairNotification(t, f.Chair)
+	if first == nil || first.Status != RideStatusMatching || first.StatusID == "" {
+		t.Fatalf("notification = %+v, want MATCHING with its status id", first)
+	}
+	again := ts.manualChairNotification(t, f.Chair)
+	if again == nil || again.StatusID != first.StatusID {
+		t.Fatalf("notification = %+v, want %s again before the ack", again, first.StatusID)
+	}
+	if sentAt := ts.chairSentAt(t, first.StatusID); sentAt.Valid {
+		t.Fatalf("chair_sent_at = %v, want unset before the ack", sentAt.Time)
+	}
+
+	// ack=manual でなければ従来どおり返したときに届けたことにする
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/chair/notification", f.Chair.Cookie, nil)
+	if data := decodeJSON[chairGetNotificationResponse](t, rec).Data; data == nil || data.StatusID != "" {
+		t.Fatalf("notification = %+v, want MATCHING without a status id", data)
+	}
+	if sentAt := ts.chairSentAt(t, first.StatusID); !sentAt.Valid {
+		t.Fatal("automatic notification did not mark the status as sent")
+	}
+}
+
+func TestChairNotificationAckMarksStatuses(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "ack")
+	rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	ts.drainAppNotifications(t, f.User)
+	// ack するまで f.Chair は空かないので、他のライドは別の椅子に割り当てられる
+	other := ts.newRideFixture(t, "ack-other")
+	otherRideID := ts.requestRide(t, other.User, testPickup, testDestination)
+	ts.runMatching(t)
+	if got := ts.assignedChair(t, otherRideID); got != other.Chair.ID {
+		t.Fatalf("other ride was assigned to %q, want %s", got, other.Chair.ID)
+	}
+
+	// 他の椅子のステータスは ack しても数えず、届けたことにもしない
+	var otherStatusID string
+	if err := ts.db.Get(&otherStatusID, "SELECT id FROM ride_statuses WHERE ride_id = ?", otherRideID); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.ackChairStatuses(t, f.Chair, otherStatusID); got != 0 {
+		t.Fatalf("acknowledged %d of another chair's statuses, want 0", got)
+	}
+	if sentAt := ts.chairSentAt(t, otherStatusID); sentAt.Valid {
+		t.Fatal("another chair's status was marked as sent")
+	}
+
+	// 通知を1件ずつ ack すると次のステータスに進む
+	var delivered []RideStatusType
+	for i := 0; i < 10; i++ {
+		data := ts.manualChairNotification(t, f.Chair)
+		if data == nil || data.StatusID == "" {
+			break
+		}
+		delivered = append(delivered, data.Status)
+		if got := ts.ackChairStatuses(t, f.Chair, data.StatusID); got != 1 {
+			t.Fatalf("acknowledged %d statuses, want 1", got)
+		}
+		if sentAt := ts.chairSentAt(t, data.StatusID); !sentAt.Valid {
+			t.Fatalf("%s was not marked as sent by the ack", data.Status)
+		}
+		// 同じIDをもう一度 ack しても数えない
+		if got := ts.ackChairStatuses(t, f.Chair, data.StatusID); got != 0 {
+			t.Fatalf("acknowledged %d statuses again, want 0", got)
+		}
+	}
+	want := []RideStatusType{RideStatusMatching, RideStatusEnroute, RideStatusPickup, RideStatusCarrying, RideStatusArrived, RideStatusCompleted}
+	if !slices.Equal(delivered, want) {
+		t.Fatalf("delivered %v, want %v", delivered, want)
+	}
+
+	// COMPLETED を ack したら椅子は空く
+	var currentRideID sql.NullString
+	if err := ts.db.Get(&currentRideID, "SELECT current_ride_id FROM chairs WHERE id = ?", f.Chair.ID); err != nil {
+		t.Fatal(err)
+	}
+	if currentRideID.Valid {
+		t.Fatalf("current_ride_id = %s after acking COMPLETED of %s, want NULL", currentRideID.String, rideID)
+	}
+
+	ts.mustDo(t, http.StatusBadRequest, http.MethodPost, "/api/chair/notification/ack", f.Chair.Cookie, chairPostNotificationAckRequest{})
+}
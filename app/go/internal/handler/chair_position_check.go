@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	positionCheckOff    = "off"
+	positionCheckLog    = "log"
+	positionCheckReject = "reject"
+)
+
+var errChairNotAtPosition = errors.New("chair is not at the expected position")
+
+// chairPositionViolations は椅子が配車位置・目的地にいないまま状態を進めようとした回数
+var chairPositionViolations struct {
+	pickup      atomic.Int64
+	destination atomic.Int64
+}
+
+// checkChairPosition は椅子の最後の座標が (latitude, longitude) から許容範囲内にあるかを確かめる
+// 範囲外ならログとメトリクスに残し、position_check が reject のときは errChairNotAtPosition を返す
+// target は pickup か destination で、ログとメトリクスのラベルに使う
+func checkChairPosition(ctx context.Context, tx *sqlx.Tx, chairID, rideID, target string, latitude, longitude int) error {
+	params := loadMatchingParams()
+	if params.PositionCheck == positionCheckOff {
+		return nil
+	}
+
+	// キャッシュの座標は並行した座標の送信で古いことがあるのでDBから読む
+	var last struct {
+		Latitude  *int `db:"last_latitude"`
+		Longitude *int `db:"last_longitude"`
+	}
+	if err := tx.GetContext(ctx, &last, "SELECT last_latitude, last_longitude FROM chairs WHERE id = ?", chairID); err != nil {
+		return err
+	}
+
+	var violation error
+	if last.Latitude == nil || last.Longitude == nil {
+		violation = fmt.Errorf("%w: position of chair is unknown", errChairNotAtPosition)
+	} else if distance := calculateDistance(*last.Latitude, *last.Longitude, latitude, longitude); distance > params.PositionTolerance {
+		violation = fmt.Errorf("%w: %d away from %s", errChairNotAtPosition, distance, target)
+	}
+	if violation == nil {
+		return nil
+	}
+
+	switch target {
+	case "pickup":
+		chairPositionViolations.pickup.Add(1)
+	case "destination":
+		chairPositionViolations.destination.Add(1)
+	}
+	slog.Warn("chair position mismatch", "chair_id", chairID, "ride_id", rideID, "err", violation)
+
+	if params.PositionCheck == positionCheckReject {
+		return violation
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChairPositionCheckOnCarryingAndCompleted(t *testing.T) {
+	const tolerance = 2
+	offsets := []struct {
+		name   string
+		offset int
+		reject bool
+	}{
+		{name: "exact", offset: 0},
+		{name: "within tolerance", offset: tolerance},
+		{name: "violation", offset: tolerance + 1, reject: true},
+	}
+	for _, o := range offsets {
+		t.Run(o.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.putMatchingSettings(t, map[string]any{"position_check": positionCheckReject, "position_tolerance": tolerance})
+			f := ts.newRideFixture(t, "position")
+			rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+			ts.runMatching(t)
+			ts.postRideStatus(t, f.Chair, rideID, RideStatusEnroute)
+
+			// PICKUP と ARRIVED は着いた座標で記録されるので、その後に offset だけ離れてから状態を進める
+			steps := []struct {
+				target string
+				at     Coordinate
+				next   RideStatusType
+				count  func() int64
+			}{
+				{target: "pickup", at: testPickup, next: RideStatusCarrying, count: chairPositionViolations.pickup.Load},
+				{target: "destination", at: testDestination, next: RideStatusCompleted, count: chairPositionViolations.destination.Load},
+			}
+			for _, step := range steps {
+				ts.moveChair(t, f.Chair, step.at)
+				ts.moveChair(t, f.Chair, Coordinate{Latitude: step.at.Latitude + o.offset, Longitude: step.at.Longitude})
+				before := step.count()
+
+				body := postChairRidesRideIDStatusRequest{Status: string(step.next)}
+				if !o.reject {
+					ts.mustDo(t, http.StatusNoContent, http.MethodPost, "/api/chair/rides/"+rideID+"/status", f.Chair.Cookie, body)
+					if got := step.count() - before; got != 0 {
+						t.Fatalf("%s violations = %d, want 0", step.target, got)
+					}
+					continue
+				}
+
+				rec := ts.mustDo(t, http.StatusBadRequest, http.MethodPost, "/api/chair/rides/"+rideID+"/status", f.Chair.Cookie, body)
+				if want := "3 away from " + step.target; !strings.Contains(rec.Body.String(), want) {
+					t.Fatalf("error = %s, want the distance %q", rec.Body.String(), want)
+				}
+				if got := step.count() - before; got != 1 {
+					t.Fatalf("%s violations = %d, want 1", step.target, got)
+				}
+				// 戻れば同じ遷移を受け付ける
+				ts.moveChair(t, f.Chair, step.at)
+				ts.postRideStatus(t, f.Chair, rideID, step.next)
+			}
+			if got := ts.latestStatus(t, rideID); got != RideStatusCompleted {
+				t.Fatalf("status = %q, want COMPLETED", got)
+			}
+		})
+	}
+}
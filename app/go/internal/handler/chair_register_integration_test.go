@@ -0,0 +1,141 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func (ts *testServer) postChair(t *testing.T, want int, query string, owner testOwner, name string) *chairPostChairsResponse {
+	t.Helper()
+	rec := ts.mustDo(t, want, http.MethodPost, "/api/chair/chairs"+query, nil, chairPostChairsRequest{
+		Name:               name,
+		Model:              testChairModel,
+		ChairRegisterToken: owner.RegisterToken,
+	})
+	if want != http.StatusCreated && want != http.StatusOK {
+		return nil
+	}
+	res := decodeJSON[chairPostChairsResponse](t, rec)
+	return &res
+}
+
+func (ts *testServer) countChairs(t *testing.T, owner testOwner, name string) int {
+	t.Helper()
+	var count int
+	if err := ts.db.Get(&count, "SELECT COUNT(*) FROM chairs WHERE owner_id = ? AND name = ? AND deleted_at IS NULL", owner.ID, name); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestChairPostChairsRejectsDuplicateName(t *testing.T) {
+	ts := newTestServer(t)
+	owner := ts.registerOwner(t, "duplicate-owner")
+	ts.registerChair(t, owner, "Chair-001", Coordinate{})
+
+	ts.postChair(t, http.StatusConflict, "", owner, "Chair-001")
+	ts.postChair(t, http.StatusConflict, "?upsert=false", owner, "Chair-001")
+	if got := ts.countChairs(t, owner, "Chair-001"); got != 1 {
+		t.Fatalf("chairs named Chair-001 = %d, want 1", got)
+	}
+
+	// オーナーの行ロックを通らない書き込みも一意制約で弾く
+	_, err := ts.db.Exec(
+		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, FALSE, ?)",
+		newID(), owner.ID, "Chair-001", testChairModel, "bypassing-token",
+	)
+	if !isDuplicateKeyError(err) {
+		t.Fatalf("direct insert of a duplicate name: err = %v, want a duplicate key error", err)
+	}
+}
+
+func TestChairPostChairsUpsertReissuesToken(t *testing.T) {
+	ts := newTestServer(t)
+	owner := ts.registerOwner(t, "upsert-owner")
+	chair := ts.registerChair(t, owner, "Chair-001", Coordinate{})
+
+	rec := ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/chair/chairs?upsert=true", nil, chairPostChairsRequest{
+		Name:               "Chair-001",
+		Model:              testChairModel,
+		ChairRegisterToken: owner.RegisterToken,
+	})
+	res := decodeJSON[chairPostChairsResponse](t, rec)
+	if res.ID != chair.ID || res.OwnerID != owner.ID {
+		t.Fatalf("upsert returned %+v, want the existing chair %s", res, chair.ID)
+	}
+	reissued := testChair{ID: res.ID, Cookie: responseCookie(t, rec, "chair_session")}
+	if reissued.Cookie.Value == chair.Cookie.Value {
+		t.Fatal("upsert returned the same access token")
+	}
+
+	// 古いトークンは使えなくなり、新しいトークンで続けられる
+	ts.mustDo(t, http.StatusUnauthorized, http.MethodPost, "/api/chair/coordinate", chair.Cookie, Coordinate{Latitude: 1, Longitude: 1})
+	ts.moveChair(t, reissued, Coordinate{Latitude: 1, Longitude: 1})
+	if got := ts.countChairs(t, owner, "Chair-001"); got != 1 {
+		t.Fatalf("chairs named Chair-001 = %d, want 1", got)
+	}
+
+	// 同じ名前の椅子が無ければ upsert でも新しく作る
+	if created := ts.postChair(t, http.StatusCreated, "?upsert=true", owner, "Chair-002"); created.ID == chair.ID {
+		t.Fatal("upsert of a new name returned the existing chair")
+	}
+}
+
+func TestChairPostChairsAllowsNameAcrossOwnersAndAfterDelete(t *testing.T) {
+	ts := newTestServer(t)
+	owner := ts.registerOwner(t, "first-owner")
+	other := ts.registerOwner(t, "second-owner")
+	chair := ts.registerChair(t, owner, "Chair-001", Coordinate{})
+
+	ts.postChair(t, http.StatusCreated, "", other, "Chair-001")
+	if got := ts.countChairs(t, other, "Chair-001"); got != 1 {
+		t.Fatalf("other owner's chairs named Chair-001 = %d, want 1", got)
+	}
+
+	// 削除した椅子の名前は同じオーナーでも使い直せる
+	ts.mustDo(t, http.StatusNoContent, http.MethodDelete, "/api/owner/chairs/"+chair.ID, owner.Cookie, nil)
+	recreated := ts.postChair(t, http.StatusCreated, "", owner, "Chair-001")
+	if recreated.ID == chair.ID {
+		t.Fatal("registration after delete returned the deleted chair")
+	}
+	ts.postChair(t, http.StatusConflict, "", owner, "Chair-001")
+}
+
+func (ts *testServer) renameChair(t *testing.T, want int, owner testOwner, chair testChair, name string) {
+	t.Helper()
+	ts.mustDo(t, want, http.MethodPut, "/api/owner/chairs/"+chair.ID, owner.Cookie, ownerPutChairRequest{Name: &name})
+}
+
+func TestOwnerPutChairRenameRejectsDuplicateName(t *testing.T) {
+	ts := newTestServer(t)
+	owner := ts.registerOwner(t, "rename-owner")
+	other := ts.registerOwner(t, "rename-other")
+	first := ts.registerChair(t, owner, "Chair-001", Coordinate{})
+	second := ts.registerChair(t, owner, "Chair-002", Coordinate{})
+	ts.registerChair(t, other, "Chair-003", Coordinate{})
+	maintenance := true
+	ts.mustDo(t, http.StatusNoContent, http.MethodPut, "/api/owner/chairs/"+second.ID, owner.Cookie, ownerPutChairRequest{Maintenance: &maintenance})
+
+	// 同じオーナーの椅子と同じ名前には変えられない
+	ts.renameChair(t, http.StatusConflict, owner, second, "Chair-001")
+	ts.renameChair(t, http.StatusBadRequest, owner, second, "")
+	if got := ts.countChairs(t, owner, "Chair-002"); got != 1 {
+		t.Fatalf("chairs named Chair-002 after the rejected rename = %d, want 1", got)
+	}
+
+	// 他のオーナーの椅子の名前や、削除した椅子の名前には変えられる
+	ts.renameChair(t, http.StatusNoContent, owner, second, "Chair-003")
+	ts.mustDo(t, http.StatusNoContent, http.MethodDelete, "/api/owner/chairs/"+first.ID, owner.Cookie, nil)
+	ts.renameChair(t, http.StatusNoContent, owner, second, "Chair-001")
+
+	// 名前だけを変えてもメンテナンス待ちはそのまま
+	var renamed Chair
+	if err := ts.db.Get(&renamed, "SELECT * FROM chairs WHERE id = ?", second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Name != "Chair-001" || !renamed.Maintenance {
+		t.Fatalf("renamed chair = %s maintenance %v, want Chair-001 still in maintenance", renamed.Name, renamed.Maintenance)
+	}
+}
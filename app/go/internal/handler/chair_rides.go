@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// chairRidesDefaultLimit は limit が指定されなかったときに返すライド数
+	chairRidesDefaultLimit = 20
+	// chairRidesMaxLimit は1ページで返すライド数の上限
+	chairRidesMaxLimit = 100
+)
+
+// rideTripStatusesQuery はライドごとに迎えに向かった・乗せた・到着した時刻を読む
+const rideTripStatusesQuery = `SELECT ride_id, status, created_at FROM ride_statuses WHERE ride_id IN (?) AND status IN ('ENROUTE', 'CARRYING', 'ARRIVED')`
+
+type chairGetRidesResponse struct {
+	Rides []chairGetRidesResponseItem `json:"rides"`
+	// NextOffset は次のページが無ければnull
+	NextOffset *int `json:"next_offset"`
+}
+
+type chairGetRidesResponseItem struct {
+	RideID string `json:"ride_id"`
+	Fare   int64  `json:"fare"`
+	// Evaluation は未評価ならnull
+	Evaluation *int `json:"evaluation"`
+	// WaitMs は迎えに向かってから乗せるまで(ENROUTE→CARRYING)の時間。ステータスが欠けていればnull
+	WaitMs *int64 `json:"wait_ms"`
+	// TripMs は乗せてから目的地に着くまで(CARRYING→ARRIVED)の時間。ステータスが欠けていればnull
+	TripMs      *int64 `json:"trip_ms"`
+	CompletedAt int64  `json:"completed_at"`
+}
+
+// chairGetRides は椅子が完了したライドを、完了した日時の新しい順に返す
+// since と until(UNIXミリ秒)で完了した日時を絞り込める。since はその時刻を含み、until は含まない
+func (s *server) chairGetRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	since := time.Unix(0, 0).UTC()
+	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	if v := r.URL.Query().Get("since"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = unixMilliUTC(parsed)
+	}
+	if v := r.URL.Query().Get("until"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		until = unixMilliUTC(parsed)
+	}
+	if !until.After(since) {
+		writeError(w, http.StatusBadRequest, errors.New("until must be after since"))
+		return
+	}
+	limit := chairRidesDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > chairRidesMaxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", chairRidesMaxLimit))
+			return
+		}
+		limit = l
+	}
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		o, err := strconv.Atoi(v)
+		if err != nil || o < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("offset must be a non-negative integer"))
+			return
+		}
+		offset = o
+	}
+
+	tx, err := s.beginTx("chairGetRides")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 次のページがあるか知るために1件多く取る
+	rows := []struct {
+		rideWithDiscount
+		CompletedAt time.Time `db:"completed_at"`
+	}{}
+	if err := tx.SelectContext(ctx, &rows, `
+		SELECT rides.*, IFNULL(coupons.discount, 0) AS discount, ride_statuses.created_at AS completed_at
+		FROM rides
+		INNER JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED'
+		LEFT JOIN coupons ON coupons.used_by = rides.id
+		WHERE rides.chair_id = ? AND ride_statuses.created_at >= ? AND ride_statuses.created_at < ?
+		ORDER BY ride_statuses.created_at DESC, rides.id
+		LIMIT ? OFFSET ?`, chair.ID, since, until, limit+1, offset); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := chairGetRidesResponse{Rides: []chairGetRidesResponseItem{}}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		next := offset + limit
+		res.NextOffset = &next
+	}
+
+	// ステータスの時刻はページ内のライドの分をまとめて読む
+	statusTimes := map[string]map[RideStatusType]time.Time{}
+	if len(rows) > 0 {
+		rideIDs := make([]string, 0, len(rows))
+		for _, row := range rows {
+			rideIDs = append(rideIDs, row.ID)
+		}
+		query, args := expandIn(rideTripStatusesQuery, rideIDs)
+		statuses := []RideStatus{}
+		if err := tx.SelectContext(ctx, &statuses, query, args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, st := range statuses {
+			if statusTimes[st.RideID] == nil {
+				statusTimes[st.RideID] = map[RideStatusType]time.Time{}
+			}
+			statusTimes[st.RideID][st.Status] = st.CreatedAt
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, row := range rows {
+		fare := applyDiscount(row.Ride, row.Discount)
+		if row.ChargedFare != nil {
+			fare = *row.ChargedFare
+		}
+		times := statusTimes[row.ID]
+		res.Rides = append(res.Rides, chairGetRidesResponseItem{
+			RideID:      row.ID,
+			Fare:        fare,
+			Evaluation:  row.Evaluation,
+			WaitMs:      statusDurationMs(times, RideStatusEnroute, RideStatusCarrying),
+			TripMs:      statusDurationMs(times, RideStatusCarrying, RideStatusArrived),
+			CompletedAt: row.CompletedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// statusDurationMs は from から to のステータスになるまでの時間を返す。どちらかが無ければ nil
+func statusDurationMs(times map[RideStatusType]time.Time, from, to RideStatusType) *int64 {
+	start, ok := times[from]
+	if !ok {
+		return nil
+	}
+	end, ok := times[to]
+	if !ok {
+		return nil
+	}
+	d := end.Sub(start).Milliseconds()
+	return &d
+}
@@ -0,0 +1,163 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// drainChairNotifications は椅子に未通知のステータスを全て受け取り、最後に受け取ったステータスを返す
+// 通知済みにした更新が次のリクエストからすぐに見えないことがあるので、最新のステータスが繰り返されるまで受け取る
+func (ts *testServer) drainChairNotifications(t *testing.T, chair testChair) RideStatusType {
+	t.Helper()
+	var last RideStatusType
+	for i := 0; i < 20; i++ {
+		rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/chair/notification", chair.Cookie, nil)
+		res := decodeJSON[chairGetNotificationResponse](t, rec)
+		if res.Data == nil {
+			return last
+		}
+		if res.Data.Status == last && last == ts.latestStatus(t, res.Data.RideID) {
+			return last
+		}
+		last = res.Data.Status
+	}
+	return last
+}
+
+func TestChairCompletesArrivedRide(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "unrated")
+
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.driveToArrival(t, f.Chair, rideID, testPickup, testDestination)
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusCompleted)
+
+	if got := ts.latestStatus(t, rideID); got != RideStatusCompleted {
+		t.Fatalf("status = %q, want COMPLETED", got)
+	}
+	if got := ts.payments.Load(); got != 1 {
+		t.Fatalf("payments = %d, want 1", got)
+	}
+	var chargedFare sql.NullInt64
+	if err := ts.db.Get(&chargedFare, "SELECT charged_fare FROM rides WHERE id = ?", rideID); err != nil {
+		t.Fatal(err)
+	}
+	if !chargedFare.Valid {
+		t.Fatal("charged_fare is NULL after the chair completed the ride")
+	}
+	// COMPLETEDがユーザーと椅子の両方に届いたら椅子は空きになる
+	if got := ts.drainChairNotifications(t, f.Chair); got != RideStatusCompleted {
+		t.Fatalf("last chair notification = %q, want COMPLETED", got)
+	}
+	if got := ts.drainAppNotifications(t, f.User); got != RideStatusCompleted {
+		t.Fatalf("last app notification = %q, want COMPLETED", got)
+	}
+	var currentRideID sql.NullString
+	if err := ts.db.Get(&currentRideID, "SELECT current_ride_id FROM chairs WHERE id = ?", f.Chair.ID); err != nil {
+		t.Fatal(err)
+	}
+	if currentRideID.Valid {
+		t.Fatalf("chair is still on ride %s", currentRideID.String)
+	}
+
+	// 評価は後から受け付けるが、支払い済みなのでチップは受け付けない
+	evaluationPath := "/api/app/rides/" + rideID + "/evaluation"
+	ts.mustDo(t, http.StatusBadRequest, http.MethodPost, evaluationPath, f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 4, Tip: 100})
+	rec := ts.mustDo(t, http.StatusOK, http.MethodPost, evaluationPath, f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 4})
+	if res := decodeJSON[appPostRideEvaluationResponse](t, rec); res.CompletedAt == 0 {
+		t.Fatal("completed_at is zero")
+	}
+	ts.mustDo(t, http.StatusBadRequest, http.MethodPost, evaluationPath, f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 5})
+	if got := ts.payments.Load(); got != 1 {
+		t.Fatalf("payments = %d after the late evaluation, want 1", got)
+	}
+
+	// 空いた椅子は次のライドに割り当てられ、目的地に着くまでは椅子から完了できない
+	nextRideID := ts.requestRide(t, f.User, testDestination, testPickup)
+	ts.runMatching(t)
+	ts.postRideStatus(t, f.Chair, nextRideID, RideStatusEnroute)
+	ts.mustDo(t, http.StatusBadRequest, http.MethodPost, "/api/chair/rides/"+nextRideID+"/status", f.Chair.Cookie, postChairRidesRideIDStatusRequest{Status: string(RideStatusCompleted)})
+	if got := ts.latestStatus(t, nextRideID); got != RideStatusEnroute {
+		t.Fatalf("status = %q, want ENROUTE", got)
+	}
+}
+
+func TestInactiveChairIsExcludedFromMatching(t *testing.T) {
+	cfg := testConfig()
+	cfg.ChairInactiveThreshold = time.Minute
+	ts := newTestServerWithConfig(t, cfg)
+	clock := useFakeClock(t)
+
+	// 近い椅子が黙ったままになり、遠い椅子だけがリクエストを送り続ける
+	f := ts.newRideFixture(t, "sweep")
+	silent := f.Chair
+	busy := ts.registerChair(t, f.Owner, "busy-chair", Coordinate{Latitude: 30, Longitude: 30})
+
+	clock.advance(cfg.ChairInactiveThreshold / 2)
+	ts.moveChair(t, busy, Coordinate{Latitude: 30, Longitude: 30})
+	clock.advance(cfg.ChairInactiveThreshold/2 + time.Second)
+	ts.sweepInactiveChairs(context.Background())
+
+	var isActive bool
+	if err := ts.db.Get(&isActive, "SELECT is_active FROM chairs WHERE id = ?", silent.ID); err != nil {
+		t.Fatal(err)
+	}
+	if isActive {
+		t.Fatal("silent chair is still active after the sweep")
+	}
+	if err := ts.db.Get(&isActive, "SELECT is_active FROM chairs WHERE id = ?", busy.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !isActive {
+		t.Fatal("busy chair was deactivated")
+	}
+
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	var assigned sql.NullString
+	if err := ts.db.Get(&assigned, "SELECT chair_id FROM rides WHERE id = ?", rideID); err != nil {
+		t.Fatal(err)
+	}
+	if assigned.String != busy.ID {
+		t.Fatalf("ride was assigned to %q, want the active chair %s", assigned.String, busy.ID)
+	}
+
+	// 位置を送ってきた椅子はアクティブに戻る
+	ts.moveChair(t, silent, testPickup)
+	if err := ts.db.Get(&isActive, "SELECT is_active FROM chairs WHERE id = ?", silent.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !isActive {
+		t.Fatal("silent chair was not reactivated by its next request")
+	}
+}
+
+func TestInactiveChairOnRideIsNotDeactivated(t *testing.T) {
+	cfg := testConfig()
+	cfg.ChairInactiveThreshold = time.Minute
+	ts := newTestServerWithConfig(t, cfg)
+	clock := useFakeClock(t)
+	f := ts.newRideFixture(t, "riding")
+
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	if got := ts.assignedChair(t, rideID); got != f.Chair.ID {
+		t.Fatalf("ride was assigned to %q, want %s", got, f.Chair.ID)
+	}
+
+	// ライド中の椅子は座標を送ってこなくても非アクティブにしない
+	clock.advance(cfg.ChairInactiveThreshold + time.Second)
+	ts.sweepInactiveChairs(context.Background())
+	var isActive bool
+	if err := ts.db.Get(&isActive, "SELECT is_active FROM chairs WHERE id = ?", f.Chair.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !isActive {
+		t.Fatal("chair on a ride was deactivated by the sweep")
+	}
+}
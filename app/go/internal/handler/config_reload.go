@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/internal/fare"
+)
+
+// runtimeConfig は再起動せずに SIGHUP で差し替えられる設定
+// リクエストは loadRuntimeConfig で取ったスナップショットを読むので、処理の途中で値が入れ替わらない
+type runtimeConfig struct {
+	// SlowQueryThreshold を超えたクエリはログに出す。0ならログには出さない
+	SlowQueryThreshold time.Duration
+	// SlowTxThreshold を超えてトランザクションを開いたままにしていたらログに出す。0ならログには出さない
+	SlowTxThreshold time.Duration
+	// ReferralChainDepth は招待者の招待者を何段上までたどってRewardを付与するか。0なら直接の招待者のみ
+	ReferralChainDepth int
+	// MaxTripDistance は配車位置から目的地までの距離の上限。0なら無制限
+	MaxTripDistance int
+	// RequireEvaluationBeforeRide が true なら、前のライドを評価するまで次のライドを作れない
+	RequireEvaluationBeforeRide bool
+	// CouponCampaigns は優先度の高い順に並んでいる
+	// どのキャンペーンのクーポンも使えなければ、付与された順番に使う
+	CouponCampaigns []couponCampaign
+	// FareRounding は運賃の丸め方
+	// 見積もり・ライド作成・履歴・決済・売上の全てで同じ丸めを使う
+	FareRounding fare.Rounding
+	// FareEstimateCacheTTL は同じ配車位置と目的地の見積もり運賃を使い回す時間。0ならキャッシュしない
+	FareEstimateCacheTTL time.Duration
+	// MaxUnusedCoupons は1人が持てる未使用のクーポンの数の上限。0なら無制限
+	MaxUnusedCoupons int
+}
+
+var currentRuntimeConfig atomic.Pointer[runtimeConfig]
+
+func init() {
+	currentRuntimeConfig.Store(&runtimeConfig{
+		SlowQueryThreshold:   100 * time.Millisecond,
+		SlowTxThreshold:      500 * time.Millisecond,
+		MaxTripDistance:      2000,
+		FareEstimateCacheTTL: time.Second,
+	})
+}
+
+func loadRuntimeConfig() *runtimeConfig {
+	return currentRuntimeConfig.Load()
+}
+
+func newRuntimeConfig(cfg Config) (*runtimeConfig, error) {
+	campaigns, err := parseCouponCampaigns(cfg.CouponCampaigns)
+	if err != nil {
+		return nil, err
+	}
+	return &runtimeConfig{
+		SlowQueryThreshold:          cfg.SlowQueryThreshold,
+		SlowTxThreshold:             cfg.SlowTxThreshold,
+		ReferralChainDepth:          cfg.ReferralChainDepth,
+		MaxTripDistance:             cfg.MaxTripDistance,
+		RequireEvaluationBeforeRide: cfg.RequireEvaluationBeforeRide,
+		CouponCampaigns:             campaigns,
+		FareRounding:                cfg.FareRounding,
+		FareEstimateCacheTTL:        cfg.FareEstimateCacheTTL,
+		MaxUnusedCoupons:            cfg.MaxUnusedCoupons,
+	}, nil
+}
+
+// reloadableConfigFields は再起動せずに反映できる Config のフィールド
+// それ以外のフィールドの変更は、接続やバックグラウンドの処理を作り直す必要があるので無視する
+var reloadableConfigFields = map[string]bool{
+	"MatchingFairnessWeight":      true,
+	"SlowQueryThreshold":          true,
+	"SlowTxThreshold":             true,
+	"ReferralChainDepth":          true,
+	"MaxTripDistance":             true,
+	"RequireEvaluationBeforeRide": true,
+	"CouponCampaigns":             true,
+	"FareRounding":                true,
+	"FareEstimateCacheTTL":        true,
+	"MaxUnusedCoupons":            true,
+}
+
+// startConfigReloader は SIGHUP を受けるたびに cfg.Reload で設定を読み直して反映する
+func startConfigReloader(cfg Config) {
+	if cfg.Reload == nil {
+		return
+	}
+	// 起動直後に届いた SIGHUP でプロセスが終了しないよう、goroutine を起こす前に受け取り始める
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		running := cfg
+		for range ch {
+			next, err := cfg.Reload()
+			if err != nil {
+				slog.Error("failed to reload config", "err", err)
+				continue
+			}
+			running, err = reloadConfig(running, next)
+			if err != nil {
+				slog.Error("failed to reload config", "err", err)
+			}
+		}
+	}()
+}
+
+// reloadConfig は next のうち再起動せずに変えられるフィールドを反映し、反映後の設定を返す
+// 失敗したときは何も反映せずに running を返す
+func reloadConfig(running, next Config) (Config, error) {
+	if err := next.validate(); err != nil {
+		return running, err
+	}
+	rc, err := newRuntimeConfig(next)
+	if err != nil {
+		return running, err
+	}
+
+	applied := running
+	changed, ignored := []string{}, []string{}
+	cur, nv, out := reflect.ValueOf(running), reflect.ValueOf(next), reflect.ValueOf(&applied).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		name := cur.Type().Field(i).Name
+		if cur.Field(i).Kind() == reflect.Func || reflect.DeepEqual(cur.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if !reloadableConfigFields[name] {
+			ignored = append(ignored, name)
+			continue
+		}
+		changed = append(changed, name)
+		out.Field(i).Set(nv.Field(i))
+	}
+
+	if applied.MatchingFairnessWeight != running.MatchingFairnessWeight {
+		params := *loadMatchingParams()
+		params.FairnessWeight = applied.MatchingFairnessWeight
+		if err := storeMatchingParams(params); err != nil {
+			return running, fmt.Errorf("failed to apply MatchingFairnessWeight: %w", err)
+		}
+	}
+	currentRuntimeConfig.Store(rc)
+
+	slog.Info("config reloaded", "changed", changed, "ignored_until_restart", ignored)
+	return applied, nil
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// restoreRuntimeConfig はテストで差し替えた設定とマッチングのパラメータをテストの終わりに元に戻す
+func restoreRuntimeConfig(t *testing.T) {
+	t.Helper()
+	rc, params := loadRuntimeConfig(), *loadMatchingParams()
+	t.Cleanup(func() {
+		currentRuntimeConfig.Store(rc)
+		if err := storeMatchingParams(params); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// waitRuntimeConfig は現在の設定が prev 以外のスナップショットに差し替わるまで待つ
+func waitRuntimeConfig(t *testing.T, prev *runtimeConfig) *runtimeConfig {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if rc := loadRuntimeConfig(); rc != prev {
+			return rc
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("runtime config was not swapped")
+	return nil
+}
+
+func TestSIGHUPSwapsRuntimeConfigSnapshot(t *testing.T) {
+	restoreRuntimeConfig(t)
+	running := DefaultConfig()
+
+	next := make(chan Config, 1)
+	running.Reload = func() (Config, error) {
+		select {
+		case cfg := <-next:
+			return cfg, nil
+		default:
+			return Config{}, errors.New("no config to reload")
+		}
+	}
+	startConfigReloader(running)
+
+	cfg := DefaultConfig()
+	cfg.SlowQueryThreshold = 3 * time.Second
+	cfg.MaxTripDistance = 42
+	next <- cfg
+	// 処理中のリクエストが持っているスナップショット
+	inFlight := loadRuntimeConfig()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	swapped := waitRuntimeConfig(t, inFlight)
+	if swapped.SlowQueryThreshold != 3*time.Second || swapped.MaxTripDistance != 42 {
+		t.Fatalf("reloaded config = %+v, want the new threshold and trip limit", swapped)
+	}
+	if inFlight.SlowQueryThreshold != running.SlowQueryThreshold || inFlight.MaxTripDistance != running.MaxTripDistance {
+		t.Fatalf("in-flight snapshot changed to %+v", inFlight)
+	}
+
+	// 読み直しに失敗したら今の設定のまま
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := loadRuntimeConfig(); got != swapped {
+		t.Fatalf("failed reload swapped the config to %+v", got)
+	}
+}
+
+func TestReloadConfigIgnoresFieldsThatNeedRestart(t *testing.T) {
+	restoreRuntimeConfig(t)
+	running := DefaultConfig()
+	next := running
+	next.MaxTripDistance = 42
+	next.MatchingFairnessWeight = 3
+	next.MatchingMaxConcurrency = running.MatchingMaxConcurrency + 1
+
+	applied, err := reloadConfig(running, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied.MaxTripDistance != 42 || loadRuntimeConfig().MaxTripDistance != 42 {
+		t.Fatalf("MaxTripDistance = %d (snapshot %d), want 42", applied.MaxTripDistance, loadRuntimeConfig().MaxTripDistance)
+	}
+	if applied.MatchingFairnessWeight != 3 || loadMatchingParams().FairnessWeight != 3 {
+		t.Fatalf("fairness weight = %v (params %v), want 3", applied.MatchingFairnessWeight, loadMatchingParams().FairnessWeight)
+	}
+	if applied.MatchingMaxConcurrency != running.MatchingMaxConcurrency {
+		t.Fatalf("MatchingMaxConcurrency = %d, want the running value until restart", applied.MatchingMaxConcurrency)
+	}
+
+	// 不正な設定は何も反映しない
+	before := loadRuntimeConfig()
+	invalid := applied
+	invalid.MaxTripDistance = 7
+	invalid.AccessLogGzipMinSize = -1
+	if got, err := reloadConfig(applied, invalid); err == nil || got.MaxTripDistance != 42 {
+		t.Fatalf("reloadConfig(invalid) = %d, %v, want an error and the running config", got.MaxTripDistance, err)
+	}
+	if loadRuntimeConfig() != before {
+		t.Fatal("invalid reload swapped the runtime config")
+	}
+}
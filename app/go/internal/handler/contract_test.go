@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// updateContracts を付けて実行すると testdata/contract の JSON を今のレスポンスの形で書き直す
+//
+//	go test ./internal/handler/ -run TestResponseContracts -update
+//
+// フィクスチャは openapi.yaml のレスポンスのスキーマに合わせてあるので、書き直したら仕様との差分も確かめること
+var updateContracts = flag.Bool("update", false, "rewrite testdata/contract fixtures")
+
+// contractTime は populate が time.Time に入れる時刻
+var contractTime = time.Date(2024, 11, 24, 16, 0, 0, 0, time.UTC)
+
+// populate は v の全てのフィールドを0以外の値で埋める
+// ポインタは確保し、スライスとマップは1要素入れるので、omitempty のフィールドもJSONに現れる
+func populate(v reflect.Value) {
+	if v.Type() == reflect.TypeOf(time.Time{}) {
+		v.Set(reflect.ValueOf(contractTime))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		populate(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				populate(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		populate(v.Index(0))
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		key := reflect.New(v.Type().Key()).Elem()
+		populate(key)
+		elem := reflect.New(v.Type().Elem()).Elem()
+		populate(elem)
+		v.SetMapIndex(key, elem)
+	case reflect.String:
+		v.SetString("string")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	}
+}
+
+// jsonFieldPaths はJSONに含まれる全てのフィールドを rides[].chair.name のようなパスで返す
+func jsonFieldPaths(v any, prefix string, paths []string) []string {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			paths = append(jsonFieldPaths(child, path, paths), path)
+		}
+	case []any:
+		for _, child := range v {
+			paths = jsonFieldPaths(child, prefix+"[]", paths)
+		}
+	}
+	return paths
+}
+
+// omitemptyPaths は型のうち omitempty が付いているフィールドを jsonFieldPaths と同じ形のパスで返す
+func omitemptyPaths(t reflect.Type, prefix string, paths []string) []string {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		if t.Kind() == reflect.Slice {
+			prefix += "[]"
+		}
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == reflect.TypeOf(time.Time{}) {
+		return paths
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		if slices.Contains(strings.Split(opts, ","), "omitempty") {
+			paths = append(paths, path)
+		}
+		paths = omitemptyPaths(f.Type, path, paths)
+	}
+	return paths
+}
+
+func fieldPathsOf(t *testing.T, data []byte) []string {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	paths := jsonFieldPaths(v, "", nil)
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// contractResponses はベンチマーカーが読むレスポンス。fixture は testdata/contract のファイル名
+var contractResponses = []struct {
+	fixture  string
+	response any
+	// optional は openapi.yaml で required になっておらず、値が無ければ省略してよいフィールド
+	optional []string
+}{
+	{fixture: "post_initialize.json", response: &postInitializeResponse{}},
+	{fixture: "app_post_users.json", response: &appPostUsersResponse{}},
+	{fixture: "app_get_rides.json", response: &getAppRidesResponse{}},
+	{fixture: "app_post_rides.json", response: &appPostRidesResponse{}},
+	{fixture: "app_post_rides_estimated_fare.json", response: &appPostRidesEstimatedFareResponse{}},
+	{fixture: "app_post_ride_evaluation.json", response: &appPostRideEvaluationResponse{}},
+	{fixture: "app_get_notification.json", response: &appGetNotificationResponse{}, optional: []string{"data.chair", "data.matching_hint"}},
+	{fixture: "app_get_nearby_chairs.json", response: &appGetNearbyChairsResponse{}},
+	{fixture: "owner_post_owners.json", response: &ownerPostOwnersResponse{}},
+	{fixture: "owner_get_sales.json", response: &ownerGetSalesResponse{}, optional: []string{"partial", "next_since"}},
+	{fixture: "owner_get_chairs.json", response: &ownerGetChairResponse{}, optional: []string{"chairs[].total_distance_updated_at", "chairs[].deleted_at"}},
+	{fixture: "chair_post_chairs.json", response: &chairPostChairsResponse{}},
+	{fixture: "chair_post_coordinate.json", response: &chairPostCoordinateResponse{}},
+	{fixture: "chair_get_notification.json", response: &chairGetNotificationResponse{}, optional: []string{"data.status_id"}},
+	{fixture: "chair_post_notification_ack.json", response: &chairPostNotificationAckResponse{}},
+	{fixture: "chair_get_rides.json", response: &chairGetRidesResponse{}},
+}
+
+func TestResponseContracts(t *testing.T) {
+	for _, c := range contractResponses {
+		t.Run(strings.TrimSuffix(c.fixture, ".json"), func(t *testing.T) {
+			v := reflect.ValueOf(c.response)
+			populated := reflect.New(v.Type().Elem())
+			populate(populated.Elem())
+			got, err := json.MarshalIndent(populated.Interface(), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			path := filepath.Join("testdata", "contract", c.fixture)
+			if *updateContracts {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotPaths, wantPaths := fieldPathsOf(t, got), fieldPathsOf(t, want)
+			for _, p := range gotPaths {
+				if !slices.Contains(wantPaths, p) {
+					t.Errorf("field %q is not in %s", p, c.fixture)
+				}
+			}
+			for _, p := range wantPaths {
+				if !slices.Contains(gotPaths, p) {
+					t.Errorf("field %q in %s is missing from the response", p, c.fixture)
+				}
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("response does not match %s (run with -update if the change is intended):\n%s", c.fixture, got)
+			}
+
+			// 必須のフィールドに omitempty が付いていると、値が無いときにフィールドごと消えてしまう
+			omitempty := omitemptyPaths(v.Type(), "", nil)
+			for _, p := range omitempty {
+				if !slices.Contains(c.optional, p) {
+					t.Errorf("required field %q has omitempty", p)
+				}
+			}
+			for _, p := range c.optional {
+				if !slices.Contains(omitempty, p) {
+					t.Errorf("optional field %q does not have omitempty", p)
+				}
+			}
+		})
+	}
+}
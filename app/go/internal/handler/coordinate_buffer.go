@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// coordinateBufferDropOldest は容量に達したら一番古い座標を捨てて新しい座標を受け付ける
+	// マッチングに使うのは最新の位置だけなので、履歴が欠けても配車は続けられる
+	coordinateBufferDropOldest = "drop_oldest"
+	// coordinateBufferReject は容量に達したら新しい座標を受け付けずに503を返す
+	coordinateBufferReject = "reject"
+	// coordinateFlushInterval ごとに溜まった座標を書き込む
+	coordinateFlushInterval = 100 * time.Millisecond
+	// coordinateFlushBatchSize は1回のINSERTで書き込む座標の数
+	coordinateFlushBatchSize = 500
+)
+
+var errCoordinateBufferFull = errors.New("coordinate buffer is full")
+
+// coordinateBuffer は chair_locations への書き込みを溜めておき、フラッシャーがまとめてINSERTする
+// MySQLが詰まってもメモリを使い切らないよう capacity を上限とし、満杯なら wait の間だけ空きを待ってから policy に従う
+type coordinateBuffer struct {
+	capacity int
+	policy   string
+	wait     time.Duration
+
+	mu     sync.Mutex
+	points []ChairLocation
+	// space は take で空きができたときに閉じ、空きを待っている add を起こす
+	space chan struct{}
+
+	// dropped は drop_oldest で捨てた座標、rejected は reject で受け付けなかった座標の数
+	dropped  atomic.Int64
+	rejected atomic.Int64
+}
+
+func newCoordinateBuffer(capacity int, policy string, wait time.Duration) *coordinateBuffer {
+	return &coordinateBuffer{
+		capacity: capacity,
+		policy:   policy,
+		wait:     wait,
+		space:    make(chan struct{}),
+	}
+}
+
+// add は loc を溜める。満杯なら wait まで待ち、reject のときは errCoordinateBufferFull を返す
+func (b *coordinateBuffer) add(ctx context.Context, loc ChairLocation) error {
+	timer := time.NewTimer(b.wait)
+	defer timer.Stop()
+	for waiting := true; waiting; {
+		b.mu.Lock()
+		if len(b.points) < b.capacity {
+			b.points = append(b.points, loc)
+			b.mu.Unlock()
+			return nil
+		}
+		space := b.space
+		b.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			waiting = false
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.points) < b.capacity {
+		b.points = append(b.points, loc)
+		return nil
+	}
+	if b.policy == coordinateBufferReject {
+		b.rejected.Add(1)
+		return errCoordinateBufferFull
+	}
+	b.points = append(b.points[1:], loc)
+	b.dropped.Add(1)
+	return nil
+}
+
+// take は古い方から最大 coordinateFlushBatchSize 件を取り出す
+func (b *coordinateBuffer) take() []ChairLocation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := min(len(b.points), coordinateFlushBatchSize)
+	if n == 0 {
+		return nil
+	}
+	batch := make([]ChairLocation, n)
+	copy(batch, b.points)
+	b.points = b.points[n:]
+	close(b.space)
+	b.space = make(chan struct{})
+	return batch
+}
+
+// requeue は書き込めなかった batch を先頭に戻す。その間に溜まった分と合わせて容量を超える古い座標は捨てる
+func (b *coordinateBuffer) requeue(batch []ChairLocation) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	points := append(batch, b.points...)
+	if over := len(points) - b.capacity; over > 0 {
+		points = points[over:]
+		b.dropped.Add(int64(over))
+	}
+	b.points = points
+}
+
+// size は溜まっている座標の数を返す
+func (b *coordinateBuffer) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.points)
+}
+
+// reset は溜まっている座標を書き込まずに捨てる。/api/initialize でDBを作り直すときに使う
+func (b *coordinateBuffer) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.points = nil
+	close(b.space)
+	b.space = make(chan struct{})
+}
+
+// startCoordinateFlusher は溜まった座標を定期的に chair_locations に書き込む
+func (s *server) startCoordinateFlusher() {
+	if s.coordinateBuffer == nil {
+		return
+	}
+	gate := s.registerWorker("coordinate_flusher")
+	go func() {
+		ticker := time.NewTicker(coordinateFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !gate.enter() {
+				continue
+			}
+			if err := s.flushCoordinates(context.Background()); err != nil {
+				slog.Error("failed to flush coordinates", "err", err)
+			}
+			gate.leave()
+		}
+	}()
+}
+
+// flushCoordinates は溜まっている座標を全て書き込む。失敗したバッチはバッファに戻して次の周期で書き直す
+func (s *server) flushCoordinates(ctx context.Context) error {
+	for {
+		batch := s.coordinateBuffer.take()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.insertChairLocations(ctx, batch); err != nil {
+			s.coordinateBuffer.requeue(batch)
+			return err
+		}
+	}
+}
+
+func (s *server) insertChairLocations(ctx context.Context, batch []ChairLocation) error {
+	args := make([]any, 0, len(batch)*5)
+	for _, loc := range batch {
+		args = append(args, loc.ID, loc.ChairID, loc.Latitude, loc.Longitude, loc.CreatedAt)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?), ", len(batch)), ", ")
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES "+placeholders, args...); err != nil {
+		return fmt.Errorf("failed to insert %d chair locations: %w", len(batch), err)
+	}
+	return nil
+}
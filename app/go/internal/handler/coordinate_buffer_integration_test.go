@@ -0,0 +1,96 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCoordinateBufferTestServer は容量 capacity の座標バッファを使う server を作る。フラッシャーは起動しない
+func newCoordinateBufferTestServer(t *testing.T, capacity int, policy string) *testServer {
+	t.Helper()
+	cfg := testConfig()
+	cfg.CoordinateBufferSize = capacity
+	cfg.CoordinateBufferPolicy = policy
+	cfg.CoordinateBufferWait = time.Millisecond
+	return newTestServerWithConfig(t, cfg)
+}
+
+func (ts *testServer) chairLocationLatitudes(t *testing.T, chairID string) []int {
+	t.Helper()
+	latitudes := []int{}
+	if err := ts.db.Select(&latitudes, "SELECT latitude FROM chair_locations WHERE chair_id = ? ORDER BY created_at", chairID); err != nil {
+		t.Fatal(err)
+	}
+	return latitudes
+}
+
+func (ts *testServer) chairLastLatitude(t *testing.T, chairID string) int {
+	t.Helper()
+	var latitude int
+	if err := ts.db.Get(&latitude, "SELECT last_latitude FROM chairs WHERE id = ?", chairID); err != nil {
+		t.Fatal(err)
+	}
+	return latitude
+}
+
+func TestCoordinateBufferDropsOldestWhileFlusherIsStalled(t *testing.T) {
+	ts := newCoordinateBufferTestServer(t, 2, coordinateBufferDropOldest)
+	// 登録時に testPickup を送るので、バッファには1件入っている
+	chair := ts.newRideFixture(t, "buffered").Chair
+
+	for _, latitude := range []int{1, 2, 3} {
+		ts.moveChair(t, chair, Coordinate{Latitude: latitude, Longitude: 0})
+	}
+	if got := ts.chairLocationLatitudes(t, chair.ID); len(got) != 0 {
+		t.Fatalf("chair_locations = %v before the flush, want nothing written yet", got)
+	}
+	// 履歴を捨てても椅子の最新の位置は更新されている
+	if got := ts.chairLastLatitude(t, chair.ID); got != 3 {
+		t.Fatalf("last_latitude = %d, want 3", got)
+	}
+
+	if err := ts.flushCoordinates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.chairLocationLatitudes(t, chair.ID); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatalf("chair_locations = %v, want the newest [2 3]", got)
+	}
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/metrics", nil, nil)
+	if !strings.Contains(rec.Body.String(), `isuride_coordinate_buffer_dropped_total{policy="drop_oldest"} 2`) {
+		t.Fatalf("metrics do not count the 2 dropped coordinates:\n%s", rec.Body.String())
+	}
+}
+
+func TestCoordinateBufferRejectsWhileFlusherIsStalled(t *testing.T) {
+	ts := newCoordinateBufferTestServer(t, 2, coordinateBufferReject)
+	f := ts.newRideFixture(t, "rejected")
+
+	ts.moveChair(t, f.Chair, Coordinate{Latitude: 1, Longitude: 0})
+	ts.mustDo(t, http.StatusServiceUnavailable, http.MethodPost, "/api/chair/coordinate", f.Chair.Cookie, Coordinate{Latitude: 2, Longitude: 0})
+	if got := ts.chairLastLatitude(t, f.Chair.ID); got != 2 {
+		t.Fatalf("last_latitude = %d, want the rejected coordinate still applied", got)
+	}
+
+	// 最新の位置でマッチングは続けられる
+	rideID := ts.requestRide(t, f.User, Coordinate{Latitude: 2, Longitude: 0}, testDestination)
+	ts.runMatching(t)
+	if got := ts.assignedChair(t, rideID); got != f.Chair.ID {
+		t.Fatalf("ride was assigned to %q, want %s", got, f.Chair.ID)
+	}
+
+	if err := ts.flushCoordinates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.chairLocationLatitudes(t, f.Chair.ID); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Fatalf("chair_locations = %v, want the accepted [0 1]", got)
+	}
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/metrics", nil, nil)
+	if !strings.Contains(rec.Body.String(), `isuride_coordinate_buffer_dropped_total{policy="reject"} 1`) {
+		t.Fatalf("metrics do not count the rejected coordinate:\n%s", rec.Body.String())
+	}
+}
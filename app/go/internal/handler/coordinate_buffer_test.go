@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const coordinateStressCapacity = 10
+
+func coordinateAt(id string) ChairLocation {
+	return ChairLocation{ID: id, ChairID: "chair", CreatedAt: time.Now()}
+}
+
+// フラッシャーが止まったまま stressGoroutines 個の書き込みが殺到しても、容量を超えて溜めない
+func TestCoordinateBufferOverflowWithPausedFlusher(t *testing.T) {
+	t.Run(coordinateBufferDropOldest, func(t *testing.T) {
+		b := newCoordinateBuffer(coordinateStressCapacity, coordinateBufferDropOldest, time.Millisecond)
+		hammer(func(g int) {
+			if err := b.add(context.Background(), coordinateAt(strconv.Itoa(g))); err != nil {
+				t.Error(err)
+			}
+		})
+		if got := b.size(); got != coordinateStressCapacity {
+			t.Fatalf("size = %d, want the capacity %d", got, coordinateStressCapacity)
+		}
+		if got := b.dropped.Load(); got != stressGoroutines-coordinateStressCapacity {
+			t.Fatalf("dropped = %d, want %d", got, stressGoroutines-coordinateStressCapacity)
+		}
+
+		// 捨てるのは古い方なので、最後に送った座標が残る
+		for i := 0; i < coordinateStressCapacity; i++ {
+			if err := b.add(context.Background(), coordinateAt("newest-"+strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, loc := range b.take() {
+			if want := "newest-" + strconv.Itoa(i); loc.ID != want {
+				t.Fatalf("buffered[%d] = %s, want %s", i, loc.ID, want)
+			}
+		}
+	})
+
+	t.Run(coordinateBufferReject, func(t *testing.T) {
+		b := newCoordinateBuffer(coordinateStressCapacity, coordinateBufferReject, time.Millisecond)
+		var rejected atomic.Int64
+		hammer(func(g int) {
+			err := b.add(context.Background(), coordinateAt(strconv.Itoa(g)))
+			if errors.Is(err, errCoordinateBufferFull) {
+				rejected.Add(1)
+			} else if err != nil {
+				t.Error(err)
+			}
+		})
+		if got := b.size(); got != coordinateStressCapacity {
+			t.Fatalf("size = %d, want the capacity %d", got, coordinateStressCapacity)
+		}
+		if got := rejected.Load(); got != stressGoroutines-coordinateStressCapacity || b.rejected.Load() != got {
+			t.Fatalf("rejected = %d (counted %d), want %d", got, b.rejected.Load(), stressGoroutines-coordinateStressCapacity)
+		}
+	})
+}
+
+func TestCoordinateBufferWaitsForFlusher(t *testing.T) {
+	b := newCoordinateBuffer(1, coordinateBufferReject, 5*time.Second)
+	if err := b.add(context.Background(), coordinateAt("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 満杯の間は待ち、フラッシャーが取り出したら空いたところに入る
+	done := make(chan error, 1)
+	go func() {
+		done <- b.add(context.Background(), coordinateAt("second"))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("add returned %v while the buffer was full", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if batch := b.take(); len(batch) != 1 || batch[0].ID != "first" {
+		t.Fatalf("took %+v, want the first coordinate", batch)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add kept waiting after the flusher made room")
+	}
+	if b.rejected.Load() != 0 || b.size() != 1 {
+		t.Fatalf("rejected = %d, size = %d, want the second coordinate buffered", b.rejected.Load(), b.size())
+	}
+
+	// 書き込めなかったバッチは先頭に戻し、容量を超える古い分は捨てる
+	b.requeue([]ChairLocation{coordinateAt("failed")})
+	if batch := b.take(); len(batch) != 1 || batch[0].ID != "second" || b.dropped.Load() != 1 {
+		t.Fatalf("took %+v with %d dropped, want only the newer coordinate", batch, b.dropped.Load())
+	}
+}
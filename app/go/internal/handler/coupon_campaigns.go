@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// キャンペーンのクーポンを使える条件
+const (
+	// campaignEligibleFirstRide は初回のライドでだけ優先して使う
+	campaignEligibleFirstRide = "first_ride"
+	// campaignEligibleAny はいつでも優先して使う
+	campaignEligibleAny = "any"
+)
+
+// couponCampaign は他のクーポンより優先して使うクーポンのコード
+type couponCampaign struct {
+	Code        string
+	Eligibility string
+}
+
+func (c couponCampaign) eligible(firstRide bool) bool {
+	return c.Eligibility == campaignEligibleAny || firstRide
+}
+
+// parseCouponCampaigns は "CP_NEW2024:first_ride,CP_SPRING:any" の形式を優先度の高い順に読む
+func parseCouponCampaigns(s string) ([]couponCampaign, error) {
+	campaigns := []couponCampaign{}
+	for _, entry := range strings.Split(s, ",") {
+		code, eligibility, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || code == "" {
+			return nil, fmt.Errorf("invalid campaign: %q", entry)
+		}
+		if eligibility != campaignEligibleFirstRide && eligibility != campaignEligibleAny {
+			return nil, fmt.Errorf("invalid campaign eligibility: %q", eligibility)
+		}
+		campaigns = append(campaigns, couponCampaign{Code: code, Eligibility: eligibility})
+	}
+	return campaigns, nil
+}
+
+// selectCoupon は次のライドに使うクーポンを選ぶ。使えるクーポンが無ければ nil を返す
+// forUpdate は実際にクーポンを使うときに指定する
+func selectCoupon(ctx context.Context, tx *sqlx.Tx, userID string, firstRide bool, forUpdate bool) (*Coupon, error) {
+	lock := ""
+	if forUpdate {
+		lock = " FOR UPDATE"
+	}
+
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at"+lock, userID); err != nil {
+		return nil, err
+	}
+	i := pickCoupon(coupons, firstRide)
+	if i < 0 {
+		return nil, nil
+	}
+	return &coupons[i], nil
+}
+
+// pickCoupon は付与された順に並んだ未使用のクーポンから、次のライドに使うものの添字を返す。使えるものが無ければ -1
+// 優先度の高いキャンペーンのクーポンから使い、どのキャンペーンのクーポンも使えなければ付与された順番に使う
+func pickCoupon(coupons []Coupon, firstRide bool) int {
+	for _, campaign := range loadRuntimeConfig().CouponCampaigns {
+		if !campaign.eligible(firstRide) {
+			continue
+		}
+		for i, coupon := range coupons {
+			if coupon.Code == campaign.Code {
+				return i
+			}
+		}
+	}
+	if len(coupons) == 0 {
+		return -1
+	}
+	return 0
+}
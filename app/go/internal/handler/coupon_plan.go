@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultCouponPlanRides = 5
+	maxCouponPlanRides     = 100
+)
+
+type couponPlanEntry struct {
+	// Ride はこれから作るライドの何件目か。1始まり
+	Ride     int    `json:"ride"`
+	Code     string `json:"code"`
+	Discount int64  `json:"discount"`
+}
+
+type internalGetCouponPlanResponse struct {
+	UserID string            `json:"user_id"`
+	Plan   []couponPlanEntry `json:"plan"`
+	// Remaining は計画したライドの後にも残る未使用のクーポンの数
+	Remaining int `json:"remaining"`
+}
+
+// planCoupons は今あるクーポンが次の rides 件のライドでどの順番に使われるかを、appPostRides と同じ選び方で求める
+// rideCount はこれまでに作ったライドの数で、初回のライドだけ使えるキャンペーンの判定に使う
+// クーポンを使わないライドは計画に含めない。残りのクーポンを返す
+func planCoupons(coupons []Coupon, rideCount int, rides int) ([]couponPlanEntry, []Coupon) {
+	remaining := append([]Coupon{}, coupons...)
+	plan := []couponPlanEntry{}
+	for n := 1; n <= rides; n++ {
+		i := pickCoupon(remaining, rideCount+n == 1)
+		if i < 0 {
+			break
+		}
+		plan = append(plan, couponPlanEntry{Ride: n, Code: remaining[i].Code, Discount: remaining[i].Discount})
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return plan, remaining
+}
+
+// internalGetCouponPlan はユーザーの今のクーポンが、次の rides 件(既定5件)のライドでどの順番に使われるかを返す
+// 「なぜこのクーポンが使われたか」を調べるためのもので、何も変更しない
+func (s *server) internalGetCouponPlan(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := r.PathValue("user_id")
+
+	rides := defaultCouponPlanRides
+	if v := r.URL.Query().Get("rides"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if parsed < 1 || parsed > maxCouponPlanRides {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("rides must be between 1 and %d", maxCouponPlanRides))
+			return
+		}
+		rides = parsed
+	}
+
+	var exists bool
+	if err := s.db.GetContext(ctx, &exists, `SELECT 1 FROM users WHERE id = ?`, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("user not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var rideCount int
+	if err := s.db.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ?`, userID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	coupons := []Coupon{}
+	if err := s.db.SelectContext(ctx, &coupons, `SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at`, userID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	plan, remaining := planCoupons(coupons, rideCount, rides)
+	writeJSON(w, http.StatusOK, &internalGetCouponPlanResponse{
+		UserID:    userID,
+		Plan:      plan,
+		Remaining: len(remaining),
+	})
+}
@@ -0,0 +1,88 @@
+//go:build integration
+
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// setCouponCampaigns はテストの間だけ CouponCampaigns を変える
+func setCouponCampaigns(t *testing.T, campaigns string) {
+	t.Helper()
+	parsed, err := parseCouponCampaigns(campaigns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := loadRuntimeConfig()
+	rc := *orig
+	rc.CouponCampaigns = parsed
+	currentRuntimeConfig.Store(&rc)
+	t.Cleanup(func() { currentRuntimeConfig.Store(orig) })
+}
+
+func TestCouponPlanMatchesActualConsumption(t *testing.T) {
+	ts := newTestServer(t)
+	setCouponCampaigns(t, "CP_NEW2024:first_ride")
+	f := ts.newRideFixture(t, "plan")
+
+	// 登録時の CP_NEW2024 より古いクーポンと新しいクーポンを持たせる
+	now := time.Now().UTC()
+	for _, c := range []struct {
+		code      string
+		discount  int
+		createdAt time.Time
+	}{
+		{code: "SUPPORT_OLD", discount: 500, createdAt: now.Add(-time.Hour)},
+		{code: "SUPPORT_NEW", discount: 700, createdAt: now.Add(time.Hour)},
+	} {
+		if _, err := ts.db.Exec("INSERT INTO coupons (user_id, code, discount, created_at) VALUES (?, ?, ?, ?)", f.User.ID, c.code, c.discount, c.createdAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const rides = 4
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, fmt.Sprintf("/api/internal/users/%s/coupon-plan?rides=%d", f.User.ID, rides), nil, nil)
+	res := decodeJSON[internalGetCouponPlanResponse](t, rec)
+	if res.Remaining != 0 {
+		t.Fatalf("remaining = %d, want every coupon planned", res.Remaining)
+	}
+	planned := make([]string, rides)
+	for _, entry := range res.Plan {
+		planned[entry.Ride-1] = entry.Code
+	}
+
+	// 計画を出しても何も使っていない
+	var unused int
+	if err := ts.db.Get(&unused, "SELECT COUNT(*) FROM coupons WHERE user_id = ? AND used_by IS NULL", f.User.ID); err != nil {
+		t.Fatal(err)
+	}
+	if unused != 3 {
+		t.Fatalf("unused coupons after planning = %d, want 3", unused)
+	}
+
+	// 実際にライドを作り、それぞれのライドで使われたクーポンを並べる
+	used := make([]string, rides)
+	for i := range used {
+		rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+		var code sql.NullString
+		if err := ts.db.Get(&code, "SELECT (SELECT code FROM coupons WHERE used_by = ?)", rideID); err != nil {
+			t.Fatal(err)
+		}
+		used[i] = code.String
+		ts.drainChairNotifications(t, f.Chair)
+		ts.drainAppNotifications(t, f.User)
+		ts.moveChair(t, f.Chair, testPickup)
+	}
+
+	if !slices.Equal(planned, used) {
+		t.Fatalf("planned %q, but rides used %q", planned, used)
+	}
+	if want := []string{"CP_NEW2024", "SUPPORT_OLD", "SUPPORT_NEW", ""}; !slices.Equal(used, want) {
+		t.Fatalf("rides used %q, want the first-ride campaign first and then the oldest coupons: %q", used, want)
+	}
+}
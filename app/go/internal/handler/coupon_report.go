@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+)
+
+type couponReportByType struct {
+	Type           string `db:"type" json:"type"`
+	Issued         int    `db:"issued" json:"issued"`
+	Used           int    `db:"used" json:"used"`
+	IssuedDiscount int64  `db:"issued_discount" json:"issued_discount"`
+	UsedDiscount   int64  `db:"used_discount" json:"used_discount"`
+}
+
+type couponLeak struct {
+	UserID   string `db:"user_id" json:"user_id"`
+	Code     string `db:"code" json:"code"`
+	Discount int64  `db:"discount" json:"discount"`
+	UsedBy   string `db:"used_by" json:"used_by"`
+}
+
+// couponLeaks は使用済みだが、その割引が売上として確定していない可能性のあるクーポン
+type couponLeaks struct {
+	// OnIncompleteRides はCOMPLETEDになっていないライドに紐づいているクーポン
+	OnIncompleteRides []couponLeak `json:"on_incomplete_rides"`
+	// OnMissingRides は存在しないライドに紐づいているクーポン
+	OnMissingRides []couponLeak `json:"on_missing_rides"`
+}
+
+// findCouponLeaks はクーポンのレポートと不変条件のチェックの両方で使う
+func (s *server) findCouponLeaks(ctx context.Context) (couponLeaks, error) {
+	leaks := couponLeaks{
+		OnIncompleteRides: []couponLeak{},
+		OnMissingRides:    []couponLeak{},
+	}
+	if err := s.db.SelectContext(ctx, &leaks.OnIncompleteRides, `
+		SELECT c.user_id, c.code, c.discount, c.used_by FROM coupons c
+		INNER JOIN rides r ON r.id = c.used_by
+		WHERE NOT EXISTS (
+			SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status = 'COMPLETED'
+		)`); err != nil {
+		return leaks, err
+	}
+	if err := s.db.SelectContext(ctx, &leaks.OnMissingRides, `
+		SELECT c.user_id, c.code, c.discount, c.used_by FROM coupons c
+		LEFT JOIN rides r ON r.id = c.used_by
+		WHERE c.used_by IS NOT NULL AND r.id IS NULL`); err != nil {
+		return leaks, err
+	}
+	return leaks, nil
+}
+
+type internalGetCouponReportResponse struct {
+	ByType []couponReportByType `json:"by_type"`
+	Issued int                  `json:"issued"`
+	Used   int                  `json:"used"`
+	// DiscountGranted は使用済みクーポンの割引額の合計
+	DiscountGranted        int64 `json:"discount_granted"`
+	IncompleteRideCoupons  int   `json:"incomplete_ride_coupons"`
+	IncompleteRideDiscount int64 `json:"incomplete_ride_discount"`
+	MissingRideCoupons     int   `json:"missing_ride_coupons"`
+	MissingRideDiscount    int64 `json:"missing_ride_discount"`
+}
+
+// internalGetCouponReport はクーポンの発行・使用状況と、割引が漏れている可能性のあるクーポンを集計する
+func (s *server) internalGetCouponReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	res := internalGetCouponReportResponse{ByType: []couponReportByType{}}
+	if err := s.db.SelectContext(ctx, &res.ByType, `
+		SELECT
+			CASE
+				WHEN code LIKE 'CP\\_%' THEN 'CP'
+				WHEN code LIKE 'INV\\_%' THEN 'INV'
+				WHEN code LIKE 'RWD\\_%' THEN 'RWD'
+				ELSE 'OTHER'
+			END AS type,
+			COUNT(*) AS issued,
+			COUNT(used_by) AS used,
+			IFNULL(SUM(discount), 0) AS issued_discount,
+			IFNULL(SUM(IF(used_by IS NULL, 0, discount)), 0) AS used_discount
+		FROM coupons
+		GROUP BY type
+		ORDER BY type`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, t := range res.ByType {
+		res.Issued += t.Issued
+		res.Used += t.Used
+		res.DiscountGranted += t.UsedDiscount
+	}
+
+	leaks, err := s.findCouponLeaks(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res.IncompleteRideCoupons = len(leaks.OnIncompleteRides)
+	for _, c := range leaks.OnIncompleteRides {
+		res.IncompleteRideDiscount += c.Discount
+	}
+	res.MissingRideCoupons = len(leaks.OnMissingRides)
+	for _, c := range leaks.OnMissingRides {
+		res.MissingRideDiscount += c.Discount
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
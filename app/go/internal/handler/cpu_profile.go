@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCPUProfileSeconds = 30
+	maxCPUProfileSeconds     = 300
+)
+
+// cpuProfile は実行中のCPUプロファイル。同時に取れるのは1つだけ
+var cpuProfile struct {
+	sync.Mutex
+	file  *os.File
+	timer *time.Timer
+}
+
+type internalCPUProfileResponse struct {
+	Path string `json:"path"`
+}
+
+// internalPostProfileStart は seconds 秒間(既定30秒)のCPUプロファイルをファイルに取り始め、そのパスを返す
+// 外部から pprof を取りに来るのを待たずに、ベンチマークの特定の区間を取るためのもの
+func (s *server) internalPostProfileStart(w http.ResponseWriter, r *http.Request) {
+	seconds := defaultCPUProfileSeconds
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if parsed < 1 || parsed > maxCPUProfileSeconds {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("seconds must be between 1 and %d", maxCPUProfileSeconds))
+			return
+		}
+		seconds = parsed
+	}
+
+	cpuProfile.Lock()
+	defer cpuProfile.Unlock()
+	if cpuProfile.file != nil {
+		writeError(w, http.StatusConflict, errors.New("profile is already running"))
+		return
+	}
+
+	f, err := os.CreateTemp("", "isuride-cpu-*.pprof")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	cpuProfile.file = f
+	cpuProfile.timer = time.AfterFunc(time.Duration(seconds)*time.Second, func() {
+		cpuProfile.Lock()
+		defer cpuProfile.Unlock()
+		// 先に stop された場合は何もしない
+		if cpuProfile.file == f {
+			stopCPUProfile()
+		}
+	})
+
+	writeJSON(w, http.StatusOK, &internalCPUProfileResponse{Path: f.Name()})
+}
+
+// internalPostProfileStop は実行中のCPUプロファイルを期限より前に止め、そのパスを返す
+func (s *server) internalPostProfileStop(w http.ResponseWriter, r *http.Request) {
+	cpuProfile.Lock()
+	defer cpuProfile.Unlock()
+	if cpuProfile.file == nil {
+		writeError(w, http.StatusConflict, errors.New("profile is not running"))
+		return
+	}
+	cpuProfile.timer.Stop()
+	path := stopCPUProfile()
+
+	writeJSON(w, http.StatusOK, &internalCPUProfileResponse{Path: path})
+}
+
+// stopCPUProfile はプロファイルを書き終えてファイルを閉じる。cpuProfile のロックを取ってから呼ぶ
+func stopCPUProfile() string {
+	pprof.StopCPUProfile()
+	path := cpuProfile.file.Name()
+	if err := cpuProfile.file.Close(); err != nil {
+		slog.Error("failed to close cpu profile", "path", path, "err", err)
+	}
+	cpuProfile.file = nil
+	cpuProfile.timer = nil
+	return path
+}
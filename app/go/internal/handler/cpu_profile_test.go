@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func postProfile(t *testing.T, handler http.HandlerFunc, path string, wantCode int) internalCPUProfileResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, path, nil))
+	if rec.Code != wantCode {
+		t.Fatalf("POST %s = %d, want %d: %s", path, rec.Code, wantCode, rec.Body.String())
+	}
+	var res internalCPUProfileResponse
+	if wantCode == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res
+}
+
+func TestCPUProfileStartAndStop(t *testing.T) {
+	s := &server{}
+	postProfile(t, s.internalPostProfileStart, "/api/internal/profile/start?seconds=0", http.StatusBadRequest)
+	postProfile(t, s.internalPostProfileStop, "/api/internal/profile/stop", http.StatusConflict)
+
+	started := postProfile(t, s.internalPostProfileStart, "/api/internal/profile/start?seconds=60", http.StatusOK)
+	t.Cleanup(func() { os.Remove(started.Path) })
+	postProfile(t, s.internalPostProfileStart, "/api/internal/profile/start", http.StatusConflict)
+
+	// 期限より前に止めても書き終えたプロファイルが残る
+	stopped := postProfile(t, s.internalPostProfileStop, "/api/internal/profile/stop", http.StatusOK)
+	if stopped.Path != started.Path {
+		t.Fatalf("stopped %s, want the started profile %s", stopped.Path, started.Path)
+	}
+	info, err := os.Stat(stopped.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 {
+		t.Fatalf("profile %s is empty", stopped.Path)
+	}
+
+	// 期限が来れば stop を呼ばなくても止まる
+	expiring := postProfile(t, s.internalPostProfileStart, "/api/internal/profile/start?seconds=1", http.StatusOK)
+	t.Cleanup(func() { os.Remove(expiring.Path) })
+	time.Sleep(1500 * time.Millisecond)
+	postProfile(t, s.internalPostProfileStop, "/api/internal/profile/stop", http.StatusConflict)
+}
@@ -0,0 +1,102 @@
+//go:build integration
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// mustLookMissing は他人のリソースへのリクエストが、存在しないリソースへのリクエストと同じ404になることを確かめる
+func (ts *testServer) mustLookMissing(t *testing.T, method, foreignPath, missingPath string, cookie *http.Cookie, body any) {
+	t.Helper()
+	foreign := ts.mustDo(t, http.StatusNotFound, method, foreignPath, cookie, body)
+	missing := ts.mustDo(t, http.StatusNotFound, method, missingPath, cookie, body)
+	if foreign.Body.String() != missing.Body.String() {
+		t.Fatalf("%s %s: body = %s, want the same as for a missing resource: %s", method, foreignPath, foreign.Body.String(), missing.Body.String())
+	}
+}
+
+func TestForeignResourcesLookMissing(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "victim")
+	other := ts.newRideFixture(t, "intruder")
+	const missingID = "01JDFEDF00000000000000MISS"
+
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.driveToArrival(t, f.Chair, rideID, testPickup, testDestination)
+
+	// 他のユーザーのライドは評価できない
+	evaluation := appPostRideEvaluationRequest{Evaluation: 1}
+	ts.mustLookMissing(t, http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", "/api/app/rides/"+missingID+"/evaluation", other.User.Cookie, evaluation)
+	if got := ts.latestStatus(t, rideID); got != RideStatusArrived {
+		t.Fatalf("status = %q after the foreign evaluation, want ARRIVED", got)
+	}
+
+	// 他の椅子に割り当てられたライドのステータスは変えられない
+	status := postChairRidesRideIDStatusRequest{Status: string(RideStatusCompleted)}
+	ts.mustLookMissing(t, http.MethodPost, "/api/chair/rides/"+rideID+"/status", "/api/chair/rides/"+missingID+"/status", other.Chair.Cookie, status)
+
+	// 他のオーナーの椅子は変更も削除もできない
+	maintenance := true
+	ts.mustLookMissing(t, http.MethodPut, "/api/owner/chairs/"+f.Chair.ID, "/api/owner/chairs/"+missingID, other.Owner.Cookie, ownerPutChairRequest{Maintenance: &maintenance})
+	ts.mustLookMissing(t, http.MethodDelete, "/api/owner/chairs/"+f.Chair.ID, "/api/owner/chairs/"+missingID, other.Owner.Cookie, nil)
+
+	// 持ち主は変わらず操作できる
+	ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 5})
+	if got := ts.latestStatus(t, rideID); got != RideStatusCompleted {
+		t.Fatalf("status = %q after the owner's evaluation, want COMPLETED", got)
+	}
+}
+
+func TestEveryScopedEndpointTreatsForeignIDsAsMissing(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "tenant")
+	other := ts.newRideFixture(t, "neighbor")
+	const missingID = "01JDFEDF00000000000000MISS"
+
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	if got := ts.assignedChair(t, rideID); got != f.Chair.ID {
+		t.Fatalf("ride %s was assigned to %q, want %s", rideID, got, f.Chair.ID)
+	}
+	rec := ts.mustDo(t, http.StatusCreated, http.MethodPost, "/api/app/routes", f.User.Cookie, appPostRoutesRequest{
+		Name:                  "home",
+		PickupCoordinate:      &Coordinate{Latitude: testPickup.Latitude, Longitude: testPickup.Longitude},
+		DestinationCoordinate: &Coordinate{Latitude: testDestination.Latitude, Longitude: testDestination.Longitude},
+	})
+	routeID := decodeJSON[appPostRoutesResponse](t, rec).ID
+	rec = ts.mustDo(t, http.StatusCreated, http.MethodPost, "/api/owner/api-keys", f.Owner.Cookie, nil)
+	keyID := decodeJSON[ownerPostAPIKeysResponse](t, rec).ID
+
+	maintenance := true
+
+	// {chair_id}・{ride_id} などを取る、テナントごとのエンドポイントを全て並べる
+	endpoints := []struct {
+		method  string
+		path    string
+		foreign string
+		cookie  *http.Cookie
+		body    any
+	}{
+		{http.MethodGet, "/api/app/routes/%s/estimate", routeID, other.User.Cookie, nil},
+		{http.MethodPost, "/api/app/rides/%s/evaluation", rideID, other.User.Cookie, appPostRideEvaluationRequest{Evaluation: 1}},
+		{http.MethodGet, "/api/app/rides/%s/chair-position", rideID, other.User.Cookie, nil},
+		{http.MethodPut, "/api/owner/chairs/%s", f.Chair.ID, other.Owner.Cookie, ownerPutChairRequest{Maintenance: &maintenance}},
+		{http.MethodDelete, "/api/owner/chairs/%s", f.Chair.ID, other.Owner.Cookie, nil},
+		{http.MethodDelete, "/api/owner/api-keys/%s", keyID, other.Owner.Cookie, nil},
+		{http.MethodPost, "/api/chair/rides/%s/status", rideID, other.Chair.Cookie, postChairRidesRideIDStatusRequest{Status: string(RideStatusEnroute)}},
+	}
+	for _, e := range endpoints {
+		ts.mustLookMissing(t, e.method, fmt.Sprintf(e.path, e.foreign), fmt.Sprintf(e.path, missingID), e.cookie, e.body)
+	}
+
+	// どのリクエストも持ち主のリソースを変えていない
+	if got := ts.latestStatus(t, rideID); got != RideStatusMatching {
+		t.Fatalf("status = %q after the foreign requests, want MATCHING", got)
+	}
+	ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/routes/"+routeID+"/estimate", f.User.Cookie, nil)
+	ts.mustDo(t, http.StatusNoContent, http.MethodDelete, "/api/owner/api-keys/"+keyID, f.Owner.Cookie, nil)
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusEnroute)
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultFareAuditLimit = 1000
+	maxFareAuditLimit     = 10000
+)
+
+type fareAuditMismatch struct {
+	RideID     string `json:"ride_id"`
+	Charged    int64  `json:"charged"`
+	Recomputed int64  `json:"recomputed"`
+}
+
+type internalGetFareAuditResponse struct {
+	Checked    int `json:"checked"`
+	Mismatched int `json:"mismatched"`
+	// TotalDrift は再計算した運賃から請求済みの運賃を引いた額の合計
+	TotalDrift int64               `json:"total_drift"`
+	Mismatches []fareAuditMismatch `json:"mismatches"`
+}
+
+// internalGetFareAudit は完了時に請求した運賃を今の計算で求め直し、食い違うライドを返す
+// 運賃の計算を変えたときに、過去のライドの売上や履歴の表示が変わっていないことを確かめる
+// charged_fare を記録するようになる前に完了したライドは対象にならない
+func (s *server) internalGetFareAudit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	limit := defaultFareAuditLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		parsed, err := strconv.Atoi(s)
+		if err != nil || parsed < 1 || parsed > maxFareAuditLimit {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 10000"))
+			return
+		}
+		limit = parsed
+	}
+
+	rides := []rideWithDiscount{}
+	if err := s.db.SelectContext(ctx, &rides, `
+		SELECT rides.*, IFNULL(coupons.discount, 0) AS discount FROM rides
+		LEFT JOIN coupons ON coupons.used_by = rides.id
+		WHERE rides.charged_fare IS NOT NULL
+		ORDER BY rides.updated_at DESC
+		LIMIT ?`, limit); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := internalGetFareAuditResponse{
+		Checked:    len(rides),
+		Mismatches: []fareAuditMismatch{},
+	}
+	for _, ride := range rides {
+		recomputed := applyDiscount(ride.Ride, ride.Discount)
+		if recomputed == *ride.ChargedFare {
+			continue
+		}
+		res.Mismatched++
+		res.TotalDrift += recomputed - *ride.ChargedFare
+		res.Mismatches = append(res.Mismatches, fareAuditMismatch{
+			RideID:     ride.ID,
+			Charged:    *ride.ChargedFare,
+			Recomputed: recomputed,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 運賃に影響するイベントの種類
+// 行き先変更やサージ料金はまだ実装されていないが、記録する側の名前だけ先に決めておく
+const (
+	fareEventCreated            = "created"
+	fareEventDestinationChanged = "destination_changed"
+	fareEventSurgeApplied       = "surge_applied"
+	fareEventCouponApplied      = "coupon_applied"
+	fareEventCompleted          = "completed"
+)
+
+// recordFareEvent はライドの運賃が変わったときに、変わった後の運賃と理由を記録する
+func recordFareEvent(ctx context.Context, tx *sqlx.Tx, rideID, event string, fare int64, detail *string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO fare_events (id, ride_id, event, fare, detail, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		newID(), rideID, event, fare, detail, clockNow().UTC().Truncate(time.Microsecond),
+	)
+	return err
+}
+
+type internalGetRideFareEventsResponse struct {
+	RideID string                     `json:"ride_id"`
+	Events []internalGetRideFareEvent `json:"events"`
+}
+
+type internalGetRideFareEvent struct {
+	ID        string  `json:"id"`
+	Event     string  `json:"event"`
+	Fare      int64   `json:"fare"`
+	Detail    *string `json:"detail"`
+	CreatedAt int64   `json:"created_at"`
+}
+
+// internalGetRideFareEvents はライドの運賃がどう決まったかを時系列で返す
+func (s *server) internalGetRideFareEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	var exists bool
+	if err := s.db.GetContext(ctx, &exists, `SELECT 1 FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	events := []FareEvent{}
+	if err := s.db.SelectContext(ctx, &events, `SELECT * FROM fare_events WHERE ride_id = ? ORDER BY created_at, id`, rideID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := internalGetRideFareEventsResponse{
+		RideID: rideID,
+		Events: make([]internalGetRideFareEvent, 0, len(events)),
+	}
+	for _, e := range events {
+		res.Events = append(res.Events, internalGetRideFareEvent{
+			ID:        e.ID,
+			Event:     e.Event,
+			Fare:      e.Fare,
+			Detail:    e.Detail,
+			CreatedAt: e.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
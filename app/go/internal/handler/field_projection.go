@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// fieldSelection は ?fields= で指定された、レスポンスに残すフィールドの木
+// 子を持たないノードはそのフィールドを丸ごと残す
+type fieldSelection map[string]fieldSelection
+
+// parseFields は ?fields=id,fare,chair.name のような指定を読み、t のJSONのフィールド名と照らし合わせる
+// 配列の要素には同じ指定を適用する。指定が無ければ nil を返す
+func parseFields(r *http.Request, t reflect.Type) (fieldSelection, error) {
+	v := r.URL.Query().Get("fields")
+	if v == "" {
+		return nil, nil
+	}
+	selection := fieldSelection{}
+	for _, path := range strings.Split(v, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		node := selection
+		cur := t
+		for _, name := range strings.Split(path, ".") {
+			field, ok := jsonField(cur, name)
+			if !ok {
+				return nil, fmt.Errorf("unknown field: %s", path)
+			}
+			cur = field
+			if node[name] == nil {
+				node[name] = fieldSelection{}
+			}
+			node = node[name]
+		}
+	}
+	if len(selection) == 0 {
+		return nil, nil
+	}
+	return selection, nil
+}
+
+// jsonField は構造体 t(配列やポインタならその要素)のJSONでの名前が name のフィールドの型を返す
+func jsonField(t reflect.Type, name string) (reflect.Type, bool) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		if tag == name {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
+
+// project は v をJSONにしたものから selection のフィールドだけを残した値を返す
+// omitempty で省略されたフィールドは指定されていても出さない
+func (selection fieldSelection) project(v any) (any, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var decoded any
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		return nil, err
+	}
+	return selection.apply(decoded), nil
+}
+
+func (selection fieldSelection) apply(v any) any {
+	if len(selection) == 0 {
+		return v
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		projected := make(map[string]any, len(selection))
+		for name, child := range selection {
+			if value, ok := v[name]; ok {
+				projected[name] = child.apply(value)
+			}
+		}
+		return projected
+	case []any:
+		for i := range v {
+			v[i] = selection.apply(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	// inQueryCacheMaxArgs より多い引数の展開はキャッシュせずに毎回組み立てる
+	inQueryCacheMaxArgs = 1024
+	// inQueryWarmArgs 個までの展開は起動時に作っておく
+	inQueryWarmArgs = 64
+)
+
+// よく使う IN 句のクエリ。展開した結果を inQueries にキャッシュする
+const (
+	latestRideStatusesQuery = `
+		SELECT rs.ride_id, rs.status FROM ride_statuses rs
+		INNER JOIN (
+			SELECT ride_id, MAX(created_at) as max_created
+			FROM ride_statuses
+			WHERE ride_id IN (?)
+			GROUP BY ride_id
+		) t ON rs.ride_id = t.ride_id AND rs.created_at = t.max_created
+	`
+	latestChairLocationsQuery = `
+		SELECT cl.*
+		FROM chair_locations cl
+		INNER JOIN (
+			SELECT chair_id, MAX(created_at) AS max_created
+			FROM chair_locations
+			WHERE chair_id IN (?)
+			GROUP BY chair_id
+		) t ON cl.chair_id = t.chair_id AND cl.created_at = t.max_created
+	`
+	ridePickupsQuery = `SELECT ride_id, created_at FROM ride_statuses WHERE ride_id IN (?) AND status = 'PICKUP'`
+)
+
+type inQueryKey struct {
+	query string
+	n     int
+}
+
+// inQueries は IN (?) を n 個のプレースホルダに展開したクエリ文字列のキャッシュ
+// InterpolateParams を使っているのでサーバー側のプリペアドステートメントにはならないが、
+// sqlx.In がリクエストのたびにクエリを組み立て直すアロケーションを省ける
+var inQueries sync.Map
+
+// expandIn は query 中の唯一の IN (?) を ids の数だけのプレースホルダに展開し、引数と一緒に返す
+// sqlx.In と同じ結果になるが、展開したクエリ文字列をキャッシュする。ids は1件以上であること
+func expandIn(query string, ids []string) (string, []any) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	if len(ids) > inQueryCacheMaxArgs {
+		return buildInQuery(query, len(ids)), args
+	}
+	key := inQueryKey{query: query, n: len(ids)}
+	if q, ok := inQueries.Load(key); ok {
+		return q.(string), args
+	}
+	q := buildInQuery(query, len(ids))
+	inQueries.Store(key, q)
+	return q, args
+}
+
+func buildInQuery(query string, n int) string {
+	placeholders := strings.Repeat("?, ", n)
+	placeholders = placeholders[:len(placeholders)-2]
+	return strings.Replace(query, "IN (?)", "IN ("+placeholders+")", 1)
+}
+
+// warmInQueries はよく使うクエリを引数 maxArgs 個まで展開しておく
+// 負荷試験の開始直後にキャッシュが空のせいでアロケーションが集中しないよう、初期化時に呼ぶ
+func warmInQueries(maxArgs int) {
+	maxArgs = min(maxArgs, inQueryCacheMaxArgs)
+	for _, query := range []string{latestRideStatusesQuery, latestChairLocationsQuery, ridePickupsQuery} {
+		for n := 1; n <= maxArgs; n++ {
+			inQueries.Store(inQueryKey{query: query, n: n}, buildInQuery(query, n))
+		}
+	}
+}
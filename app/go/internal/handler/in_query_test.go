@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func inQueryIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("ride-%04d", i)
+	}
+	return ids
+}
+
+func TestExpandInMatchesSqlxIn(t *testing.T) {
+	warmInQueries(inQueryWarmArgs)
+	// キャッシュ済み、起動後に初めて使う数、キャッシュしない数のどれでも sqlx.In と同じになること
+	for _, n := range []int{1, inQueryWarmArgs, inQueryWarmArgs + 1, inQueryCacheMaxArgs + 1} {
+		ids := inQueryIDs(n)
+		wantQuery, wantArgs, err := sqlx.In(latestRideStatusesQuery, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			query, args := expandIn(latestRideStatusesQuery, ids)
+			if query != wantQuery || !reflect.DeepEqual(args, wantArgs) {
+				t.Fatalf("expandIn with %d ids (call %d) differs from sqlx.In", n, i+1)
+			}
+		}
+	}
+}
+
+// BenchmarkInQueryExpansion はリクエストごとの IN 句の展開を sqlx.In とキャッシュで比べる
+//
+//	go test -run '^$' -bench InQueryExpansion -benchmem ./internal/handler/
+func BenchmarkInQueryExpansion(b *testing.B) {
+	warmInQueries(inQueryWarmArgs)
+	for _, n := range []int{1, 10, inQueryWarmArgs} {
+		ids := inQueryIDs(n)
+		b.Run(fmt.Sprintf("sqlx.In/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := sqlx.In(latestRideStatusesQuery, ids); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("cached/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				expandIn(latestRideStatusesQuery, ids)
+			}
+		})
+	}
+}
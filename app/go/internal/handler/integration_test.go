@@ -0,0 +1,517 @@
+//go:build integration
+
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// 統合テストはMySQLに接続し、HTTPのハンドラを通して実行する
+//
+//	go test -tags integration ./internal/handler/
+//
+// 接続先はアプリと同じ ISUCON_DB_* の環境変数で指定する。データベースは ISUCON_TEST_DB_NAME(既定は isuride_test)を使い、
+// テストごとに app/sql のスキーマを流し直すので、本番のデータベースを指定しないこと
+
+// testServer はテスト用のDBに接続した server と、そのルーティング済みのハンドラ
+type testServer struct {
+	*server
+	handler http.Handler
+	queries *queryLog
+	cfg     Config
+	// payments は決済サービスが受け付けた支払いの回数
+	payments *atomic.Int64
+	// lastPayment は決済サービスが最後に受け付けた支払いの金額
+	lastPayment *atomic.Int64
+}
+
+// newTestServer はスキーマを流し直したDBに接続した server を testConfig の設定で作る。バックグラウンドの処理は起動しない
+func newTestServer(t testing.TB) *testServer {
+	t.Helper()
+	return newTestServerWithConfig(t, testConfig())
+}
+
+// newTestServerWithConfig は cfg で newTestServer と同じように server を作る。cfg は testConfig を元に変えること
+func newTestServerWithConfig(t testing.TB, cfg Config) *testServer {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	ts := openTestServer(t, cfg)
+	loadTestSchema(t, ts.db)
+
+	ts.payments = &atomic.Int64{}
+	ts.lastPayment = &atomic.Int64{}
+	payments := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte("[]"))
+			return
+		}
+		var req paymentGatewayPostPaymentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ts.lastPayment.Store(req.Amount)
+		ts.payments.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(payments.Close)
+	setPaymentGatewayURL(payments.URL)
+	t.Cleanup(func() { setPaymentGatewayURL("") })
+	if _, err := ts.db.Exec("UPDATE settings SET value = ? WHERE name = 'payment_gateway_url'", payments.URL); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// peer は同じDBを共有するもう1台のインスタンスを作る
+func (ts *testServer) peer(t testing.TB) *testServer {
+	t.Helper()
+	return openTestServer(t, ts.cfg)
+}
+
+func openTestServer(t testing.TB, cfg Config) *testServer {
+	t.Helper()
+	connector, err := mysql.NewConnector(cfg.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := &queryLog{}
+	db := sqlx.NewDb(sql.OpenDB(countingConnector{Connector: connector, log: queries}), "mysql")
+	t.Cleanup(func() { db.Close() })
+
+	s := newServer(db, cfg)
+	return &testServer{server: s, handler: s.routes(nil), queries: queries, cfg: cfg}
+}
+
+// testConfig は統合テストの既定の設定を返す
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.DB = testDBConfig()
+	cfg.PriceLockSecret = "integration-test"
+	return cfg
+}
+
+func testDBConfig() *mysql.Config {
+	cfg := mysql.NewConfig()
+	cfg.User = getenv("ISUCON_DB_USER", "isucon")
+	cfg.Passwd = getenv("ISUCON_DB_PASSWORD", "isucon")
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(getenv("ISUCON_DB_HOST", "127.0.0.1"), getenv("ISUCON_DB_PORT", "3306"))
+	cfg.DBName = getenv("ISUCON_TEST_DB_NAME", "isuride_test")
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	cfg.Params = map[string]string{"time_zone": "'+00:00'"}
+	cfg.InterpolateParams = true
+	return cfg
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// loadTestSchema は init.sh と同じ順にスキーマとマスタデータを流す。初期データ(3-initial-data.sql.gz)は入れない
+func loadTestSchema(t testing.TB, db *sqlx.DB) {
+	t.Helper()
+	if err := execTestSchema(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// execTestSchema は loadTestSchema と同じスキーマを流し、失敗したらエラーを返す。テストの goroutine 以外から使う
+func execTestSchema(db *sqlx.DB) error {
+	for _, name := range []string{"1-schema.sql", "2-master-data.sql", "4-insert-chair-models.sql"} {
+		buf, err := os.ReadFile(filepath.Join("..", "..", "..", "sql", name))
+		if err != nil {
+			return err
+		}
+		for _, stmt := range splitSQLStatements(string(buf)) {
+			// テスト用のデータベースに流すので USE は飛ばす
+			if strings.HasPrefix(strings.ToUpper(stmt), "USE ") {
+				continue
+			}
+			if _, err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to load %s: %w\n%s", name, err, stmt)
+			}
+		}
+	}
+	return nil
+}
+
+// splitSQLStatements は行末の ; で文を区切る。スキーマのファイルは文字列の中で行末に ; を置いていない
+func splitSQLStatements(s string) []string {
+	stmts := []string{}
+	var cur strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		cur.WriteString(line)
+		cur.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(cur.String()), ";"))
+			cur.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(cur.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
+
+// queryLog はテスト中に発行したクエリを記録する
+type queryLog struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (l *queryLog) add(query string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = append(l.queries, query)
+}
+
+// mark は今までに記録したクエリの数を返す。since に渡すとそれ以降のクエリが分かる
+func (l *queryLog) mark() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queries)
+}
+
+// since は mark 以降に発行したクエリのうち、ignore に当てはまらないものを返す
+func (l *queryLog) since(mark int, ignore ...string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []string{}
+next:
+	for _, q := range l.queries[mark:] {
+		for _, prefix := range ignore {
+			if strings.HasPrefix(strings.TrimSpace(q), prefix) {
+				continue next
+			}
+		}
+		out = append(out, q)
+	}
+	return out
+}
+
+// countingConnector は発行したクエリを queryLog に記録する
+type countingConnector struct {
+	driver.Connector
+	log *queryLog
+}
+
+func (c countingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, log: c.log}, nil
+}
+
+type countingConn struct {
+	driver.Conn
+	log *queryLog
+}
+
+func (c *countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.log.add(query)
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.log.add(query)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *countingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c.log.add(query)
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c *countingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.log.add("BEGIN")
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *countingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+func (c *countingConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *countingConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+// do はハンドラにリクエストを送る。cookie が nil なら付けない
+func (ts *testServer) do(t testing.TB, method, path string, cookie *http.Cookie, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(buf)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// mustDo は do でリクエストを送り、ステータスコードが want でなければテストを止める
+func (ts *testServer) mustDo(t testing.TB, want int, method, path string, cookie *http.Cookie, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := ts.do(t, method, path, cookie, body)
+	if rec.Code != want {
+		t.Fatalf("%s %s: status = %d, want %d: %s", method, path, rec.Code, want, rec.Body.String())
+	}
+	return rec
+}
+
+func decodeJSON[T any](t testing.TB, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("failed to decode %s: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+func responseCookie(t testing.TB, rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	t.Helper()
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("cookie %s was not set", name)
+	return nil
+}
+
+type testUser struct {
+	ID             string
+	InvitationCode string
+	Cookie         *http.Cookie
+}
+
+// registerUser は決済トークンを登録済みのユーザーを作る
+func (ts *testServer) registerUser(t testing.TB, username string, invitationCode *string) testUser {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusCreated, http.MethodPost, "/api/app/users", nil, appPostUsersRequest{
+		Username:       username,
+		FirstName:      "太郎",
+		LastName:       "椅子",
+		DateOfBirth:    "2000-01-01",
+		InvitationCode: invitationCode,
+	})
+	res := decodeJSON[appPostUsersResponse](t, rec)
+	user := testUser{ID: res.ID, InvitationCode: res.InvitationCode, Cookie: responseCookie(t, rec, "app_session")}
+	ts.mustDo(t, http.StatusNoContent, http.MethodPost, "/api/app/payment-methods", user.Cookie, appPostPaymentMethodsRequest{Token: "token-" + username})
+	return user
+}
+
+type testOwner struct {
+	ID            string
+	RegisterToken string
+	Cookie        *http.Cookie
+}
+
+func (ts *testServer) registerOwner(t testing.TB, name string) testOwner {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusCreated, http.MethodPost, "/api/owner/owners", nil, ownerPostOwnersRequest{Name: name})
+	res := decodeJSON[ownerPostOwnersResponse](t, rec)
+	return testOwner{ID: res.ID, RegisterToken: res.ChairRegisterToken, Cookie: responseCookie(t, rec, "owner_session")}
+}
+
+type testChair struct {
+	ID     string
+	Cookie *http.Cookie
+}
+
+// testChairModel は 2-master-data.sql に入っている椅子のモデル
+const testChairModel = "リラックスシート NEO"
+
+// registerChair は椅子を登録し、配車を受け付ける状態で at に置く
+func (ts *testServer) registerChair(t testing.TB, owner testOwner, name string, at Coordinate) testChair {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusCreated, http.MethodPost, "/api/chair/chairs", nil, chairPostChairsRequest{
+		Name:               name,
+		Model:              testChairModel,
+		ChairRegisterToken: owner.RegisterToken,
+	})
+	res := decodeJSON[chairPostChairsResponse](t, rec)
+	chair := testChair{ID: res.ID, Cookie: responseCookie(t, rec, "chair_session")}
+	ts.mustDo(t, http.StatusNoContent, http.MethodPost, "/api/chair/activity", chair.Cookie, postChairActivityRequest{IsActive: true})
+	ts.moveChair(t, chair, at)
+	return chair
+}
+
+// testPickup と testDestination はテストのライドの既定の配車位置と目的地
+var (
+	testPickup      = Coordinate{Latitude: 0, Longitude: 0}
+	testDestination = Coordinate{Latitude: 10, Longitude: 10}
+)
+
+// rideFixture はライドを1件走らせるのに必要なユーザーと、そのライドを受ける椅子
+type rideFixture struct {
+	User  testUser
+	Owner testOwner
+	Chair testChair
+}
+
+// newRideFixture は name-user, name-owner と、testPickup で配車を待つ name-chair を登録する
+func (ts *testServer) newRideFixture(t testing.TB, name string) rideFixture {
+	t.Helper()
+	f := rideFixture{
+		User:  ts.registerUser(t, name+"-user", nil),
+		Owner: ts.registerOwner(t, name+"-owner"),
+	}
+	f.Chair = ts.registerChair(t, f.Owner, name+"-chair", testPickup)
+	return f
+}
+
+func (ts *testServer) moveChair(t testing.TB, chair testChair, at Coordinate) {
+	t.Helper()
+	ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/chair/coordinate", chair.Cookie, at)
+}
+
+func (ts *testServer) requestRide(t testing.TB, user testUser, pickup, destination Coordinate) string {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusAccepted, http.MethodPost, "/api/app/rides", user.Cookie, appPostRidesRequest{
+		PickupCoordinate:      &pickup,
+		DestinationCoordinate: &destination,
+	})
+	return decodeJSON[appPostRidesResponse](t, rec).RideID
+}
+
+func (ts *testServer) runMatching(t testing.TB) {
+	t.Helper()
+	ts.mustDo(t, http.StatusNoContent, http.MethodGet, "/api/internal/matching", nil, nil)
+}
+
+func (ts *testServer) postRideStatus(t testing.TB, chair testChair, rideID string, status RideStatusType) {
+	t.Helper()
+	ts.mustDo(t, http.StatusNoContent, http.MethodPost, "/api/chair/rides/"+rideID+"/status", chair.Cookie, postChairRidesRideIDStatusRequest{Status: string(status)})
+}
+
+// driveToArrival は作成済みのライドを chair に割り当て、目的地に着いた(ARRIVED)ところまで進める
+func (ts *testServer) driveToArrival(t testing.TB, chair testChair, rideID string, pickup, destination Coordinate) {
+	t.Helper()
+	ts.runMatching(t)
+	var assigned sql.NullString
+	if err := ts.db.Get(&assigned, "SELECT chair_id FROM rides WHERE id = ?", rideID); err != nil {
+		t.Fatal(err)
+	}
+	if assigned.String != chair.ID {
+		t.Fatalf("ride %s was assigned to %q, want %s", rideID, assigned.String, chair.ID)
+	}
+	ts.postRideStatus(t, chair, rideID, RideStatusEnroute)
+	ts.moveChair(t, chair, pickup)
+	ts.postRideStatus(t, chair, rideID, RideStatusCarrying)
+	ts.moveChair(t, chair, destination)
+}
+
+// completeRide はライドを作成してから、ユーザーが評価して完了するまで進める
+func (ts *testServer) completeRide(t testing.TB, user testUser, chair testChair, pickup, destination Coordinate) string {
+	t.Helper()
+	rideID := ts.requestRide(t, user, pickup, destination)
+	ts.driveToArrival(t, chair, rideID, pickup, destination)
+	ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", user.Cookie, appPostRideEvaluationRequest{Evaluation: 5})
+	return rideID
+}
+
+// latestStatus はライドの最新のステータスをDBから読む
+func (ts *testServer) latestStatus(t testing.TB, rideID string) RideStatusType {
+	t.Helper()
+	status, err := getLatestRideStatus(context.Background(), ts.db, rideID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// openEventStream は実際にHTTPで path の Server-Sent Events のストリームを開き、空行を除いて受け取った行を流すチャネルを返す
+// ストリームが閉じるとチャネルも閉じる。disconnect を呼ぶとクライアント側から接続を切る
+func (ts *testServer) openEventStream(t testing.TB, path string, cookie *http.Cookie, header http.Header) (lines <-chan string, disconnect func()) {
+	t.Helper()
+	srv := httptest.NewServer(ts.handler)
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.AddCookie(cookie)
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status = %d, want 200", path, res.StatusCode)
+	}
+
+	ch := make(chan string, 64)
+	go func() {
+		defer close(ch)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				ch <- line
+			}
+		}
+	}()
+	return ch, func() { res.Body.Close() }
+}
+
+// nextStreamLine は openEventStream のチャネルから次の行を受け取る
+func nextStreamLine(t testing.TB, lines <-chan string) string {
+	t.Helper()
+	select {
+	case line, ok := <-lines:
+		if !ok {
+			t.Fatal("the stream closed early")
+		}
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stream")
+	}
+	return ""
+}
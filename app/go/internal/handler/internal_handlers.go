@@ -0,0 +1,720 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// unassignableCost はマッチングで割り当てない組み合わせのコスト
+	// ハンガリアン法のポテンシャルの加減算で溢れないよう、int64の上限に十分な余裕を残す
+	unassignableCost int64 = math.MaxInt64 / 4
+	// maxAssignableCost は割り当てる組み合わせのコストの上限
+	maxAssignableCost = unassignableCost - 1
+	// chairAssignmentHalfLife ごとに椅子の直近割り当て数が半分に減衰する
+	chairAssignmentHalfLife = 30 * time.Second
+	// matchingWriteChunkSize 件書き込むごとに、パスの時間切れを確かめる
+	matchingWriteChunkSize = 50
+)
+
+func (s *server) internalGetMatching(w http.ResponseWriter, r *http.Request) {
+	// 前回のマッチングが終わっていなければ積み上げずにすぐ返す
+	if !s.tryAcquireMatching() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	defer s.releaseMatching()
+
+	err := s.runMatching(r.Context())
+	recordMatchingResult(err)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// matchingChairRow はマッチングの候補になる椅子をDBから読むときの行
+type matchingChairRow struct {
+	ID       string        `db:"id"`
+	Model    string        `db:"model"`
+	IsActive bool          `db:"is_active"`
+	LastLat  sql.NullInt64 `db:"last_latitude"`
+	LastLon  sql.NullInt64 `db:"last_longitude"`
+	Speed    int           `db:"speed"`
+}
+
+// matchingFreeChair は位置と速度が分かっていて割り当てられる椅子
+type matchingFreeChair struct {
+	ID      string
+	Speed   int
+	LastLat int
+	LastLon int
+}
+
+// matchingWaitingRide はマッチング待ちのライドと、MATCHINGになった日時
+type matchingWaitingRide struct {
+	Ride
+	MatchingAt time.Time `db:"matching_at"`
+}
+
+// sortWaitingRides は ride_priority に従って、先に割り当てを試すライドから並べる
+// ride_cap で打ち切られるのは後ろのライドになる
+func sortWaitingRides(rides []matchingWaitingRide, priority string) {
+	switch priority {
+	case ridePriorityFare:
+		sort.SliceStable(rides, func(i, j int) bool {
+			return calculateFareByDistance(rides[i].Distance) > calculateFareByDistance(rides[j].Distance)
+		})
+	case ridePriorityWait:
+		sort.SliceStable(rides, func(i, j int) bool {
+			return rides[i].MatchingAt.Before(rides[j].MatchingAt)
+		})
+	default:
+		sort.SliceStable(rides, func(i, j int) bool {
+			return rides[i].CreatedAt.Before(rides[j].CreatedAt)
+		})
+	}
+}
+
+type matchingAssignment struct {
+	RideID  string
+	ChairID string
+}
+
+// runMatching はマッチング待ちのライドに空いている椅子を割り当てる
+// budget_ms を超えた場合は、割り当ての計算前なら何も書き込まず、
+// 計算後なら書き込み終えたチャンクまでをコミットして打ち切る
+func (s *server) runMatching(ctx context.Context) error {
+	// /api/initialize の間は何もしない
+	if !s.matchingGate.enter() {
+		return nil
+	}
+	defer s.matchingGate.leave()
+
+	params := loadMatchingParams()
+	summary := matchingSummary{Params: *params, StartedAt: clockNow().UnixMilli()}
+	defer func() {
+		storeMatchingSummary(summary)
+	}()
+
+	// 候補の取得と打ち切りの判定には budgetCtx を使い、書き込みは期限で失敗しないよう ctx で行う
+	budgetCtx := ctx
+	if params.BudgetMs > 0 {
+		var cancel context.CancelFunc
+		budgetCtx, cancel = context.WithTimeout(ctx, time.Duration(params.BudgetMs)*time.Millisecond)
+		defer cancel()
+	}
+	truncate := func(left int) error {
+		summary.Truncated = true
+		summary.RidesLeft = left
+		slog.Warn("matching pass exceeded its budget", "budget_ms", params.BudgetMs, "rides_left", left)
+		return nil
+	}
+
+	tx, err := s.beginTx("runMatching")
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// MATCHING状態でchair_idがNULLのライドを全て取得
+	rides := []matchingWaitingRide{}
+	const waitingRidesQuery = `
+		SELECT r.*, rs.created_at AS matching_at FROM rides r
+		INNER JOIN (
+			SELECT ride_id, MAX(created_at) AS max_created FROM ride_statuses GROUP BY ride_id
+		) rs_max ON rs_max.ride_id = r.id
+		INNER JOIN ride_statuses rs ON rs.ride_id = r.id AND rs.created_at = rs_max.max_created
+		WHERE rs.status = 'MATCHING' AND r.chair_id IS NULL
+		ORDER BY r.created_at
+	`
+	err = timedQuery("matching_waiting_rides", waitingRidesQuery, func() error {
+		return tx.SelectContext(budgetCtx, &rides, waitingRidesQuery)
+	})
+	if err != nil {
+		if budgetCtx.Err() != nil {
+			return truncate(0)
+		}
+		if errors.Is(err, sql.ErrNoRows) || len(rides) == 0 {
+			return nil
+		}
+		return err
+	}
+	// 1回のマッチングで扱うライド数を制限する
+	sortWaitingRides(rides, params.RidePriority)
+	if params.RideCap > 0 && len(rides) > params.RideCap {
+		rides = rides[:params.RideCap]
+	}
+	summary.Rides = len(rides)
+
+	// 空いている椅子を取得
+	var chairsWithModel []matchingChairRow
+	const freeChairsQuery = `
+		SELECT c.id, c.model, c.is_active, c.last_latitude, c.last_longitude, cm.speed
+		FROM chairs c
+		INNER JOIN chair_models cm ON c.model = cm.name
+		WHERE c.is_active = TRUE AND c.current_ride_id IS NULL AND c.maintenance = FALSE AND c.deleted_at IS NULL
+	`
+	err = timedQuery("matching_free_chairs", freeChairsQuery, func() error {
+		return tx.SelectContext(budgetCtx, &chairsWithModel, freeChairsQuery)
+	})
+	if err != nil {
+		if budgetCtx.Err() != nil {
+			return truncate(len(rides))
+		}
+		return err
+	}
+
+	freeChairs := make([]matchingFreeChair, 0, len(chairsWithModel))
+	for _, c := range chairsWithModel {
+		if !c.LastLat.Valid || !c.LastLon.Valid {
+			continue
+		}
+		if c.Speed <= 0 {
+			continue
+		}
+		freeChairs = append(freeChairs, matchingFreeChair{
+			ID:      c.ID,
+			Speed:   c.Speed,
+			LastLat: int(c.LastLat.Int64),
+			LastLon: int(c.LastLon.Int64),
+		})
+	}
+
+	summary.Chairs = len(freeChairs)
+	if len(freeChairs) == 0 {
+		return nil
+	}
+
+	// costMatrix作成
+	// cost = (dist(chair→pickup) + dist(pickup→destination)) / speed
+	// これにより、長距離移動が必要なユーザーには、速い椅子が有利になる
+	n := len(rides)
+	m := len(freeChairs)
+	size := n
+	if m > size {
+		size = m
+	}
+
+	var assignmentScores map[string]float64
+	if params.FairnessWeight > 0 {
+		chairIDs := make([]string, 0, m)
+		for _, c := range freeChairs {
+			chairIDs = append(chairIDs, c.ID)
+		}
+		assignmentScores = s.state.chairAssignments.scores(chairIDs)
+	}
+
+	// 行ごとに確保せず、1つの領域を切り分けて使う
+	costCells := make([]int64, size*size)
+	costMatrix := make([][]int64, size)
+	for i := 0; i < size; i++ {
+		costMatrix[i] = costCells[i*size : (i+1)*size : (i+1)*size]
+		distToDestination := 0
+		if i < n {
+			ride := rides[i]
+			distToDestination = calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		}
+		for j := 0; j < size; j++ {
+			if i < n && j < m {
+				chair := freeChairs[j]
+				ride := rides[i]
+				distToPickup := calculateDistance(chair.LastLat, chair.LastLon, ride.PickupLatitude, ride.PickupLongitude)
+				if params.MaxPickupDistance > 0 && distToPickup > params.MaxPickupDistance {
+					// 遠すぎる椅子は割り当てない
+					costMatrix[i][j] = unassignableCost
+					continue
+				}
+				totalDist := distToPickup + distToDestination*2
+				// 直近で多く割り当てられている椅子ほどコストを上げて、仕事を分散させる
+				costMatrix[i][j] = assignmentCost(totalDist, chair.Speed, params.FairnessWeight*assignmentScores[chair.ID])
+			} else {
+				costMatrix[i][j] = unassignableCost
+			}
+		}
+	}
+
+	if budgetCtx.Err() != nil {
+		return truncate(n)
+	}
+	assignments, cost := computeAssignments(costMatrix, rides, freeChairs, hungarianMethod)
+	// 比較用のアルゴリズムはメモリ上で解くだけで、書き込むのは本番の割り当てのみ
+	if params.ShadowAlgorithm != shadowAlgorithmOff {
+		summary.Shadow = runShadowMatching(params.ShadowAlgorithm, costMatrix, rides, freeChairs, assignments, cost)
+	}
+
+	if len(assignments) == 0 {
+		return nil
+	}
+
+	// 求め終えた割り当ては少なくとも1チャンク書き込み、時間切れになったらそこまでをコミットする
+	written := 0
+	for written < len(assignments) {
+		chunkEnd := min(written+matchingWriteChunkSize, len(assignments))
+		for _, asg := range assignments[written:chunkEnd] {
+			if _, err := tx.ExecContext(ctx, assignRideQuery, asg.ChairID, asg.RideID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE chairs SET current_ride_id = ? WHERE id = ?", asg.RideID, asg.ChairID); err != nil {
+				return err
+			}
+		}
+		written = chunkEnd
+		if budgetCtx.Err() != nil {
+			break
+		}
+	}
+	truncated := written < len(assignments)
+	assignments = assignments[:written]
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if params.FairnessWeight > 0 {
+		for _, asg := range assignments {
+			s.state.chairAssignments.record(asg.ChairID)
+		}
+	}
+	summary.Assigned = len(assignments)
+	if truncated {
+		return truncate(n - len(assignments))
+	}
+
+	return nil
+}
+
+// assignmentCost は椅子をライドに割り当てるコストを返す
+// 距離やペナルティがどれだけ大きくても、割り当てない組み合わせと区別できるよう maxAssignableCost で打ち止めにする
+func assignmentCost(totalDist, speed int, penalty float64) int64 {
+	cost := int64(totalDist) / int64(speed)
+	if cost >= maxAssignableCost || !(penalty < float64(maxAssignableCost-cost)) {
+		return maxAssignableCost
+	}
+	return min(cost+int64(penalty), maxAssignableCost)
+}
+
+// matchingAlgorithm はコスト行列の各行(ライド)に割り当てる列(椅子)を返す。割り当てない行は -1 にする
+type matchingAlgorithm func(costMatrix [][]int64) []int
+
+// computeAssignments は solve の結果から割り当て可能な組み合わせだけを取り出し、そのコストの合計とともに返す
+// コストの合計は math.MaxInt64 で打ち止めにする
+func computeAssignments(costMatrix [][]int64, rides []matchingWaitingRide, freeChairs []matchingFreeChair, solve matchingAlgorithm) ([]matchingAssignment, int64) {
+	n, m := len(rides), len(freeChairs)
+	assignments := make([]matchingAssignment, 0, n)
+	var cost int64
+	for i, j := range solve(costMatrix) {
+		if i < n && j >= 0 && j < m && costMatrix[i][j] < unassignableCost {
+			assignments = append(assignments, matchingAssignment{RideID: rides[i].ID, ChairID: freeChairs[j].ID})
+			if costMatrix[i][j] > math.MaxInt64-cost {
+				cost = math.MaxInt64
+			} else {
+				cost += costMatrix[i][j]
+			}
+		}
+	}
+	return assignments, cost
+}
+
+// ハンガリアン法の実装例（前回答参照）
+func hungarianMethod(costMatrix [][]int64) []int {
+	n := len(costMatrix)
+	u := make([]int64, n+1)
+	v := make([]int64, n+1)
+	p := make([]int, n+1)
+	way := make([]int, n+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]int64, n+1)
+		used := make([]bool, n+1)
+		for j := 1; j <= n; j++ {
+			minv[j] = math.MaxInt64
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			j1 := 0
+			delta := int64(math.MaxInt64)
+			for j := 1; j <= n; j++ {
+				if !used[j] {
+					cur := costMatrix[i0-1][j-1] - u[i0] - v[j]
+					if cur < minv[j] {
+						minv[j] = cur
+						way[j] = j0
+					}
+					if minv[j] < delta {
+						delta = minv[j]
+						j1 = j
+					}
+				}
+			}
+			for j := 0; j <= n; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+			if j0 == 0 {
+				break
+			}
+		}
+	}
+
+	res := make([]int, n)
+	for j := 1; j <= n; j++ {
+		res[p[j]-1] = j - 1
+	}
+	return res
+}
+
+const (
+	// activeRidesDefaultLimit は limit が指定されなかったときに返すライド数
+	activeRidesDefaultLimit = 100
+	// activeRidesMaxLimit は1ページで返すライド数の上限
+	activeRidesMaxLimit = 1000
+)
+
+type internalGetActiveRidesResponse struct {
+	Rides []internalGetActiveRidesRide `json:"rides"`
+	// NextOffset は次のページが無ければnull
+	NextOffset *int `json:"next_offset"`
+}
+
+type internalGetActiveRidesRide struct {
+	ID                    string         `json:"id"`
+	UserID                string         `json:"user_id"`
+	ChairID               *string        `json:"chair_id"`
+	Status                RideStatusType `json:"status"`
+	PickupCoordinate      Coordinate     `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate     `json:"destination_coordinate"`
+	// WaitMs はライドの作成から乗車まで(未乗車なら現在まで)の時間
+	WaitMs int64 `json:"wait_ms"`
+	// RideMs は乗車から現在までの時間。未乗車なら0
+	RideMs    int64 `json:"ride_ms"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+// internalGetActiveRides はCOMPLETEDになっていない全てのライドを作成順に返す
+func (s *server) internalGetActiveRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	limit := activeRidesDefaultLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l < 1 || l > activeRidesMaxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", activeRidesMaxLimit))
+			return
+		}
+		limit = l
+	}
+	offset := 0
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		o, err := strconv.Atoi(offsetStr)
+		if err != nil || o < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("offset must be a non-negative integer"))
+			return
+		}
+		offset = o
+	}
+
+	tx, err := s.beginTx("internalGetActiveRides")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 次のページがあるか知るために1件多く取る
+	rides := []Ride{}
+	if err := tx.SelectContext(ctx, &rides, `
+		SELECT r.* FROM rides r
+		WHERE NOT EXISTS (
+			SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status = 'COMPLETED'
+		)
+		ORDER BY r.created_at, r.id
+		LIMIT ? OFFSET ?`, limit+1, offset); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := internalGetActiveRidesResponse{Rides: []internalGetActiveRidesRide{}}
+	if len(rides) > limit {
+		rides = rides[:limit]
+		next := offset + limit
+		res.NextOffset = &next
+	}
+
+	rideIDs := make([]string, 0, len(rides))
+	for _, ride := range rides {
+		rideIDs = append(rideIDs, ride.ID)
+	}
+	statusMap, err := getLatestRideStatuses(ctx, tx.Tx, rideIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pickedUpAt := map[string]time.Time{}
+	if len(rideIDs) > 0 {
+		query, args := expandIn(ridePickupsQuery, rideIDs)
+		pickups := []struct {
+			RideID    string    `db:"ride_id"`
+			CreatedAt time.Time `db:"created_at"`
+		}{}
+		if err := tx.SelectContext(ctx, &pickups, query, args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, p := range pickups {
+			pickedUpAt[p.RideID] = p.CreatedAt
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := clockNow()
+	for _, ride := range rides {
+		item := internalGetActiveRidesRide{
+			ID:                    ride.ID,
+			UserID:                ride.UserID,
+			Status:                statusMap[ride.ID],
+			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+			CreatedAt:             ride.CreatedAt.UnixMilli(),
+		}
+		if ride.ChairID.Valid {
+			item.ChairID = &ride.ChairID.String
+		}
+		if p, ok := pickedUpAt[ride.ID]; ok {
+			item.WaitMs = p.Sub(ride.CreatedAt).Milliseconds()
+			item.RideMs = now.Sub(p).Milliseconds()
+		} else {
+			item.WaitMs = now.Sub(ride.CreatedAt).Milliseconds()
+		}
+		res.Rides = append(res.Rides, item)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+const (
+	// rideTraceMaxLocations はトレースで返す椅子の座標の最大数
+	rideTraceMaxLocations = 200
+)
+
+type internalGetRideTraceResponse struct {
+	Ride      internalGetRideTraceRide       `json:"ride"`
+	Statuses  []internalGetRideTraceStatus   `json:"statuses"`
+	Locations []internalGetRideTraceLocation `json:"locations"`
+	// LocationsTotal は間引いたり省いたりする前の座標の数
+	LocationsTotal int                          `json:"locations_total"`
+	Coupon         *internalGetRideTraceCoupon  `json:"coupon"`
+	PaymentToken   *internalGetRideTracePayment `json:"payment_token"`
+}
+
+type internalGetRideTraceRide struct {
+	ID                    string     `json:"id"`
+	UserID                string     `json:"user_id"`
+	ChairID               *string    `json:"chair_id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Distance              int        `json:"distance"`
+	Evaluation            *int       `json:"evaluation"`
+	CreatedAt             int64      `json:"created_at"`
+	UpdatedAt             int64      `json:"updated_at"`
+}
+
+type internalGetRideTraceStatus struct {
+	ID          string         `json:"id"`
+	Status      RideStatusType `json:"status"`
+	CreatedAt   int64          `json:"created_at"`
+	AppSentAt   *int64         `json:"app_sent_at"`
+	ChairSentAt *int64         `json:"chair_sent_at"`
+}
+
+type internalGetRideTraceLocation struct {
+	Coordinate
+	CreatedAt int64 `json:"created_at"`
+}
+
+type internalGetRideTraceCoupon struct {
+	Code      string `json:"code"`
+	Discount  int64  `json:"discount"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type internalGetRideTracePayment struct {
+	Token     string `json:"token"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func unixMilliOrNil(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	ms := t.UnixMilli()
+	return &ms
+}
+
+// internalGetRideTrace はライド1件の状態遷移・椅子の移動・クーポン・決済情報をまとめて返す
+// simplify を指定すると、椅子の座標を経路の形からその距離以上ずれない範囲で省いてから返す
+func (s *server) internalGetRideTrace(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	simplify := 0
+	if v := r.URL.Query().Get("simplify"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("simplify must be a non-negative integer"))
+			return
+		}
+		simplify = parsed
+	}
+
+	ride := &Ride{}
+	if err := s.db.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statuses := []RideStatus{}
+	if err := s.db.SelectContext(ctx, &statuses, `SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := internalGetRideTraceResponse{
+		Ride: internalGetRideTraceRide{
+			ID:                    ride.ID,
+			UserID:                ride.UserID,
+			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+			Distance:              ride.Distance,
+			Evaluation:            ride.Evaluation,
+			CreatedAt:             ride.CreatedAt.UnixMilli(),
+			UpdatedAt:             ride.UpdatedAt.UnixMilli(),
+		},
+		Statuses:  []internalGetRideTraceStatus{},
+		Locations: []internalGetRideTraceLocation{},
+	}
+	if ride.ChairID.Valid {
+		res.Ride.ChairID = &ride.ChairID.String
+	}
+
+	var enrouteAt, completedAt *time.Time
+	for _, rs := range statuses {
+		res.Statuses = append(res.Statuses, internalGetRideTraceStatus{
+			ID:          rs.ID,
+			Status:      rs.Status,
+			CreatedAt:   rs.CreatedAt.UnixMilli(),
+			AppSentAt:   unixMilliOrNil(rs.AppSentAt),
+			ChairSentAt: unixMilliOrNil(rs.ChairSentAt),
+		})
+		switch rs.Status {
+		case RideStatusEnroute:
+			enrouteAt = &rs.CreatedAt
+		case RideStatusCompleted:
+			completedAt = &rs.CreatedAt
+		}
+	}
+
+	// ENROUTEからCOMPLETEDまで(未完了なら現在まで)の椅子の座標
+	if ride.ChairID.Valid && enrouteAt != nil {
+		until := clockNow()
+		if completedAt != nil {
+			until = *completedAt
+		}
+		locations := []ChairLocation{}
+		if err := s.db.SelectContext(
+			ctx,
+			&locations,
+			`SELECT * FROM chair_locations WHERE chair_id = ? AND created_at BETWEEN ? AND ? ORDER BY created_at`,
+			ride.ChairID.String, *enrouteAt, until,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		res.LocationsTotal = len(locations)
+		if simplify > 0 {
+			locations = simplifyLocations(locations, float64(simplify))
+		}
+		for _, loc := range downsampleLocations(locations, rideTraceMaxLocations) {
+			res.Locations = append(res.Locations, internalGetRideTraceLocation{
+				Coordinate: Coordinate{Latitude: loc.Latitude, Longitude: loc.Longitude},
+				CreatedAt:  loc.CreatedAt.UnixMilli(),
+			})
+		}
+	}
+
+	coupon := &Coupon{}
+	if err := s.db.GetContext(ctx, coupon, `SELECT * FROM coupons WHERE used_by = ?`, ride.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		res.Coupon = &internalGetRideTraceCoupon{
+			Code:      coupon.Code,
+			Discount:  coupon.Discount,
+			CreatedAt: coupon.CreatedAt.UnixMilli(),
+		}
+	}
+
+	paymentToken := &PaymentToken{}
+	if err := s.db.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		res.PaymentToken = &internalGetRideTracePayment{
+			Token:     paymentToken.Token,
+			CreatedAt: paymentToken.CreatedAt.UnixMilli(),
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// downsampleLocations は始点と終点を残したまま、等間隔に limit 件まで間引く
+func downsampleLocations(locations []ChairLocation, limit int) []ChairLocation {
+	if len(locations) <= limit || limit < 2 {
+		return locations
+	}
+	sampled := make([]ChairLocation, 0, limit)
+	last := len(locations) - 1
+	for i := 0; i < limit; i++ {
+		sampled = append(sampled, locations[i*last/(limit-1)])
+	}
+	return sampled
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestAssignmentCost(t *testing.T) {
+	tests := []struct {
+		name      string
+		totalDist int
+		speed     int
+		penalty   float64
+		want      int64
+	}{
+		{name: "plain", totalDist: 100, speed: 3, penalty: 0, want: 33},
+		{name: "with penalty", totalDist: 100, speed: 3, penalty: 7.9, want: 40},
+		{name: "max distance", totalDist: math.MaxInt, speed: 1, penalty: 0, want: maxAssignableCost},
+		{name: "max distance with penalty", totalDist: math.MaxInt, speed: 2, penalty: 1e6, want: maxAssignableCost},
+		{name: "penalty beyond int64", totalDist: 100, speed: 1, penalty: 1e30, want: maxAssignableCost},
+		{name: "infinite penalty", totalDist: 100, speed: 1, penalty: math.Inf(1), want: maxAssignableCost},
+		{name: "large penalty below the cap", totalDist: 10, speed: 1, penalty: 1 << 60, want: 1<<60 + 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := assignmentCost(tt.totalDist, tt.speed, tt.penalty)
+			if got != tt.want {
+				t.Fatalf("assignmentCost(%d, %d, %g) = %d, want %d", tt.totalDist, tt.speed, tt.penalty, got, tt.want)
+			}
+			if got < 0 || got >= unassignableCost {
+				t.Fatalf("assignmentCost(%d, %d, %g) = %d is not assignable", tt.totalDist, tt.speed, tt.penalty, got)
+			}
+		})
+	}
+}
+
+// newCostMatrix は rides x chairs のコストを size x size の行列に広げ、余った部分を unassignableCost で埋める
+func newCostMatrix(costs [][]int64) ([][]int64, []matchingWaitingRide, []matchingFreeChair) {
+	n, m := len(costs), len(costs[0])
+	size := max(n, m)
+	matrix := make([][]int64, size)
+	for i := range matrix {
+		matrix[i] = make([]int64, size)
+		for j := range matrix[i] {
+			matrix[i][j] = unassignableCost
+			if i < n && j < m {
+				matrix[i][j] = costs[i][j]
+			}
+		}
+	}
+	rides := make([]matchingWaitingRide, n)
+	for i := range rides {
+		rides[i].ID = fmt.Sprintf("ride-%d", i)
+	}
+	chairs := make([]matchingFreeChair, m)
+	for j := range chairs {
+		chairs[j].ID = fmt.Sprintf("chair-%d", j)
+	}
+	return matrix, rides, chairs
+}
+
+func TestComputeAssignmentsExtremeCosts(t *testing.T) {
+	// 公平性のペナルティは重み * 直近の割り当て数
+	near := assignmentCost(100, 1, 0)
+	nearButBusy := assignmentCost(100, 1, 1e18*50)
+	far := assignmentCost(math.MaxInt/8, 1, 0)
+	farAndBusy := assignmentCost(math.MaxInt, 1, 1e18*50)
+
+	tests := []struct {
+		name  string
+		costs [][]int64
+		// want[i] はライド i に割り当てる椅子。-1 なら割り当てない
+		want     []int
+		wantCost int64
+	}{
+		{
+			name:     "penalty moves the ride to an idle chair",
+			costs:    [][]int64{{nearButBusy, near}},
+			want:     []int{1},
+			wantCost: near,
+		},
+		{
+			name:     "penalized chair is still assigned when it is the only one",
+			costs:    [][]int64{{nearButBusy}},
+			want:     []int{0},
+			wantCost: maxAssignableCost,
+		},
+		{
+			name:     "far chairs are assigned rather than dropped",
+			costs:    [][]int64{{far, farAndBusy}, {farAndBusy, far}},
+			want:     []int{0, 1},
+			wantCost: 2 * far,
+		},
+		{
+			name:     "unassignable pairs stay unassigned",
+			costs:    [][]int64{{farAndBusy}, {unassignableCost}},
+			want:     []int{0, -1},
+			wantCost: maxAssignableCost,
+		},
+		{
+			name: "total cost saturates",
+			costs: [][]int64{
+				{farAndBusy, farAndBusy, farAndBusy, farAndBusy, farAndBusy},
+				{farAndBusy, farAndBusy, farAndBusy, farAndBusy, farAndBusy},
+				{farAndBusy, farAndBusy, farAndBusy, farAndBusy, farAndBusy},
+				{farAndBusy, farAndBusy, farAndBusy, farAndBusy, farAndBusy},
+				{farAndBusy, farAndBusy, farAndBusy, farAndBusy, farAndBusy},
+			},
+			want:     nil,
+			wantCost: math.MaxInt64,
+		},
+	}
+	for _, tt := range tests {
+		for name, solve := range map[string]matchingAlgorithm{"hungarian": hungarianMethod, "greedy": greedyMatching} {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				matrix, rides, chairs := newCostMatrix(tt.costs)
+				assignments, cost := computeAssignments(matrix, rides, chairs, solve)
+				if cost != tt.wantCost {
+					t.Fatalf("cost = %d, want %d", cost, tt.wantCost)
+				}
+				if tt.want == nil {
+					// 全て同じコストなら、どの組み合わせでも全てのライドに割り当てる
+					if len(assignments) != len(rides) {
+						t.Fatalf("assigned %d rides, want %d", len(assignments), len(rides))
+					}
+					return
+				}
+				var want []matchingAssignment
+				for i, j := range tt.want {
+					if j >= 0 {
+						want = append(want, matchingAssignment{RideID: rides[i].ID, ChairID: chairs[j].ID})
+					}
+				}
+				if !slices.Equal(assignments, want) {
+					t.Fatalf("assignments = %v, want %v", assignments, want)
+				}
+			})
+		}
+	}
+}
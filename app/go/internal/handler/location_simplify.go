@@ -0,0 +1,59 @@
+package handler
+
+import "math"
+
+// simplifyLocations はDouglas-Peucker法で、経路の形から tolerance 以上ずれない点を取り除く
+// 始点と終点は必ず残す。渡されたスライスは変更しない
+func simplifyLocations(locations []ChairLocation, tolerance float64) []ChairLocation {
+	if len(locations) <= 2 {
+		return locations
+	}
+
+	keep := make([]bool, len(locations))
+	keep[0] = true
+	keep[len(locations)-1] = true
+
+	// 長い経路で再帰が深くならないよう、区間をスタックで処理する
+	type span struct{ first, last int }
+	stack := []span{{0, len(locations) - 1}}
+	for len(stack) > 0 {
+		sp := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		farthest := -1
+		maxDist := tolerance
+		for i := sp.first + 1; i < sp.last; i++ {
+			if d := distanceToSegment(locations[i], locations[sp.first], locations[sp.last]); d > maxDist {
+				farthest = i
+				maxDist = d
+			}
+		}
+		if farthest < 0 {
+			continue
+		}
+		keep[farthest] = true
+		stack = append(stack, span{sp.first, farthest}, span{farthest, sp.last})
+	}
+
+	simplified := make([]ChairLocation, 0, len(locations))
+	for i, loc := range locations {
+		if keep[i] {
+			simplified = append(simplified, loc)
+		}
+	}
+	return simplified
+}
+
+// distanceToSegment は p から線分 a-b までのユークリッド距離
+func distanceToSegment(p, a, b ChairLocation) float64 {
+	px, py := float64(p.Latitude), float64(p.Longitude)
+	ax, ay := float64(a.Latitude), float64(a.Longitude)
+	dx, dy := float64(b.Latitude)-ax, float64(b.Longitude)-ay
+
+	if dx == 0 && dy == 0 {
+		return math.Hypot(px-ax, py-ay)
+	}
+	t := ((px-ax)*dx + (py-ay)*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
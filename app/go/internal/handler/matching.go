@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minMatchingInterval = 10 * time.Millisecond
+	maxMatchingInterval = 10 * time.Second
+	// matchingLoopIdleInterval はアプリ内のマッチングループが無効な間に設定を確認する間隔
+	matchingLoopIdleInterval = time.Second
+	// maxMatchingBackoff はマッチングが失敗し続けたときにアプリ内のマッチングループが待つ間隔の上限
+	maxMatchingBackoff = 30 * time.Second
+	// defaultMaxNearbyDistance は nearby-chairs の distance の上限の初期値
+	defaultMaxNearbyDistance = 400
+	// chairIdleRetryAfterMs はマッチング待ちのライドが無いときに空いている椅子へ返すリトライ間隔
+	chairIdleRetryAfterMs = 100
+	// chairRetrySpreadMs の範囲で椅子ごとにリトライをずらし、パスの直後にポーリングが集中しないようにする
+	chairRetrySpreadMs = 50
+)
+
+const (
+	// ridePriorityFIFO はライドを作成した順に割り当てる
+	ridePriorityFIFO = "fifo"
+	// ridePriorityFare は運賃の高いライドから割り当てる
+	ridePriorityFare = "fare"
+	// ridePriorityWait はMATCHINGになってから長く待っているライドから割り当てる
+	ridePriorityWait = "wait"
+)
+
+// matchingParams はマッチングの実行パラメータ
+// 各パスの開始時にスナップショットを取得するので、パスの途中で値が変わることはない
+type matchingParams struct {
+	// IntervalMs はアプリ内のマッチングループの間隔。0なら外部の matcher に任せる
+	IntervalMs int `json:"interval_ms"`
+	// RideCap は1回のパスで扱うライドの最大数。0なら無制限
+	RideCap int `json:"ride_cap"`
+	// RidePriority は ride_cap で打ち切るときにどのライドを優先するか。fifo, fare, wait のいずれか
+	RidePriority string `json:"ride_priority"`
+	// MaxPickupDistance は椅子から配車位置までの最大距離。0なら無制限
+	MaxPickupDistance int `json:"max_pickup_distance"`
+	// FairnessWeight は直近の割り当て数1件あたりにコストへ加えるペナルティ。0なら公平性を考慮しない
+	FairnessWeight float64 `json:"fairness_weight"`
+	// MaxNearbyDistance は nearby-chairs で指定できる distance の上限
+	MaxNearbyDistance int `json:"max_nearby_distance"`
+	// BudgetMs は1回のパスにかけてよい時間。超えたら求め終えた割り当てだけを書き込んで終える。0なら無制限
+	BudgetMs int `json:"budget_ms"`
+	// PositionCheck は乗車・完了時に椅子が配車位置・目的地にいるかの確認方法。off, log, reject のいずれか
+	PositionCheck string `json:"position_check"`
+	// PositionTolerance は配車位置・目的地からずれていても許容する距離
+	PositionTolerance int `json:"position_tolerance"`
+	// ChairRetryMinMs と ChairRetryMaxMs は、マッチング待ちのライドがあるときに空いている椅子へ返すリトライ間隔の範囲
+	ChairRetryMinMs int `json:"chair_retry_min_ms"`
+	ChairRetryMaxMs int `json:"chair_retry_max_ms"`
+	// ShadowAlgorithm は本番と並べて試す割り当てアルゴリズム。空なら比較しない
+	ShadowAlgorithm string `json:"shadow_algorithm"`
+}
+
+func (p matchingParams) validate() error {
+	if p.IntervalMs != 0 && (time.Duration(p.IntervalMs)*time.Millisecond < minMatchingInterval || time.Duration(p.IntervalMs)*time.Millisecond > maxMatchingInterval) {
+		return errors.New("interval_ms must be 0 or between 10 and 10000")
+	}
+	if p.RideCap < 0 {
+		return errors.New("ride_cap must not be negative")
+	}
+	if p.RidePriority != ridePriorityFIFO && p.RidePriority != ridePriorityFare && p.RidePriority != ridePriorityWait {
+		return errors.New("ride_priority must be fifo, fare or wait")
+	}
+	if p.MaxPickupDistance < 0 {
+		return errors.New("max_pickup_distance must not be negative")
+	}
+	if p.FairnessWeight < 0 {
+		return errors.New("fairness_weight must not be negative")
+	}
+	if p.BudgetMs < 0 {
+		return errors.New("budget_ms must not be negative")
+	}
+	if p.MaxNearbyDistance < 1 {
+		return errors.New("max_nearby_distance must be positive")
+	}
+	if p.PositionCheck != positionCheckOff && p.PositionCheck != positionCheckLog && p.PositionCheck != positionCheckReject {
+		return errors.New("position_check must be off, log or reject")
+	}
+	if p.PositionTolerance < 0 {
+		return errors.New("position_tolerance must not be negative")
+	}
+	if p.ChairRetryMinMs < 1 || p.ChairRetryMaxMs < p.ChairRetryMinMs {
+		return errors.New("chair_retry_min_ms must be positive and chair_retry_max_ms must not be less than it")
+	}
+	if _, ok := shadowAlgorithms[p.ShadowAlgorithm]; p.ShadowAlgorithm != shadowAlgorithmOff && !ok {
+		return errors.New("shadow_algorithm must be empty or greedy")
+	}
+	return nil
+}
+
+func (s *server) tryAcquireMatching() bool {
+	select {
+	case s.matchingSemaphore <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *server) releaseMatching() {
+	<-s.matchingSemaphore
+}
+
+var currentMatchingParams atomic.Pointer[matchingParams]
+
+func init() {
+	currentMatchingParams.Store(&matchingParams{
+		MaxNearbyDistance: defaultMaxNearbyDistance,
+		RidePriority:      ridePriorityFIFO,
+		PositionCheck:     positionCheckOff,
+		ChairRetryMinMs:   50,
+		ChairRetryMaxMs:   1000,
+	})
+}
+
+func loadMatchingParams() *matchingParams {
+	return currentMatchingParams.Load()
+}
+
+func storeMatchingParams(p matchingParams) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	currentMatchingParams.Store(&p)
+	return nil
+}
+
+// matchingSummary は1回のマッチングパスの結果と、その時に使われたパラメータ
+type matchingSummary struct {
+	Params     matchingParams `json:"params"`
+	StartedAt  int64          `json:"started_at"`
+	DurationMs int64          `json:"duration_ms"`
+	Rides      int            `json:"rides"`
+	Chairs     int            `json:"chairs"`
+	Assigned   int            `json:"assigned"`
+	// Truncated は時間切れでパスを途中で打ち切ったときに true になる
+	Truncated bool `json:"truncated"`
+	// RidesLeft は打ち切りにより割り当てを書き込めなかったライドの数
+	RidesLeft int `json:"rides_left"`
+	// Shadow は shadow_algorithm を設定しているときの比較結果
+	Shadow *matchingShadowResult `json:"shadow,omitempty"`
+}
+
+var lastMatchingSummary atomic.Pointer[matchingSummary]
+
+// nextMatchingAt はアプリ内のマッチングループが次のパスを始める予定のUNIXミリ秒。予定が無ければ0
+var nextMatchingAt atomic.Int64
+
+func storeMatchingSummary(summary matchingSummary) {
+	summary.DurationMs = clockNow().UnixMilli() - summary.StartedAt
+	lastMatchingSummary.Store(&summary)
+}
+
+// matchingHint はマッチング待ちのライドについて、直近のマッチング結果からクライアント向けのヒントを返す
+// ライドを扱った直近のパスで空いている椅子が無かった場合のみ no_chairs_available とする
+func matchingHint(assigned bool) string {
+	if assigned {
+		return "assigned"
+	}
+	if summary := lastMatchingSummary.Load(); summary != nil && summary.Rides > 0 && summary.Chairs == 0 {
+		return "no_chairs_available"
+	}
+	return "searching"
+}
+
+// chairRetryAfterMs は空いている椅子が次に通知を取りに来るまでの間隔を返す
+// マッチング待ちのライドがあれば、次のパスが終わる頃に椅子ごとに少しずつずらして来るようにする
+// 外部の matcher を使っていてパスの予定がわからないときは chairIdleRetryAfterMs を返す
+func chairRetryAfterMs(chairID string, now time.Time) int {
+	next := nextMatchingAt.Load()
+	summary := lastMatchingSummary.Load()
+	if next == 0 || summary == nil || summary.Rides == 0 {
+		return chairIdleRetryAfterMs
+	}
+	params := loadMatchingParams()
+
+	h := fnv.New32a()
+	h.Write([]byte(chairID))
+	// 次のパスも前回と同じくらいかかるとみなす
+	wait := next + summary.DurationMs - now.UnixMilli() + int64(h.Sum32()%chairRetrySpreadMs)
+	return int(min(max(wait, int64(params.ChairRetryMinMs)), int64(params.ChairRetryMaxMs)))
+}
+
+// startMatchingLoop は interval_ms が設定されている間、アプリ内でマッチングを実行する
+func (s *server) startMatchingLoop() {
+	go func() {
+		for {
+			params := loadMatchingParams()
+			if params.IntervalMs == 0 {
+				nextMatchingAt.Store(0)
+				time.Sleep(matchingLoopIdleInterval)
+				continue
+			}
+
+			var failures int64
+			if s.tryAcquireMatching() {
+				err := s.runMatching(context.Background())
+				s.releaseMatching()
+				failures = recordMatchingResult(err)
+			} else {
+				failures = matchingConsecutiveFailures.Load()
+			}
+			interval := matchingLoopDelay(time.Duration(params.IntervalMs)*time.Millisecond, failures)
+			nextMatchingAt.Store(clockNow().Add(interval).UnixMilli())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// matchingLoopDelay は次のマッチングまで待つ間隔を返す
+// 連続で失敗している間は失敗するたびに間隔を倍にし、maxMatchingBackoff で打ち止めにする
+func matchingLoopDelay(interval time.Duration, failures int64) time.Duration {
+	for i := int64(0); i < failures && interval < maxMatchingBackoff; i++ {
+		interval *= 2
+	}
+	return min(interval, maxMatchingBackoff)
+}
+
+func (s *server) internalGetSettings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, loadMatchingParams())
+}
+
+func (s *server) internalPutSettings(w http.ResponseWriter, r *http.Request) {
+	// 指定されなかった項目は現在の値を引き継ぐ
+	params := *loadMatchingParams()
+	if err := bindJSON(r, &params); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := storeMatchingParams(params); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &params)
+}
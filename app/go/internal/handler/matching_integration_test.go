@@ -0,0 +1,127 @@
+//go:build integration
+
+package handler
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+)
+
+// putMatchingSettings は設定APIでマッチングのパラメータを変え、テストの終わりに元に戻す
+func (ts *testServer) putMatchingSettings(t *testing.T, settings map[string]any) {
+	t.Helper()
+	previous := *loadMatchingParams()
+	t.Cleanup(func() {
+		if err := storeMatchingParams(previous); err != nil {
+			t.Error(err)
+		}
+	})
+	ts.mustDo(t, http.StatusOK, http.MethodPut, "/api/internal/settings", nil, settings)
+}
+
+// assignedChair はライドに割り当てられた椅子のIDを返す
+func (ts *testServer) assignedChair(t *testing.T, rideID string) string {
+	t.Helper()
+	var chairID sql.NullString
+	if err := ts.db.Get(&chairID, "SELECT chair_id FROM rides WHERE id = ?", rideID); err != nil {
+		t.Fatal(err)
+	}
+	return chairID.String
+}
+
+func TestMatchingFairnessDivertsToIdleChair(t *testing.T) {
+	ts := newTestServer(t)
+	ts.putMatchingSettings(t, map[string]any{"fairness_weight": 100})
+	f := ts.newRideFixture(t, "fairness")
+	// 配車位置から少しだけ遠い椅子
+	idle := ts.registerChair(t, f.Owner, "idle-chair", Coordinate{Latitude: 2, Longitude: 2})
+
+	// どちらも割り当てられていなければ近い椅子が選ばれる
+	ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	ts.drainChairNotifications(t, f.Chair)
+	ts.drainAppNotifications(t, f.User)
+	ts.moveChair(t, f.Chair, testPickup)
+
+	// 直近で割り当てられた椅子はペナルティで後回しになり、遠い方の椅子に割り当てる
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	if got := ts.assignedChair(t, rideID); got != idle.ID {
+		t.Fatalf("ride was assigned to %q, want the idle chair %s (busy chair %s)", got, idle.ID, f.Chair.ID)
+	}
+}
+
+func TestMatchingWithoutFairnessPrefersNearChair(t *testing.T) {
+	ts := newTestServer(t)
+	ts.putMatchingSettings(t, map[string]any{"fairness_weight": 0})
+	f := ts.newRideFixture(t, "unbalanced")
+	ts.registerChair(t, f.Owner, "idle-chair", Coordinate{Latitude: 2, Longitude: 2})
+
+	ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+	ts.drainChairNotifications(t, f.Chair)
+	ts.drainAppNotifications(t, f.User)
+	ts.moveChair(t, f.Chair, testPickup)
+
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	if got := ts.assignedChair(t, rideID); got != f.Chair.ID {
+		t.Fatalf("ride was assigned to %q, want the near chair %s", got, f.Chair.ID)
+	}
+}
+
+func TestOverlappingMatchingCallReturnsImmediately(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "overlap")
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+
+	// 別のパスが実行中の間に呼ばれたら、積み上げずに何もせず返す
+	if !ts.tryAcquireMatching() {
+		t.Fatal("could not start a matching run")
+	}
+	ts.runMatching(t)
+	if got := ts.assignedChair(t, rideID); got != "" {
+		t.Fatalf("overlapping call assigned the ride to %s", got)
+	}
+
+	ts.releaseMatching()
+	ts.runMatching(t)
+	if got := ts.assignedChair(t, rideID); got != f.Chair.ID {
+		t.Fatalf("ride was assigned to %q after the run finished, want %s", got, f.Chair.ID)
+	}
+}
+
+func TestShadowMatchingRecordsDifferenceWithoutCommittingCandidate(t *testing.T) {
+	ts := newTestServer(t)
+	ts.putMatchingSettings(t, map[string]any{"shadow_algorithm": shadowAlgorithmGreedy})
+	f := ts.newRideFixture(t, "shadow")
+	far := ts.registerChair(t, f.Owner, "far-chair", Coordinate{Latitude: 10, Longitude: 0})
+	other := ts.registerUser(t, "shadow-other-user", nil)
+
+	// 先に来たライドに近い椅子を渡す greedy は、後のライドに遠い椅子しか残せない
+	first := ts.requestRide(t, f.User, Coordinate{Latitude: 4, Longitude: 0}, Coordinate{Latitude: 4, Longitude: 2})
+	second := ts.requestRide(t, other, testPickup, Coordinate{Latitude: 0, Longitude: 2})
+	ts.runMatching(t)
+
+	summary := lastMatchingSummary.Load()
+	if summary == nil || summary.Shadow == nil {
+		t.Fatalf("summary = %+v, want a shadow comparison", summary)
+	}
+	shadow := summary.Shadow
+	if shadow.Algorithm != shadowAlgorithmGreedy || shadow.ProductionAssigned != 2 || shadow.CandidateAssigned != 2 {
+		t.Fatalf("shadow = %+v, want both algorithms to assign 2 rides", shadow)
+	}
+	if shadow.Overlap != 0 || shadow.CandidateCost <= shadow.ProductionCost {
+		t.Fatalf("shadow = %+v, want greedy to pick other chairs at a higher cost", shadow)
+	}
+
+	// 書き込まれるのは本番の割り当てだけ
+	if got := ts.assignedChair(t, first); got != far.ID {
+		t.Fatalf("first ride was assigned to %q, want the production choice %s", got, far.ID)
+	}
+	if got := ts.assignedChair(t, second); got != f.Chair.ID {
+		t.Fatalf("second ride was assigned to %q, want the production choice %s", got, f.Chair.ID)
+	}
+	if summary.Assigned != 2 {
+		t.Fatalf("assigned = %d, want 2", summary.Assigned)
+	}
+}
@@ -0,0 +1,86 @@
+package handler
+
+import "log/slog"
+
+const (
+	// shadowAlgorithmOff は比較を行わない
+	shadowAlgorithmOff = ""
+	// shadowAlgorithmGreedy は優先順に並べたライドから、一番コストの低い空いている椅子を割り当てる
+	shadowAlgorithmGreedy = "greedy"
+)
+
+// shadowAlgorithms は shadow_algorithm に指定できる候補のアルゴリズム
+var shadowAlgorithms = map[string]matchingAlgorithm{
+	shadowAlgorithmGreedy: greedyMatching,
+}
+
+// matchingShadowResult は1回のパスで本番と候補のアルゴリズムが出した割り当ての比較
+type matchingShadowResult struct {
+	Algorithm          string `json:"algorithm"`
+	ProductionCost     int64  `json:"production_cost"`
+	CandidateCost      int64  `json:"candidate_cost"`
+	ProductionAssigned int    `json:"production_assigned"`
+	CandidateAssigned  int    `json:"candidate_assigned"`
+	// Overlap は本番と候補で同じライドに同じ椅子を割り当てた数
+	Overlap int `json:"overlap"`
+}
+
+// runShadowMatching は同じコスト行列を候補のアルゴリズムで解き、本番の割り当てと比べる
+// 候補の割り当てはどこにも書き込まない
+func runShadowMatching(algorithm string, costMatrix [][]int64, rides []matchingWaitingRide, freeChairs []matchingFreeChair, production []matchingAssignment, productionCost int64) *matchingShadowResult {
+	solve, ok := shadowAlgorithms[algorithm]
+	if !ok {
+		return nil
+	}
+	candidate, candidateCost := computeAssignments(costMatrix, rides, freeChairs, solve)
+
+	chairByRide := make(map[string]string, len(production))
+	for _, asg := range production {
+		chairByRide[asg.RideID] = asg.ChairID
+	}
+	overlap := 0
+	for _, asg := range candidate {
+		if chairByRide[asg.RideID] == asg.ChairID {
+			overlap++
+		}
+	}
+
+	result := &matchingShadowResult{
+		Algorithm:          algorithm,
+		ProductionCost:     productionCost,
+		CandidateCost:      candidateCost,
+		ProductionAssigned: len(production),
+		CandidateAssigned:  len(candidate),
+		Overlap:            overlap,
+	}
+	slog.Info("shadow matching",
+		"algorithm", algorithm,
+		"production_cost", productionCost,
+		"candidate_cost", candidateCost,
+		"production_assigned", len(production),
+		"candidate_assigned", len(candidate),
+		"overlap", overlap,
+	)
+	return result
+}
+
+// greedyMatching は行の順に、まだ使われていない列のうち一番コストの低いものを割り当てる
+func greedyMatching(costMatrix [][]int64) []int {
+	used := make([]bool, len(costMatrix))
+	res := make([]int, len(costMatrix))
+	for i, row := range costMatrix {
+		res[i] = -1
+		for j, cost := range row {
+			if used[j] || cost >= unassignableCost {
+				continue
+			}
+			if res[i] < 0 || cost < row[res[i]] {
+				res[i] = j
+			}
+		}
+		if res[i] >= 0 {
+			used[res[i]] = true
+		}
+	}
+	return res
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMatchingLoopDelay(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		failures int64
+		want     time.Duration
+	}{
+		{interval: 500 * time.Millisecond, failures: 0, want: 500 * time.Millisecond},
+		{interval: 500 * time.Millisecond, failures: 1, want: time.Second},
+		{interval: 500 * time.Millisecond, failures: 3, want: 4 * time.Second},
+		{interval: 500 * time.Millisecond, failures: 6, want: maxMatchingBackoff},
+		{interval: maxMatchingInterval, failures: 2, want: maxMatchingBackoff},
+		{interval: minMatchingInterval, failures: 1 << 40, want: maxMatchingBackoff},
+	}
+	for _, tt := range tests {
+		if got := matchingLoopDelay(tt.interval, tt.failures); got != tt.want {
+			t.Errorf("matchingLoopDelay(%v, %d) = %v, want %v", tt.interval, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestRecordMatchingResultResetsOnSuccess(t *testing.T) {
+	t.Cleanup(func() { matchingConsecutiveFailures.Store(0) })
+	matchingConsecutiveFailures.Store(0)
+
+	for want := int64(1); want <= matchingFailureAlertThreshold+1; want++ {
+		if got := recordMatchingResult(errors.New("db is down")); got != want {
+			t.Fatalf("failures = %d, want %d", got, want)
+		}
+	}
+	if got := recordMatchingResult(nil); got != 0 {
+		t.Fatalf("failures after success = %d, want 0", got)
+	}
+	if got := matchingLoopDelay(time.Second, matchingConsecutiveFailures.Load()); got != time.Second {
+		t.Fatalf("delay after success = %v, want the configured interval", got)
+	}
+}
+
+func TestTryAcquireMatchingLimitsConcurrentRuns(t *testing.T) {
+	for _, limit := range []int{1, 3} {
+		s := &server{matchingSemaphore: make(chan struct{}, limit)}
+		var running, maxRunning, rejected atomic.Int64
+		hammer(func(int) {
+			if !s.tryAcquireMatching() {
+				rejected.Add(1)
+				return
+			}
+			defer s.releaseMatching()
+			n := running.Add(1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			// 実行中のパスが重なるように少し待つ
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+		})
+		if got := maxRunning.Load(); got > int64(limit) {
+			t.Errorf("limit %d: %d runs overlapped", limit, got)
+		}
+		if rejected.Load() == 0 {
+			t.Errorf("limit %d: no overlapping call was rejected", limit)
+		}
+	}
+}
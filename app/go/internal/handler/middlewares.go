@@ -1,13 +1,14 @@
-package main
+package handler
 
 import (
 	"context"
 	"database/sql"
 	"errors"
 	"net/http"
+	"strings"
 )
 
-func appAuthMiddleware(next http.Handler) http.Handler {
+func (s *server) appAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		c, err := r.Cookie("app_session")
@@ -17,7 +18,7 @@ func appAuthMiddleware(next http.Handler) http.Handler {
 		}
 		accessToken := c.Value
 		user := &User{}
-		err = db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
+		err = s.db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
@@ -32,9 +33,29 @@ func appAuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func ownerAuthMiddleware(next http.Handler) http.Handler {
+func (s *server) ownerAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
+		// APIキーが指定されていればセッションの代わりに使う
+		if apiKey, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && apiKey != "" {
+			owner := &Owner{}
+			if err := s.db.GetContext(ctx, owner, `
+				SELECT o.* FROM owners o
+				INNER JOIN owner_api_keys k ON k.owner_id = o.id
+				WHERE k.key_hash = ? AND k.revoked_at IS NULL`, hashOwnerAPIKey(apiKey)); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeError(w, http.StatusUnauthorized, errors.New("invalid api key"))
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			ctx = context.WithValue(ctx, "owner", owner)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		c, err := r.Cookie("owner_session")
 		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
 			writeError(w, http.StatusUnauthorized, errors.New("owner_session cookie is required"))
@@ -42,7 +63,7 @@ func ownerAuthMiddleware(next http.Handler) http.Handler {
 		}
 		accessToken := c.Value
 		owner := &Owner{}
-		if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken); err != nil {
+		if err := s.db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
 				return
@@ -56,7 +77,7 @@ func ownerAuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func chairAuthMiddleware(next http.Handler) http.Handler {
+func (s *server) chairAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		c, err := r.Cookie("chair_session")
@@ -66,22 +87,17 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		}
 		accessToken := c.Value
 		// cacheからとる
-		chair, err := chairCache.Get(ctx, accessToken)
+		chair, err := s.state.chairs.get(ctx, accessToken)
 		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+				return
+			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		// chair := &Chair{}
-		// err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ?", accessToken)
-		// if err != nil {
-		// 	if errors.Is(err, sql.ErrNoRows) {
-		// 		writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-		// 		return
-		// 	}
-		// 	writeError(w, http.StatusInternalServerError, err)
-		// 	return
-		// }
+		s.touchChairActivity(chair)
 
 		ctx = context.WithValue(ctx, "chair", chair)
 		next.ServeHTTP(w, r.WithContext(ctx))
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"database/sql"
+	"time"
+)
+
+type Chair struct {
+	ID          string    `db:"id"`
+	OwnerID     string    `db:"owner_id"`
+	Name        string    `db:"name"`
+	Model       string    `db:"model"`
+	IsActive    bool      `db:"is_active"`
+	AccessToken string    `db:"access_token"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+
+	TotalDistance          int        `db:"total_distance"`
+	TotalDistanceUpdatedAt *time.Time `db:"total_distance_updated_at"`
+	LastLongitude          *int       `db:"last_longitude"`
+	LastLatitude           *int       `db:"last_latitude"`
+	// DistanceOnRide と DistanceIdle は TotalDistance を ENROUTE・CARRYING 中の移動とそれ以外に分けたもの
+	DistanceOnRide int `db:"distance_on_ride"`
+	DistanceIdle   int `db:"distance_idle"`
+	// CurrentRideID はキャッシュ上の値だと古いことがあるので、判定にはDBの値を使う
+	CurrentRideID sql.NullString `db:"current_ride_id"`
+	// Maintenance の椅子は今のライドは続けるが、新しいライドは割り当てない
+	Maintenance bool `db:"maintenance"`
+	// DeletedAt はオーナーが削除した日時。削除した椅子のライドは売上の集計に残す
+	DeletedAt *time.Time `db:"deleted_at"`
+	// ActiveName は削除されていなければ Name、削除されていれば nil になる生成列
+	ActiveName *string `db:"active_name"`
+}
+
+type ChairModel struct {
+	Name  string `db:"name"`
+	Speed int    `db:"speed"`
+}
+
+type ChairLocation struct {
+	ID        string    `db:"id"`
+	ChairID   string    `db:"chair_id"`
+	Latitude  int       `db:"latitude"`
+	Longitude int       `db:"longitude"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type User struct {
+	ID             string    `db:"id"`
+	Username       string    `db:"username"`
+	Firstname      string    `db:"firstname"`
+	Lastname       string    `db:"lastname"`
+	DateOfBirth    string    `db:"date_of_birth"`
+	AccessToken    string    `db:"access_token"`
+	InvitationCode string    `db:"invitation_code"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+type PaymentToken struct {
+	UserID    string    `db:"user_id"`
+	Token     string    `db:"token"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type Ride struct {
+	ID                   string         `db:"id"`
+	UserID               string         `db:"user_id"`
+	ChairID              sql.NullString `db:"chair_id"`
+	PickupLatitude       int            `db:"pickup_latitude"`
+	PickupLongitude      int            `db:"pickup_longitude"`
+	DestinationLatitude  int            `db:"destination_latitude"`
+	DestinationLongitude int            `db:"destination_longitude"`
+	Distance             int            `db:"distance"`
+	Evaluation           *int           `db:"evaluation"`
+	Tip                  int64          `db:"tip"`
+	ChargedFare          *int64         `db:"charged_fare"`
+	LockedFare           *int64         `db:"locked_fare"`
+	// ChairName, ChairModel, ChairOwnerName は割り当て時の椅子の情報。後から椅子を変更しても履歴が変わらないように残す
+	ChairName      *string   `db:"chair_name"`
+	ChairModel     *string   `db:"chair_model"`
+	ChairOwnerName *string   `db:"chair_owner_name"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+type RideStatus struct {
+	ID          string         `db:"id"`
+	RideID      string         `db:"ride_id"`
+	Status      RideStatusType `db:"status"`
+	CreatedAt   time.Time      `db:"created_at"`
+	AppSentAt   *time.Time     `db:"app_sent_at"`
+	ChairSentAt *time.Time     `db:"chair_sent_at"`
+}
+
+type Route struct {
+	ID                   string    `db:"id"`
+	UserID               string    `db:"user_id"`
+	Name                 string    `db:"name"`
+	PickupLatitude       int       `db:"pickup_latitude"`
+	PickupLongitude      int       `db:"pickup_longitude"`
+	DestinationLatitude  int       `db:"destination_latitude"`
+	DestinationLongitude int       `db:"destination_longitude"`
+	CreatedAt            time.Time `db:"created_at"`
+}
+
+type Owner struct {
+	ID                 string    `db:"id"`
+	Name               string    `db:"name"`
+	AccessToken        string    `db:"access_token"`
+	ChairRegisterToken string    `db:"chair_register_token"`
+	CreatedAt          time.Time `db:"created_at"`
+	UpdatedAt          time.Time `db:"updated_at"`
+}
+
+type OwnerAPIKey struct {
+	ID        string     `db:"id"`
+	OwnerID   string     `db:"owner_id"`
+	KeyHash   string     `db:"key_hash"`
+	CreatedAt time.Time  `db:"created_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+type Coupon struct {
+	UserID    string    `db:"user_id"`
+	Code      string    `db:"code"`
+	Discount  int64     `db:"discount"`
+	CreatedAt time.Time `db:"created_at"`
+	UsedBy    *string   `db:"used_by"`
+}
+
+type FareEvent struct {
+	ID        string    `db:"id"`
+	RideID    string    `db:"ride_id"`
+	Event     string    `db:"event"`
+	Fare      int64     `db:"fare"`
+	Detail    *string   `db:"detail"`
+	CreatedAt time.Time `db:"created_at"`
+}
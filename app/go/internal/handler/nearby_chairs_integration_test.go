@@ -0,0 +1,48 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// nearbyChairIDs は testPickup の近くにいる椅子のIDを返す
+func (ts *testServer) nearbyChairIDs(t *testing.T, user testUser) []string {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/nearby-chairs?latitude=0&longitude=0&distance=10", user.Cookie, nil)
+	ids := []string{}
+	for _, c := range decodeJSON[appGetNearbyChairsResponse](t, rec).Chairs {
+		ids = append(ids, c.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestNearbyChairsExcludesInactiveAndDeletedChairs(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "nearby")
+	deactivated := ts.registerChair(t, f.Owner, "deactivated-chair", testPickup)
+	deleted := ts.registerChair(t, f.Owner, "deleted-chair", testPickup)
+
+	want := []string{f.Chair.ID, deactivated.ID, deleted.ID}
+	slices.Sort(want)
+	if got := ts.nearbyChairIDs(t, f.User); !slices.Equal(got, want) {
+		t.Fatalf("nearby chairs = %v, want %v", got, want)
+	}
+
+	// 直前に返していた椅子でも、無効化・削除した次のリクエストからは返さない
+	ts.mustDo(t, http.StatusNoContent, http.MethodPost, "/api/chair/activity", deactivated.Cookie, postChairActivityRequest{IsActive: false})
+	ts.mustDo(t, http.StatusNoContent, http.MethodDelete, "/api/owner/chairs/"+deleted.ID, f.Owner.Cookie, nil)
+	if got := ts.nearbyChairIDs(t, f.User); !slices.Equal(got, []string{f.Chair.ID}) {
+		t.Fatalf("nearby chairs = %v, want only %s", got, f.Chair.ID)
+	}
+
+	// ライドを割り当てられた椅子も返さない
+	ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	if got := ts.nearbyChairIDs(t, f.User); len(got) != 0 {
+		t.Fatalf("nearby chairs = %v, want none while the last chair is on a ride", got)
+	}
+}
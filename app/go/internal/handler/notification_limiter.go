@@ -0,0 +1,30 @@
+package handler
+
+import "sync/atomic"
+
+const (
+	// defaultNotificationConcurrency は通知エンドポイントが同時にDBを触ってよいリクエスト数の既定値
+	defaultNotificationConcurrency = 256
+	// shedRetryAfterMs は混雑で通知を返せなかったときのリトライ間隔
+	// 通常の100msより長くして、ポーリングの波が引くのを待たせる
+	shedRetryAfterMs = 500
+)
+
+// notificationShed は混雑により通知を返さなかった回数
+var notificationShed atomic.Int64
+
+// tryAcquireNotification は空きが無ければ待たずに false を返す
+// DBのコネクション待ちに並ばせるより、リトライ間隔を延ばして返したほうが全体として早く捌ける
+func (s *server) tryAcquireNotification() bool {
+	select {
+	case s.notificationSemaphore <- struct{}{}:
+		return true
+	default:
+		notificationShed.Add(1)
+		return false
+	}
+}
+
+func (s *server) releaseNotification() {
+	<-s.notificationSemaphore
+}
@@ -0,0 +1,45 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSaturatedNotificationLimiterShedsWithLongerRetry(t *testing.T) {
+	cfg := testConfig()
+	cfg.NotificationMaxConcurrency = 2
+	ts := newTestServerWithConfig(t, cfg)
+	f := ts.newRideFixture(t, "shed")
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+
+	// DBを触っている通知のリクエストで枠が埋まっているとみなす
+	for range cfg.NotificationMaxConcurrency {
+		ts.notificationSemaphore <- struct{}{}
+	}
+	shedBefore := notificationShed.Load()
+
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/notification", f.User.Cookie, nil)
+	if res := decodeJSON[appGetNotificationResponse](t, rec); res.Data != nil || res.RetryAfterMs != shedRetryAfterMs {
+		t.Fatalf("app notification while saturated = %+v, want no data and retry_after_ms %d", res, shedRetryAfterMs)
+	}
+	rec = ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/chair/notification", f.Chair.Cookie, nil)
+	if res := decodeJSON[chairGetNotificationResponse](t, rec); res.Data != nil || res.RetryAfterMs != shedRetryAfterMs {
+		t.Fatalf("chair notification while saturated = %+v, want no data and retry_after_ms %d", res, shedRetryAfterMs)
+	}
+	if got := notificationShed.Load() - shedBefore; got != 2 {
+		t.Fatalf("shed = %d, want 2", got)
+	}
+
+	// 枠が空けば、捨てた通知は次のポーリングで届く
+	ts.releaseNotification()
+	rec = ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/notification", f.User.Cookie, nil)
+	res := decodeJSON[appGetNotificationResponse](t, rec)
+	if res.Data == nil || res.Data.RideID != rideID || res.Data.Status != RideStatusMatching {
+		t.Fatalf("app notification after release = %+v, want %s MATCHING", res, rideID)
+	}
+	if res.RetryAfterMs >= shedRetryAfterMs {
+		t.Fatalf("retry_after_ms = %d, want shorter than the shed interval %d", res.RetryAfterMs, shedRetryAfterMs)
+	}
+}
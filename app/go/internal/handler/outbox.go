@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// outboxKindRideStatusWebhook はライドのステータスが変わったことを webhook で知らせる
+	outboxKindRideStatusWebhook = "ride_status_webhook"
+	// outboxDispatchInterval ごとに未送信の行を取りに行く
+	outboxDispatchInterval = 500 * time.Millisecond
+	// outboxBatchSize は一度に取る行数
+	outboxBatchSize = 50
+	// outboxLease より前に取ったまま送信済みにならない行は、取った側が落ちたとみなして送り直す
+	outboxLease = 30 * time.Second
+)
+
+type outboxMessage struct {
+	ID       string `db:"id"`
+	Kind     string `db:"kind"`
+	Payload  []byte `db:"payload"`
+	Attempts int    `db:"attempts"`
+}
+
+type rideStatusWebhookPayload struct {
+	RideID    string         `json:"ride_id"`
+	Status    RideStatusType `json:"status"`
+	ChangedAt int64          `json:"changed_at"`
+}
+
+// insertRideStatus はライドのステータスを追加し、同じトランザクションで webhook を outbox に積む
+// ロールバックすれば webhook も送られず、コミットすればプロセスが落ちても後で送られる
+func (s *server) insertRideStatus(ctx context.Context, tx *sqlx.Tx, rideID string, status RideStatusType) error {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", newID(), rideID, status); err != nil {
+		return err
+	}
+	if s.rideStatusWebhookURL == "" {
+		return nil
+	}
+	return enqueueOutbox(ctx, tx, outboxKindRideStatusWebhook, &rideStatusWebhookPayload{
+		RideID:    rideID,
+		Status:    status,
+		ChangedAt: clockNow().UnixMilli(),
+	})
+}
+
+func enqueueOutbox(ctx context.Context, tx *sqlx.Tx, kind string, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO outbox (id, kind, payload) VALUES (?, ?, ?)", newID(), kind, b)
+	return err
+}
+
+// startOutboxDispatcher は outbox の未送信の行を定期的に送る
+func (s *server) startOutboxDispatcher() {
+	if s.rideStatusWebhookURL == "" {
+		return
+	}
+	gate := s.registerWorker("outbox_dispatcher")
+	go func() {
+		ticker := time.NewTicker(outboxDispatchInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !gate.enter() {
+				continue
+			}
+			if err := s.dispatchOutbox(context.Background()); err != nil {
+				slog.Error("failed to dispatch outbox", "err", err)
+			}
+			gate.leave()
+		}
+	}()
+}
+
+// dispatchOutbox は未送信の行を取ってから送り、送れたものを送信済みにする
+// 取ってから送信済みにするまでに落ちた行は outboxLease の後にもう一度取られるので、少なくとも一度は届く
+// 受け取る側は id で重複を除くこと
+func (s *server) dispatchOutbox(ctx context.Context) error {
+	messages, err := s.claimOutbox(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		if err := s.sendOutboxMessage(ctx, m); err != nil {
+			slog.Warn("failed to send outbox message", "id", m.ID, "kind", m.Kind, "attempts", m.Attempts+1, "err", err)
+			// すぐに次の周期で送り直す
+			if _, err := s.db.ExecContext(ctx, "UPDATE outbox SET claimed_at = NULL, attempts = attempts + 1 WHERE id = ?", m.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, "UPDATE outbox SET delivered_at = CURRENT_TIMESTAMP(6), attempts = attempts + 1 WHERE id = ?", m.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimOutbox は未送信で、誰も取っていないか取ってから outboxLease を過ぎた行を取る
+// 複数のプロセスで動かしても SKIP LOCKED で同じ行を取り合わない
+func (s *server) claimOutbox(ctx context.Context) ([]outboxMessage, error) {
+	tx, err := s.beginTx("claimOutbox")
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	messages := []outboxMessage{}
+	if err := tx.SelectContext(ctx, &messages, `
+		SELECT id, kind, payload, attempts FROM outbox
+		WHERE delivered_at IS NULL AND (claimed_at IS NULL OR claimed_at < ?)
+		ORDER BY created_at
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED`, clockNow().Add(-outboxLease), outboxBatchSize); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return messages, nil
+	}
+
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	query, args, err := sqlx.In("UPDATE outbox SET claimed_at = ? WHERE id IN (?)", clockNow(), ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *server) sendOutboxMessage(ctx context.Context, m outboxMessage) error {
+	var url string
+	switch m.Kind {
+	case outboxKindRideStatusWebhook:
+		url = s.rideStatusWebhookURL
+	default:
+		return fmt.Errorf("unknown outbox kind: %s", m.Kind)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(m.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", m.ID)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
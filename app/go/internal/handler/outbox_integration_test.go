@@ -0,0 +1,112 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	IdempotencyKey string
+	Payload        rideStatusWebhookPayload
+}
+
+// webhookReceiver は受け取った webhook を順に記録する
+type webhookReceiver struct {
+	mu       sync.Mutex
+	received []receivedWebhook
+}
+
+func newWebhookReceiver(t *testing.T) (*webhookReceiver, string) {
+	t.Helper()
+	rcv := &webhookReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var payload rideStatusWebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rcv.mu.Lock()
+		rcv.received = append(rcv.received, receivedWebhook{IdempotencyKey: r.Header.Get("Idempotency-Key"), Payload: payload})
+		rcv.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return rcv, srv.URL
+}
+
+func (rcv *webhookReceiver) all() []receivedWebhook {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]receivedWebhook(nil), rcv.received...)
+}
+
+func TestOutboxRedeliversMessageClaimedByCrashedDispatcher(t *testing.T) {
+	clock := useFakeClock(t)
+	rcv, url := newWebhookReceiver(t)
+	cfg := testConfig()
+	cfg.RideStatusWebhookURL = url
+	ts := newTestServerWithConfig(t, cfg)
+	ctx := context.Background()
+
+	f := ts.newRideFixture(t, "outbox")
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+
+	// 取ったところで送る前に落ちた dispatcher の代わりに、取るだけで何もしない
+	claimed, err := ts.claimOutbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("claimed %d messages, want the MATCHING webhook", len(claimed))
+	}
+
+	// リースが切れるまでは別の dispatcher も取らない
+	if err := ts.dispatchOutbox(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := rcv.all(); len(got) != 0 {
+		t.Fatalf("delivered %+v while the crashed dispatcher still held the lease", got)
+	}
+
+	// リースが切れれば再起動した dispatcher が送り直す
+	clock.advance(outboxLease + time.Second)
+	if err := ts.dispatchOutbox(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := rcv.all()
+	if len(got) != 1 {
+		t.Fatalf("delivered %d webhooks after the lease expired, want 1", len(got))
+	}
+	if got[0].IdempotencyKey != claimed[0].ID || got[0].Payload.RideID != rideID || got[0].Payload.Status != RideStatusMatching {
+		t.Fatalf("webhook = %+v, want %s MATCHING keyed by %s", got[0], rideID, claimed[0].ID)
+	}
+	var attempts int
+	if err := ts.db.Get(&attempts, "SELECT attempts FROM outbox WHERE id = ? AND delivered_at IS NOT NULL", claimed[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1", attempts)
+	}
+
+	// 送信済みになった行は二度と送らない
+	clock.advance(outboxLease + time.Second)
+	if err := ts.dispatchOutbox(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := rcv.all(); len(got) != 1 {
+		t.Fatalf("delivered %d webhooks after another dispatch, want still 1", len(got))
+	}
+}
@@ -0,0 +1,63 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// doWithAPIKey はセッションの代わりに Authorization ヘッダーのAPIキーでオーナーのAPIを呼ぶ
+func (ts *testServer) doWithAPIKey(t *testing.T, method, path, apiKey string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOwnerAPIKeyAuthenticatesUntilRevoked(t *testing.T) {
+	ts := newTestServer(t)
+	owner := ts.registerOwner(t, "keyed-owner")
+	ts.registerChair(t, owner, "keyed-chair", testPickup)
+
+	rec := ts.mustDo(t, http.StatusCreated, http.MethodPost, "/api/owner/api-keys", owner.Cookie, nil)
+	key := decodeJSON[ownerPostAPIKeysResponse](t, rec)
+	if key.ID == "" || key.APIKey == "" {
+		t.Fatalf("minted key = %+v, want an id and the key", key)
+	}
+	var stored string
+	if err := ts.db.Get(&stored, "SELECT key_hash FROM owner_api_keys WHERE id = ?", key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored == key.APIKey {
+		t.Fatal("the api key is stored in plain text")
+	}
+
+	// APIキーだけでセッションと同じオーナーとして扱われる
+	rec = ts.doWithAPIKey(t, http.MethodGet, "/api/owner/chairs", key.APIKey)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/owner/chairs with the key: status = %d: %s", rec.Code, rec.Body.String())
+	}
+	chairs := decodeJSON[ownerGetChairResponse](t, rec).Chairs
+	if len(chairs) != 1 || chairs[0].Name != "keyed-chair" {
+		t.Fatalf("chairs = %+v, want the owner's keyed-chair", chairs)
+	}
+	if rec := ts.doWithAPIKey(t, http.MethodGet, "/api/owner/chairs", key.APIKey+"x"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown key: status = %d, want 401", rec.Code)
+	}
+
+	// 他のオーナーは取り消せず、取り消した後のキーは使えない
+	other := ts.registerOwner(t, "other-owner")
+	ts.mustDo(t, http.StatusNotFound, http.MethodDelete, "/api/owner/api-keys/"+key.ID, other.Cookie, nil)
+	ts.mustDo(t, http.StatusNoContent, http.MethodDelete, "/api/owner/api-keys/"+key.ID, owner.Cookie, nil)
+	if rec := ts.doWithAPIKey(t, http.MethodGet, "/api/owner/chairs", key.APIKey); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked key: status = %d, want 401", rec.Code)
+	}
+	ts.mustDo(t, http.StatusNotFound, http.MethodDelete, "/api/owner/api-keys/"+key.ID, owner.Cookie, nil)
+
+	// セッションでは引き続き使える
+	ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/owner/chairs", owner.Cookie, nil)
+}
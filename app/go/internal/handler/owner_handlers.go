@@ -0,0 +1,694 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/internal/fare"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// maxTip は1回のライドで支払えるチップの上限
+	maxTip = 10000
+)
+
+type ownerPostOwnersRequest struct {
+	Name string `json:"name"`
+}
+
+type ownerPostOwnersResponse struct {
+	ID                 string `json:"id"`
+	ChairRegisterToken string `json:"chair_register_token"`
+}
+
+func (s *server) ownerPostOwners(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &ownerPostOwnersRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(name) are empty"))
+		return
+	}
+
+	ownerID := newID()
+	accessToken := secureRandomStr(32)
+	chairRegisterToken := secureRandomStr(32)
+
+	_, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO owners (id, name, access_token, chair_register_token) VALUES (?, ?, ?, ?)",
+		ownerID, req.Name, accessToken, chairRegisterToken,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Path:  "/",
+		Name:  "owner_session",
+		Value: accessToken,
+	})
+
+	writeJSON(w, http.StatusCreated, &ownerPostOwnersResponse{
+		ID:                 ownerID,
+		ChairRegisterToken: chairRegisterToken,
+	})
+}
+
+type ownerPostAPIKeysResponse struct {
+	ID string `json:"id"`
+	// APIKey は発行時にしか返さない
+	APIKey string `json:"api_key"`
+}
+
+// hashOwnerAPIKey はAPIキーを保存・照合するためのハッシュを返す
+func hashOwnerAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *server) ownerPostAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	keyID := newID()
+	apiKey := secureRandomStr(32)
+
+	if _, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO owner_api_keys (id, owner_id, key_hash) VALUES (?, ?, ?)",
+		keyID, owner.ID, hashOwnerAPIKey(apiKey),
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &ownerPostAPIKeysResponse{
+		ID:     keyID,
+		APIKey: apiKey,
+	})
+}
+
+func (s *server) ownerDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	keyID := r.PathValue("key_id")
+
+	result, err := s.db.ExecContext(
+		ctx,
+		"UPDATE owner_api_keys SET revoked_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND owner_id = ? AND revoked_at IS NULL",
+		keyID, owner.ID,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("api key not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type chairSales struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Sales         int64  `json:"sales"`
+	DiscountTotal int64  `json:"discount_total"`
+	NetSales      int64  `json:"net_sales"`
+	Tips          int64  `json:"tips"`
+}
+
+type modelSales struct {
+	Model         string `json:"model"`
+	Sales         int64  `json:"sales"`
+	DiscountTotal int64  `json:"discount_total"`
+	NetSales      int64  `json:"net_sales"`
+	Tips          int64  `json:"tips"`
+}
+
+type ownerGetSalesResponse struct {
+	TotalSales    int64        `json:"total_sales"`
+	DiscountTotal int64        `json:"discount_total"`
+	NetSales      int64        `json:"net_sales"`
+	Tips          int64        `json:"tips"`
+	Chairs        []chairSales `json:"chairs"`
+	Models        []modelSales `json:"models"`
+	// Since と Until は実際に集計した範囲 [Since, Until) をミリ秒のUNIX時刻で返す
+	Since int64 `json:"since"`
+	Until int64 `json:"until"`
+	// Partial は範囲が大きすぎて until より手前までしか集計していないときに true になる
+	// 続きは since に NextSince を指定して取得する
+	Partial   bool   `json:"partial,omitempty"`
+	NextSince *int64 `json:"next_since,omitempty"`
+	// Unit は金額の単位。100なら各金額は100円を1とした値になる
+	Unit int `json:"unit"`
+}
+
+// parseSalesUnit は unit と rounding のクエリパラメータを読む。unit の既定は1円で、丸めの既定は四捨五入
+func parseSalesUnit(r *http.Request) (fare.Rounding, error) {
+	rounding := fare.Rounding{Unit: 1, Mode: fare.RoundNearest}
+	if v := r.URL.Query().Get("unit"); v != "" {
+		unit, err := strconv.Atoi(v)
+		if err != nil {
+			return rounding, err
+		}
+		if unit < 1 {
+			return rounding, fmt.Errorf("unit must be positive: %d", unit)
+		}
+		rounding.Unit = unit
+	}
+	if v := r.URL.Query().Get("rounding"); v != "" {
+		if v != fare.RoundUp && v != fare.RoundNearest && v != fare.RoundDown {
+			return rounding, fmt.Errorf("rounding must be up, nearest or down: %s", v)
+		}
+		rounding.Mode = v
+	}
+	return rounding, nil
+}
+
+// scale は集計した金額をすべて同じ単位と丸めで換算する
+// 金額ごとに丸めるので、換算後は net_sales = total_sales - discount_total が成り立たないことがある
+func (res *ownerGetSalesResponse) scale(rounding fare.Rounding) {
+	res.Unit = rounding.Unit
+	res.TotalSales = rounding.Scale(res.TotalSales)
+	res.DiscountTotal = rounding.Scale(res.DiscountTotal)
+	res.NetSales = rounding.Scale(res.NetSales)
+	res.Tips = rounding.Scale(res.Tips)
+	for i := range res.Chairs {
+		c := &res.Chairs[i]
+		c.Sales = rounding.Scale(c.Sales)
+		c.DiscountTotal = rounding.Scale(c.DiscountTotal)
+		c.NetSales = rounding.Scale(c.NetSales)
+		c.Tips = rounding.Scale(c.Tips)
+	}
+	for i := range res.Models {
+		m := &res.Models[i]
+		m.Sales = rounding.Scale(m.Sales)
+		m.DiscountTotal = rounding.Scale(m.DiscountTotal)
+		m.NetSales = rounding.Scale(m.NetSales)
+		m.Tips = rounding.Scale(m.Tips)
+	}
+}
+
+// ownerSalesChunkRides は1回のリクエストで集計する完了済みライドのおおよその上限
+const ownerSalesChunkRides = 10000
+
+// ownerSalesChunkEnd は since から数えて ownerSalesChunkRides 件目の完了済みライドがあれば、
+// その次のミリ秒の始まりを今回の集計範囲の終端(その時刻を含まない)として返す
+// ミリ秒単位で区切るので、続きを next_since から取得すれば重複も漏れもない
+func ownerSalesChunkEnd(ctx context.Context, tx *sqlx.Tx, ownerID string, since, until time.Time) (time.Time, bool, error) {
+	var updatedAt time.Time
+	if err := tx.GetContext(ctx, &updatedAt, `
+		SELECT rides.updated_at FROM rides
+		JOIN chairs ON chairs.id = rides.chair_id
+		JOIN ride_statuses ON rides.id = ride_statuses.ride_id
+		WHERE chairs.owner_id = ? AND status = 'COMPLETED' AND rides.updated_at >= ? AND rides.updated_at < ?
+		ORDER BY rides.updated_at
+		LIMIT 1 OFFSET ?`, ownerID, since, until, ownerSalesChunkRides); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return until, false, nil
+		}
+		return until, false, err
+	}
+	end := updatedAt.Truncate(time.Millisecond).Add(time.Millisecond)
+	if !end.Before(until) {
+		return until, false, nil
+	}
+	return end, true, nil
+}
+
+// rideWithDiscount はライドと、そのライドに適用されたクーポンの割引額
+type rideWithDiscount struct {
+	Ride
+	Discount int64 `db:"discount"`
+}
+
+func (s *server) ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since := time.Unix(0, 0).UTC()
+	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	if r.URL.Query().Get("since") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = unixMilliUTC(parsed)
+	}
+	if r.URL.Query().Get("until") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		until = unixMilliUTC(parsed)
+	}
+	// since はその時刻を含み、until はその時刻を含まない
+	if !until.After(since) {
+		writeError(w, http.StatusBadRequest, errors.New("until must be after since"))
+		return
+	}
+	rounding, err := parseSalesUnit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	owner := r.Context().Value("owner").(*Owner)
+
+	tx, err := s.beginTx("ownerGetSales")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chairs := []Chair{}
+	if err := tx.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetSalesResponse{
+		TotalSales: 0,
+		Chairs:     []chairSales{},
+		Since:      since.UnixMilli(),
+	}
+
+	chunkEnd, partial, err := ownerSalesChunkEnd(ctx, tx.Tx, owner.ID, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if partial {
+		until = chunkEnd
+		nextSince := chunkEnd.UnixMilli()
+		res.Partial = true
+		res.NextSince = &nextSince
+	}
+	res.Until = until.UnixMilli()
+
+	modelSalesByModel := map[string]*modelSales{}
+	for _, chair := range chairs {
+		rides := []rideWithDiscount{}
+		if err := tx.SelectContext(ctx, &rides, `
+			SELECT rides.*, IFNULL(coupons.discount, 0) AS discount FROM rides
+			JOIN ride_statuses ON rides.id = ride_statuses.ride_id
+			LEFT JOIN coupons ON coupons.used_by = rides.id
+			WHERE chair_id = ? AND status = 'COMPLETED' AND rides.updated_at >= ? AND rides.updated_at < ?`, chair.ID, since, until); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		sales, discount := sumSales(rides)
+		tips := sumTips(rides)
+		res.TotalSales += sales
+		res.DiscountTotal += discount
+		res.Tips += tips
+
+		res.Chairs = append(res.Chairs, chairSales{
+			ID:            chair.ID,
+			Name:          chair.Name,
+			Sales:         sales,
+			DiscountTotal: discount,
+			NetSales:      sales - discount,
+			Tips:          tips,
+		})
+
+		ms, ok := modelSalesByModel[chair.Model]
+		if !ok {
+			ms = &modelSales{Model: chair.Model}
+			modelSalesByModel[chair.Model] = ms
+		}
+		ms.Sales += sales
+		ms.DiscountTotal += discount
+		ms.NetSales += sales - discount
+		ms.Tips += tips
+	}
+	res.NetSales = res.TotalSales - res.DiscountTotal
+
+	models := []modelSales{}
+	for _, ms := range modelSalesByModel {
+		models = append(models, *ms)
+	}
+	res.Models = models
+	res.scale(rounding)
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// unixMilliUTC はミリ秒のUNIX時刻をUTCの時刻にする
+// DBとの読み書きはUTCで行うので、サーバーのタイムゾーンに依存させない
+func unixMilliUTC(ms int64) time.Time {
+	return time.UnixMilli(ms).UTC()
+}
+
+// sumSales は割引前の売上と、クーポンにより実際に割り引かれた額を返す
+func sumSales(rides []rideWithDiscount) (int64, int64) {
+	var sale, discount int64
+	for _, ride := range rides {
+		gross := calculateSale(ride.Ride)
+		sale += gross
+		discount += gross - applyDiscount(ride.Ride, ride.Discount)
+	}
+	return sale, discount
+}
+
+// sumTips はチップの合計を返す。チップは売上とは別に集計する
+func sumTips(rides []rideWithDiscount) int64 {
+	var tips int64
+	for _, ride := range rides {
+		tips += ride.Tip
+	}
+	return tips
+}
+
+// applyDiscount は calculateDiscountedFare と同じく、割引を距離料金部分にのみ適用した運賃を返す
+// 見積もりで運賃を保証したライドは保証した運賃を返す
+func applyDiscount(ride Ride, discount int64) int64 {
+	if ride.LockedFare != nil {
+		return *ride.LockedFare
+	}
+	return fare.Calculate(fare.Input{Distance: ride.Distance, Discount: discount, Rounding: loadRuntimeConfig().FareRounding})
+}
+
+func calculateSale(ride Ride) int64 {
+	return calculateFareByDistance(ride.Distance)
+}
+
+type chairWithDetail struct {
+	ID                     string       `db:"id"`
+	OwnerID                string       `db:"owner_id"`
+	Name                   string       `db:"name"`
+	AccessToken            string       `db:"access_token"`
+	Model                  string       `db:"model"`
+	IsActive               bool         `db:"is_active"`
+	CreatedAt              time.Time    `db:"created_at"`
+	UpdatedAt              time.Time    `db:"updated_at"`
+	TotalDistance          int          `db:"total_distance"`
+	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+	DistanceOnRide         int          `db:"distance_on_ride"`
+	DistanceIdle           int          `db:"distance_idle"`
+	Maintenance            bool         `db:"maintenance"`
+	DeletedAt              sql.NullTime `db:"deleted_at"`
+}
+
+type ownerGetChairResponse struct {
+	Chairs []ownerGetChairResponseChair `json:"chairs"`
+}
+
+type ownerGetChairResponseChair struct {
+	ID                     string `json:"id"`
+	Name                   string `json:"name"`
+	Model                  string `json:"model"`
+	Active                 bool   `json:"active"`
+	RegisteredAt           int64  `json:"registered_at"`
+	TotalDistance          int    `json:"total_distance"`
+	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	DistanceOnRide         int    `json:"distance_on_ride"`
+	DistanceIdle           int    `json:"distance_idle"`
+	Maintenance            bool   `json:"maintenance"`
+	DeletedAt              *int64 `json:"deleted_at,omitempty"`
+}
+
+// ownerGetChairs はオーナーの椅子を返す。削除した椅子は include_deleted=1 のときだけ含める
+func (s *server) ownerGetChairs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	includeDeleted := r.URL.Query().Get("include_deleted") == "1"
+
+	// 変更後は単純なSELECTのみ
+	chairs := []chairWithDetail{}
+	if err := s.db.SelectContext(ctx, &chairs, `
+		SELECT
+			id, owner_id, name, access_token, model, is_active, created_at, updated_at,
+			total_distance, total_distance_updated_at, distance_on_ride, distance_idle, maintenance, deleted_at
+		FROM chairs
+		WHERE owner_id = ? AND (? OR deleted_at IS NULL)`, owner.ID, includeDeleted); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 椅子が無いオーナーにも null ではなく空の配列を返す
+	res := ownerGetChairResponse{Chairs: []ownerGetChairResponseChair{}}
+	for _, chair := range chairs {
+		c := ownerGetChairResponseChair{
+			ID:             chair.ID,
+			Name:           chair.Name,
+			Model:          chair.Model,
+			Active:         chair.IsActive,
+			RegisteredAt:   chair.CreatedAt.UnixMilli(),
+			TotalDistance:  chair.TotalDistance,
+			DistanceOnRide: chair.DistanceOnRide,
+			DistanceIdle:   chair.DistanceIdle,
+			Maintenance:    chair.Maintenance,
+		}
+		if chair.TotalDistanceUpdatedAt.Valid {
+			t := chair.TotalDistanceUpdatedAt.Time.UnixMilli()
+			c.TotalDistanceUpdatedAt = &t
+		}
+		if chair.DeletedAt.Valid {
+			t := chair.DeletedAt.Time.UnixMilli()
+			c.DeletedAt = &t
+		}
+		res.Chairs = append(res.Chairs, c)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// ownerPutChairRequest は指定した項目だけを変更する
+type ownerPutChairRequest struct {
+	Maintenance *bool   `json:"maintenance,omitempty"`
+	Name        *string `json:"name,omitempty"`
+}
+
+func (s *server) ownerPutChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerPutChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	chair, err := chairForOwner(ctx, s.db, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if req.Name != nil {
+		if *req.Name == "" {
+			writeError(w, http.StatusBadRequest, errors.New("name must not be empty"))
+			return
+		}
+		// 名前はオーナーごとに一意。登録時と同じく chairs_owner_id_active_name で弾かれたら 409 にする
+		if err := s.renameChair(ctx, chair, *req.Name); err != nil {
+			if isDuplicateKeyError(err) {
+				writeError(w, http.StatusConflict, errors.New("chair with the same name already exists"))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if req.Maintenance != nil {
+		if err := s.setChairMaintenance(ctx, chair, *req.Maintenance); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownerDeleteChair は椅子を論理削除する
+// 削除した椅子はマッチングや一覧から外れ、アクセストークンもすぐに使えなくなるが、過去のライドは売上に残る
+// ライドが割り当てられている間は削除できない
+func (s *server) ownerDeleteChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	tx, err := s.beginTx("ownerDeleteChair")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, err := lockChairForOwner(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.CurrentRideID.Valid {
+		writeError(w, http.StatusConflict, errors.New("chair has an active ride"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET deleted_at = CURRENT_TIMESTAMP(6), is_active = FALSE WHERE id = ?", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 認証のキャッシュから外して、以降のリクエストを拒否する
+	s.forgetChair(chair.AccessToken)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const (
+	// ownerNotificationLimit は1回の通知で返すイベントの最大数
+	ownerNotificationLimit = 100
+	// ownerNotificationRetryAfterMs は売上の通知なので、ユーザーや椅子の通知よりゆっくりポーリングさせる
+	ownerNotificationRetryAfterMs = 1000
+)
+
+// ownerNotificationLongPollTimeout は wait=true でライドの完了を待つ最長の時間。テストでは短くする
+var ownerNotificationLongPollTimeout = 25 * time.Second
+
+type ownerGetNotificationResponse struct {
+	Events []ownerGetNotificationEvent `json:"events"`
+	// Cursor は次回のリクエストで cursor に指定する値。イベントが無ければリクエストの値をそのまま返す
+	Cursor       string `json:"cursor"`
+	RetryAfterMs int    `json:"retry_after_ms"`
+}
+
+type ownerGetNotificationEvent struct {
+	RideID      string `json:"ride_id"`
+	ChairID     string `json:"chair_id"`
+	ChairName   string `json:"chair_name"`
+	Fare        int64  `json:"fare"`
+	CompletedAt int64  `json:"completed_at"`
+}
+
+// ownerGetNotification はオーナーの椅子で完了したライドを、cursor で指定されたCOMPLETEDのステータスIDより後ろから返す
+// wait=true でまだイベントが無ければ、ライドが完了するまで最長 ownerNotificationLongPollTimeout 待ってから返す
+func (s *server) ownerGetNotification(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	cursor := r.URL.Query().Get("cursor")
+	wait := r.URL.Query().Get("wait") == "true"
+
+	var completed <-chan struct{}
+	if wait {
+		// 読んでから待ち始めるまでに完了したライドを取りこぼさないよう、先に待ち始める
+		ch, release, ok := s.state.ownerCompletions.wait(owner.ID)
+		if ok {
+			defer release()
+			completed = ch
+		}
+	}
+
+	res, err := s.ownerNotificationEvents(ctx, owner.ID, cursor)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if completed != nil {
+		// long poll の後はすぐに次の long poll を始めさせる
+		res.RetryAfterMs = 0
+	}
+	if completed == nil || len(res.Events) > 0 {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	timer := time.NewTimer(ownerNotificationLongPollTimeout)
+	defer timer.Stop()
+	select {
+	case <-completed:
+		res, err = s.ownerNotificationEvents(ctx, owner.ID, cursor)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		res.RetryAfterMs = 0
+	case <-timer.C:
+	case <-ctx.Done():
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *server) ownerNotificationEvents(ctx context.Context, ownerID, cursor string) (*ownerGetNotificationResponse, error) {
+	rows := []struct {
+		rideWithDiscount
+		StatusID    string    `db:"status_id"`
+		CompletedAt time.Time `db:"completed_at"`
+		// LiveChairName は今の椅子の名前。rides.chair_name と区別するため別名にする
+		LiveChairName string `db:"live_chair_name"`
+	}{}
+	if err := s.db.SelectContext(ctx, &rows, `
+		SELECT rides.*, IFNULL(coupons.discount, 0) AS discount,
+			ride_statuses.id AS status_id, ride_statuses.created_at AS completed_at, chairs.name AS live_chair_name
+		FROM ride_statuses
+		INNER JOIN rides ON rides.id = ride_statuses.ride_id
+		INNER JOIN chairs ON chairs.id = rides.chair_id
+		LEFT JOIN coupons ON coupons.used_by = rides.id
+		WHERE chairs.owner_id = ? AND ride_statuses.status = 'COMPLETED' AND ride_statuses.id > ?
+		ORDER BY ride_statuses.id
+		LIMIT ?`, ownerID, cursor, ownerNotificationLimit); err != nil {
+		return nil, err
+	}
+
+	res := &ownerGetNotificationResponse{
+		Events:       []ownerGetNotificationEvent{},
+		Cursor:       cursor,
+		RetryAfterMs: ownerNotificationRetryAfterMs,
+	}
+	for _, row := range rows {
+		// 割り当て時の名前が残っていれば、後から椅子の名前を変えても履歴は変わらない
+		chairName := row.LiveChairName
+		if row.ChairName != nil {
+			chairName = *row.ChairName
+		}
+		res.Events = append(res.Events, ownerGetNotificationEvent{
+			RideID:      row.ID,
+			ChairID:     row.ChairID.String,
+			ChairName:   chairName,
+			Fare:        applyDiscount(row.Ride, row.Discount),
+			CompletedAt: row.CompletedAt.UnixMilli(),
+		})
+		res.Cursor = row.StatusID
+	}
+	if len(rows) == ownerNotificationLimit {
+		// 続きがあるかもしれないのですぐに取りに来させる
+		res.RetryAfterMs = 0
+	}
+	return res, nil
+}
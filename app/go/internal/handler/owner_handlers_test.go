@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+// inTimezones は time.Local を tz ごとに差し替えて fn を呼ぶ
+func inTimezones(t *testing.T, fn func(t *testing.T)) {
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+	for _, tz := range []*time.Location{time.UTC, time.FixedZone("JST", 9*60*60), time.FixedZone("EST", -5*60*60)} {
+		time.Local = tz
+		t.Run(tz.String(), fn)
+	}
+}
+
+func TestUnixMilliUTCIgnoresLocalTimezone(t *testing.T) {
+	// 2024-11-24 16:00:00.123 UTC
+	const ms = 1732464000123
+	const datetime = "2024-11-24 16:00:00.123"
+	inTimezones(t, func(t *testing.T) {
+		got := unixMilliUTC(ms)
+		if got.UnixMilli() != ms || got.Location() != time.UTC {
+			t.Fatalf("unixMilliUTC(%d) = %v", ms, got)
+		}
+		// DBへはUTCのDATETIMEとして書き、読むときもUTCとして解釈する
+		if s := got.Format("2006-01-02 15:04:05.000"); s != datetime {
+			t.Fatalf("DATETIME = %q, want %q", s, datetime)
+		}
+		parsed, err := time.ParseInLocation("2006-01-02 15:04:05.000", datetime, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.UnixMilli() != ms {
+			t.Fatalf("parsed DATETIME = %d, want %d", parsed.UnixMilli(), ms)
+		}
+	})
+}
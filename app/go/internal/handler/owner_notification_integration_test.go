@@ -0,0 +1,180 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func (ts *testServer) ownerNotificationEvents(t *testing.T, owner testOwner) []ownerGetNotificationEvent {
+	t.Helper()
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/owner/notification", owner.Cookie, nil)
+	return decodeJSON[ownerGetNotificationResponse](t, rec).Events
+}
+
+func TestOwnerNotificationKeepsChairNameAtAssignment(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "history")
+	rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+
+	if _, err := ts.db.Exec("UPDATE chairs SET name = ? WHERE id = ?", "renamed", f.Chair.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	events := ts.ownerNotificationEvents(t, f.Owner)
+	if len(events) != 1 || events[0].RideID != rideID {
+		t.Fatalf("events = %+v, want the completed ride %s", events, rideID)
+	}
+	if events[0].ChairName != "history-chair" {
+		t.Fatalf("chair_name = %q, want the name at assignment", events[0].ChairName)
+	}
+
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/app/rides", f.User.Cookie, nil)
+	rides := decodeJSON[getAppRidesResponse](t, rec).Rides
+	if len(rides) != 1 || rides[0].Chair.Name != "history-chair" {
+		t.Fatalf("ride history = %+v, want the name at assignment", rides)
+	}
+}
+
+func TestOwnerNotificationFallsBackToLiveChairName(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "legacy")
+	rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+
+	// 割り当て時の椅子の情報を残す前に完了したライド
+	if _, err := ts.db.Exec("UPDATE rides SET chair_name = NULL, chair_model = NULL, chair_owner_name = NULL WHERE id = ?", rideID); err != nil {
+		t.Fatal(err)
+	}
+
+	events := ts.ownerNotificationEvents(t, f.Owner)
+	if len(events) != 1 || events[0].ChairName != "legacy-chair" {
+		t.Fatalf("events = %+v, want the current chair name", events)
+	}
+}
+
+// setOwnerLongPollTimeout はテストの間だけ long poll の待ち時間を変える
+func setOwnerLongPollTimeout(t *testing.T, d time.Duration) {
+	t.Helper()
+	orig := ownerNotificationLongPollTimeout
+	ownerNotificationLongPollTimeout = d
+	t.Cleanup(func() { ownerNotificationLongPollTimeout = orig })
+}
+
+// startOwnerLongPoll は wait=true の通知の取得を別の goroutine で始め、ライドの完了を待ち始めるまで待つ
+func (ts *testServer) startOwnerLongPoll(t *testing.T, ctx context.Context, owner testOwner, cursor string) <-chan *httptest.ResponseRecorder {
+	t.Helper()
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/api/owner/notification?wait=true&cursor="+cursor, nil)
+		req.AddCookie(owner.Cookie)
+		rec := httptest.NewRecorder()
+		ts.handler.ServeHTTP(rec, req)
+		done <- rec
+	}()
+	for i := 0; ; i++ {
+		ts.state.ownerCompletions.mu.Lock()
+		waiting := len(ts.state.ownerCompletions.waiters[owner.ID])
+		ts.state.ownerCompletions.mu.Unlock()
+		if waiting > 0 {
+			return done
+		}
+		if i == 100 {
+			t.Fatal("long poll did not start waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOwnerNotificationLongPoll(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		setOwnerLongPollTimeout(t, 100*time.Millisecond)
+		ts := newTestServer(t)
+		f := ts.newRideFixture(t, "timeout")
+
+		start := time.Now()
+		rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/owner/notification?wait=true&cursor=before", f.Owner.Cookie, nil)
+		res := decodeJSON[ownerGetNotificationResponse](t, rec)
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("returned after %v, want to wait for the timeout", elapsed)
+		}
+		if len(res.Events) != 0 || res.Cursor != "before" || res.RetryAfterMs != 0 {
+			t.Fatalf("response = %+v, want no events, the same cursor and an immediate retry", res)
+		}
+	})
+
+	t.Run("event arrives", func(t *testing.T) {
+		setOwnerLongPollTimeout(t, 10*time.Second)
+		ts := newTestServer(t)
+		f := ts.newRideFixture(t, "arrives")
+
+		done := ts.startOwnerLongPoll(t, context.Background(), f.Owner, "")
+		rideID := ts.completeRide(t, f.User, f.Chair, testPickup, testDestination)
+		select {
+		case rec := <-done:
+			res := decodeJSON[ownerGetNotificationResponse](t, rec)
+			if len(res.Events) != 1 || res.Events[0].RideID != rideID {
+				t.Fatalf("events = %+v, want the completed ride %s", res.Events, rideID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("long poll was not woken by the completed ride")
+		}
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		setOwnerLongPollTimeout(t, 10*time.Second)
+		ts := newTestServer(t)
+		f := ts.newRideFixture(t, "interrupted")
+
+		// クライアントが切断したら何も書かずに返る
+		ctx, cancel := context.WithCancel(context.Background())
+		done := ts.startOwnerLongPoll(t, ctx, f.Owner, "")
+		cancel()
+		select {
+		case rec := <-done:
+			if rec.Body.Len() != 0 {
+				t.Fatalf("canceled long poll wrote %s", rec.Body.String())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("long poll did not return after the client disconnected")
+		}
+
+		// /api/initialize で状態を作り直すときも待っている long poll を返す
+		done = ts.startOwnerLongPoll(t, context.Background(), f.Owner, "")
+		ts.state.Reset()
+		select {
+		case rec := <-done:
+			if res := decodeJSON[ownerGetNotificationResponse](t, rec); len(res.Events) != 0 {
+				t.Fatalf("events = %+v, want none", res.Events)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("long poll did not return after the state was reset")
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		setOwnerLongPollTimeout(t, 10*time.Second)
+		ts := newTestServer(t)
+		f := ts.newRideFixture(t, "limit")
+		for i := 0; i < ownerLongPollLimit; i++ {
+			_, release, ok := ts.state.ownerCompletions.wait(f.Owner.ID)
+			if !ok {
+				t.Fatalf("long poll %d was refused below the limit", i+1)
+			}
+			t.Cleanup(release)
+		}
+
+		// 上限を超えた分は待たずに普通のポーリングとして返す
+		start := time.Now()
+		rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/owner/notification?wait=true", f.Owner.Cookie, nil)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("returned after %v, want at once over the limit", elapsed)
+		}
+		if res := decodeJSON[ownerGetNotificationResponse](t, rec); res.RetryAfterMs != ownerNotificationRetryAfterMs {
+			t.Fatalf("retry_after_ms = %d, want the normal polling interval", res.RetryAfterMs)
+		}
+	})
+}
@@ -1,4 +1,4 @@
-package main
+package handler
 
 import (
 	"bytes"
@@ -7,17 +7,39 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
 var erroredUpstream = errors.New("errored upstream")
 
+// paymentGatewayURL は settings テーブルの payment_gateway_url
+// 書き換えは /api/initialize のみなので、その時だけ更新する
+var paymentGatewayURL atomic.Value
+
+func setPaymentGatewayURL(url string) {
+	paymentGatewayURL.Store(url)
+}
+
+// getPaymentGatewayURL はまだ読み込んでいなければDBから読み込む
+func (s *server) getPaymentGatewayURL(ctx context.Context) (string, error) {
+	if url, ok := paymentGatewayURL.Load().(string); ok && url != "" {
+		return url, nil
+	}
+	var url string
+	if err := s.db.GetContext(ctx, &url, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return "", err
+	}
+	setPaymentGatewayURL(url)
+	return url, nil
+}
+
 type paymentGatewayPostPaymentRequest struct {
-	Amount int `json:"amount"`
+	Amount int64 `json:"amount"`
 }
 
 type paymentGatewayGetPaymentsResponseOne struct {
-	Amount int    `json:"amount"`
+	Amount int64  `json:"amount"`
 	Status string `json:"status"`
 }
 
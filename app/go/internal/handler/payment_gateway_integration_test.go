@@ -0,0 +1,62 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// insertArrivedRide は目的地に着いた(ARRIVED)ライドをDBに直接作る
+func (ts *testServer) insertArrivedRide(t *testing.T, f rideFixture, at time.Time) string {
+	t.Helper()
+	rideID := newID()
+	distance := calculateDistance(testPickup.Latitude, testPickup.Longitude, testDestination.Latitude, testDestination.Longitude)
+	if _, err := ts.db.Exec(
+		`INSERT INTO rides (id, user_id, chair_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, distance, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rideID, f.User.ID, f.Chair.ID, testPickup.Latitude, testPickup.Longitude, testDestination.Latitude, testDestination.Longitude, distance, at, at,
+	); err != nil {
+		t.Fatal(err)
+	}
+	for i, status := range []RideStatusType{RideStatusMatching, RideStatusEnroute, RideStatusPickup, RideStatusCarrying, RideStatusArrived} {
+		if _, err := ts.db.Exec(
+			"INSERT INTO ride_statuses (id, ride_id, status, created_at, app_sent_at, chair_sent_at) VALUES (?, ?, ?, ?, ?, ?)",
+			newID(), rideID, status, at.Add(time.Duration(i)*time.Millisecond), at, at,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rideID
+}
+
+func TestEvaluationsDoNotReadSettings(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "burst")
+
+	const evaluations = 100
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Microsecond)
+	rideIDs := make([]string, evaluations)
+	for i := range rideIDs {
+		rideIDs[i] = ts.insertArrivedRide(t, f, start.Add(time.Duration(i)*time.Second))
+	}
+
+	// payment_gateway_url は /api/initialize で読み込んだものを使い、評価のたびにDBを読まない
+	mark := ts.queries.mark()
+	for _, rideID := range rideIDs {
+		ts.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", f.User.Cookie, appPostRideEvaluationRequest{Evaluation: 5})
+	}
+	var settingsQueries []string
+	for _, q := range ts.queries.since(mark) {
+		if strings.Contains(q, "settings") {
+			settingsQueries = append(settingsQueries, q)
+		}
+	}
+	if len(settingsQueries) != 0 {
+		t.Fatalf("%d evaluations issued settings queries: %v", evaluations, settingsQueries)
+	}
+	if got := ts.payments.Load(); got != evaluations {
+		t.Fatalf("payments = %d, want %d", got, evaluations)
+	}
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// priceLockTTL は見積もりの運賃を保証する期間
+	priceLockTTL = time.Minute
+	// errCodePriceLockExpired は見積もりをやり直せばよいことをクライアントが判別するためのエラーコード
+	errCodePriceLockExpired = "price_lock_expired"
+	errCodePriceLockInvalid = "price_lock_invalid"
+)
+
+var (
+	errPriceLockExpired = errors.New("price lock has expired")
+	errPriceLockInvalid = errors.New("price lock is invalid")
+)
+
+// priceLock は見積もりで提示した運賃と、その運賃を保証する条件
+type priceLock struct {
+	UserID      string
+	Pickup      Coordinate
+	Destination Coordinate
+	Fare        int64
+	ExpiresAt   time.Time
+}
+
+func (l priceLock) payload() string {
+	return fmt.Sprintf("%s|%d|%d|%d|%d|%d|%d",
+		l.UserID,
+		l.Pickup.Latitude, l.Pickup.Longitude,
+		l.Destination.Latitude, l.Destination.Longitude,
+		l.Fare, l.ExpiresAt.UnixMilli(),
+	)
+}
+
+func signPriceLockPayload(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// token は payload と key による署名をつないだ文字列を返す
+func (l priceLock) token(key []byte) string {
+	payload := l.payload()
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signPriceLockPayload(key, payload))
+}
+
+// verifyPriceLock は署名を確かめ、同じユーザー・同じ経路の期限内の見積もりなら保証する運賃を返す
+func verifyPriceLock(key []byte, token, userID string, pickup, destination Coordinate, now time.Time) (int64, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, errPriceLockInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return 0, errPriceLockInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return 0, errPriceLockInvalid
+	}
+	if !hmac.Equal(sig, signPriceLockPayload(key, string(payload))) {
+		return 0, errPriceLockInvalid
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 7 {
+		return 0, errPriceLockInvalid
+	}
+	fare, err := strconv.ParseInt(fields[5], 10, 64)
+	if err != nil {
+		return 0, errPriceLockInvalid
+	}
+	expiresAt, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return 0, errPriceLockInvalid
+	}
+
+	// 別のユーザーや経路の見積もりは使わせない
+	expected := priceLock{UserID: userID, Pickup: pickup, Destination: destination, Fare: fare, ExpiresAt: time.UnixMilli(expiresAt)}
+	if expected.payload() != string(payload) {
+		return 0, errPriceLockInvalid
+	}
+	if !now.Before(expected.ExpiresAt) {
+		return 0, errPriceLockExpired
+	}
+	return fare, nil
+}
@@ -0,0 +1,68 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPriceLockIsHonoredByPeer(t *testing.T) {
+	cfg := testConfig()
+	cfg.CacheSyncInterval = time.Second
+	a := newTestServerWithConfig(t, cfg)
+	b := a.peer(t)
+	clock := useFakeClock(t)
+
+	user := a.registerUser(t, "locked-user", nil)
+	pickup, destination := testPickup, testDestination
+	rec := a.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/estimated-fare", user.Cookie, appPostRidesEstimatedFareRequest{
+		PickupCoordinate:      &pickup,
+		DestinationCoordinate: &destination,
+	})
+	quote := decodeJSON[appPostRidesEstimatedFareResponse](t, rec)
+	if quote.Discount == 0 {
+		t.Fatal("the quote has no discount, want the registration coupon applied")
+	}
+
+	// 見積もりの後でクーポンが無くなっても、期限内の price_lock があれば見積もりの運賃で乗れる
+	if _, err := a.db.Exec("DELETE FROM coupons WHERE user_id = ?", user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := b.do(t, http.MethodPost, "/api/app/rides", user.Cookie, appPostRidesRequest{
+		PickupCoordinate:      &pickup,
+		DestinationCoordinate: &destination,
+		PriceLock:             quote.PriceLock + "x",
+	})
+	if res := decodeJSON[map[string]string](t, tampered); tampered.Code != http.StatusBadRequest || res["code"] != errCodePriceLockInvalid {
+		t.Fatalf("tampered lock: status = %d, body = %v", tampered.Code, res)
+	}
+
+	rec = b.mustDo(t, http.StatusAccepted, http.MethodPost, "/api/app/rides", user.Cookie, appPostRidesRequest{
+		PickupCoordinate:      &pickup,
+		DestinationCoordinate: &destination,
+		PriceLock:             quote.PriceLock,
+	})
+	if got := decodeJSON[appPostRidesResponse](t, rec).Fare; got != quote.Fare {
+		t.Fatalf("fare on the peer = %d, want the quoted %d", got, quote.Fare)
+	}
+
+	// 期限を過ぎた price_lock は使えない
+	other := a.registerUser(t, "late-user", nil)
+	rec = a.mustDo(t, http.StatusOK, http.MethodPost, "/api/app/rides/estimated-fare", other.Cookie, appPostRidesEstimatedFareRequest{
+		PickupCoordinate:      &pickup,
+		DestinationCoordinate: &destination,
+	})
+	lateQuote := decodeJSON[appPostRidesEstimatedFareResponse](t, rec)
+	clock.advance(priceLockTTL)
+	late := b.do(t, http.MethodPost, "/api/app/rides", other.Cookie, appPostRidesRequest{
+		PickupCoordinate:      &pickup,
+		DestinationCoordinate: &destination,
+		PriceLock:             lateQuote.PriceLock,
+	})
+	if res := decodeJSON[map[string]string](t, late); late.Code != http.StatusBadRequest || res["code"] != errCodePriceLockExpired {
+		t.Fatalf("expired lock: status = %d, body = %v", late.Code, res)
+	}
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyPriceLock(t *testing.T) {
+	key := []byte("secret")
+	issuedAt := time.Date(2024, 11, 24, 16, 0, 0, 0, time.UTC)
+	pickup, destination := Coordinate{Latitude: 0, Longitude: 0}, Coordinate{Latitude: 10, Longitude: 10}
+	lock := priceLock{UserID: "user", Pickup: pickup, Destination: destination, Fare: 1500, ExpiresAt: issuedAt.Add(priceLockTTL)}
+	token := lock.token(key)
+
+	// 署名はそのままで、payload の運賃だけを書き換える
+	payload, sig, _ := strings.Cut(token, ".")
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheaper := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(decoded), "|1500|", "|1|", 1))) + "." + sig
+
+	tests := []struct {
+		name        string
+		key         []byte
+		token       string
+		userID      string
+		destination Coordinate
+		now         time.Time
+		wantErr     error
+	}{
+		{name: "valid", key: key, token: token, userID: "user", destination: destination, now: issuedAt},
+		{name: "just before expiry", key: key, token: token, userID: "user", destination: destination, now: issuedAt.Add(priceLockTTL - time.Millisecond)},
+		{name: "expired", key: key, token: token, userID: "user", destination: destination, now: issuedAt.Add(priceLockTTL), wantErr: errPriceLockExpired},
+		{name: "tampered fare", key: key, token: cheaper, userID: "user", destination: destination, now: issuedAt, wantErr: errPriceLockInvalid},
+		{name: "tampered signature", key: key, token: payload + ".AAAA", userID: "user", destination: destination, now: issuedAt, wantErr: errPriceLockInvalid},
+		{name: "signed with another key", key: []byte("other"), token: token, userID: "user", destination: destination, now: issuedAt, wantErr: errPriceLockInvalid},
+		{name: "another user", key: key, token: token, userID: "other", destination: destination, now: issuedAt, wantErr: errPriceLockInvalid},
+		{name: "another destination", key: key, token: token, userID: "user", destination: Coordinate{Latitude: 20, Longitude: 20}, now: issuedAt, wantErr: errPriceLockInvalid},
+		{name: "malformed", key: key, token: "not-a-token", userID: "user", destination: destination, now: issuedAt, wantErr: errPriceLockInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fare, err := verifyPriceLock(tt.key, tt.token, tt.userID, pickup, tt.destination, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && fare != lock.Fare {
+				t.Fatalf("fare = %d, want %d", fare, lock.Fare)
+			}
+		})
+	}
+}
+
+func TestConfigRequiresPriceLockSecretWithCacheSync(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CacheSyncInterval = time.Second
+	if err := cfg.validate(); err == nil {
+		t.Fatal("validate accepted a multi-instance config without PriceLockSecret")
+	}
+	cfg.PriceLockSecret = "shared"
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate rejected a multi-instance config with PriceLockSecret: %v", err)
+	}
+}
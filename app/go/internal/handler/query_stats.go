@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// queryDurationBuckets はクエリ時間のヒストグラムの各バケットの上限(秒)
+var queryDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+type queryDurationStats struct {
+	// Buckets は queryDurationBuckets の各上限以下だったクエリの累積数
+	Buckets []int64
+	Count   int64
+	Sum     float64
+}
+
+// queryStats はクエリ名ごとの実行時間
+var queryStats = struct {
+	sync.Mutex
+	m map[string]*queryDurationStats
+}{m: map[string]*queryDurationStats{}}
+
+// timedQuery は fn の実行時間をクエリ名ごとに集計する
+// query はログに出すためのもので、プレースホルダのまま渡して値は含めない
+func timedQuery(name, query string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	observeQuery(name, query, time.Since(start))
+	return err
+}
+
+func observeQuery(name, query string, d time.Duration) {
+	if threshold := loadRuntimeConfig().SlowQueryThreshold; threshold > 0 && d >= threshold {
+		slog.Warn("slow query", "name", name, "duration_ms", d.Milliseconds(), "query", query)
+	}
+
+	seconds := d.Seconds()
+	queryStats.Lock()
+	defer queryStats.Unlock()
+	s, ok := queryStats.m[name]
+	if !ok {
+		s = &queryDurationStats{Buckets: make([]int64, len(queryDurationBuckets))}
+		queryStats.m[name] = s
+	}
+	for i, le := range queryDurationBuckets {
+		if seconds <= le {
+			s.Buckets[i]++
+		}
+	}
+	s.Count++
+	s.Sum += seconds
+}
+
+func snapshotQueryStats() map[string]queryDurationStats {
+	queryStats.Lock()
+	defer queryStats.Unlock()
+	res := make(map[string]queryDurationStats, len(queryStats.m))
+	for name, s := range queryStats.m {
+		snapshot := *s
+		snapshot.Buckets = append([]int64(nil), s.Buckets...)
+		res[name] = snapshot
+	}
+	return res
+}
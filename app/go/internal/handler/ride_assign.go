@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// assignRideQuery はライドに椅子を割り当て、その時点の椅子の名前・モデル・オーナーの名前を残す
+// 引数は椅子のID、ライドのIDの順
+const assignRideQuery = `
+	UPDATE rides
+	INNER JOIN chairs ON chairs.id = ?
+	INNER JOIN owners ON owners.id = chairs.owner_id
+	SET rides.chair_id = chairs.id, rides.chair_name = chairs.name, rides.chair_model = chairs.model, rides.chair_owner_name = owners.name
+	WHERE rides.id = ?`
+
+type internalPostRideAssignRequest struct {
+	ChairID string `json:"chair_id"`
+}
+
+type internalPostRideAssignResponse struct {
+	RideID  string         `json:"ride_id"`
+	ChairID string         `json:"chair_id"`
+	Status  RideStatusType `json:"status"`
+}
+
+// internalPostRideAssign はマッチングを通さずに、指定した椅子をMATCHINGのライドに割り当ててENROUTEにする
+// E2Eテストでライドの流れを決まった椅子で再現するためのもので、nginxでlocalhost以外からは拒否している
+// ライドがMATCHINGでない場合や、椅子が空いていない場合は409を返す
+func (s *server) internalPostRideAssign(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	req := &internalPostRideAssignRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.ChairID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(chair_id) are empty"))
+		return
+	}
+
+	tx, err := s.beginTx("internalPostRideAssign")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status != RideStatusMatching || ride.ChairID.Valid {
+		writeError(w, http.StatusConflict, errors.New("ride is not waiting for matching"))
+		return
+	}
+
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? FOR UPDATE", req.ChairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// マッチングが空いている椅子とみなす条件と揃える
+	if !chair.IsActive || chair.CurrentRideID.Valid || chair.Maintenance || chair.DeletedAt != nil {
+		writeError(w, http.StatusConflict, errors.New("chair is not free"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, assignRideQuery, chair.ID, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET current_ride_id = ? WHERE id = ?", ride.ID, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := s.insertRideStatus(ctx, tx.Tx, ride.ID, RideStatusEnroute); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &internalPostRideAssignResponse{
+		RideID:  ride.ID,
+		ChairID: chair.ID,
+		Status:  RideStatusEnroute,
+	})
+}
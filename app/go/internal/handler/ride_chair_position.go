@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type appRideChairPositionEvent struct {
+	Coordinate
+	RecordedAt int64 `json:"recorded_at"`
+}
+
+// appGetRideChairPosition はライド中の椅子の座標を Server-Sent Events で送り続ける
+// 座標は chairPostCoordinate から直接受け取り、ライドが完了すると end イベントを送って終わる
+// 送信が追いつかずに座標が捨てられた場合は、溜まっていた分を送り終えてからDBの最新の座標を送る
+func (s *server) appGetRideChairPosition(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	rideID := r.PathValue("ride_id")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	ride, err := rideForUser(ctx, s.db, user.ID, rideID)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ride.ChairID.Valid {
+		writeError(w, http.StatusBadRequest, errors.New("ride is not active"))
+		return
+	}
+
+	// 完了を見逃さないよう、状態を確認する前に購読しておく
+	sub := s.state.chairPositions.subscribe(ride.ChairID.String, ride.ID)
+	defer s.state.chairPositions.unsubscribe(ride.ChairID.String, sub)
+
+	status, err := getLatestRideStatus(ctx, s.db, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status == RideStatusMatching || status == RideStatusCompleted {
+		writeError(w, http.StatusBadRequest, errors.New("ride is not active"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.done:
+			fmt.Fprint(w, "event: end\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		case loc := <-sub.locations:
+			if err := writeChairPositionEvent(w, loc); err != nil {
+				return
+			}
+			flusher.Flush()
+
+			if len(sub.locations) == 0 && sub.stale.Swap(false) {
+				latest := ChairLocation{}
+				if err := s.db.GetContext(ctx, &latest, `SELECT * FROM chair_locations WHERE chair_id = ? ORDER BY created_at DESC LIMIT 1`, ride.ChairID.String); err != nil {
+					return
+				}
+				if err := writeChairPositionEvent(w, latest); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeChairPositionEvent(w http.ResponseWriter, loc ChairLocation) error {
+	buf, err := json.Marshal(&appRideChairPositionEvent{
+		Coordinate: Coordinate{Latitude: loc.Latitude, Longitude: loc.Longitude},
+		RecordedAt: loc.CreatedAt.UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", buf)
+	return err
+}
@@ -0,0 +1,64 @@
+//go:build integration
+
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRideChairPositionStreamsCoordinatesInOrder(t *testing.T) {
+	ts := newTestServer(t)
+	f := ts.newRideFixture(t, "streamed")
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusEnroute)
+
+	lines, _ := ts.openEventStream(t, "/api/app/rides/"+rideID+"/chair-position", f.User.Cookie, nil)
+	path := []Coordinate{{Latitude: 1, Longitude: 1}, {Latitude: 2, Longitude: 1}, testPickup}
+	for _, at := range path {
+		ts.moveChair(t, f.Chair, at)
+	}
+	for i, want := range path {
+		data, ok := strings.CutPrefix(nextStreamLine(t, lines), "data: ")
+		if !ok {
+			t.Fatalf("event %d is not a data line", i)
+		}
+		// Coordinate の UnmarshalJSON が昇格しないよう、埋め込まずに受け取る
+		var event struct {
+			Latitude   int   `json:"latitude"`
+			Longitude  int   `json:"longitude"`
+			RecordedAt int64 `json:"recorded_at"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatal(err)
+		}
+		if got := (Coordinate{Latitude: event.Latitude, Longitude: event.Longitude}); got != want || event.RecordedAt == 0 {
+			t.Fatalf("event %d = %+v, want %+v", i, event, want)
+		}
+	}
+
+	// 完了すると end イベントを送ってストリームを閉じる
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusCarrying)
+	ts.moveChair(t, f.Chair, testDestination)
+	if data := nextStreamLine(t, lines); !strings.HasPrefix(data, "data: ") {
+		t.Fatalf("got %q, want the destination position", data)
+	}
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusCompleted)
+	if got := nextStreamLine(t, lines); got != "event: end" {
+		t.Fatalf("got %q, want the end event", got)
+	}
+	if got := nextStreamLine(t, lines); got != "data: {}" {
+		t.Fatalf("got %q, want the end event's empty data", got)
+	}
+	select {
+	case line, ok := <-lines:
+		if ok {
+			t.Fatalf("got %q after the end event, want the stream closed", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream stayed open after the ride completed")
+	}
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+)
+
+// checkRidePath は完了したライドについて、椅子が実際に送ってきた経路を配車位置から目的地までの距離と比べる
+// 経路が直線距離より短いことはありえないので、座標の偽装を疑ってログに残す
+func (s *server) checkRidePath(ctx context.Context, ride *Ride) {
+	if !ride.ChairID.Valid {
+		return
+	}
+
+	locations := []ChairLocation{}
+	if err := s.db.SelectContext(ctx, &locations, `
+		SELECT cl.* FROM chair_locations cl
+		INNER JOIN ride_statuses pickup ON pickup.ride_id = ? AND pickup.status = 'PICKUP'
+		INNER JOIN ride_statuses arrived ON arrived.ride_id = ? AND arrived.status = 'ARRIVED'
+		WHERE cl.chair_id = ? AND cl.created_at BETWEEN pickup.created_at AND arrived.created_at
+		ORDER BY cl.created_at`,
+		ride.ID, ride.ID, ride.ChairID.String,
+	); err != nil {
+		slog.Error("failed to load ride path", "ride_id", ride.ID, "err", err)
+		return
+	}
+
+	direct := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	if traveled, ok := isPlausibleRidePath(direct, locations); !ok {
+		slog.Warn("ride path is shorter than direct distance",
+			"ride_id", ride.ID, "chair_id", ride.ChairID.String, "direct", direct, "traveled", traveled)
+	}
+}
+
+// isPlausibleRidePath は経路の長さと、それが直線距離以上かを返す
+// 座標が1件以下の場合は判断できないので妥当とみなす
+func isPlausibleRidePath(direct int, locations []ChairLocation) (int, bool) {
+	if len(locations) < 2 {
+		return 0, true
+	}
+	traveled := 0
+	for i := 1; i < len(locations); i++ {
+		traveled += calculateDistance(
+			locations[i-1].Latitude,
+			locations[i-1].Longitude,
+			locations[i].Latitude,
+			locations[i].Longitude,
+		)
+	}
+	return traveled, traveled >= direct
+}
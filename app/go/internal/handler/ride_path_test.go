@@ -0,0 +1,62 @@
+package handler
+
+import "testing"
+
+func TestIsPlausibleRidePath(t *testing.T) {
+	path := func(coords ...Coordinate) []ChairLocation {
+		locations := make([]ChairLocation, len(coords))
+		for i, c := range coords {
+			locations[i] = ChairLocation{Latitude: c.Latitude, Longitude: c.Longitude}
+		}
+		return locations
+	}
+	tests := []struct {
+		name         string
+		direct       int
+		locations    []ChairLocation
+		wantTraveled int
+		want         bool
+	}{
+		{
+			name:         "straight to the destination",
+			direct:       20,
+			locations:    path(Coordinate{Latitude: 0, Longitude: 0}, Coordinate{Latitude: 10, Longitude: 0}, Coordinate{Latitude: 10, Longitude: 10}),
+			wantTraveled: 20,
+			want:         true,
+		},
+		{
+			name:         "detour",
+			direct:       20,
+			locations:    path(Coordinate{Latitude: 0, Longitude: 0}, Coordinate{Latitude: -5, Longitude: 0}, Coordinate{Latitude: 10, Longitude: 0}, Coordinate{Latitude: 10, Longitude: 10}),
+			wantTraveled: 30,
+			want:         true,
+		},
+		{
+			// 配車位置からいきなり目的地の近くに現れた
+			name:         "teleported",
+			direct:       20,
+			locations:    path(Coordinate{Latitude: 9, Longitude: 10}, Coordinate{Latitude: 10, Longitude: 10}),
+			wantTraveled: 1,
+			want:         false,
+		},
+		{
+			name:      "too few locations to judge",
+			direct:    20,
+			locations: path(Coordinate{Latitude: 10, Longitude: 10}),
+			want:      true,
+		},
+		{
+			name:   "no locations",
+			direct: 20,
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traveled, ok := isPlausibleRidePath(tt.direct, tt.locations)
+			if traveled != tt.wantTraveled || ok != tt.want {
+				t.Fatalf("isPlausibleRidePath(%d, ...) = %d, %v, want %d, %v", tt.direct, traveled, ok, tt.wantTraveled, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"database/sql/driver"
+	"fmt"
+)
+
+// RideStatusType はライドの状態。ride_statuses.status の値
+// RideStatus はステータスの行を表す構造体なので、値の型はこの名前にしている
+type RideStatusType string
+
+const (
+	// RideStatusMatching はライドが作成され、椅子の割り当てを待っている
+	RideStatusMatching RideStatusType = "MATCHING"
+	// RideStatusEnroute は椅子が配車位置に向かっている
+	RideStatusEnroute RideStatusType = "ENROUTE"
+	// RideStatusPickup は椅子が配車位置に着いた
+	RideStatusPickup RideStatusType = "PICKUP"
+	// RideStatusCarrying はユーザーを乗せて目的地に向かっている
+	RideStatusCarrying RideStatusType = "CARRYING"
+	// RideStatusArrived は目的地に着き、評価を待っている
+	RideStatusArrived RideStatusType = "ARRIVED"
+	// RideStatusCompleted は評価か椅子からの完了によって、決済まで終わった
+	RideStatusCompleted RideStatusType = "COMPLETED"
+)
+
+// rideStatusTypes は ParseRideStatus が受け付ける値。ride_statuses.status の ENUM と揃える
+var rideStatusTypes = map[RideStatusType]bool{
+	RideStatusMatching:  true,
+	RideStatusEnroute:   true,
+	RideStatusPickup:    true,
+	RideStatusCarrying:  true,
+	RideStatusArrived:   true,
+	RideStatusCompleted: true,
+}
+
+// ParseRideStatus はクライアントやDBから受け取った文字列をライドの状態にする。知らない値はエラーにする
+func ParseRideStatus(s string) (RideStatusType, error) {
+	status := RideStatusType(s)
+	if !rideStatusTypes[status] {
+		return "", fmt.Errorf("unknown ride status: %q", s)
+	}
+	return status, nil
+}
+
+// Scan はDBから読んだステータスを ParseRideStatus で検証する
+func (s *RideStatusType) Scan(src any) error {
+	var v string
+	switch src := src.(type) {
+	case string:
+		v = src
+	case []byte:
+		v = string(src)
+	default:
+		return fmt.Errorf("unsupported type for ride status: %T", src)
+	}
+	status, err := ParseRideStatus(v)
+	if err != nil {
+		return err
+	}
+	*s = status
+	return nil
+}
+
+// Value はステータスをDBに書き込む値にする
+func (s RideStatusType) Value() (driver.Value, error) {
+	return string(s), nil
+}
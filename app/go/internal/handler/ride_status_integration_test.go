@@ -0,0 +1,51 @@
+//go:build integration
+
+package handler
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRideStatusTypesMatchColumn(t *testing.T) {
+	ts := newTestServer(t)
+
+	// ride_statuses.status の ENUM と ParseRideStatus が受け付ける値が揃っていること
+	var columnType string
+	if err := ts.db.Get(&columnType, `
+		SELECT COLUMN_TYPE FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'ride_statuses' AND COLUMN_NAME = 'status'`); err != nil {
+		t.Fatal(err)
+	}
+	var enum []string
+	for _, v := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(strings.ToUpper(columnType), "ENUM("), ")"), ",") {
+		enum = append(enum, strings.Trim(v, "'"))
+	}
+	var constants []string
+	for status := range rideStatusTypes {
+		constants = append(constants, string(status))
+	}
+	slices.Sort(enum)
+	slices.Sort(constants)
+	if !slices.Equal(enum, constants) {
+		t.Fatalf("ride_statuses.status is %v, ParseRideStatus accepts %v", enum, constants)
+	}
+
+	// どの値も Value で書き込み、Scan で読み戻せること
+	user := ts.registerUser(t, "status-user", nil)
+	rideID := ts.requestRide(t, user, testPickup, testDestination)
+	for status := range rideStatusTypes {
+		id := newID()
+		if _, err := ts.db.Exec("INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", id, rideID, status); err != nil {
+			t.Fatalf("insert %q: %v", status, err)
+		}
+		var got RideStatusType
+		if err := ts.db.Get(&got, "SELECT status FROM ride_statuses WHERE id = ?", id); err != nil {
+			t.Fatalf("read %q: %v", status, err)
+		}
+		if got != status {
+			t.Fatalf("round trip of %q returned %q", status, got)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package handler
+
+import "testing"
+
+func TestParseRideStatus(t *testing.T) {
+	for status := range rideStatusTypes {
+		got, err := ParseRideStatus(string(status))
+		if err != nil || got != status {
+			t.Errorf("ParseRideStatus(%q) = %q, %v", status, got, err)
+		}
+	}
+	for _, s := range []string{"", "CANCELED", "matching", "COMPLETED "} {
+		if got, err := ParseRideStatus(s); err == nil {
+			t.Errorf("ParseRideStatus(%q) = %q, want an error", s, got)
+		}
+	}
+}
+
+func TestRideStatusTypeScan(t *testing.T) {
+	var status RideStatusType
+	if err := status.Scan([]byte("ARRIVED")); err != nil || status != RideStatusArrived {
+		t.Fatalf("Scan([]byte) = %q, %v", status, err)
+	}
+	if err := status.Scan("PICKUP"); err != nil || status != RideStatusPickup {
+		t.Fatalf("Scan(string) = %q, %v", status, err)
+	}
+	for _, src := range []any{"CANCELED", nil, 1} {
+		status = RideStatusMatching
+		if err := status.Scan(src); err == nil {
+			t.Errorf("Scan(%#v) succeeded with %q", src, status)
+		}
+		if status != RideStatusMatching {
+			t.Errorf("Scan(%#v) overwrote the status with %q", src, status)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+//go:build integration
+
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRideTraceIncludesLocationsUntilNow(t *testing.T) {
+	ts := newTestServer(t)
+	clock := useFakeClock(t)
+	f := ts.newRideFixture(t, "trace")
+
+	rideID := ts.requestRide(t, f.User, testPickup, testDestination)
+	ts.runMatching(t)
+	if got := lastMatchingSummary.Load(); got == nil || got.StartedAt != clock.Now().UnixMilli() {
+		t.Fatalf("matching summary = %+v, want started_at from the clock", got)
+	}
+	ts.postRideStatus(t, f.Chair, rideID, RideStatusEnroute)
+
+	// 未完了のライドは現在時刻までの座標を返す。現在時刻は差し替えた時計から取る
+	clock.advance(time.Hour)
+	route := []Coordinate{{Latitude: 1, Longitude: 0}, {Latitude: 1, Longitude: 1}}
+	for _, c := range route {
+		clock.advance(time.Second)
+		ts.moveChair(t, f.Chair, c)
+	}
+
+	rec := ts.mustDo(t, http.StatusOK, http.MethodGet, "/api/internal/rides/"+rideID+"/trace", nil, nil)
+	// Coordinate の UnmarshalJSON が埋め込み先に昇格するので、座標と時刻は別々のフィールドで受ける
+	res := decodeJSON[struct {
+		Locations []struct {
+			Latitude  int   `json:"latitude"`
+			Longitude int   `json:"longitude"`
+			CreatedAt int64 `json:"created_at"`
+		} `json:"locations"`
+	}](t, rec)
+	if len(res.Locations) != len(route) {
+		t.Fatalf("locations = %+v, want %v", res.Locations, route)
+	}
+	for i, loc := range res.Locations {
+		if got := (Coordinate{Latitude: loc.Latitude, Longitude: loc.Longitude}); got != route[i] {
+			t.Fatalf("locations[%d] = %+v, want %+v", i, got, route[i])
+		}
+		if want := clock.Now().Add(time.Duration(i+1-len(route)) * time.Second).UnixMilli(); loc.CreatedAt != want {
+			t.Fatalf("locations[%d].created_at = %d, want %d", i, loc.CreatedAt, want)
+		}
+	}
+}
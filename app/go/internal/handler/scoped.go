@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// errNotFound は存在しないリソースと他人のリソースを区別せずに返すためのエラー
+var errNotFound = errors.New("not found")
+
+// chairForOwner はオーナーの削除されていない椅子を返す。他のオーナーの椅子は errNotFound になる
+func chairForOwner(ctx context.Context, q executableGet, ownerID, chairID string) (*Chair, error) {
+	return getScoped[Chair](ctx, q, "SELECT * FROM chairs WHERE id = ? AND owner_id = ? AND deleted_at IS NULL", chairID, ownerID)
+}
+
+// lockChairForOwner は chairForOwner と同じ椅子を更新のためにロックして返す
+func lockChairForOwner(ctx context.Context, q executableGet, ownerID, chairID string) (*Chair, error) {
+	return getScoped[Chair](ctx, q, "SELECT * FROM chairs WHERE id = ? AND owner_id = ? AND deleted_at IS NULL FOR UPDATE", chairID, ownerID)
+}
+
+// rideForUser はユーザーのライドを返す。他のユーザーのライドは errNotFound になる
+func rideForUser(ctx context.Context, q executableGet, userID, rideID string) (*Ride, error) {
+	return getScoped[Ride](ctx, q, "SELECT * FROM rides WHERE id = ? AND user_id = ?", rideID, userID)
+}
+
+// lockRideForChair は椅子に割り当てられたライドを更新のためにロックして返す。他の椅子のライドは errNotFound になる
+func lockRideForChair(ctx context.Context, q executableGet, chairID, rideID string) (*Ride, error) {
+	return getScoped[Ride](ctx, q, "SELECT * FROM rides WHERE id = ? AND chair_id = ? FOR UPDATE", rideID, chairID)
+}
+
+func getScoped[T any](ctx context.Context, q executableGet, query string, args ...any) (*T, error) {
+	v := new(T)
+	if err := q.GetContext(ctx, v, query, args...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,746 @@
+package handler
+
+import (
+	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-sql-driver/mysql"
+	"github.com/isucon/isucon14/webapp/go/internal/fare"
+	"github.com/jmoiron/sqlx"
+	"github.com/kaz/pprotein/integration"
+	"github.com/oklog/ulid/v2"
+)
+
+// newID と clockNow はテストで決定的な値に差し替えられるように変数にしている
+// 経過時間で振る舞いが変わる処理は clockNow を使い、テストでは時刻を進めた関数に差し替える
+var (
+	newID    = func() string { return ulid.Make().String() }
+	clockNow = time.Now
+)
+
+// Config はアプリケーションの設定。DefaultConfig の値を元に上書きして使う
+type Config struct {
+	DB *mysql.Config
+
+	MatchingFairnessWeight      float64
+	MatchingMaxConcurrency      int
+	NotificationMaxConcurrency  int
+	SerializeUserNotifications  bool
+	SlowQueryThreshold          time.Duration
+	SlowTxThreshold             time.Duration
+	ChairInactiveThreshold      time.Duration
+	ReferralChainDepth          int
+	RequireEvaluationBeforeRide bool
+	// MaxTripDistance は見積もりと配車を受け付ける配車位置から目的地までの距離の上限。0なら無制限
+	MaxTripDistance int
+	// CouponCampaigns は "CP_NEW2024:first_ride,CP_SPRING:any" の形式で、優先度の高い順に並べる
+	CouponCampaigns string
+	FareRounding    fare.Rounding
+	// PriceLockSecret は見積もりの price_lock の署名に使う。空なら起動ごとにランダムに生成する
+	// 複数台構成では別のインスタンスで発行した price_lock も検証できるよう、全てのインスタンスで同じ値を指定する
+	PriceLockSecret string
+	// AccessLogPath が空でなければ、アプリ自身でアクセスログを書き出す
+	AccessLogPath string
+	// AccessLogGzipLevel は /debug/log/httplog で gzip_level クエリが無い場合の圧縮レベル
+	AccessLogGzipLevel int
+	// AccessLogGzipMinSize 未満の /debug/log/httplog のレスポンスは圧縮しない
+	AccessLogGzipMinSize int64
+	// RideStatusWebhookURL が空でなければ、ライドのステータスが変わるたびに outbox を通して POST する
+	RideStatusWebhookURL string
+	// CacheSyncInterval は複数台構成で他のインスタンスのキャッシュの破棄を取りに行く間隔。0なら1台構成とみなす
+	CacheSyncInterval time.Duration
+	// FareEstimateCacheTTL は同じユーザー・配車位置・目的地の見積もり運賃を使い回す時間。0ならキャッシュしない
+	FareEstimateCacheTTL time.Duration
+	// MaxUnusedCoupons は1人が持てる未使用のクーポンの数の上限。上限に達したユーザーには新しく付与しない。0なら無制限
+	MaxUnusedCoupons int
+	// CoordinateBufferSize は chair_locations に書き込む前に溜めておける座標の数。0ならバッファせずリクエストの中で書き込む
+	CoordinateBufferSize int
+	// CoordinateBufferPolicy はバッファが満杯のときの振る舞い。drop_oldest か reject
+	CoordinateBufferPolicy string
+	// CoordinateBufferWait はバッファが満杯のときに CoordinateBufferPolicy に従う前に空きを待つ時間
+	CoordinateBufferWait time.Duration
+	// Reload が nil でなければ SIGHUP を受けたときに呼び、再起動せずに変えられる設定だけを反映する
+	Reload func() (Config, error)
+}
+
+// DefaultConfig は環境変数で何も指定しなかったときの設定を返す
+func DefaultConfig() Config {
+	return Config{
+		DB:                         mysql.NewConfig(),
+		MatchingFairnessWeight:     loadMatchingParams().FairnessWeight,
+		MatchingMaxConcurrency:     1,
+		NotificationMaxConcurrency: defaultNotificationConcurrency,
+		SerializeUserNotifications: true,
+		SlowQueryThreshold:         loadRuntimeConfig().SlowQueryThreshold,
+		SlowTxThreshold:            loadRuntimeConfig().SlowTxThreshold,
+		MaxTripDistance:            loadRuntimeConfig().MaxTripDistance,
+		FareEstimateCacheTTL:       loadRuntimeConfig().FareEstimateCacheTTL,
+		CouponCampaigns:            "CP_NEW2024:first_ride",
+		FareRounding:               fare.Rounding{Unit: 1, Mode: fare.RoundUp},
+		AccessLogGzipLevel:         gzip.DefaultCompression,
+		CoordinateBufferPolicy:     coordinateBufferDropOldest,
+		CoordinateBufferWait:       50 * time.Millisecond,
+	}
+}
+
+// validate は値の範囲を確かめる。環境変数の構文は main で、範囲はここでまとめて確かめる
+func (cfg Config) validate() error {
+	if cfg.DB == nil {
+		return errors.New("DB must be set")
+	}
+	if cfg.MatchingFairnessWeight < 0 {
+		return fmt.Errorf("MatchingFairnessWeight must not be negative: %g", cfg.MatchingFairnessWeight)
+	}
+	if cfg.MatchingMaxConcurrency < 1 {
+		return fmt.Errorf("MatchingMaxConcurrency must be positive: %d", cfg.MatchingMaxConcurrency)
+	}
+	if cfg.NotificationMaxConcurrency < 1 {
+		return fmt.Errorf("NotificationMaxConcurrency must be positive: %d", cfg.NotificationMaxConcurrency)
+	}
+	if cfg.SlowQueryThreshold < 0 {
+		return fmt.Errorf("SlowQueryThreshold must not be negative: %s", cfg.SlowQueryThreshold)
+	}
+	if cfg.SlowTxThreshold < 0 {
+		return fmt.Errorf("SlowTxThreshold must not be negative: %s", cfg.SlowTxThreshold)
+	}
+	if cfg.ChairInactiveThreshold < 0 {
+		return fmt.Errorf("ChairInactiveThreshold must not be negative: %s", cfg.ChairInactiveThreshold)
+	}
+	if cfg.FareEstimateCacheTTL < 0 {
+		return fmt.Errorf("FareEstimateCacheTTL must not be negative: %s", cfg.FareEstimateCacheTTL)
+	}
+	if cfg.CacheSyncInterval < 0 {
+		return fmt.Errorf("CacheSyncInterval must not be negative: %s", cfg.CacheSyncInterval)
+	}
+	if cfg.CacheSyncInterval > 0 && cfg.PriceLockSecret == "" {
+		return errors.New("PriceLockSecret must be set when CacheSyncInterval is positive, or price locks fail on other instances")
+	}
+	if cfg.ReferralChainDepth < 0 {
+		return fmt.Errorf("ReferralChainDepth must not be negative: %d", cfg.ReferralChainDepth)
+	}
+	if cfg.MaxTripDistance < 0 {
+		return fmt.Errorf("MaxTripDistance must not be negative: %d", cfg.MaxTripDistance)
+	}
+	if cfg.MaxUnusedCoupons < 0 {
+		return fmt.Errorf("MaxUnusedCoupons must not be negative: %d", cfg.MaxUnusedCoupons)
+	}
+	if cfg.CoordinateBufferSize < 0 {
+		return fmt.Errorf("CoordinateBufferSize must not be negative: %d", cfg.CoordinateBufferSize)
+	}
+	if cfg.CoordinateBufferPolicy != coordinateBufferDropOldest && cfg.CoordinateBufferPolicy != coordinateBufferReject {
+		return fmt.Errorf("CoordinateBufferPolicy must be drop_oldest or reject: %s", cfg.CoordinateBufferPolicy)
+	}
+	if cfg.CoordinateBufferWait < 0 {
+		return fmt.Errorf("CoordinateBufferWait must not be negative: %s", cfg.CoordinateBufferWait)
+	}
+	if _, err := parseCouponCampaigns(cfg.CouponCampaigns); err != nil {
+		return fmt.Errorf("invalid CouponCampaigns: %w", err)
+	}
+	if !validGzipLevel(cfg.AccessLogGzipLevel) {
+		return fmt.Errorf("AccessLogGzipLevel must be between %d and %d: %d", gzip.HuffmanOnly, gzip.BestCompression, cfg.AccessLogGzipLevel)
+	}
+	if cfg.AccessLogGzipMinSize < 0 {
+		return fmt.Errorf("AccessLogGzipMinSize must not be negative: %d", cfg.AccessLogGzipMinSize)
+	}
+	if cfg.FareRounding.Unit < 1 {
+		return fmt.Errorf("FareRounding.Unit must be positive: %d", cfg.FareRounding.Unit)
+	}
+	if cfg.FareRounding.Mode != fare.RoundUp && cfg.FareRounding.Mode != fare.RoundNearest {
+		return fmt.Errorf("FareRounding.Mode must be up or nearest: %s", cfg.FareRounding.Mode)
+	}
+	return nil
+}
+
+// server はハンドラが使うDB・キャッシュ・バックグラウンドの処理をまとめたもの
+type server struct {
+	db          *sqlx.DB
+	state       *appState
+	cacheEvents *cacheEventLog
+	// workers は /api/initialize の間止めるバックグラウンドの処理
+	workers []pausable
+	// matchingGate はマッチングループと外部の matcher からの /api/internal/matching の両方で使う
+	matchingGate *workerGate
+
+	// 以下は Config から newServer で作り、以降は差し替えない
+	// matchingSemaphore は同時に実行できるマッチングの数を制限する
+	matchingSemaphore chan struct{}
+	// notificationSemaphore はアプリと椅子の通知エンドポイントで共有する
+	notificationSemaphore chan struct{}
+	// serializeUserNotifications が true なら、同じユーザーの通知の取得を1件ずつ処理する
+	serializeUserNotifications bool
+	// inactiveChairThreshold の間リクエストが無い椅子を非アクティブにする。0なら無効
+	inactiveChairThreshold time.Duration
+	// priceLockKey は price_lock の署名に使う鍵
+	priceLockKey []byte
+	// rideStatusWebhookURL が空なら webhook を送らない
+	rideStatusWebhookURL string
+	// cacheSyncInterval ごとに他のインスタンスが書いた cache_events を取りに行く。0なら1台構成とみなして何もしない
+	cacheSyncInterval time.Duration
+	// coordinateBuffer が nil なら椅子の座標をリクエストの中で chair_locations に書き込む
+	coordinateBuffer *coordinateBuffer
+}
+
+// newServer は検証済みの cfg から server を作る。DBへの接続とバックグラウンドの処理の開始は呼び出し側で行う
+func newServer(db *sqlx.DB, cfg Config) *server {
+	priceLockKey := []byte(cfg.PriceLockSecret)
+	if cfg.PriceLockSecret == "" {
+		priceLockKey = []byte(secureRandomStr(32))
+	}
+	s := &server{
+		db:                         db,
+		state:                      newAppState(db),
+		cacheEvents:                &cacheEventLog{instanceID: newID()},
+		matchingSemaphore:          make(chan struct{}, cfg.MatchingMaxConcurrency),
+		notificationSemaphore:      make(chan struct{}, cfg.NotificationMaxConcurrency),
+		serializeUserNotifications: cfg.SerializeUserNotifications,
+		inactiveChairThreshold:     cfg.ChairInactiveThreshold,
+		priceLockKey:               priceLockKey,
+		rideStatusWebhookURL:       cfg.RideStatusWebhookURL,
+		cacheSyncInterval:          cfg.CacheSyncInterval,
+	}
+	if cfg.CoordinateBufferSize > 0 {
+		s.coordinateBuffer = newCoordinateBuffer(cfg.CoordinateBufferSize, cfg.CoordinateBufferPolicy, cfg.CoordinateBufferWait)
+	}
+	s.matchingGate = s.registerWorker("matching")
+	return s
+}
+
+// New は設定を反映してDBに接続し、バックグラウンドの処理を開始してルーティング済みのハンドラを返す
+func New(cfg Config) (http.Handler, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	rc, err := newRuntimeConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	params := *loadMatchingParams()
+	params.FairnessWeight = cfg.MatchingFairnessWeight
+	if err := storeMatchingParams(params); err != nil {
+		return nil, err
+	}
+	currentRuntimeConfig.Store(rc)
+	warmInQueries(inQueryWarmArgs)
+
+	db, err := sqlx.Connect("mysql", cfg.DB.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+
+	// プール内に保持できるアイドル接続数の制限を設定 (default: 2)
+	db.SetMaxIdleConns(1024)
+	// 接続してから再利用できる最大期間
+	db.SetConnMaxLifetime(0)
+	// アイドル接続してから再利用できる最大期間
+	db.SetConnMaxIdleTime(0)
+
+	s := newServer(db, cfg)
+	s.startInactiveChairSweeper()
+	s.startMatchingLoop()
+	s.startOutboxDispatcher()
+	s.startCacheEventPoller()
+	s.startCoordinateFlusher()
+	startConfigReloader(cfg)
+
+	http.DefaultTransport.(*http.Transport).MaxIdleConns = 0           // default: 100
+	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 1024 // default: 2
+	http.DefaultTransport.(*http.Transport).ForceAttemptHTTP2 = true
+	http.DefaultClient.Timeout = 5 * time.Second // 問題の切り分け用
+
+	// nginxを経由しない構成ではアプリ自身でアクセスログを書き出す
+	var accessLog *accessLogWriter
+	if cfg.AccessLogPath != "" {
+		accessLog, err = newAccessLogWriter(cfg.AccessLogPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	{
+		pproteinHandler := http.NewServeMux()
+		if cfg.AccessLogPath != "" {
+			// nginxのaccess.logの代わりにアプリのアクセスログを返す
+			pproteinHandler.Handle("/debug/log/httplog", NewTailHandler(cfg.AccessLogPath).WithGzip(cfg.AccessLogGzipLevel, cfg.AccessLogGzipMinSize))
+		}
+		pproteinHandler.Handle("/", integration.NewDebugHandler())
+		go http.ListenAndServe(":3000", pproteinHandler)
+	}
+
+	return s.routes(accessLog), nil
+}
+
+func (s *server) routes(accessLog *accessLogWriter) http.Handler {
+	mux := chi.NewRouter()
+	if accessLog != nil {
+		mux.Use(accessLog.Middleware)
+	}
+	mux.Use(middleware.Logger)
+	mux.Use(middleware.Recoverer)
+	mux.Use(statsMiddleware)
+	mux.HandleFunc("POST /api/initialize", s.postInitialize)
+
+	// app handlers
+	{
+		mux.HandleFunc("POST /api/app/users", s.appPostUsers)
+
+		authedMux := mux.With(s.appAuthMiddleware)
+		authedMux.HandleFunc("POST /api/app/payment-methods", s.appPostPaymentMethods)
+		authedMux.HandleFunc("GET /api/app/rides", s.appGetRides)
+		authedMux.HandleFunc("POST /api/app/rides", s.appPostRides)
+		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", s.appPostRidesEstimatedFare)
+		authedMux.HandleFunc("POST /api/app/routes", s.appPostRoutes)
+		authedMux.HandleFunc("GET /api/app/routes/{route_id}/estimate", s.appGetRouteEstimate)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", s.appPostRideEvaluatation)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/chair-position", s.appGetRideChairPosition)
+		authedMux.HandleFunc("GET /api/app/notification", s.appGetNotification)
+		authedMux.HandleFunc("GET /api/app/nearby-chairs", s.appGetNearbyChairs)
+		authedMux.HandleFunc("GET /api/app/stats", s.appGetStats)
+	}
+
+	// owner handlers
+	{
+		mux.HandleFunc("POST /api/owner/owners", s.ownerPostOwners)
+
+		authedMux := mux.With(s.ownerAuthMiddleware)
+		authedMux.HandleFunc("GET /api/owner/sales", s.ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/chairs", s.ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/notification", s.ownerGetNotification)
+		authedMux.HandleFunc("PUT /api/owner/chairs/{chair_id}", s.ownerPutChair)
+		authedMux.HandleFunc("DELETE /api/owner/chairs/{chair_id}", s.ownerDeleteChair)
+		authedMux.HandleFunc("POST /api/owner/api-keys", s.ownerPostAPIKeys)
+		authedMux.HandleFunc("DELETE /api/owner/api-keys/{key_id}", s.ownerDeleteAPIKey)
+	}
+
+	// chair handlers
+	{
+		mux.HandleFunc("POST /api/chair/chairs", s.chairPostChairs)
+
+		authedMux := mux.With(s.chairAuthMiddleware)
+		authedMux.HandleFunc("POST /api/chair/activity", s.chairPostActivity)
+		authedMux.HandleFunc("POST /api/chair/maintenance", s.chairPostMaintenance)
+		authedMux.HandleFunc("POST /api/chair/coordinate", s.chairPostCoordinate)
+		authedMux.HandleFunc("GET /api/chair/notification", s.chairGetNotification)
+		authedMux.HandleFunc("POST /api/chair/notification/ack", s.chairPostNotificationAck)
+		authedMux.HandleFunc("GET /api/chair/rides", s.chairGetRides)
+		authedMux.HandleFunc("GET /api/chair/rides/current/status", s.chairGetCurrentRideStatus)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", s.chairPostRideStatus)
+	}
+
+	// internal handlers
+	{
+		mux.HandleFunc("GET /api/internal/matching", s.internalGetMatching)
+		mux.HandleFunc("GET /api/internal/settings", s.internalGetSettings)
+		mux.HandleFunc("PUT /api/internal/settings", s.internalPutSettings)
+		mux.HandleFunc("GET /api/internal/stats", s.internalGetStats)
+		mux.HandleFunc("GET /api/internal/rides/active", s.internalGetActiveRides)
+		mux.HandleFunc("GET /api/internal/rides/{ride_id}/trace", s.internalGetRideTrace)
+		mux.HandleFunc("GET /api/internal/rides/{ride_id}/fare-events", s.internalGetRideFareEvents)
+		mux.HandleFunc("POST /api/internal/rides/{ride_id}/assign", s.internalPostRideAssign)
+		mux.HandleFunc("GET /api/internal/chairs/{chair_id}/assignment", s.internalGetChairAssignment)
+		mux.HandleFunc("GET /api/internal/invariants", s.internalGetInvariants)
+		mux.HandleFunc("GET /api/internal/coupons/report", s.internalGetCouponReport)
+		mux.HandleFunc("GET /api/internal/users/{user_id}/coupon-plan", s.internalGetCouponPlan)
+		mux.HandleFunc("GET /api/internal/fares/audit", s.internalGetFareAudit)
+		mux.HandleFunc("POST /api/internal/profile/start", s.internalPostProfileStart)
+		mux.HandleFunc("POST /api/internal/profile/stop", s.internalPostProfileStop)
+	}
+
+	// debug handlers
+	{
+		mux.HandleFunc("GET /metrics", s.getMetrics)
+		mux.HandleFunc("GET /debug/errors", s.debugGetErrors)
+	}
+
+	mux.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	})
+	mux.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range allowedMethods(mux, r.URL.Path) {
+			w.Header().Add("Allow", method)
+		}
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	})
+
+	return mux
+}
+
+// allowedMethods は path に登録されているメソッドを返す
+// 独自の MethodNotAllowed を設定すると chi は Allow ヘッダを付けないので、ルーティングを引き直して求める
+func allowedMethods(routes chi.Routes, path string) []string {
+	methods := []string{}
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions} {
+		if routes.Match(chi.NewRouteContext(), method, path) {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+type postInitializeRequest struct {
+	PaymentServer string `json:"payment_server"`
+}
+
+type postInitializeResponse struct {
+	Language string `json:"language"`
+}
+
+// resetDatabase はスキーマと初期データを流し直す。テストではテスト用のスキーマを流す関数に差し替える
+var resetDatabase = func() error {
+	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to initialize: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+func (s *server) postInitialize(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &postInitializeRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// 作り直す前のIDで書き込まないよう、バックグラウンドの処理を止めてからDBを作り直す
+	quiesceCtx, cancel := context.WithTimeout(ctx, initializeQuiesceTimeout)
+	defer cancel()
+	defer s.resumeWorkers()
+	if err := s.pauseWorkers(quiesceCtx); err != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("failed to pause background workers: %w", err))
+		return
+	}
+
+	if err := resetDatabase(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 各椅子の総移動距離を初期化
+	if err := s.initializeChairTotalDistance(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// ステータスの無いライドを修復
+	if err := s.repairStatuslessRides(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 各椅子の現在のライドを初期化
+	if err := s.initializeChairCurrentRides(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 初期データのライドに距離を埋める
+	if _, err := s.db.ExecContext(ctx, "UPDATE rides SET distance = ABS(pickup_latitude - destination_latitude) + ABS(pickup_longitude - destination_longitude)"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 割り当て済みのライドに椅子の情報を残す
+	if err := s.initializeRideChairSnapshots(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// DBを作り直したのでキャッシュを全て捨てる
+	s.state.Reset()
+	s.resetCacheEvents()
+	if s.coordinateBuffer != nil {
+		s.coordinateBuffer.reset()
+	}
+
+	if err := s.primeChairCache(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 通知済みライドの状態を初期化
+	if err := s.initializeDeliveredRides(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := s.db.ExecContext(ctx, "UPDATE settings SET value = ? WHERE name = 'payment_gateway_url'", req.PaymentServer); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setPaymentGatewayURL(req.PaymentServer)
+
+	go func() {
+		if _, err := http.Get("http://57.180.38.84:9000/api/group/collect"); err != nil {
+			log.Printf("failed to communicate with pprotein: %v", err)
+		}
+	}()
+
+	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
+}
+
+type Coordinate struct {
+	Latitude  int `json:"latitude"`
+	Longitude int `json:"longitude"`
+}
+
+// UnmarshalJSON は整数に加えて、整数値の小数 (35.0) と数値の文字列 ("35") も受け付ける
+// 座標は整数のグリッドなので、35.6 のように小数部のある値はエラーにする
+func (c *Coordinate) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Latitude  json.RawMessage `json:"latitude"`
+		Longitude json.RawMessage `json:"longitude"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	latitude, err := parseGridValue("latitude", raw.Latitude)
+	if err != nil {
+		return err
+	}
+	longitude, err := parseGridValue("longitude", raw.Longitude)
+	if err != nil {
+		return err
+	}
+	c.Latitude = latitude
+	c.Longitude = longitude
+	return nil
+}
+
+func parseGridValue(name string, data json.RawMessage) (int, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return 0, nil
+	}
+	var s string
+	if data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return 0, err
+		}
+	} else {
+		s = string(data)
+	}
+	if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+		return v, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number: %q", name, s)
+	}
+	if f != math.Trunc(f) || f < math.MinInt32 || f > math.MaxInt32 {
+		return 0, fmt.Errorf("%s must be an integer: %s", name, s)
+	}
+	return int(f), nil
+}
+
+// isDuplicateKeyError は一意制約に違反したエラーかどうかを返す
+func isDuplicateKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+func bindJSON(r *http.Request, v interface{}) error {
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	writeJSONAs(w, statusCode, "application/json;charset=utf-8", v)
+}
+
+// writeJSONAs は Content-Type を指定してJSONを書き出す
+func writeJSONAs(w http.ResponseWriter, statusCode int, contentType string, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	buf, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// 圧縮するミドルウェアがボディを書き換える場合は長さが変わるので付けない
+	if w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	}
+	w.WriteHeader(statusCode)
+	w.Write(buf)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err error) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(statusCode)
+	buf, marshalError := json.Marshal(map[string]string{"message": err.Error()})
+	if marshalError != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"marshaling error failed"}`))
+		return
+	}
+	w.Write(buf)
+
+	recordError(err)
+	slog.Error("error response wrote", "err", err)
+}
+
+// writeErrorWithCode はクライアントがメッセージに頼らず判別できるよう、code を付けてエラーを返す
+func writeErrorWithCode(w http.ResponseWriter, statusCode int, code string, err error) {
+	recordError(err)
+	slog.Error("error response wrote", "err", err, "code", code)
+	writeJSON(w, statusCode, map[string]string{"message": err.Error(), "code": code})
+}
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldErrors はリクエストボディのフィールドごとのバリデーションエラー
+type fieldErrors []fieldError
+
+// required は value が空ならフィールドのエラーを追加する
+func (e fieldErrors) required(field string, empty bool) fieldErrors {
+	if empty {
+		return append(e, fieldError{Field: field, Message: "required"})
+	}
+	return e
+}
+
+type validationErrorResponse struct {
+	Message string      `json:"message"`
+	Errors  fieldErrors `json:"errors"`
+}
+
+// writeValidationError は互換性のため message を残しつつ、フィールドごとのエラーを返す
+func writeValidationError(w http.ResponseWriter, err error, errs fieldErrors) {
+	recordError(err)
+	slog.Error("error response wrote", "err", err)
+	writeJSON(w, http.StatusBadRequest, &validationErrorResponse{
+		Message: err.Error(),
+		Errors:  errs,
+	})
+}
+
+func secureRandomStr(b int) string {
+	k := make([]byte, b)
+	if _, err := crand.Read(k); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", k)
+}
+
+type (
+	TailHandler struct {
+		filename string
+		// gzipLevel は gzip_level クエリが無い場合の圧縮レベル
+		gzipLevel int
+		// gzipMinSize 未満のレスポンスは圧縮せずにそのまま返す
+		gzipMinSize int64
+	}
+)
+
+func NewTailHandler(filename string) *TailHandler {
+	return &TailHandler{
+		filename:    filename,
+		gzipLevel:   gzip.DefaultCompression,
+		gzipMinSize: 0,
+	}
+}
+
+// WithGzip はデフォルトの圧縮レベルと圧縮を行う最小サイズを設定する
+func (h *TailHandler) WithGzip(level int, minSize int64) *TailHandler {
+	h.gzipLevel = level
+	h.gzipMinSize = minSize
+	return h
+}
+
+func (h *TailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.serve(w, r); err != nil {
+		log.Printf("serve failed: %v", err)
+	}
+}
+
+func (h *TailHandler) serve(w http.ResponseWriter, r *http.Request) error {
+	seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil {
+		seconds = 30
+	}
+
+	level := h.gzipLevel
+	if levelStr := r.URL.Query().Get("gzip_level"); levelStr != "" {
+		level, err = strconv.Atoi(levelStr)
+		if err != nil || !validGzipLevel(level) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("gzip_level is invalid"))
+			return fmt.Errorf("invalid gzip_level: %s", levelStr)
+		}
+	}
+
+	file, size, err := h.tail(time.Duration(seconds) * time.Second)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+
+		return fmt.Errorf("failed to tail: %w", err)
+	}
+	defer file.Close()
+
+	var output io.Writer = w
+	if size >= h.gzipMinSize && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		ew, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return fmt.Errorf("failed to initialize gzip writer: %w", err)
+		}
+		defer ew.Close()
+
+		output = ew
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+
+	if _, err := io.Copy(output, io.LimitReader(file, size)); err != nil {
+		return fmt.Errorf("failed to copy: %w", err)
+	}
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// validGzipLevel は compress/gzip が受け付ける圧縮レベルかどうかを返す
+func validGzipLevel(level int) bool {
+	return level >= gzip.HuffmanOnly && level <= gzip.BestCompression
+}
+
+// tail は duration の間にファイルへ追記された範囲のサイズと、その先頭にシーク済みのファイルを返す
+func (h *TailHandler) tail(duration time.Duration) (*os.File, int64, error) {
+	file, err := os.Open(h.filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open: %w", err)
+	}
+
+	startPos, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to seek: %w", err)
+	}
+
+	time.Sleep(duration)
+
+	finfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to stat: %w", err)
+	}
+
+	return file, finfo.Size() - startPos, nil
+}
@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTail は TailHandler に1秒間の tail を要求し、その間にログを1行追記したときのレスポンスを返す
+func serveTail(t *testing.T, h *TailHandler, query string) *http.Response {
+	t.Helper()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		f, err := os.OpenFile(h.filename, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		f.WriteString(strings.Repeat("time:0\tmethod:GET\turi:/api/app/notification\n", 10))
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/log/httplog?seconds=1&"+query, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func newTailTestHandler(t *testing.T) *TailHandler {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return NewTailHandler(path)
+}
+
+func TestTailHandlerRejectsInvalidGzipLevel(t *testing.T) {
+	for _, level := range []string{"10", "-3", "fast"} {
+		t.Run(level, func(t *testing.T) {
+			t.Parallel()
+			h := newTailTestHandler(t)
+			req := httptest.NewRequest(http.MethodGet, "/debug/log/httplog?seconds=0&gzip_level="+level, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestTailHandlerHonorsGzipLevel(t *testing.T) {
+	// gzip のヘッダの XFL は BestCompression なら2、BestSpeed なら4になる
+	tests := []struct {
+		query string
+		xfl   byte
+	}{
+		{query: "gzip_level=1", xfl: 4},
+		{query: "gzip_level=9", xfl: 2},
+		{query: "", xfl: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			t.Parallel()
+			res := serveTail(t, newTailTestHandler(t), tt.query)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+			}
+			if got := res.Header.Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", got)
+			}
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(body) < 10 || body[8] != tt.xfl {
+				t.Fatalf("gzip XFL = %v, want %d", body[8:9], tt.xfl)
+			}
+			zr, err := gzip.NewReader(strings.NewReader(string(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(plain), "uri:/api/app/notification") {
+				t.Fatalf("unexpected body: %q", plain)
+			}
+		})
+	}
+}
+
+func TestTailHandlerSkipsGzipBelowMinSize(t *testing.T) {
+	t.Parallel()
+	h := newTailTestHandler(t).WithGzip(gzip.BestSpeed, 1<<20)
+	res := serveTail(t, h, "")
+	if got := res.Header.Get("Content-Encoding"); got != "" {
+		t.Fatalf("Content-Encoding = %q, want none", got)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "uri:/api/app/notification") {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestConfigValidateAccessLogGzip(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+	cfg.AccessLogGzipLevel = gzip.BestCompression + 1
+	if err := cfg.validate(); err == nil {
+		t.Fatal("validate accepted an out-of-range gzip level")
+	}
+	cfg = DefaultConfig()
+	cfg.AccessLogGzipMinSize = -1
+	if err := cfg.validate(); err == nil {
+		t.Fatal("validate accepted a negative gzip min size")
+	}
+}
+
+func TestNewServerKeepsConfigPerInstance(t *testing.T) {
+	a := DefaultConfig()
+	a.MatchingMaxConcurrency = 1
+	a.PriceLockSecret = "a"
+	a.ChairInactiveThreshold = time.Minute
+	b := DefaultConfig()
+	b.MatchingMaxConcurrency = 2
+	b.PriceLockSecret = "b"
+	b.CacheSyncInterval = time.Second
+
+	sa, sb := newServer(nil, a), newServer(nil, b)
+	if string(sa.priceLockKey) != "a" || string(sb.priceLockKey) != "b" {
+		t.Fatalf("price lock keys = %q, %q, want a, b", sa.priceLockKey, sb.priceLockKey)
+	}
+	if sa.inactiveChairThreshold != time.Minute || sb.inactiveChairThreshold != 0 {
+		t.Fatalf("inactive chair thresholds = %v, %v", sa.inactiveChairThreshold, sb.inactiveChairThreshold)
+	}
+	if sa.cacheSyncInterval != 0 || sb.cacheSyncInterval != time.Second {
+		t.Fatalf("cache sync intervals = %v, %v", sa.cacheSyncInterval, sb.cacheSyncInterval)
+	}
+
+	// a のマッチングが走っていても b は自分の上限まで走れる
+	if !sa.tryAcquireMatching() || sa.tryAcquireMatching() {
+		t.Fatal("a must run exactly one matching at a time")
+	}
+	if !sb.tryAcquireMatching() || !sb.tryAcquireMatching() || sb.tryAcquireMatching() {
+		t.Fatal("b must run exactly two matchings at a time")
+	}
+	sa.releaseMatching()
+	if !sa.tryAcquireMatching() {
+		t.Fatal("a could not run matching after the previous run released it")
+	}
+}
+
+func TestNewServerGeneratesPriceLockKey(t *testing.T) {
+	a, b := newServer(nil, DefaultConfig()), newServer(nil, DefaultConfig())
+	if len(a.priceLockKey) == 0 || string(a.priceLockKey) == string(b.priceLockKey) {
+		t.Fatalf("price lock keys = %q, %q, want distinct random keys", a.priceLockKey, b.priceLockKey)
+	}
+}
+
+func TestWriteJSONSetsContentLength(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeJSON(rec, http.StatusOK, map[string]string{"message": "hello"})
+	const want = `{"message":"hello"}`
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("body = %s, want %s", got, want)
+	}
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(want)) {
+		t.Fatalf("Content-Length = %q, want %d", got, len(want))
+	}
+
+	// 圧縮するミドルウェアがボディを書き換える場合は付けない
+	rec = httptest.NewRecorder()
+	rec.Header().Set("Content-Encoding", "gzip")
+	writeJSON(rec, http.StatusOK, map[string]string{"message": "hello"})
+	if got := rec.Header().Get("Content-Length"); got != "" {
+		t.Fatalf("Content-Length = %q on a compressed response, want none", got)
+	}
+}
+
+func TestCoordinateUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    Coordinate
+		wantErr string
+	}{
+		{name: "int", body: `{"latitude":35,"longitude":-139}`, want: Coordinate{Latitude: 35, Longitude: -139}},
+		{name: "float int", body: `{"latitude":35.0,"longitude":-1.39e2}`, want: Coordinate{Latitude: 35, Longitude: -139}},
+		{name: "string", body: `{"latitude":"35","longitude":" -139.0 "}`, want: Coordinate{Latitude: 35, Longitude: -139}},
+		{name: "fractional", body: `{"latitude":35.6,"longitude":139}`, wantErr: "latitude must be an integer: 35.6"},
+		{name: "fractional string", body: `{"latitude":35,"longitude":"139.5"}`, wantErr: "longitude must be an integer: 139.5"},
+		{name: "not a number", body: `{"latitude":"north","longitude":139}`, wantErr: `latitude must be a number: "north"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Coordinate
+			err := json.Unmarshal([]byte(tt.body), &got)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,585 @@
+package handler
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// appState はプロセス内で共有するキャッシュをまとめたもの
+// 各ストアは自分のロックを持ち、外からはメソッド経由でのみ触る
+// 統計情報やマッチングのパラメータは atomic なスナップショットで管理しているのでここには含めない
+type appState struct {
+	chairs           chairStore
+	deliveredRides   deliveredRideStore
+	chairAssignments chairAssignmentStore
+	chairActivities  chairActivityStore
+	chairPositions   chairPositionStore
+	userStats        userStatsStore
+	ownerCompletions ownerCompletionStore
+	fareEstimates    fareEstimateStore
+	// userNotifications はユーザーごとに通知の取得を直列にする
+	userNotifications keyedMutex
+}
+
+func newAppState(db *sqlx.DB) *appState {
+	s := &appState{chairs: chairStore{db: db}}
+	s.Reset()
+	return s
+}
+
+// Reset は /api/initialize でDBを作り直したときに全てのキャッシュを空にする
+func (s *appState) Reset() {
+	s.chairs.reset()
+	s.deliveredRides.reset()
+	s.chairAssignments.reset()
+	s.chairActivities.reset()
+	s.chairPositions.reset()
+	s.userStats.reset()
+	s.ownerCompletions.reset()
+	s.fareEstimates.reset()
+}
+
+// keyedMutex はキーごとの排他ロック
+// 使われていないキーのロックは残さない
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mu      sync.Mutex
+	waiters int
+}
+
+// lock はキーのロックを取得し、解放する関数を返す
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*keyedMutexEntry{}
+	}
+	e, ok := k.locks[key]
+	if !ok {
+		e = &keyedMutexEntry{}
+		k.locks[key] = e
+	}
+	e.waiters++
+	k.mu.Unlock()
+
+	e.mu.Lock()
+	return func() {
+		e.mu.Unlock()
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		e.waiters--
+		if e.waiters == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+// chairStore はアクセストークンをキーにした椅子のキャッシュ
+// 保持している *Chair は読み取り専用として扱い、更新時はコピーを差し替える
+type chairStore struct {
+	// db はキャッシュに無い椅子を読み込むのに使う
+	db      *sqlx.DB
+	mu      sync.RWMutex
+	byToken map[string]*Chair
+}
+
+func (s *chairStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byToken = map[string]*Chair{}
+}
+
+// get はキャッシュに無ければDBから取得する
+// 存在しない椅子の場合は sql.ErrNoRows を返す
+func (s *chairStore) get(ctx context.Context, accessToken string) (*Chair, error) {
+	s.mu.RLock()
+	chair, ok := s.byToken[accessToken]
+	s.mu.RUnlock()
+	if ok {
+		return chair, nil
+	}
+
+	chair = &Chair{}
+	if err := s.db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ? AND deleted_at IS NULL", accessToken); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 並行して読み込まれていた場合は先に入ったものを使う
+	if cached, ok := s.byToken[accessToken]; ok {
+		return cached, nil
+	}
+	s.byToken[accessToken] = chair
+	return chair, nil
+}
+
+// prime はDBから読んだ椅子をまとめてキャッシュに載せる
+func (s *chairStore) prime(chairs []Chair) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range chairs {
+		s.byToken[chairs[i].AccessToken] = &chairs[i]
+	}
+}
+
+// update はキャッシュ済みの椅子をコピーして fn で更新し、差し替えた椅子を返す
+// キャッシュに無い場合は何もしない
+func (s *chairStore) update(accessToken string, fn func(chair *Chair)) *Chair {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chair, ok := s.byToken[accessToken]
+	if !ok {
+		return nil
+	}
+	updated := *chair
+	fn(&updated)
+	s.byToken[accessToken] = &updated
+	return &updated
+}
+
+func (s *chairStore) forget(accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byToken, accessToken)
+}
+
+// deliveredRideStore はCOMPLETEDまで通知済みのライドをユーザーIDごとに保持する
+// 通知を読んでいる間に新しいライドが作られると古いライドを通知済みにしてしまうので、
+// 通知の前に generation を取り、その後にライドが作られていたら markDelivered で記録しない
+type deliveredRideStore struct {
+	mu sync.RWMutex
+	// rides はCOMPLETEDまで通知済みのライドID
+	rides map[string]string
+	// latest はこのインスタンスが知っている最新のライドID。他のインスタンスで作られたライドは消すだけで分からない
+	latest map[string]string
+	// seq はライドが作られるかリセットされるたびに進める
+	seq uint64
+	// changedAt はユーザーのライドが最後に作られたときの seq
+	changedAt map[string]uint64
+	// resetAt は最後にリセットしたときの seq
+	resetAt uint64
+}
+
+func (s *deliveredRideStore) reset() {
+	s.replace(map[string]string{})
+}
+
+// replace はユーザーごとの最新のライドがCOMPLETEDまで通知済みであるものとして置き換える
+func (s *deliveredRideStore) replace(m map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rides = m
+	s.latest = make(map[string]string, len(m))
+	for userID, rideID := range m {
+		s.latest[userID] = rideID
+	}
+	s.changedAt = map[string]uint64{}
+	s.seq++
+	s.resetAt = s.seq
+}
+
+// generation は markDelivered に渡す値を返す。ライドを読む前に取る
+func (s *deliveredRideStore) generation() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seq
+}
+
+// isDelivered は通知済みのライドがそのユーザーの最新のライドのままかどうかを返す
+func (s *deliveredRideStore) isDelivered(userID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rideID, ok := s.rides[userID]
+	if !ok {
+		return false
+	}
+	latest, known := s.latest[userID]
+	return !known || latest == rideID
+}
+
+// markDelivered は generation を取った後にライドが作られていなければ、rideID を通知済みにする
+func (s *deliveredRideStore) markDelivered(userID, rideID string, generation uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resetAt > generation || s.changedAt[userID] > generation {
+		return false
+	}
+	if latest, known := s.latest[userID]; known && latest != rideID {
+		return false
+	}
+	s.rides[userID] = rideID
+	return true
+}
+
+// rideCreated はこのインスタンスでライドが作られたときに呼び、通知済みの状態を捨てる
+func (s *deliveredRideStore) rideCreated(userID, rideID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetLocked(userID)
+	s.latest[userID] = rideID
+}
+
+// forget は他のインスタンスでライドが作られたときに呼び、通知済みの状態を捨てる
+func (s *deliveredRideStore) forget(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetLocked(userID)
+}
+
+func (s *deliveredRideStore) forgetLocked(userID string) {
+	delete(s.rides, userID)
+	delete(s.latest, userID)
+	s.seq++
+	s.changedAt[userID] = s.seq
+}
+
+type chairAssignmentScore struct {
+	score     float64
+	updatedAt time.Time
+}
+
+func (s chairAssignmentScore) decayed(now time.Time) float64 {
+	elapsed := now.Sub(s.updatedAt)
+	return s.score * math.Pow(0.5, elapsed.Seconds()/chairAssignmentHalfLife.Seconds())
+}
+
+// chairAssignmentStore は椅子ごとの直近の割り当て数を減衰させながら保持する
+type chairAssignmentStore struct {
+	mu sync.Mutex
+	m  map[string]chairAssignmentScore
+}
+
+func (s *chairAssignmentStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m = map[string]chairAssignmentScore{}
+}
+
+// scores は椅子ごとの減衰後の割り当て数を返す
+func (s *chairAssignmentStore) scores(chairIDs []string) map[string]float64 {
+	now := clockNow()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scores := make(map[string]float64, len(chairIDs))
+	for _, id := range chairIDs {
+		if score, ok := s.m[id]; ok {
+			scores[id] = score.decayed(now)
+		}
+	}
+	return scores
+}
+
+func (s *chairAssignmentStore) record(chairID string) {
+	now := clockNow()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	score, ok := s.m[chairID]
+	if !ok {
+		s.m[chairID] = chairAssignmentScore{score: 1, updatedAt: now}
+		return
+	}
+	s.m[chairID] = chairAssignmentScore{score: score.decayed(now) + 1, updatedAt: now}
+}
+
+type chairActivity struct {
+	accessToken string
+	seenAt      time.Time
+}
+
+// chairActivityStore は椅子ごとの最終アクセス日時と、放置により非アクティブにした椅子を保持する
+type chairActivityStore struct {
+	mu          sync.Mutex
+	lastSeen    map[string]chairActivity
+	deactivated map[string]struct{}
+}
+
+func (s *chairActivityStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = map[string]chairActivity{}
+	s.deactivated = map[string]struct{}{}
+}
+
+func (s *chairActivityStore) touch(chair *Chair, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen[chair.ID] = chairActivity{
+		accessToken: chair.AccessToken,
+		seenAt:      now,
+	}
+}
+
+// popStale は deadline より前から見ていない椅子を取り出す
+func (s *chairActivityStore) popStale(deadline time.Time) map[string]chairActivity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stale := map[string]chairActivity{}
+	for id, a := range s.lastSeen {
+		if a.seenAt.Before(deadline) {
+			stale[id] = a
+			delete(s.lastSeen, id)
+		}
+	}
+	return stale
+}
+
+func (s *chairActivityStore) markDeactivated(chairID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deactivated[chairID] = struct{}{}
+}
+
+func (s *chairActivityStore) isDeactivated(chairID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.deactivated[chairID]
+	return ok
+}
+
+func (s *chairActivityStore) clearDeactivated(chairID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deactivated, chairID)
+}
+
+// userStatsStore はユーザーごとのライドの集計結果のキャッシュ
+// ライドが完了したときと評価されたときに捨てる
+type userStatsStore struct {
+	mu sync.RWMutex
+	m  map[string]appGetStatsResponse
+}
+
+func (s *userStatsStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m = map[string]appGetStatsResponse{}
+}
+
+func (s *userStatsStore) get(userID string) (appGetStatsResponse, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats, ok := s.m[userID]
+	return stats, ok
+}
+
+func (s *userStatsStore) set(userID string, stats appGetStatsResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[userID] = stats
+}
+
+func (s *userStatsStore) invalidate(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, userID)
+}
+
+const (
+	// chairPositionBufferSize を超えて溜まった座標は、遅い購読者のために待たずに捨てる
+	chairPositionBufferSize = 16
+)
+
+// chairPositionSubscription はライド中の椅子の座標を受け取る購読
+// ライドが完了するか Reset されると done が閉じられる
+type chairPositionSubscription struct {
+	rideID    string
+	locations chan ChairLocation
+	done      chan struct{}
+	// stale はバッファが溢れて座標を捨てたときに立つ。購読者はDBから最新の座標を読み直す
+	stale atomic.Bool
+}
+
+// chairPositionStore は椅子IDごとに座標の購読者を保持する
+type chairPositionStore struct {
+	mu   sync.Mutex
+	subs map[string]map[*chairPositionSubscription]struct{}
+	// dropped は遅い購読者のために捨てた座標の数
+	dropped atomic.Int64
+}
+
+func (s *chairPositionStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, subs := range s.subs {
+		for sub := range subs {
+			close(sub.done)
+		}
+	}
+	s.subs = map[string]map[*chairPositionSubscription]struct{}{}
+}
+
+func (s *chairPositionStore) subscribe(chairID, rideID string) *chairPositionSubscription {
+	sub := &chairPositionSubscription{
+		rideID:    rideID,
+		locations: make(chan ChairLocation, chairPositionBufferSize),
+		done:      make(chan struct{}),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[chairID] == nil {
+		s.subs[chairID] = map[*chairPositionSubscription]struct{}{}
+	}
+	s.subs[chairID][sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe は購読をやめる。done は閉じない
+func (s *chairPositionStore) unsubscribe(chairID string, sub *chairPositionSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs[chairID], sub)
+	if len(s.subs[chairID]) == 0 {
+		delete(s.subs, chairID)
+	}
+}
+
+func (s *chairPositionStore) publish(chairID string, location ChairLocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs[chairID] {
+		select {
+		case sub.locations <- location:
+		default:
+			sub.stale.Store(true)
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// endRide はライドが完了したときに、そのライドの購読を終わらせる
+func (s *chairPositionStore) endRide(chairID, rideID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs[chairID] {
+		if sub.rideID == rideID {
+			close(sub.done)
+			delete(s.subs[chairID], sub)
+		}
+	}
+	if len(s.subs[chairID]) == 0 {
+		delete(s.subs, chairID)
+	}
+}
+
+type fareEstimateKey struct {
+	pickup      Coordinate
+	destination Coordinate
+}
+
+type fareEstimate struct {
+	fare      int64
+	expiresAt time.Time
+}
+
+// fareEstimateStore はユーザーごとの見積もり運賃のキャッシュ
+// 使われるクーポンが変わるので、クーポンを付与したときとライドを作成したときに捨てる
+type fareEstimateStore struct {
+	mu sync.Mutex
+	m  map[string]map[fareEstimateKey]fareEstimate
+}
+
+func (s *fareEstimateStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m = map[string]map[fareEstimateKey]fareEstimate{}
+}
+
+func (s *fareEstimateStore) get(userID string, key fareEstimateKey, now time.Time) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[userID][key]
+	if !ok || !now.Before(e.expiresAt) {
+		return 0, false
+	}
+	return e.fare, true
+}
+
+// set は期限切れのエントリを捨ててから見積もりを保存する
+func (s *fareEstimateStore) set(userID string, key fareEstimateKey, fare int64, now time.Time, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	estimates := s.m[userID]
+	if estimates == nil {
+		estimates = map[fareEstimateKey]fareEstimate{}
+		s.m[userID] = estimates
+	}
+	for k, e := range estimates {
+		if !now.Before(e.expiresAt) {
+			delete(estimates, k)
+		}
+	}
+	estimates[key] = fareEstimate{fare: fare, expiresAt: now.Add(ttl)}
+}
+
+func (s *fareEstimateStore) invalidate(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, userID)
+}
+
+// ownerLongPollLimit はオーナーごとに同時にライドの完了を待てる long poll の数
+const ownerLongPollLimit = 4
+
+// ownerCompletionStore はオーナーの椅子でライドが完了するのを待っている long poll を起こす
+// 起こすのは同じインスタンスで完了したライドだけで、他のインスタンスの分はタイムアウト後に読む
+type ownerCompletionStore struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+// reset は待っている全ての long poll を起こす
+func (s *ownerCompletionStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, waiters := range s.waiters {
+		for ch := range waiters {
+			close(ch)
+		}
+	}
+	s.waiters = map[string]map[chan struct{}]struct{}{}
+}
+
+// wait は次にオーナーの椅子でライドが完了したときに閉じられるチャネルと、待つのをやめる関数を返す
+// 既に ownerLongPollLimit 件待っていれば false を返す
+func (s *ownerCompletionStore) wait(ownerID string) (<-chan struct{}, func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiters[ownerID]) >= ownerLongPollLimit {
+		return nil, nil, false
+	}
+	if s.waiters[ownerID] == nil {
+		s.waiters[ownerID] = map[chan struct{}]struct{}{}
+	}
+	ch := make(chan struct{})
+	s.waiters[ownerID][ch] = struct{}{}
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// 起こされた後や reset 後は既に消えている
+		if _, ok := s.waiters[ownerID][ch]; !ok {
+			return
+		}
+		delete(s.waiters[ownerID], ch)
+		if len(s.waiters[ownerID]) == 0 {
+			delete(s.waiters, ownerID)
+		}
+	}, true
+}
+
+func (s *ownerCompletionStore) notify(ownerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.waiters[ownerID] {
+		close(ch)
+	}
+	delete(s.waiters, ownerID)
+}
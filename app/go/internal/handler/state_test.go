@@ -0,0 +1,377 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeliveredRideStoreIgnoresMarkAfterRideCreated(t *testing.T) {
+	var s deliveredRideStore
+	s.reset()
+
+	// 通知がCOMPLETEDの古いライドを読んでいる間に新しいライドが作られる
+	generation := s.generation()
+	s.rideCreated("user", "ride-2")
+	if s.markDelivered("user", "ride-1", generation) {
+		t.Fatal("markDelivered accepted a ride read before a newer ride was created")
+	}
+	if s.isDelivered("user") {
+		t.Fatal("isDelivered = true, want false while ride-2 is not delivered")
+	}
+
+	// 新しいライドを読み直した通知は通知済みにできる
+	if !s.markDelivered("user", "ride-2", s.generation()) {
+		t.Fatal("markDelivered rejected the latest ride")
+	}
+	if !s.isDelivered("user") {
+		t.Fatal("isDelivered = false, want true after ride-2 is delivered")
+	}
+}
+
+func TestDeliveredRideStoreRejectsStaleRide(t *testing.T) {
+	var s deliveredRideStore
+	s.reset()
+	s.rideCreated("user", "ride-2")
+
+	// generation は進んでいなくても、最新でないと分かっているライドは通知済みにしない
+	if s.markDelivered("user", "ride-1", s.generation()) {
+		t.Fatal("markDelivered accepted a ride that is not the latest one")
+	}
+}
+
+func TestDeliveredRideStoreForgetAndReset(t *testing.T) {
+	var s deliveredRideStore
+	s.replace(map[string]string{"user": "ride-1"})
+	if !s.isDelivered("user") {
+		t.Fatal("isDelivered = false after replace")
+	}
+
+	generation := s.generation()
+	s.forget("user")
+	if s.isDelivered("user") {
+		t.Fatal("isDelivered = true after forget")
+	}
+	if s.markDelivered("user", "ride-1", generation) {
+		t.Fatal("markDelivered accepted a generation taken before forget")
+	}
+
+	generation = s.generation()
+	s.reset()
+	if s.markDelivered("other", "ride-9", generation) {
+		t.Fatal("markDelivered accepted a generation taken before reset")
+	}
+}
+
+// fakeClock は clockNow を差し替えて、テストから時刻を進められるようにする
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func useFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	c := &fakeClock{now: time.Now()}
+	orig := clockNow
+	clockNow = c.Now
+	t.Cleanup(func() { clockNow = orig })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestChairAssignmentStoreDecaysWithClock(t *testing.T) {
+	clock := useFakeClock(t)
+	var s chairAssignmentStore
+	s.reset()
+	s.record("chair")
+	s.record("chair")
+
+	clock.advance(chairAssignmentHalfLife)
+	if got := s.scores([]string{"chair"})["chair"]; math.Abs(got-1) > 1e-9 {
+		t.Fatalf("score after one half-life = %g, want 1", got)
+	}
+
+	// 減衰した値に加算する
+	s.record("chair")
+	clock.advance(chairAssignmentHalfLife)
+	if got := s.scores([]string{"chair"})["chair"]; math.Abs(got-1) > 1e-9 {
+		t.Fatalf("score after another half-life = %g, want 1", got)
+	}
+}
+
+func TestChairActivityStorePopStale(t *testing.T) {
+	var s chairActivityStore
+	s.reset()
+	start := time.Date(2024, 11, 24, 16, 0, 0, 0, time.UTC)
+	s.touch(&Chair{ID: "quiet", AccessToken: "quiet-token"}, start)
+	s.touch(&Chair{ID: "busy", AccessToken: "busy-token"}, start.Add(time.Minute))
+
+	stale := s.popStale(start.Add(30 * time.Second))
+	if len(stale) != 1 || stale["quiet"].accessToken != "quiet-token" {
+		t.Fatalf("stale = %+v, want only the quiet chair", stale)
+	}
+	// 取り出した椅子は次にアクセスがあるまで候補に戻らない
+	if stale := s.popStale(start.Add(time.Hour)); len(stale) != 1 || stale["busy"].seenAt != start.Add(time.Minute) {
+		t.Fatalf("stale = %+v, want only the busy chair", stale)
+	}
+}
+
+// stressGoroutines は共有状態の競合を確かめるときに同時に動かす goroutine の数
+const stressGoroutines = 100
+
+// hammer は fn を stressGoroutines 個の goroutine から同時に呼び、全て終わるまで待つ
+// go test -race で動かすと、ロックの取り忘れを競合検出器が見つける
+func hammer(fn func(g int)) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for g := 0; g < stressGoroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			fn(g)
+		}()
+	}
+	close(start)
+	wg.Wait()
+}
+
+func TestAppStateConcurrentAccess(t *testing.T) {
+	const iterations = 50
+	now := time.Date(2024, 11, 24, 16, 0, 0, 0, time.UTC)
+
+	t.Run("chairs", func(t *testing.T) {
+		// 読む椅子は消さない。キャッシュに無いとDBを読みに行くため
+		s := chairStore{}
+		s.reset()
+		s.prime([]Chair{{ID: "shared", AccessToken: "shared-token"}})
+		hammer(func(g int) {
+			token := fmt.Sprintf("chair-%d", g)
+			for i := 0; i < iterations; i++ {
+				s.prime([]Chair{{ID: token, AccessToken: token}})
+				s.update("shared-token", func(c *Chair) { c.IsActive = i%2 == 0 })
+				chair, err := s.get(context.Background(), "shared-token")
+				if err != nil || chair.ID != "shared" {
+					t.Errorf("get = %+v, %v", chair, err)
+					return
+				}
+				_ = chair.IsActive
+				s.forget(token)
+			}
+		})
+	})
+
+	t.Run("deliveredRides", func(t *testing.T) {
+		var s deliveredRideStore
+		s.reset()
+		hammer(func(g int) {
+			userID := fmt.Sprintf("user-%d", g%10)
+			for i := 0; i < iterations; i++ {
+				rideID := fmt.Sprintf("ride-%d-%d", g, i)
+				generation := s.generation()
+				s.rideCreated(userID, rideID)
+				s.markDelivered(userID, rideID, generation)
+				s.isDelivered(userID)
+				switch i % 10 {
+				case 0:
+					s.forget(userID)
+				case 9:
+					s.replace(map[string]string{userID: rideID})
+				}
+			}
+		})
+	})
+
+	t.Run("chairAssignments", func(t *testing.T) {
+		var s chairAssignmentStore
+		s.reset()
+		ids := []string{"chair-0", "chair-1", "chair-2"}
+		hammer(func(g int) {
+			for i := 0; i < iterations; i++ {
+				s.record(ids[(g+i)%len(ids)])
+				for id, score := range s.scores(ids) {
+					if score < 0 {
+						t.Errorf("score of %s = %g", id, score)
+					}
+				}
+				if g == 0 && i%10 == 0 {
+					s.reset()
+				}
+			}
+		})
+	})
+
+	t.Run("chairActivities", func(t *testing.T) {
+		var s chairActivityStore
+		s.reset()
+		hammer(func(g int) {
+			chair := &Chair{ID: fmt.Sprintf("chair-%d", g%10), AccessToken: fmt.Sprintf("token-%d", g%10)}
+			for i := 0; i < iterations; i++ {
+				s.touch(chair, now.Add(time.Duration(i)*time.Second))
+				for id := range s.popStale(now.Add(time.Duration(i) * time.Second)) {
+					s.markDeactivated(id)
+				}
+				if s.isDeactivated(chair.ID) {
+					s.clearDeactivated(chair.ID)
+				}
+			}
+		})
+	})
+
+	t.Run("chairPositions", func(t *testing.T) {
+		var s chairPositionStore
+		s.reset()
+		hammer(func(g int) {
+			chairID := fmt.Sprintf("chair-%d", g%10)
+			rideID := fmt.Sprintf("ride-%d", g)
+			for i := 0; i < iterations; i++ {
+				switch g % 4 {
+				case 0:
+					// 購読者は座標を読み捨てながら、終わったら購読をやめる
+					sub := s.subscribe(chairID, rideID)
+					select {
+					case <-sub.locations:
+					case <-sub.done:
+					default:
+					}
+					_ = sub.stale.Load()
+					s.unsubscribe(chairID, sub)
+				case 1:
+					s.subscribe(chairID, rideID)
+					s.endRide(chairID, rideID)
+				default:
+					s.publish(chairID, ChairLocation{ChairID: chairID, Latitude: i, Longitude: g})
+				}
+			}
+			if g == 0 {
+				s.reset()
+			}
+		})
+	})
+
+	t.Run("userStats", func(t *testing.T) {
+		var s userStatsStore
+		s.reset()
+		hammer(func(g int) {
+			userID := fmt.Sprintf("user-%d", g%10)
+			for i := 0; i < iterations; i++ {
+				s.set(userID, appGetStatsResponse{})
+				s.get(userID)
+				if i%5 == 0 {
+					s.invalidate(userID)
+				}
+			}
+		})
+	})
+
+	t.Run("fareEstimates", func(t *testing.T) {
+		var s fareEstimateStore
+		s.reset()
+		hammer(func(g int) {
+			userID := fmt.Sprintf("user-%d", g%10)
+			for i := 0; i < iterations; i++ {
+				key := fareEstimateKey{pickup: Coordinate{Latitude: i % 3}, destination: Coordinate{Longitude: g % 3}}
+				at := now.Add(time.Duration(i) * time.Second)
+				s.set(userID, key, int64(i), at, 2*time.Second)
+				s.get(userID, key, at)
+				if i%7 == 0 {
+					s.invalidate(userID)
+				}
+			}
+		})
+	})
+
+	t.Run("ownerCompletions", func(t *testing.T) {
+		var s ownerCompletionStore
+		s.reset()
+		hammer(func(g int) {
+			ownerID := fmt.Sprintf("owner-%d", g%5)
+			for i := 0; i < iterations; i++ {
+				if g%2 == 0 {
+					s.notify(ownerID)
+					continue
+				}
+				ch, stop, ok := s.wait(ownerID)
+				if !ok {
+					continue
+				}
+				select {
+				case <-ch:
+				default:
+				}
+				stop()
+			}
+			if g == 1 {
+				s.reset()
+			}
+		})
+	})
+
+	t.Run("userNotifications", func(t *testing.T) {
+		// 同じキーのロックを取っている間は他の goroutine が入らないこと
+		var k keyedMutex
+		counters := make([]int, 10)
+		hammer(func(g int) {
+			key := g % len(counters)
+			for i := 0; i < iterations; i++ {
+				unlock := k.lock(strconv.Itoa(key))
+				counters[key]++
+				unlock()
+			}
+		})
+		for key, n := range counters {
+			if want := stressGoroutines / len(counters) * iterations; n != want {
+				t.Errorf("counter %d = %d, want %d", key, n, want)
+			}
+		}
+		if len(k.locks) != 0 {
+			t.Errorf("%d locks are left after every holder released them", len(k.locks))
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		// /api/initialize と並行して各ストアが使われても競合しないこと
+		s := &appState{}
+		s.Reset()
+		s.chairs.prime([]Chair{{ID: "shared", AccessToken: "shared-token"}})
+		hammer(func(g int) {
+			userID := fmt.Sprintf("user-%d", g%10)
+			for i := 0; i < iterations; i++ {
+				switch g % 5 {
+				case 0:
+					if i%10 == 0 {
+						s.Reset()
+					}
+				case 1:
+					s.deliveredRides.rideCreated(userID, fmt.Sprintf("ride-%d-%d", g, i))
+				case 2:
+					s.chairAssignments.record("shared")
+					s.chairActivities.touch(&Chair{ID: "shared", AccessToken: "shared-token"}, now)
+				case 3:
+					s.userStats.set(userID, appGetStatsResponse{})
+					s.fareEstimates.set(userID, fareEstimateKey{}, 1, now, time.Second)
+				case 4:
+					sub := s.chairPositions.subscribe("shared", userID)
+					s.chairPositions.publish("shared", ChairLocation{})
+					s.chairPositions.unsubscribe("shared", sub)
+					s.chairs.update("shared-token", func(c *Chair) { c.IsActive = true })
+				}
+			}
+		})
+	})
+}
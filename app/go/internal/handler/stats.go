@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	// recentErrorsSize は /debug/errors で保持する異なるエラーメッセージの数
+	recentErrorsSize = 100
+	// matchingFailureAlertThreshold 回連続でマッチングが失敗したらログに出す
+	matchingFailureAlertThreshold = 5
+)
+
+type routeErrorStats struct {
+	Requests     int64 `json:"requests"`
+	ClientErrors int64 `json:"client_errors"`
+	ServerErrors int64 `json:"server_errors"`
+	Panics       int64 `json:"panics"`
+	// ResponseBytes は圧縮前のレスポンスボディの合計バイト数
+	ResponseBytes    int64   `json:"response_bytes"`
+	AvgResponseBytes float64 `json:"avg_response_bytes"`
+}
+
+// routeStats はルートごとのリクエスト数とエラー数
+var routeStats = struct {
+	sync.Mutex
+	m map[string]*routeErrorStats
+}{m: map[string]*routeErrorStats{}}
+
+func recordRouteStats(route string, status int, bytes int, panicked bool) {
+	routeStats.Lock()
+	defer routeStats.Unlock()
+	s, ok := routeStats.m[route]
+	if !ok {
+		s = &routeErrorStats{}
+		routeStats.m[route] = s
+	}
+	s.Requests++
+	s.ResponseBytes += int64(bytes)
+	switch {
+	case panicked:
+		s.Panics++
+		s.ServerErrors++
+	case status >= 500:
+		s.ServerErrors++
+	case status >= 400:
+		s.ClientErrors++
+	}
+}
+
+func snapshotRouteStats() map[string]routeErrorStats {
+	routeStats.Lock()
+	defer routeStats.Unlock()
+	res := make(map[string]routeErrorStats, len(routeStats.m))
+	for route, s := range routeStats.m {
+		snapshot := *s
+		if snapshot.Requests > 0 {
+			snapshot.AvgResponseBytes = float64(snapshot.ResponseBytes) / float64(snapshot.Requests)
+		}
+		res[route] = snapshot
+	}
+	return res
+}
+
+type recentError struct {
+	Message    string `json:"message"`
+	Count      int64  `json:"count"`
+	LastSeenAt int64  `json:"last_seen_at"`
+}
+
+// recentErrors は直近の異なるエラーメッセージをリングバッファで保持する
+var recentErrors = struct {
+	sync.Mutex
+	entries map[string]*recentError
+	ring    []string
+	next    int
+}{
+	entries: map[string]*recentError{},
+	ring:    make([]string, recentErrorsSize),
+}
+
+func recordError(err error) {
+	msg := err.Error()
+	now := time.Now()
+
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	if e, ok := recentErrors.entries[msg]; ok {
+		e.Count++
+		e.LastSeenAt = now.UnixMilli()
+		return
+	}
+
+	// 一番古いメッセージを追い出す
+	if evicted := recentErrors.ring[recentErrors.next]; evicted != "" {
+		delete(recentErrors.entries, evicted)
+	}
+	recentErrors.ring[recentErrors.next] = msg
+	recentErrors.next = (recentErrors.next + 1) % len(recentErrors.ring)
+	recentErrors.entries[msg] = &recentError{Message: msg, Count: 1, LastSeenAt: now.UnixMilli()}
+}
+
+func snapshotRecentErrors() []recentError {
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	res := make([]recentError, 0, len(recentErrors.entries))
+	for _, e := range recentErrors.entries {
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastSeenAt > res[j].LastSeenAt
+	})
+	return res
+}
+
+// statsMiddleware はルートごとのリクエスト数・エラー数・panic数・レスポンスサイズを数える
+func statsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// WrapResponseWriter は元の ResponseWriter が Flusher や Hijacker を実装していればそれも引き継ぐ
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			route := r.Method + " " + chi.RouteContext(r.Context()).RoutePattern()
+			if rvr := recover(); rvr != nil {
+				recordRouteStats(route, ww.Status(), ww.BytesWritten(), true)
+				// レスポンスは Recoverer に任せる
+				panic(rvr)
+			}
+			recordRouteStats(route, ww.Status(), ww.BytesWritten(), false)
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
+
+var (
+	matchingConsecutiveFailures atomic.Int64
+	matchingLastSucceededAt     atomic.Int64
+)
+
+// recordMatchingResult はマッチングの連続失敗回数を数えて返す
+// 失敗が matchingFailureAlertThreshold 回続くまでは Warn、それ以降は Error でログに出す
+func recordMatchingResult(err error) int64 {
+	if err == nil {
+		matchingConsecutiveFailures.Store(0)
+		matchingLastSucceededAt.Store(time.Now().UnixMilli())
+		return 0
+	}
+	failures := matchingConsecutiveFailures.Add(1)
+	if failures >= matchingFailureAlertThreshold {
+		slog.Error("matching keeps failing",
+			"consecutive_failures", failures,
+			"last_succeeded_at", matchingLastSucceededAt.Load(),
+			"err", err,
+		)
+	} else {
+		slog.Warn("matching failed", "consecutive_failures", failures, "err", err)
+	}
+	return failures
+}
+
+type internalGetStatsResponse struct {
+	Routes   map[string]routeErrorStats `json:"routes"`
+	Matching internalGetStatsMatching   `json:"matching"`
+}
+
+type internalGetStatsMatching struct {
+	ConsecutiveFailures int64            `json:"consecutive_failures"`
+	LastSucceededAt     int64            `json:"last_succeeded_at"`
+	LastPass            *matchingSummary `json:"last_pass"`
+}
+
+func (s *server) internalGetStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &internalGetStatsResponse{
+		Routes: snapshotRouteStats(),
+		Matching: internalGetStatsMatching{
+			ConsecutiveFailures: matchingConsecutiveFailures.Load(),
+			LastSucceededAt:     matchingLastSucceededAt.Load(),
+			LastPass:            lastMatchingSummary.Load(),
+		},
+	})
+}
+
+// getMetrics は Prometheus のテキスト形式でカウンタを出力する
+func (s *server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := snapshotRouteStats()
+	routes := make([]string, 0, len(stats))
+	for route := range stats {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "# TYPE isuride_requests_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "isuride_requests_total{route=%q} %d\n", route, stats[route].Requests)
+	}
+	fmt.Fprintln(w, "# TYPE isuride_errors_total counter")
+	for _, route := range routes {
+		s := stats[route]
+		fmt.Fprintf(w, "isuride_errors_total{route=%q,class=\"4xx\"} %d\n", route, s.ClientErrors)
+		fmt.Fprintf(w, "isuride_errors_total{route=%q,class=\"5xx\"} %d\n", route, s.ServerErrors)
+	}
+	fmt.Fprintln(w, "# TYPE isuride_panics_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "isuride_panics_total{route=%q} %d\n", route, stats[route].Panics)
+	}
+	fmt.Fprintln(w, "# TYPE isuride_response_bytes_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "isuride_response_bytes_total{route=%q} %d\n", route, stats[route].ResponseBytes)
+	}
+	fmt.Fprintln(w, "# TYPE isuride_response_bytes_avg gauge")
+	for _, route := range routes {
+		fmt.Fprintf(w, "isuride_response_bytes_avg{route=%q} %g\n", route, stats[route].AvgResponseBytes)
+	}
+	queries := snapshotQueryStats()
+	queryNames := make([]string, 0, len(queries))
+	for name := range queries {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	fmt.Fprintln(w, "# TYPE isuride_query_duration_seconds histogram")
+	for _, name := range queryNames {
+		s := queries[name]
+		for i, le := range queryDurationBuckets {
+			fmt.Fprintf(w, "isuride_query_duration_seconds_bucket{name=%q,le=\"%g\"} %d\n", name, le, s.Buckets[i])
+		}
+		fmt.Fprintf(w, "isuride_query_duration_seconds_bucket{name=%q,le=\"+Inf\"} %d\n", name, s.Count)
+		fmt.Fprintf(w, "isuride_query_duration_seconds_sum{name=%q} %g\n", name, s.Sum)
+		fmt.Fprintf(w, "isuride_query_duration_seconds_count{name=%q} %d\n", name, s.Count)
+	}
+	fmt.Fprintln(w, "# TYPE isuride_notification_shed_total counter")
+	fmt.Fprintf(w, "isuride_notification_shed_total %d\n", notificationShed.Load())
+	fmt.Fprintln(w, "# TYPE isuride_chair_position_dropped_total counter")
+	fmt.Fprintf(w, "isuride_chair_position_dropped_total %d\n", s.state.chairPositions.dropped.Load())
+	if b := s.coordinateBuffer; b != nil {
+		fmt.Fprintln(w, "# TYPE isuride_coordinate_buffer_size gauge")
+		fmt.Fprintf(w, "isuride_coordinate_buffer_size %d\n", b.size())
+		fmt.Fprintln(w, "# TYPE isuride_coordinate_buffer_dropped_total counter")
+		fmt.Fprintf(w, "isuride_coordinate_buffer_dropped_total{policy=\"drop_oldest\"} %d\n", b.dropped.Load())
+		fmt.Fprintf(w, "isuride_coordinate_buffer_dropped_total{policy=\"reject\"} %d\n", b.rejected.Load())
+	}
+	fmt.Fprintln(w, "# TYPE isuride_chair_position_violations_total counter")
+	fmt.Fprintf(w, "isuride_chair_position_violations_total{target=\"pickup\"} %d\n", chairPositionViolations.pickup.Load())
+	fmt.Fprintf(w, "isuride_chair_position_violations_total{target=\"destination\"} %d\n", chairPositionViolations.destination.Load())
+	fmt.Fprintln(w, "# TYPE isuride_matching_consecutive_failures gauge")
+	fmt.Fprintf(w, "isuride_matching_consecutive_failures %d\n", matchingConsecutiveFailures.Load())
+	if summary := lastMatchingSummary.Load(); summary != nil {
+		fmt.Fprintln(w, "# TYPE isuride_matching_last_pass gauge")
+		fmt.Fprintf(w, "isuride_matching_last_pass{field=\"rides\"} %d\n", summary.Rides)
+		fmt.Fprintf(w, "isuride_matching_last_pass{field=\"chairs\"} %d\n", summary.Chairs)
+		fmt.Fprintf(w, "isuride_matching_last_pass{field=\"assigned\"} %d\n", summary.Assigned)
+		fmt.Fprintf(w, "isuride_matching_last_pass{field=\"duration_ms\"} %d\n", summary.DurationMs)
+		fmt.Fprintf(w, "isuride_matching_last_pass{field=\"rides_left\"} %d\n", summary.RidesLeft)
+		fmt.Fprintln(w, "# TYPE isuride_matching_params gauge")
+		fmt.Fprintf(w, "isuride_matching_params{param=\"interval_ms\"} %d\n", summary.Params.IntervalMs)
+		fmt.Fprintf(w, "isuride_matching_params{param=\"ride_cap\"} %d\n", summary.Params.RideCap)
+		fmt.Fprintf(w, "isuride_matching_params{param=\"max_pickup_distance\"} %d\n", summary.Params.MaxPickupDistance)
+		fmt.Fprintf(w, "isuride_matching_params{param=\"fairness_weight\"} %g\n", summary.Params.FairnessWeight)
+		fmt.Fprintf(w, "isuride_matching_params{param=\"max_nearby_distance\"} %d\n", summary.Params.MaxNearbyDistance)
+	}
+}
+
+type debugGetErrorsResponse struct {
+	Errors []recentError `json:"errors"`
+}
+
+func (s *server) debugGetErrors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &debugGetErrorsResponse{
+		Errors: snapshotRecentErrors(),
+	})
+}
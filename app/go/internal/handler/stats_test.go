@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestStatsMiddlewareCountsResponseBytesAndFlushes(t *testing.T) {
+	const body = `{"message":"hello"}`
+	r := chi.NewRouter()
+	r.Use(statsMiddleware)
+	r.Get("/stats-test/known", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	r.Get("/stats-test/stream", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("the wrapped ResponseWriter does not implement http.Flusher")
+			return
+		}
+		w.Write([]byte("data: 1\n\n"))
+		flusher.Flush()
+	})
+
+	for range 2 {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stats-test/known", nil))
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats-test/stream", nil))
+	if !rec.Flushed {
+		t.Fatal("Flush did not reach the underlying ResponseWriter")
+	}
+
+	stats := snapshotRouteStats()
+	known := stats["GET /stats-test/known"]
+	if known.Requests != 2 || known.ResponseBytes != int64(2*len(body)) || known.AvgResponseBytes != float64(len(body)) {
+		t.Fatalf("known route stats = %+v, want 2 requests of %d bytes", known, len(body))
+	}
+	if stream := stats["GET /stats-test/stream"]; stream.ResponseBytes != int64(len("data: 1\n\n")) {
+		t.Fatalf("stream route bytes = %d, want %d", stream.ResponseBytes, len("data: 1\n\n"))
+	}
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// trackedTx は Beginx から Commit か Rollback までの時間を測るトランザクション
+// 決済など外部への呼び出しの間にロックを持ち続けている箇所を見つけるために使う
+type trackedTx struct {
+	*sqlx.Tx
+	name    string
+	begunAt time.Time
+	ended   atomic.Bool
+}
+
+// beginTx は name をログに出す名前にしてトランザクションを開始する
+func (s *server) beginTx(name string) (*trackedTx, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &trackedTx{Tx: tx, name: name, begunAt: time.Now()}, nil
+}
+
+func (tx *trackedTx) Commit() error {
+	err := tx.Tx.Commit()
+	tx.end("commit")
+	return err
+}
+
+// Rollback は Commit 後に defer で呼ばれても計測し直さない
+func (tx *trackedTx) Rollback() error {
+	err := tx.Tx.Rollback()
+	tx.end("rollback")
+	return err
+}
+
+func (tx *trackedTx) end(how string) {
+	if !tx.ended.CompareAndSwap(false, true) {
+		return
+	}
+	d := time.Since(tx.begunAt)
+	if threshold := loadRuntimeConfig().SlowTxThreshold; threshold > 0 && d >= threshold {
+		slog.Warn("transaction held too long", "handler", tx.name, "duration_ms", d.Milliseconds(), "end", how)
+	}
+}
@@ -0,0 +1,110 @@
+//go:build integration
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer はバックグラウンドの処理からも書かれるログの出力先
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs はテストの間だけ slog の出力を JSON で受け取る
+func captureLogs(t *testing.T) *lockedBuffer {
+	t.Helper()
+	buf := &lockedBuffer{}
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+	return buf
+}
+
+// setSlowTxThreshold はテストの間だけ SlowTxThreshold を変える
+func setSlowTxThreshold(t *testing.T, threshold time.Duration) {
+	t.Helper()
+	orig := loadRuntimeConfig()
+	rc := *orig
+	rc.SlowTxThreshold = threshold
+	currentRuntimeConfig.Store(&rc)
+	t.Cleanup(func() { currentRuntimeConfig.Store(orig) })
+}
+
+type slowTxLog struct {
+	Msg        string `json:"msg"`
+	Handler    string `json:"handler"`
+	DurationMs int64  `json:"duration_ms"`
+	End        string `json:"end"`
+}
+
+func slowTxLogs(t *testing.T, logs *lockedBuffer) []slowTxLog {
+	t.Helper()
+	entries := []slowTxLog{}
+	for _, line := range bytes.Split([]byte(logs.String()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry slowTxLog
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Msg == "transaction held too long" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestSlowTransactionLogsHandlerName(t *testing.T) {
+	ts := newTestServer(t)
+	setSlowTxThreshold(t, 50*time.Millisecond)
+	logs := captureLogs(t)
+
+	// しきい値より短いトランザクションはログに出さない
+	fast, err := ts.beginTx("fastHandler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fast.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 決済の呼び出しを待つ間のように、しきい値を超えて開いたままにする
+	slow, err := ts.beginTx("slowHandler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if err := slow.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// Commit 後の defer の Rollback で二重に出さない
+	slow.Rollback()
+
+	entries := slowTxLogs(t, logs)
+	if len(entries) != 1 {
+		t.Fatalf("slow transaction warnings = %+v, want exactly one", entries)
+	}
+	if got := entries[0]; got.Handler != "slowHandler" || got.End != "commit" || got.DurationMs < 80 {
+		t.Fatalf("warning = %+v, want slowHandler committed after at least 80ms", got)
+	}
+}
@@ -0,0 +1,65 @@
+package handler
+
+import "net/http"
+
+type appGetStatsResponse struct {
+	Rides         int   `json:"rides"`
+	TotalDistance int   `json:"total_distance"`
+	TotalFare     int64 `json:"total_fare"`
+	TotalTips     int64 `json:"total_tips"`
+	// AverageEvaluation は評価したライドの平均。1件も評価していなければ null
+	AverageEvaluation *float64 `json:"average_evaluation"`
+	// FirstRideAt は最初に完了したライドを作成した日時。完了したライドが無ければ null
+	FirstRideAt *int64 `json:"first_ride_at"`
+}
+
+// appGetStats はユーザーの完了したライドの件数・距離・支払った運賃・評価の平均を返す
+// 運賃はオーナーの売上と同じく割引を反映した額で、完了時に決済した額が残っていればそれを使う
+func (s *server) appGetStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	if stats, ok := s.state.userStats.get(user.ID); ok {
+		writeJSON(w, http.StatusOK, stats)
+		return
+	}
+
+	rides := []rideWithDiscount{}
+	if err := s.db.SelectContext(ctx, &rides, `
+		SELECT rides.*, IFNULL(coupons.discount, 0) AS discount FROM rides
+		JOIN ride_statuses ON rides.id = ride_statuses.ride_id
+		LEFT JOIN coupons ON coupons.used_by = rides.id
+		WHERE rides.user_id = ? AND ride_statuses.status = 'COMPLETED'
+		ORDER BY rides.created_at`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	stats := appGetStatsResponse{Rides: len(rides)}
+	evaluations := 0
+	evaluationSum := 0
+	for _, ride := range rides {
+		stats.TotalDistance += ride.Distance
+		if ride.ChargedFare != nil {
+			stats.TotalFare += *ride.ChargedFare
+		} else {
+			stats.TotalFare += applyDiscount(ride.Ride, ride.Discount)
+		}
+		stats.TotalTips += ride.Tip
+		if ride.Evaluation != nil {
+			evaluations++
+			evaluationSum += *ride.Evaluation
+		}
+	}
+	if evaluations > 0 {
+		avg := float64(evaluationSum) / float64(evaluations)
+		stats.AverageEvaluation = &avg
+	}
+	if len(rides) > 0 {
+		firstRideAt := rides[0].CreatedAt.UnixMilli()
+		stats.FirstRideAt = &firstRideAt
+	}
+
+	s.state.userStats.set(user.ID, stats)
+	writeJSON(w, http.StatusOK, stats)
+}
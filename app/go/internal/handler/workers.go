@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// initializeQuiesceTimeout は /api/initialize でバックグラウンドの処理が止まるのを待つ最長の時間
+const initializeQuiesceTimeout = 10 * time.Second
+
+// pausable は /api/initialize でDBを作り直す間止めておくバックグラウンドの処理
+// 作り直す前のライドや椅子のIDを持ったまま、作り直した後のDBに書き込まないようにする
+type pausable interface {
+	// Pause は新しく処理を始めないようにし、実行中の処理が終わるまで待つ。ctx が終わるまでに終わらなければエラーを返す
+	Pause(ctx context.Context) error
+	// Resume は Pause で止めた処理を再開する
+	Resume()
+}
+
+// workerGate はループの1回ごとに enter と leave で囲み、Pause の間は処理を読み飛ばさせる
+type workerGate struct {
+	name    string
+	mu      sync.Mutex
+	paused  bool
+	running int
+	// drained は Pause が待っている間だけ作られ、実行中の処理が無くなったら閉じられる
+	drained chan struct{}
+}
+
+// registerWorker は name の処理を /api/initialize で止める対象に加える
+func (s *server) registerWorker(name string) *workerGate {
+	g := &workerGate{name: name}
+	s.workers = append(s.workers, g)
+	return g
+}
+
+// enter は処理を始めてよければ true を返す。true のときは終わったら leave を呼ぶ
+func (g *workerGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return false
+	}
+	g.running++
+	return true
+}
+
+func (g *workerGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.running--
+	if g.running == 0 && g.drained != nil {
+		close(g.drained)
+		g.drained = nil
+	}
+}
+
+func (g *workerGate) Pause(ctx context.Context) error {
+	g.mu.Lock()
+	g.paused = true
+	if g.running == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.drained == nil {
+		g.drained = make(chan struct{})
+	}
+	drained := g.drained
+	g.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s did not stop: %w", g.name, ctx.Err())
+	}
+}
+
+func (g *workerGate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = false
+}
+
+// pauseWorkers は登録された全ての処理を止める。止まらなかった処理があればまとめてエラーを返す
+// エラーのときも止める指示は出したままなので、呼び出し側は resumeWorkers を呼ぶこと
+func (s *server) pauseWorkers(ctx context.Context) error {
+	errs := make([]error, len(s.workers))
+	var wg sync.WaitGroup
+	for i, w := range s.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = w.Pause(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *server) resumeWorkers() {
+	for _, w := range s.workers {
+		w.Resume()
+	}
+}
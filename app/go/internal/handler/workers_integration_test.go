@@ -0,0 +1,81 @@
+//go:build integration
+
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInitializeWaitsForFlusherMidBatch(t *testing.T) {
+	cfg := testConfig()
+	cfg.CoordinateBufferSize = 100
+	ts := newTestServerWithConfig(t, cfg)
+	f := ts.newRideFixture(t, "quiesce")
+	ts.moveChair(t, f.Chair, Coordinate{Latitude: 1, Longitude: 0})
+	ts.moveChair(t, f.Chair, Coordinate{Latitude: 2, Longitude: 0})
+
+	reset := make(chan struct{}, 1)
+	orig := resetDatabase
+	resetDatabase = func() error {
+		reset <- struct{}{}
+		return execTestSchema(ts.db)
+	}
+	t.Cleanup(func() { resetDatabase = orig })
+
+	// startCoordinateFlusher の1回分を、バッチを取り出して書き込む前のところで止めておく
+	gate := ts.registerWorker("coordinate_flusher")
+	if !gate.enter() {
+		t.Fatal("flusher could not start a batch")
+	}
+	batch := ts.coordinateBuffer.take()
+	if len(batch) == 0 {
+		t.Fatal("no buffered locations to flush")
+	}
+	// 書き込まれる前に初期化される座標
+	ts.moveChair(t, f.Chair, Coordinate{Latitude: 3, Longitude: 0})
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- ts.do(t, http.MethodPost, "/api/initialize", nil, postInitializeRequest{PaymentServer: paymentGatewayURL.Load().(string)})
+	}()
+
+	// 書き込み中のバッチがある間はDBを作り直さない
+	select {
+	case <-reset:
+		t.Fatal("database was reset while the flusher was writing a batch")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := ts.insertChairLocations(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	gate.leave()
+
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusOK {
+			t.Fatalf("initialize = %d: %s", rec.Code, rec.Body.String())
+		}
+	case <-time.After(initializeQuiesceTimeout):
+		t.Fatal("initialize did not finish after the flusher left")
+	}
+
+	// 初期化の後は作り直す前の椅子の座標を書き込まない
+	if err := ts.flushCoordinates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var locations int
+	if err := ts.db.Get(&locations, "SELECT COUNT(*) FROM chair_locations WHERE chair_id = ?", f.Chair.ID); err != nil {
+		t.Fatal(err)
+	}
+	if locations != 0 {
+		t.Fatalf("chair_locations has %d rows of the chair from before initialize", locations)
+	}
+	if !gate.enter() {
+		t.Fatal("flusher is still paused after initialize")
+	}
+	gate.leave()
+}
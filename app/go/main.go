@@ -1,50 +1,88 @@
 package main
 
 import (
-	"context"
-	crand "crypto/rand"
-	"encoding/json"
+	"bufio"
+	"errors"
 	"fmt"
-	"log"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
-	"github.com/kaz/pprotein/integration"
-	"github.com/motoki317/sc"
+	"github.com/isucon/isucon14/webapp/go/internal/handler"
 )
 
-var db *sqlx.DB
+func main() {
+	cfg := loadConfig()
+	cfg.Reload = reloadConfig
+	h, err := handler.New(cfg)
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("Listening on :8080")
+	http.ListenAndServe(":8080", h)
+}
 
-var (
-	// chairCache はアクセストークンをキーにした椅子のキャッシュ
-	chairCache *sc.Cache[string, *Chair]
-)
+// defaultEnvFile は systemd の EnvironmentFile として読ませている deploy.sh のコピー先
+const defaultEnvFile = "/home/isucon/env.sh"
 
-func getChair(ctx context.Context, accessToken string) (*Chair, error) {
-	chair := &Chair{}
-	if err := db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ?", accessToken); err != nil {
-		return nil, err
+// reloadConfig は SIGHUP で環境変数のファイルを読み直して設定を作る。解釈できない値があっても panic せずにエラーを返す
+// プロセスの環境変数は起動後に変わらないので、ISUCON_ENV_FILE(既定は defaultEnvFile)の値で上書きしてから読む
+func reloadConfig() (cfg handler.Config, err error) {
+	path := os.Getenv("ISUCON_ENV_FILE")
+	if path == "" {
+		path = defaultEnvFile
 	}
-	return chair, nil
+	if err := applyEnvFile(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return loadConfig(), nil
 }
 
-func main() {
-	mux := setup()
-	slog.Info("Listening on :8080")
-	http.ListenAndServe(":8080", mux)
+// applyEnvFile は KEY=VALUE の行を環境変数に設定する。空行と # で始まる行は読み飛ばす
+// ファイルから消した変数は元の値のまま残る
+func applyEnvFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("invalid line in %s: %q", path, line)
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		if err := os.Setenv(strings.TrimSpace(key), value); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
 }
 
-func setup() http.Handler {
+// loadConfig は環境変数から設定を読み込む。解釈できない値が指定されていれば panic する
+// 値の範囲は handler.New で確かめる
+func loadConfig() handler.Config {
+	cfg := handler.DefaultConfig()
+
 	host := os.Getenv("ISUCON_DB_HOST")
 	if host == "" {
 		host = "127.0.0.1"
@@ -70,350 +108,155 @@ func setup() http.Handler {
 		dbname = "isuride"
 	}
 
-	dbConfig := mysql.NewConfig()
-	dbConfig.User = user
-	dbConfig.Passwd = password
-	dbConfig.Addr = net.JoinHostPort(host, port)
-	dbConfig.Net = "tcp"
-	dbConfig.DBName = dbname
-	dbConfig.ParseTime = true
-	dbConfig.InterpolateParams = true
-
-	_db, err := sqlx.Connect("mysql", dbConfig.FormatDSN())
-	if err != nil {
-		panic(err)
+	if weight := os.Getenv("ISUCON_MATCHING_FAIRNESS_WEIGHT"); weight != "" {
+		cfg.MatchingFairnessWeight, err = strconv.ParseFloat(weight, 64)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_MATCHING_FAIRNESS_WEIGHT environment variable into float: %v", err))
+		}
 	}
-	db = _db
-
-	// プール内に保持できるアイドル接続数の制限を設定 (default: 2)
-	db.SetMaxIdleConns(1024)
-	// 接続してから再利用できる最大期間
-	db.SetConnMaxLifetime(0)
-	// アイドル接続してから再利用できる最大期間
-	db.SetConnMaxIdleTime(0)
 
-	// キャッシュの初期化
-	chairCache = sc.NewMust(getChair, 90*time.Second, 90*time.Second)
-
-	http.DefaultTransport.(*http.Transport).MaxIdleConns = 0           // default: 100
-	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 1024 // default: 2
-	http.DefaultTransport.(*http.Transport).ForceAttemptHTTP2 = true
-	http.DefaultClient.Timeout = 5 * time.Second // 問題の切り分け用
-
-	{
-		pproteinHandler := integration.NewDebugHandler()
-		go http.ListenAndServe(":3000", pproteinHandler)
+	if concurrency := os.Getenv("ISUCON_MATCHING_MAX_CONCURRENCY"); concurrency != "" {
+		cfg.MatchingMaxConcurrency, err = strconv.Atoi(concurrency)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_MATCHING_MAX_CONCURRENCY environment variable into int: %v", err))
+		}
 	}
 
-	mux := chi.NewRouter()
-	mux.Use(middleware.Logger)
-	mux.Use(middleware.Recoverer)
-	mux.HandleFunc("POST /api/initialize", postInitialize)
-
-	// app handlers
-	{
-		mux.HandleFunc("POST /api/app/users", appPostUsers)
-
-		authedMux := mux.With(appAuthMiddleware)
-		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
-		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
-		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
-		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
-		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
-		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
-		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
+	if concurrency := os.Getenv("ISUCON_NOTIFICATION_MAX_CONCURRENCY"); concurrency != "" {
+		cfg.NotificationMaxConcurrency, err = strconv.Atoi(concurrency)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_NOTIFICATION_MAX_CONCURRENCY environment variable into int: %v", err))
+		}
 	}
 
-	// owner handlers
-	{
-		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
-
-		authedMux := mux.With(ownerAuthMiddleware)
-		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
-		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+	if serialize := os.Getenv("ISUCON_SERIALIZE_USER_NOTIFICATIONS"); serialize != "" {
+		cfg.SerializeUserNotifications, err = strconv.ParseBool(serialize)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_SERIALIZE_USER_NOTIFICATIONS environment variable into bool: %v", err))
+		}
 	}
 
-	// chair handlers
-	{
-		mux.HandleFunc("POST /api/chair/chairs", chairPostChairs)
-
-		authedMux := mux.With(chairAuthMiddleware)
-		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
-		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
-		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
-		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+	if threshold := os.Getenv("ISUCON_SLOW_QUERY_THRESHOLD"); threshold != "" {
+		cfg.SlowQueryThreshold, err = time.ParseDuration(threshold)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_SLOW_QUERY_THRESHOLD environment variable into duration: %v", err))
+		}
 	}
 
-	// internal handlers
-	{
-		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+	if threshold := os.Getenv("ISUCON_SLOW_TX_THRESHOLD"); threshold != "" {
+		cfg.SlowTxThreshold, err = time.ParseDuration(threshold)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_SLOW_TX_THRESHOLD environment variable into duration: %v", err))
+		}
 	}
 
-	return mux
-}
-
-type postInitializeRequest struct {
-	PaymentServer string `json:"payment_server"`
-}
-
-type postInitializeResponse struct {
-	Language string `json:"language"`
-}
-
-func postInitialize(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	req := &postInitializeRequest{}
-	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
-		return
+	if threshold := os.Getenv("ISUCON_CHAIR_INACTIVE_THRESHOLD"); threshold != "" {
+		cfg.ChairInactiveThreshold, err = time.ParseDuration(threshold)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_CHAIR_INACTIVE_THRESHOLD environment variable into duration: %v", err))
+		}
 	}
 
-	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
-		return
+	if interval := os.Getenv("ISUCON_CACHE_SYNC_INTERVAL"); interval != "" {
+		cfg.CacheSyncInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_CACHE_SYNC_INTERVAL environment variable into duration: %v", err))
+		}
 	}
 
-	// 各椅子の総移動距離を初期化
-	if err := initializeChairTotalDistance(ctx); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	if ttl := os.Getenv("ISUCON_FARE_ESTIMATE_CACHE_TTL"); ttl != "" {
+		cfg.FareEstimateCacheTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_FARE_ESTIMATE_CACHE_TTL environment variable into duration: %v", err))
+		}
 	}
 
-	if _, err := db.ExecContext(ctx, "UPDATE settings SET value = ? WHERE name = 'payment_gateway_url'", req.PaymentServer); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	if distance := os.Getenv("ISUCON_MAX_TRIP_DISTANCE"); distance != "" {
+		cfg.MaxTripDistance, err = strconv.Atoi(distance)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_MAX_TRIP_DISTANCE environment variable into int: %v", err))
+		}
 	}
 
-	go func() {
-		if _, err := http.Get("http://57.180.38.84:9000/api/group/collect"); err != nil {
-			log.Printf("failed to communicate with pprotein: %v", err)
+	if maxCoupons := os.Getenv("ISUCON_MAX_UNUSED_COUPONS"); maxCoupons != "" {
+		cfg.MaxUnusedCoupons, err = strconv.Atoi(maxCoupons)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_MAX_UNUSED_COUPONS environment variable into int: %v", err))
 		}
-	}()
-
-	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
-}
-
-type Coordinate struct {
-	Latitude  int `json:"latitude"`
-	Longitude int `json:"longitude"`
-}
-
-func bindJSON(r *http.Request, v interface{}) error {
-	return json.NewDecoder(r.Body).Decode(v)
-}
-
-func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	buf, err := json.Marshal(v)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
 	}
-	w.WriteHeader(statusCode)
-	w.Write(buf)
-}
-
-func writeError(w http.ResponseWriter, statusCode int, err error) {
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	w.WriteHeader(statusCode)
-	buf, marshalError := json.Marshal(map[string]string{"message": err.Error()})
-	if marshalError != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"error":"marshaling error failed"}`))
-		return
-	}
-	w.Write(buf)
-
-	slog.Error("error response wrote", err)
-}
 
-func secureRandomStr(b int) string {
-	k := make([]byte, b)
-	if _, err := crand.Read(k); err != nil {
-		panic(err)
+	if depth := os.Getenv("ISUCON_REFERRAL_CHAIN_DEPTH"); depth != "" {
+		cfg.ReferralChainDepth, err = strconv.Atoi(depth)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_REFERRAL_CHAIN_DEPTH environment variable into int: %v", err))
+		}
 	}
-	return fmt.Sprintf("%x", k)
-}
-
-// type (
-// 	TailHandler struct {
-// 		filename string
-// 	}
-// )
-
-// func NewTailHandler(filename string) *TailHandler {
-// 	return &TailHandler{filename}
-// }
-
-// func (h *TailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-// 	if err := h.serve(w, r); err != nil {
-// 		log.Printf("serve failed: %v", err)
-// 	}
-// }
-// func (h *TailHandler) serve(w http.ResponseWriter, r *http.Request) error {
-// 	seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
-// 	if err != nil {
-// 		seconds = 30
-// 	}
-
-// 	var output io.Writer = w
-// 	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-// 		ew, err := gzip.NewWriterLevel(w, gzip.DefaultCompression)
-// 		if err != nil {
-// 			return fmt.Errorf("failed to initialize gzip writer: %w", err)
-// 		}
-// 		defer ew.Close()
-
-// 		output = ew
-// 		w.Header().Set("Content-Encoding", "gzip")
-// 	}
-
-// 	if err := h.tail(output, time.Duration(seconds)*time.Second); err != nil {
-// 		w.WriteHeader(http.StatusInternalServerError)
-// 		output.Write([]byte(err.Error()))
-
-// 		return fmt.Errorf("failed to tail: %w", err)
-// 	}
-
-// 	if f, ok := w.(http.Flusher); ok {
-// 		f.Flush()
-// 	}
-// 	return nil
-// }
-
-// func (h *TailHandler) tail(w io.Writer, duration time.Duration) error {
-// 	file, err := os.Open(h.filename)
-// 	if err != nil {
-// 		return fmt.Errorf("failed to open: %w", err)
-// 	}
-// 	defer file.Close()
-
-// 	startPos, err := file.Seek(0, io.SeekEnd)
-// 	if err != nil {
-// 		return fmt.Errorf("failed to seek: %w", err)
-// 	}
-
-// 	time.Sleep(duration)
 
-// 	finfo, err := file.Stat()
-// 	if err != nil {
-// 		return fmt.Errorf("failed to stat: %w", err)
-// 	}
-
-// 	r := io.LimitReader(file, finfo.Size()-startPos)
-// 	if _, err := io.Copy(w, r); err != nil {
-// 		return fmt.Errorf("failed to copy: %w", err)
-// 	}
-// 	return nil
-// }
-
-func initializeChairTotalDistance(ctx context.Context) error {
-	// 全ての位置情報を一度に取得
-	var locations []ChairLocation
-	if err := db.SelectContext(
-		ctx,
-		&locations,
-		`SELECT * FROM chair_locations ORDER BY chair_id, created_at ASC`,
-	); err != nil {
-		return err
+	if require := os.Getenv("ISUCON_REQUIRE_EVALUATION_BEFORE_RIDE"); require != "" {
+		cfg.RequireEvaluationBeforeRide, err = strconv.ParseBool(require)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_REQUIRE_EVALUATION_BEFORE_RIDE environment variable into bool: %v", err))
+		}
 	}
 
-	// chair_idごとに位置情報をグループ化
-	chairLocations := make(map[string][]ChairLocation)
-	for _, loc := range locations {
-		chairLocations[loc.ChairID] = append(chairLocations[loc.ChairID], loc)
+	if campaigns := os.Getenv("ISUCON_COUPON_CAMPAIGNS"); campaigns != "" {
+		cfg.CouponCampaigns = campaigns
 	}
 
-	// バルクアップデート用のクエリを構築
-	var values []string
-	var args []interface{}
-
-	for chairID, locs := range chairLocations {
-		var totalDistance int
-		for i := 1; i < len(locs); i++ {
-			totalDistance += calculateDistance(
-				locs[i].Latitude,
-				locs[i].Longitude,
-				locs[i-1].Latitude,
-				locs[i-1].Longitude,
-			)
+	if unit := os.Getenv("ISUCON_FARE_ROUNDING_UNIT"); unit != "" {
+		cfg.FareRounding.Unit, err = strconv.Atoi(unit)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_FARE_ROUNDING_UNIT environment variable into int: %v", err))
 		}
+	}
+	if mode := os.Getenv("ISUCON_FARE_ROUNDING_MODE"); mode != "" {
+		cfg.FareRounding.Mode = mode
+	}
 
-		var updatedAt time.Time
-		var lastLatitude, lastLongitude int
-		if len(locs) > 0 {
-			updatedAt = locs[len(locs)-1].CreatedAt
-			lastLatitude = locs[len(locs)-1].Latitude
-			lastLongitude = locs[len(locs)-1].Longitude
+	cfg.PriceLockSecret = os.Getenv("ISUCON_PRICE_LOCK_SECRET")
+	cfg.AccessLogPath = os.Getenv("ISUCON_ACCESS_LOG")
+	if level := os.Getenv("ISUCON_ACCESS_LOG_GZIP_LEVEL"); level != "" {
+		cfg.AccessLogGzipLevel, err = strconv.Atoi(level)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_ACCESS_LOG_GZIP_LEVEL environment variable into int: %v", err))
 		}
-
-		values = append(values, "(?, ?, ?, ?, ?)")
-		args = append(args, chairID, totalDistance, updatedAt, lastLatitude, lastLongitude)
 	}
-
-	// バルクアップデートのクエリを修正
-	if len(values) > 0 {
-		query := `
-			UPDATE chairs 
-			SET total_distance = CASE id 
-				%s
-				END,
-			total_distance_updated_at = CASE id 
-				%s
-				END,
-			last_latitude = CASE id
-				%s
-				END,
-			last_longitude = CASE id
-				%s
-				END
-			WHERE id IN (%s)`
-
-		// WHENケースを構築
-		var distanceCases []string
-		var timestampCases []string
-		var latitudeCases []string
-		var longitudeCases []string
-		var chairIDs []string
-
-		for i := 0; i < len(args); i += 5 {
-			chairID := args[i].(string)
-			distanceCases = append(distanceCases, fmt.Sprintf("WHEN '%s' THEN ?", chairID))
-			timestampCases = append(timestampCases, fmt.Sprintf("WHEN '%s' THEN ?", chairID))
-			latitudeCases = append(latitudeCases, fmt.Sprintf("WHEN '%s' THEN ?", chairID))
-			longitudeCases = append(longitudeCases, fmt.Sprintf("WHEN '%s' THEN ?", chairID))
-			chairIDs = append(chairIDs, "'"+chairID+"'")
+	if minSize := os.Getenv("ISUCON_ACCESS_LOG_GZIP_MIN_SIZE"); minSize != "" {
+		cfg.AccessLogGzipMinSize, err = strconv.ParseInt(minSize, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_ACCESS_LOG_GZIP_MIN_SIZE environment variable into int: %v", err))
 		}
+	}
+	cfg.RideStatusWebhookURL = os.Getenv("ISUCON_RIDE_STATUS_WEBHOOK_URL")
 
-		// 最終的なクエリを組み立て
-		query = fmt.Sprintf(
-			query,
-			strings.Join(distanceCases, "\n"),
-			strings.Join(timestampCases, "\n"),
-			strings.Join(latitudeCases, "\n"),
-			strings.Join(longitudeCases, "\n"),
-			strings.Join(chairIDs, ","),
-		)
-
-		// パラメータを再構築
-		var execArgs []interface{}
-		for i := 0; i < len(args); i += 5 {
-			execArgs = append(execArgs, args[i+1]) // distance
-		}
-		for i := 0; i < len(args); i += 5 {
-			execArgs = append(execArgs, args[i+2]) // timestamp
+	if size := os.Getenv("ISUCON_COORDINATE_BUFFER_SIZE"); size != "" {
+		cfg.CoordinateBufferSize, err = strconv.Atoi(size)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_COORDINATE_BUFFER_SIZE environment variable into int: %v", err))
 		}
-		for i := 0; i < len(args); i += 5 {
-			execArgs = append(execArgs, args[i+3]) // last_latitude
-		}
-		for i := 0; i < len(args); i += 5 {
-			execArgs = append(execArgs, args[i+4]) // last_longitude
-		}
-
-		if _, err := db.ExecContext(ctx, query, execArgs...); err != nil {
-			return fmt.Errorf("failed to update chair distances: %w", err)
+	}
+	if policy := os.Getenv("ISUCON_COORDINATE_BUFFER_POLICY"); policy != "" {
+		cfg.CoordinateBufferPolicy = policy
+	}
+	if wait := os.Getenv("ISUCON_COORDINATE_BUFFER_WAIT"); wait != "" {
+		cfg.CoordinateBufferWait, err = time.ParseDuration(wait)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse ISUCON_COORDINATE_BUFFER_WAIT environment variable into duration: %v", err))
 		}
 	}
 
-	return nil
+	dbConfig := cfg.DB
+	dbConfig.User = user
+	dbConfig.Passwd = password
+	dbConfig.Addr = net.JoinHostPort(host, port)
+	dbConfig.Net = "tcp"
+	dbConfig.DBName = dbname
+	dbConfig.ParseTime = true
+	// DATETIMEはUTCとして読み書きする
+	// DEFAULT CURRENT_TIMESTAMP(6) で入る値もUTCに揃えるため、セッションのタイムゾーンも合わせる
+	dbConfig.Loc = time.UTC
+	dbConfig.Params = map[string]string{"time_zone": "'+00:00'"}
+	dbConfig.InterpolateParams = true
+
+	return cfg
 }
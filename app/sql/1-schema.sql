@@ -100,6 +100,7 @@ CREATE TABLE rides
 
 CREATE INDEX rides_chair_id_updated_at ON `rides` (`chair_id`, `updated_at`);
 CREATE INDEX rides_user_id_created_at ON `rides` (`user_id`, `created_at` DESC);
+CREATE INDEX rides_created_at ON `rides` (`created_at`);
 
 DROP TABLE IF EXISTS ride_statuses;
 CREATE TABLE ride_statuses
@@ -117,6 +118,7 @@ CREATE TABLE ride_statuses
 CREATE INDEX ride_statuses_ride_id_created_at ON `ride_statuses` (`ride_id`, `created_at`);
 CREATE INDEX ride_statuses_ride_id_chair_sent_at_created_at ON `ride_statuses` (`ride_id`, `chair_sent_at`, `created_at`);
 CREATE INDEX ride_statuses_ride_id_app_sent_at_created_at ON `ride_statuses` (`ride_id`, `app_sent_at`, `created_at`);
+CREATE INDEX ride_statuses_status_id ON `ride_statuses` (`status`, `id`);
 
 DROP TABLE IF EXISTS owners;
 CREATE TABLE owners
@@ -147,3 +149,78 @@ CREATE TABLE coupons
   COMMENT 'クーポンテーブル';
 
 CREATE INDEX coupons_used_by ON `coupons` (`used_by`);
+
+DROP TABLE IF EXISTS routes;
+CREATE TABLE routes
+(
+  id                    VARCHAR(26) NOT NULL COMMENT 'ルートID',
+  user_id               VARCHAR(26) NOT NULL COMMENT 'ユーザーID',
+  name                  VARCHAR(30) NOT NULL COMMENT 'ルート名',
+  pickup_latitude       INTEGER     NOT NULL COMMENT '配車位置(経度)',
+  pickup_longitude      INTEGER     NOT NULL COMMENT '配車位置(緯度)',
+  destination_latitude  INTEGER     NOT NULL COMMENT '目的地(経度)',
+  destination_longitude INTEGER     NOT NULL COMMENT '目的地(緯度)',
+  created_at            DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '保存されたルートテーブル';
+
+CREATE INDEX routes_user_id ON `routes` (`user_id`);
+
+DROP TABLE IF EXISTS owner_api_keys;
+CREATE TABLE owner_api_keys
+(
+  id         VARCHAR(26) NOT NULL COMMENT 'APIキーID',
+  owner_id   VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  key_hash   CHAR(64)    NOT NULL COMMENT 'APIキーのSHA-256',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  revoked_at DATETIME(6) NULL COMMENT '失効日時',
+  PRIMARY KEY (id),
+  UNIQUE (key_hash)
+)
+  COMMENT = 'オーナーのAPIキーテーブル';
+
+CREATE INDEX owner_api_keys_owner_id ON `owner_api_keys` (`owner_id`);
+
+DROP TABLE IF EXISTS fare_events;
+CREATE TABLE fare_events
+(
+  id         VARCHAR(26) NOT NULL,
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  event      VARCHAR(30) NOT NULL COMMENT '運賃が変わった理由',
+  fare       BIGINT      NOT NULL COMMENT 'イベント後の運賃',
+  detail     TEXT        NULL COMMENT '補足情報',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '記録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '運賃の変更履歴テーブル';
+
+CREATE INDEX fare_events_ride_id_created_at ON `fare_events` (`ride_id`, `created_at`);
+
+DROP TABLE IF EXISTS outbox;
+CREATE TABLE outbox
+(
+  id           VARCHAR(26) NOT NULL,
+  kind         VARCHAR(30) NOT NULL COMMENT '送信先の種類',
+  payload      BLOB        NOT NULL COMMENT '送信するJSON',
+  attempts     INTEGER     NOT NULL DEFAULT 0 COMMENT '送信を試みた回数',
+  claimed_at   DATETIME(6) NULL COMMENT '送信のために取った日時',
+  delivered_at DATETIME(6) NULL COMMENT '送信できた日時',
+  created_at   DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '外部への送信を同じトランザクションで記録するテーブル';
+
+CREATE INDEX outbox_delivered_at_created_at ON `outbox` (`delivered_at`, `created_at`);
+
+DROP TABLE IF EXISTS cache_events;
+CREATE TABLE cache_events
+(
+  id         BIGINT       NOT NULL AUTO_INCREMENT,
+  namespace  VARCHAR(30)  NOT NULL COMMENT '捨てるキャッシュの種類',
+  cache_key  VARCHAR(255) NOT NULL COMMENT '捨てるキャッシュのキー',
+  origin     VARCHAR(26)  NOT NULL COMMENT '書き込んだインスタンスのID',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '記録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '複数台構成でキャッシュの破棄を他のインスタンスに知らせるテーブル';
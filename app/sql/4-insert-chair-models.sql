@@ -2,4 +2,23 @@ ALTER TABLE chairs
 ADD COLUMN total_distance INT NOT NULL DEFAULT 0 COMMENT '累積走行距離',
 ADD COLUMN total_distance_updated_at DATETIME(6) NULL COMMENT '累積距離更新日時',
 ADD COLUMN last_longitude INT NULL COMMENT '最後の経度',
-ADD COLUMN last_latitude INT NULL COMMENT '最後の緯度';
+ADD COLUMN last_latitude INT NULL COMMENT '最後の緯度',
+ADD COLUMN current_ride_id VARCHAR(26) NULL COMMENT '現在割り当てられているライドID',
+ADD COLUMN maintenance TINYINT(1) NOT NULL DEFAULT 0 COMMENT 'メンテナンス待ちで新しいライドを受け付けないか',
+ADD COLUMN deleted_at DATETIME(6) NULL COMMENT 'オーナーが削除した日時',
+ADD COLUMN distance_on_ride INT NOT NULL DEFAULT 0 COMMENT '累積走行距離のうち配車位置・目的地へ向かっていた距離',
+ADD COLUMN distance_idle INT NOT NULL DEFAULT 0 COMMENT '累積走行距離のうちライド以外で移動した距離';
+
+ALTER TABLE chairs
+ADD COLUMN active_name VARCHAR(30) AS (IF(deleted_at IS NULL, name, NULL)) VIRTUAL COMMENT '削除されていない椅子の名前。削除した椅子はNULL';
+
+CREATE UNIQUE INDEX chairs_owner_id_active_name ON `chairs` (`owner_id`, `active_name`);
+
+ALTER TABLE rides
+ADD COLUMN distance INT NOT NULL DEFAULT 0 COMMENT '配車位置から目的地までの距離',
+ADD COLUMN tip BIGINT NOT NULL DEFAULT 0 COMMENT 'チップ',
+ADD COLUMN charged_fare BIGINT NULL COMMENT '完了時に決済した運賃(チップを除く)',
+ADD COLUMN locked_fare BIGINT NULL COMMENT '見積もりで保証した運賃',
+ADD COLUMN chair_name VARCHAR(30) NULL COMMENT '割り当て時の椅子の名前',
+ADD COLUMN chair_model TEXT NULL COMMENT '割り当て時の椅子のモデル',
+ADD COLUMN chair_owner_name VARCHAR(30) NULL COMMENT '割り当て時の椅子のオーナーの名前';
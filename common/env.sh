@@ -5,5 +5,33 @@ ISUCON_DB_USER="isucon"
 ISUCON_DB_PASSWORD="isucon"
 ISUCON_DB_NAME="isuride"
 
+# nginxを経由しない場合のアクセスログ出力先（空なら出力しない）
+# ISUCON_ACCESS_LOG=/var/log/isuride/access.log
+# /debug/log/httplog の既定の圧縮レベル（-2〜9、既定は-1）と、圧縮する最小バイト数（既定は0で常に圧縮）
+# ISUCON_ACCESS_LOG_GZIP_LEVEL=1
+# ISUCON_ACCESS_LOG_GZIP_MIN_SIZE=1024
+
+# ライドのステータスが変わるたびに POST する webhook の送信先（空なら送らない）
+# ISUCON_RIDE_STATUS_WEBHOOK_URL=http://localhost:8081/ride-status
+
+# 複数台構成で他のインスタンスのキャッシュの破棄を取りに行く間隔（空なら1台構成とみなして何もしない）
+# ISUCON_CACHE_SYNC_INTERVAL=250ms
+# 見積もりの price_lock の署名に使う鍵（空なら起動ごとにランダム）。複数台構成では全台で同じ値が必須
+# ISUCON_PRICE_LOCK_SECRET=change-me
+
+# 同じ配車位置・目的地の見積もり運賃を使い回す時間（既定は1s、0でキャッシュしない）
+# ISUCON_FARE_ESTIMATE_CACHE_TTL=1s
+
+# 1人が持てる未使用のクーポンの数の上限。超える分の付与はスキップする（既定は0で無制限）
+# ISUCON_MAX_UNUSED_COUPONS=50
+
+# 椅子の座標の履歴(chair_locations)への書き込みを溜めておける数（既定は0でバッファせずリクエストの中で書き込む）
+# 満杯になったら ISUCON_COORDINATE_BUFFER_WAIT（既定は50ms）だけ空きを待ち、それでも空かなければ
+# ISUCON_COORDINATE_BUFFER_POLICY に従う。drop_oldest（既定）は一番古い座標を捨て、reject は503を返す
+# どちらの場合も椅子の最新の位置は更新されるので、マッチングは止まらない
+# ISUCON_COORDINATE_BUFFER_SIZE=10000
+# ISUCON_COORDINATE_BUFFER_POLICY=drop_oldest
+# ISUCON_COORDINATE_BUFFER_WAIT=50ms
+
 # マッチング間隔（秒）
 ISUCON_MATCHING_INTERVAL=0.5